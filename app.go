@@ -22,6 +22,8 @@ func NewApp(conn *app.Connections) *App {
 func (a *App) startup(ctx context.Context) {
 	a.ctx = ctx
 
+	// Needed to emit connection state changes of the pools
+	a.conn.PM.SetContext(ctx)
 }
 
 // domReady is called after front-end resources have been loaded
@@ -38,6 +40,7 @@ func (a *App) beforeClose(ctx context.Context) (prevent bool) {
 
 // shutdown is called at application termination
 func (a *App) shutdown(ctx context.Context) {
+	// Also stops the change streams, dropping their replication slots and publications
 	err := a.conn.TerminateAllDatabaseConnections()
 	if err != nil {
 		fmt.Println("Error terminating database connections:", err)
@@ -0,0 +1,557 @@
+package app
+
+import (
+	"context"
+	"dbmx/model"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// Table locks taken by ALTER TABLE and index statements
+const (
+	lockAccessExclusive      = "ACCESS EXCLUSIVE"
+	lockShareRowExclusive    = "SHARE ROW EXCLUSIVE"
+	lockShare                = "SHARE"
+	lockShareUpdateExclusive = "SHARE UPDATE EXCLUSIVE"
+)
+
+// Strength of the locks, the transaction holds the strongest one until it commits
+var lockStrength = map[string]int{
+	lockShareUpdateExclusive: 1,
+	lockShare:                2,
+	lockShareRowExclusive:    3,
+	lockAccessExclusive:      4,
+}
+
+// Index methods accepted in USING
+var indexMethods = map[string]bool{
+	"btree":  true,
+	"hash":   true,
+	"gist":   true,
+	"spgist": true,
+	"gin":    true,
+	"brin":   true,
+}
+
+// alterationStatement builds the statement for a single change of the table
+func alterationStatement(rel *model.Relation, change model.TableChange) (model.AlterationStatement, error) {
+	table := quoteIdent(rel.Schema) + "." + quoteIdent(rel.Name)
+	stmt := model.AlterationStatement{Lock: lockAccessExclusive, Transactional: true}
+
+	hasColumn := func(name string) bool {
+		for _, c := range rel.Columns {
+			if c.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	action := strings.ToLower(strings.TrimSpace(change.Action))
+	column := strings.TrimSpace(change.Column)
+
+	// Every change other than these works on an existing column
+	switch action {
+	case "add_column", "add_constraint", "drop_constraint", "add_index", "drop_index", "table_comment",
+		"enable_rls", "disable_rls", "force_rls", "no_force_rls", "create_policy", "alter_policy", "drop_policy":
+	default:
+		if column == "" {
+			return stmt, errors.Errorf("%s needs a column", action)
+		}
+		if !hasColumn(column) {
+			return stmt, errors.Errorf("column %s doesn't exist in %s", column, rel.Name)
+		}
+	}
+
+	cascade := ""
+	if change.Cascade {
+		cascade = " CASCADE"
+	}
+
+	switch action {
+	case "add_column":
+		if column == "" || strings.TrimSpace(change.Type) == "" {
+			return stmt, errors.New("a new column needs a name and a type")
+		}
+		if hasColumn(column) {
+			return stmt, errors.Errorf("column %s already exists in %s", column, rel.Name)
+		}
+		stmt.Statement = fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, quoteIdent(column), strings.TrimSpace(change.Type))
+		if change.Default != "" {
+			stmt.Statement += " DEFAULT " + change.Default
+			stmt.Warning = "A volatile default, e.g. random() or clock_timestamp(), rewrites the whole table"
+		}
+		if change.NotNull {
+			stmt.Statement += " NOT NULL"
+			if change.Default == "" {
+				stmt.Warning = "Fails if the table has rows, a NOT NULL column needs a default"
+			}
+		}
+
+	case "drop_column":
+		stmt.Destructive = true
+		stmt.Statement = fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s%s", table, quoteIdent(column), cascade)
+		stmt.Warning = "The column's data is lost"
+
+	case "rename_column":
+		if strings.TrimSpace(change.NewName) == "" {
+			return stmt, errors.New("rename_column needs a new name")
+		}
+		stmt.Statement = fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", table, quoteIdent(column), quoteIdent(strings.TrimSpace(change.NewName)))
+		stmt.Warning = "Queries, views and functions using the old name stop working"
+
+	case "alter_type":
+		if strings.TrimSpace(change.Type) == "" {
+			return stmt, errors.New("alter_type needs the new type")
+		}
+		// A narrower type or a USING expression can lose data
+		stmt.Destructive = true
+		stmt.Statement = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s", table, quoteIdent(column), strings.TrimSpace(change.Type))
+		if change.Using != "" {
+			stmt.Statement += " USING " + change.Using
+		}
+		stmt.Warning = "Unless the types are binary compatible the table and its indexes are rewritten, blocking reads and writes meanwhile"
+
+	case "set_default":
+		if change.Default == "" {
+			return stmt, errors.New("set_default needs a default expression, use drop_default to remove it")
+		}
+		stmt.Statement = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET DEFAULT %s", table, quoteIdent(column), change.Default)
+
+	case "drop_default":
+		stmt.Destructive = true
+		stmt.Statement = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP DEFAULT", table, quoteIdent(column))
+
+	case "set_not_null":
+		stmt.Statement = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET NOT NULL", table, quoteIdent(column))
+		stmt.Warning = "The whole table is scanned to check for NULLs while holding the lock"
+
+	case "drop_not_null":
+		stmt.Destructive = true
+		stmt.Statement = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL", table, quoteIdent(column))
+
+	case "add_constraint":
+		definition := strings.TrimSpace(change.Definition)
+		if definition == "" {
+			return stmt, errors.New("add_constraint needs a definition")
+		}
+		stmt.Statement = fmt.Sprintf("ALTER TABLE %s ADD", table)
+		if name := strings.TrimSpace(change.Name); name != "" {
+			stmt.Statement += " CONSTRAINT " + quoteIdent(name)
+		}
+		stmt.Statement += " " + definition
+
+		kind := strings.ToLower(strings.Fields(definition)[0])
+		switch kind {
+		case "foreign":
+			stmt.Lock = lockShareRowExclusive
+		case "check":
+		default:
+			if change.NotValid {
+				return stmt, errors.New("only CHECK and FOREIGN KEY constraints can be NOT VALID")
+			}
+		}
+
+		switch {
+		case change.NotValid:
+			stmt.Statement += " NOT VALID"
+			stmt.Warning = "Existing rows are not checked until the constraint is validated"
+		case kind == "check" || kind == "foreign":
+			stmt.Warning = "Existing rows are checked while holding the lock, add it NOT VALID and validate it later on big tables"
+		default:
+			stmt.Warning = "Building the constraint's index blocks reads and writes, create a unique index concurrently first on big tables"
+		}
+
+	case "drop_constraint":
+		if strings.TrimSpace(change.Name) == "" {
+			return stmt, errors.New("drop_constraint needs the constraint name")
+		}
+		stmt.Destructive = true
+		stmt.Statement = fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s%s", table, quoteIdent(strings.TrimSpace(change.Name)), cascade)
+
+	case "add_index":
+		if len(change.IndexColumns) == 0 {
+			return stmt, errors.New("add_index needs at least one column")
+		}
+
+		var keys []string
+		for _, key := range change.IndexColumns {
+			key = strings.TrimSpace(key)
+			// Plain columns are quoted, anything else is taken as an expression
+			if hasColumn(key) {
+				key = quoteIdent(key)
+			} else if !strings.HasPrefix(key, "(") {
+				key = "(" + key + ")"
+			}
+			keys = append(keys, key)
+		}
+
+		stmt.Statement = "CREATE"
+		if change.Unique {
+			stmt.Statement += " UNIQUE"
+		}
+		stmt.Statement += " INDEX"
+		if change.Concurrently {
+			stmt.Statement += " CONCURRENTLY"
+		}
+		if name := strings.TrimSpace(change.Name); name != "" {
+			stmt.Statement += " " + quoteIdent(name)
+		}
+		stmt.Statement += " ON " + table
+		if method := strings.ToLower(strings.TrimSpace(change.Method)); method != "" {
+			if !indexMethods[method] {
+				return stmt, errors.Errorf("unknown index method %s", change.Method)
+			}
+			stmt.Statement += " USING " + method
+		}
+		stmt.Statement += " (" + strings.Join(keys, ", ") + ")"
+		if where := strings.TrimSpace(change.Where); where != "" {
+			stmt.Statement += " WHERE " + where
+		}
+
+		if change.Concurrently {
+			stmt.Lock = lockShareUpdateExclusive
+			stmt.Transactional = false
+			stmt.Warning = "Runs outside the transaction, a failed build leaves an invalid index which has to be dropped"
+		} else {
+			stmt.Lock = lockShare
+			stmt.Warning = "Writes to the table are blocked while the index is built, use CONCURRENTLY on big tables"
+		}
+
+	case "drop_index":
+		name := strings.TrimSpace(change.Name)
+		if name == "" {
+			return stmt, errors.New("drop_index needs the index name")
+		}
+		stmt.Destructive = true
+		stmt.Statement = "DROP INDEX"
+		if change.Concurrently {
+			if change.Cascade {
+				return stmt, errors.New("an index can't be dropped concurrently with CASCADE")
+			}
+			stmt.Statement += " CONCURRENTLY"
+			stmt.Lock = lockShareUpdateExclusive
+			stmt.Transactional = false
+			stmt.Warning = "Runs outside the transaction"
+		}
+		stmt.Statement += fmt.Sprintf(" %s.%s%s", quoteIdent(rel.Schema), quoteIdent(name), cascade)
+
+	case "table_comment":
+		comment := "NULL"
+		if change.Comment != "" {
+			comment = quoteLiteral(change.Comment)
+		}
+		stmt.Statement = fmt.Sprintf("COMMENT ON TABLE %s IS %s", table, comment)
+		stmt.Lock = lockShareUpdateExclusive
+
+	case "column_comment":
+		comment := "NULL"
+		if change.Comment != "" {
+			comment = quoteLiteral(change.Comment)
+		}
+		stmt.Statement = fmt.Sprintf("COMMENT ON COLUMN %s.%s IS %s", table, quoteIdent(column), comment)
+		stmt.Lock = lockShareUpdateExclusive
+
+	case "enable_rls":
+		stmt.Statement = fmt.Sprintf("ALTER TABLE %s ENABLE ROW LEVEL SECURITY", table)
+		stmt.Warning = "Roles without a policy see no rows, except for the owner and roles bypassing RLS"
+
+	case "disable_rls":
+		stmt.Destructive = true
+		stmt.Statement = fmt.Sprintf("ALTER TABLE %s DISABLE ROW LEVEL SECURITY", table)
+		stmt.Warning = "Every role with privileges on the table sees all rows, the policies are kept but ignored"
+
+	case "force_rls":
+		stmt.Statement = fmt.Sprintf("ALTER TABLE %s FORCE ROW LEVEL SECURITY", table)
+		stmt.Warning = "The policies apply to the table owner as well"
+
+	case "no_force_rls":
+		stmt.Statement = fmt.Sprintf("ALTER TABLE %s NO FORCE ROW LEVEL SECURITY", table)
+
+	case "create_policy", "alter_policy", "drop_policy":
+		return policyStatement(table, action, change.Policy, stmt)
+
+	default:
+		return stmt, errors.Errorf("unknown change %s", change.Action)
+	}
+
+	return stmt, nil
+}
+
+// Commands a policy can apply to
+var policyCommands = map[string]bool{
+	"ALL":    true,
+	"SELECT": true,
+	"INSERT": true,
+	"UPDATE": true,
+	"DELETE": true,
+}
+
+// policyStatement builds the statement creating, altering or dropping a policy of the table
+func policyStatement(table, action string, spec model.PolicySpec, stmt model.AlterationStatement) (model.AlterationStatement, error) {
+	name := strings.TrimSpace(spec.Name)
+	if name == "" {
+		return stmt, errors.Errorf("%s needs the policy name", action)
+	}
+
+	var roles []string
+	for _, role := range spec.Roles {
+		roles = append(roles, grantee(role))
+	}
+
+	switch action {
+	case "create_policy":
+		command := strings.ToUpper(strings.TrimSpace(spec.Command))
+		if command == "" {
+			command = "ALL"
+		}
+		if !policyCommands[command] {
+			return stmt, errors.Errorf("unknown policy command %s", spec.Command)
+		}
+		if command == "INSERT" && spec.Using != "" {
+			return stmt, errors.New("an INSERT policy only takes a WITH CHECK expression")
+		}
+		if (command == "SELECT" || command == "DELETE") && spec.WithCheck != "" {
+			return stmt, errors.Errorf("a %s policy only takes a USING expression", command)
+		}
+
+		stmt.Statement = fmt.Sprintf("CREATE POLICY %s ON %s", quoteIdent(name), table)
+		if spec.Restrictive {
+			stmt.Statement += " AS RESTRICTIVE"
+		}
+		stmt.Statement += " FOR " + command
+		if len(roles) > 0 {
+			stmt.Statement += " TO " + strings.Join(roles, ", ")
+		}
+		if spec.Using != "" {
+			stmt.Statement += " USING (" + spec.Using + ")"
+		}
+		if spec.WithCheck != "" {
+			stmt.Statement += " WITH CHECK (" + spec.WithCheck + ")"
+		}
+
+	case "alter_policy":
+		stmt.Statement = fmt.Sprintf("ALTER POLICY %s ON %s", quoteIdent(name), table)
+		if newName := strings.TrimSpace(spec.NewName); newName != "" && newName != name {
+			stmt.Statement += " RENAME TO " + quoteIdent(newName)
+			break
+		}
+		if len(roles) == 0 && spec.Using == "" && spec.WithCheck == "" {
+			return stmt, errors.New("alter_policy needs a new name, roles or expressions")
+		}
+		if len(roles) > 0 {
+			stmt.Statement += " TO " + strings.Join(roles, ", ")
+		}
+		if spec.Using != "" {
+			stmt.Statement += " USING (" + spec.Using + ")"
+		}
+		if spec.WithCheck != "" {
+			stmt.Statement += " WITH CHECK (" + spec.WithCheck + ")"
+		}
+
+	case "drop_policy":
+		stmt.Destructive = true
+		stmt.Statement = fmt.Sprintf("DROP POLICY %s ON %s", quoteIdent(name), table)
+		stmt.Warning = "Roles only covered by this policy lose access to the rows it allowed"
+	}
+
+	return stmt, nil
+}
+
+// planAlteration builds the script for the changes. Statements which can run in a
+// transaction come first, the ones which can't follow in their order.
+func planAlteration(rel *model.Relation, changes []model.TableChange) (*model.AlterationPlan, error) {
+	if len(changes) == 0 {
+		return nil, errors.New("no changes to apply")
+	}
+
+	plan := &model.AlterationPlan{
+		Table:      tabTableName(rel.Schema, rel.Name),
+		Statements: []model.AlterationStatement{},
+		Warnings:   []string{},
+	}
+
+	var outside []model.AlterationStatement
+	strongest := ""
+	for i, change := range changes {
+		stmt, err := alterationStatement(rel, change)
+		if err != nil {
+			return nil, errors.Wrapf(err, "change %d", i+1)
+		}
+
+		if !stmt.Transactional {
+			outside = append(outside, stmt)
+			continue
+		}
+		plan.Statements = append(plan.Statements, stmt)
+		if lockStrength[stmt.Lock] > lockStrength[strongest] {
+			strongest = stmt.Lock
+		}
+	}
+
+	var script strings.Builder
+	if len(plan.Statements) > 0 {
+		script.WriteString("BEGIN;\n")
+		for _, stmt := range plan.Statements {
+			script.WriteString(stmt.Statement + ";\n")
+		}
+		script.WriteString("COMMIT;\n")
+
+		if len(plan.Statements) > 1 {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("The transaction holds the %s lock on %s until it commits", strongest, plan.Table))
+		}
+		if strongest == lockAccessExclusive {
+			plan.Warnings = append(plan.Warnings, "ACCESS EXCLUSIVE blocks all reads and writes of the table, and waits for running queries on it to finish")
+		}
+	}
+	for _, stmt := range outside {
+		script.WriteString(stmt.Statement + ";\n")
+	}
+	if len(outside) > 0 {
+		plan.Warnings = append(plan.Warnings, "CONCURRENTLY statements can't run in a transaction, they run one by one after it commits")
+	}
+
+	plan.Statements = append(plan.Statements, outside...)
+	plan.Script = script.String()
+
+	return plan, nil
+}
+
+// alterationPlan builds the plan for the changes of a table of the pool's database
+func (c *Connections) alterationPlan(ctx context.Context, activePoolID uuid.UUID, tableName string, changes []model.TableChange) (*model.AlterationPlan, error) {
+	// The table may have been altered outside of the app since the last refresh
+	if _, err := c.MC.Refresh(ctx, activePoolID); err != nil {
+		return nil, err
+	}
+	metadata, err := c.MC.Get(ctx, activePoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	rel, err := tableRelation(metadata, tableName)
+	if err != nil {
+		return nil, err
+	}
+	if rel.Kind != "table" && rel.Kind != "partitioned table" {
+		return nil, errors.Errorf("%s is a %s, only tables can be altered", tableName, rel.Kind)
+	}
+
+	return planAlteration(rel, changes)
+}
+
+// PreviewTableAlteration returns the ALTER script for the changes along with the locks
+// it takes, without running anything
+func (c *Connections) PreviewTableAlteration(activePoolID uuid.UUID, tableName string, changes []model.TableChange) (*model.AlterationPlan, error) {
+	return c.alterationPlan(context.Background(), activePoolID, tableName, changes)
+}
+
+// ApplyTableAlteration runs the ALTER script for the changes in a transaction, except
+// for CONCURRENTLY statements which run one by one after it. When the environment
+// policy asks for confirmation the token returned in the confirmation has to be passed.
+func (c *Connections) ApplyTableAlteration(activePoolID uuid.UUID, tableName string, changes []model.TableChange, token string) *model.AlterationResult {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return &model.AlterationResult{OK: false, Message: "pool doesn't exist"}
+	}
+
+	ctx := context.Background()
+	started := time.Now()
+
+	plan, err := c.alterationPlan(ctx, activePoolID, tableName, changes)
+	if err != nil {
+		return &model.AlterationResult{OK: false, Message: err.Error()}
+	}
+
+	policy, err := c.poolPolicy(activePoolID)
+	if err != nil {
+		return &model.AlterationResult{OK: false, Message: err.Error()}
+	}
+
+	if policy.BlockDestructive {
+		for _, stmt := range plan.Statements {
+			if stmt.Destructive {
+				err := fmt.Errorf("destructive changes are blocked on %s connections: %s", policy.Env, stmt.Statement)
+				c.audit(activePoolID, plan.Script, started, 0, auditBlocked, err)
+				return &model.AlterationResult{OK: false, Message: err.Error()}
+			}
+		}
+	}
+
+	toConfirm, toConfirmInfo, err := checkPolicy(policy, plan.Script)
+	if err != nil {
+		c.audit(activePoolID, plan.Script, started, 0, auditBlocked, err)
+		return &model.AlterationResult{OK: false, Message: err.Error()}
+	}
+
+	if len(toConfirm) > 0 && !c.consumeConfirmation(activePoolID, plan.Script, token) {
+		confirmation, err := c.requestConfirmation(ctx, activePoolID, policy, plan.Script, toConfirm, toConfirmInfo)
+		if err != nil {
+			return &model.AlterationResult{OK: false, Message: err.Error()}
+		}
+
+		return &model.AlterationResult{
+			OK:                   false,
+			Message:              fmt.Sprintf("This alteration changes %s on a %s connection and needs to be confirmed", plan.Table, policy.Env),
+			RequiresConfirmation: true,
+			Confirmation:         confirmation,
+		}
+	}
+
+	// Whatever happens the cached structure of the table may be outdated now
+	defer c.MC.Invalidate(activePoolID)
+
+	result := &model.AlterationResult{OK: true}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return &model.AlterationResult{OK: false, Message: err.Error()}
+	}
+	defer tx.Rollback(ctx)
+
+	batch := c.newAuditBatch(activePoolID)
+	transactional := 0
+	for _, stmt := range plan.Statements {
+		if !stmt.Transactional {
+			continue
+		}
+
+		started := time.Now()
+		_, err := tx.Exec(ctx, stmt.Statement)
+		batch.add(stmt.Statement, started)
+		if err != nil {
+			batch.flush(err)
+			return &model.AlterationResult{OK: false, Message: fmt.Sprintf("%s: %s, nothing was changed", stmt.Statement, err.Error())}
+		}
+		transactional++
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		batch.flush(err)
+		return &model.AlterationResult{OK: false, Message: err.Error()}
+	}
+	batch.flush(nil)
+	result.Applied = transactional
+
+	for _, stmt := range plan.Statements {
+		if stmt.Transactional {
+			continue
+		}
+
+		started := time.Now()
+		if _, err := pool.Exec(ctx, stmt.Statement); err != nil {
+			c.audit(activePoolID, stmt.Statement, started, 0, auditError, err)
+			result.OK = false
+			result.Message = fmt.Sprintf("%s: %s", stmt.Statement, err.Error())
+			return result
+		}
+		c.audit(activePoolID, stmt.Statement, started, 0, auditSuccess, nil)
+		result.Applied++
+	}
+
+	result.Message = fmt.Sprintf("%d statements applied to %s", result.Applied, plan.Table)
+	return result
+}
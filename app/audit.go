@@ -0,0 +1,402 @@
+package app
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"database/sql"
+	"dbmx/model"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// Outcomes of audited statements
+const (
+	auditSuccess = "success"
+	auditError   = "error"
+	auditBlocked = "blocked"
+	auditDryRun  = "dry_run"
+)
+
+// Hash the first entry of the audit log chains to
+const auditGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Serialises appends so that every entry chains to the one written right before it
+var auditMu sync.Mutex
+
+// osUsername returns the name of the user running the app
+func osUsername() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return os.Getenv("USERNAME")
+}
+
+// redactLiterals replaces string and number literals in the sql with ?
+func redactLiterals(sql string) string {
+	var b strings.Builder
+	last := 0
+	for _, t := range lexSQL(sql) {
+		if t.kind != tokenString && t.kind != tokenNumber {
+			continue
+		}
+		b.WriteString(sql[last:t.start])
+		b.WriteString("?")
+		last = t.end
+	}
+	b.WriteString(sql[last:])
+	return b.String()
+}
+
+// Values postgres quotes in error messages, e.g. Key (id)=(42) or a trailing : "abc"
+var errorValueRegex = regexp.MustCompile(`'(?:[^']|'')*'|\)=\((?:[^()]|\([^()]*\))*\)|: "[^"]*"`)
+
+// redactError replaces the values quoted in an error message with ?
+func redactError(message string) string {
+	return errorValueRegex.ReplaceAllStringFunc(message, func(value string) string {
+		switch {
+		case strings.HasPrefix(value, ")=("):
+			return ")=(?)"
+		case strings.HasPrefix(value, ": "):
+			return ": ?"
+		}
+		return "?"
+	})
+}
+
+// classifyQuery classifies all statements of a query together. The kind is the most
+// dangerous kind among the statements and the command lists every statement's command.
+func classifyQuery(query string) statementInfo {
+	rank := map[string]int{statementRead: 0, statementOther: 1, statementDML: 2, statementDDL: 3}
+
+	info := statementInfo{Kind: statementRead}
+	var commands []string
+	for _, stmt := range splitStatements(query) {
+		si := classifyStatement(stmt)
+		commands = append(commands, si.Command)
+		if rank[si.Kind] > rank[info.Kind] {
+			info.Kind = si.Kind
+		}
+	}
+	info.Command = strings.Join(commands, "; ")
+
+	return info
+}
+
+// auditHash hashes the entry together with the hash of the previous entry
+func auditHash(e *model.AuditEntry) string {
+	fields := []string{
+		e.PrevHash,
+		e.CreatedAt,
+		e.OSUser,
+		fmt.Sprintf("%d", e.PostgresConnectionID),
+		e.PostgresConnectionName,
+		e.Database,
+		e.Env,
+		e.Kind,
+		e.Command,
+		e.Statement,
+		fmt.Sprintf("%t", e.Redacted),
+		fmt.Sprintf("%d", e.DurationMs),
+		fmt.Sprintf("%d", e.RowsAffected),
+		e.Outcome,
+		e.Error,
+	}
+
+	// Length prefixes keep field boundaries unambiguous
+	h := sha256.New()
+	for _, f := range fields {
+		fmt.Fprintf(h, "%d:%s", len(f), f)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// appendAudit chains the entry to the last one in the log and writes it
+func appendAudit(db *sql.DB, e *model.AuditEntry) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1").Scan(&e.PrevHash)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			return err
+		}
+		e.PrevHash = auditGenesisHash
+	}
+
+	e.Hash = auditHash(e)
+
+	result, err := tx.Exec(
+		`INSERT INTO audit_log (created_at, os_user, postgres_conn_id, postgres_conn_name, database, env, kind, command, statement, redacted, duration_ms, rows_affected, outcome, error, prev_hash, hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.CreatedAt, e.OSUser, e.PostgresConnectionID, e.PostgresConnectionName, e.Database, e.Env, e.Kind, e.Command, e.Statement, e.Redacted, e.DurationMs, e.RowsAffected, e.Outcome, e.Error, e.PrevHash, e.Hash,
+	)
+	if err != nil {
+		return err
+	}
+
+	e.ID, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// audit records a statement sent to the server of the pool, if the environment
+// of the pool's connection is audited
+func (c *Connections) audit(activePoolID uuid.UUID, query string, started time.Time, rowsAffected int64, outcome string, queryErr error) {
+	connID, dbName, exists := c.PM.Connection(activePoolID)
+	if !exists {
+		return
+	}
+
+	p, err := c.getPostgresConnection(connID)
+	if err != nil {
+		fmt.Println("Error writing audit log:", err)
+		return
+	}
+
+	policy, err := loadEnvPolicy(c.DB, p.Env)
+	if err != nil {
+		fmt.Println("Error writing audit log:", err)
+		return
+	}
+
+	if !policy.Audit {
+		return
+	}
+
+	info := classifyQuery(query)
+
+	entry := &model.AuditEntry{
+		CreatedAt:              time.Now().UTC().Format(time.RFC3339Nano),
+		OSUser:                 osUsername(),
+		PostgresConnectionID:   connID,
+		PostgresConnectionName: p.Name,
+		Database:               dbName,
+		Env:                    policy.Env,
+		Kind:                   info.Kind,
+		Command:                info.Command,
+		Statement:              query,
+		Redacted:               policy.RedactLiterals,
+		DurationMs:             time.Since(started).Milliseconds(),
+		RowsAffected:           rowsAffected,
+		Outcome:                outcome,
+	}
+
+	if policy.RedactLiterals {
+		entry.Statement = redactLiterals(query)
+	}
+
+	if queryErr != nil {
+		entry.Error = queryErr.Error()
+		if policy.RedactLiterals {
+			entry.Error = redactError(entry.Error)
+		}
+	}
+
+	err = appendAudit(c.DB, entry)
+	if err != nil {
+		fmt.Println("Error writing audit log:", err)
+	}
+}
+
+// auditedStatement is a statement run in a transaction whose audit entry waits for the
+// transaction to end
+type auditedStatement struct {
+	query    string
+	duration time.Duration
+}
+
+// auditBatch collects the statements of a transaction so that they are audited as
+// succeeded only once the transaction committed
+type auditBatch struct {
+	c            *Connections
+	activePoolID uuid.UUID
+	statements   []auditedStatement
+}
+
+func (c *Connections) newAuditBatch(activePoolID uuid.UUID) *auditBatch {
+	return &auditBatch{c: c, activePoolID: activePoolID}
+}
+
+// add records a statement which was started at started and just ended
+func (b *auditBatch) add(query string, started time.Time) {
+	b.statements = append(b.statements, auditedStatement{query: query, duration: time.Since(started)})
+}
+
+// flush audits the collected statements as succeeded, or with the error which
+// rolled the transaction back, including a failed commit
+func (b *auditBatch) flush(err error) {
+	for _, stmt := range b.statements {
+		// The entry's duration is the statement's own, not the wait for the commit
+		started := time.Now().Add(-stmt.duration)
+		if err != nil {
+			b.c.audit(b.activePoolID, stmt.query, started, 0, auditError, err)
+			continue
+		}
+		b.c.audit(b.activePoolID, stmt.query, started, 0, auditSuccess, nil)
+	}
+	b.statements = nil
+}
+
+// scanAuditEntries reads audit log rows selected with all columns in table order
+func scanAuditEntries(rows *sql.Rows, fn func(e *model.AuditEntry) error) error {
+	defer rows.Close()
+
+	for rows.Next() {
+		var e model.AuditEntry
+		var connID sql.NullInt64
+		err := rows.Scan(&e.ID, &e.CreatedAt, &e.OSUser, &connID, &e.PostgresConnectionName, &e.Database, &e.Env, &e.Kind, &e.Command, &e.Statement, &e.Redacted, &e.DurationMs, &e.RowsAffected, &e.Outcome, &e.Error, &e.PrevHash, &e.Hash)
+		if err != nil {
+			return errors.Wrap(err, "unable to read resultant rows into audit entry variable")
+		}
+		e.PostgresConnectionID = connID.Int64
+
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+const auditColumns = `id, created_at, os_user, postgres_conn_id, postgres_conn_name, database, env, kind, command, statement, redacted, duration_ms, rows_affected, outcome, error, prev_hash, hash`
+
+// GetAuditLog returns a page of the audit log, newest first. An empty env returns all environments.
+func (c *Connections) GetAuditLog(env string, limit, offset int) ([]model.AuditEntry, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	query := "SELECT " + auditColumns + " FROM audit_log"
+	args := []interface{}{}
+	if strings.TrimSpace(env) != "" {
+		query += " WHERE env = ?"
+		args = append(args, normalizeEnv(env))
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := c.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []model.AuditEntry
+	err = scanAuditEntries(rows, func(e *model.AuditEntry) error {
+		entries = append(entries, *e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// VerifyAuditLog walks the whole audit log and checks that every entry's hash matches
+// its contents and chains to the previous entry
+func (c *Connections) VerifyAuditLog() (*model.AuditVerification, error) {
+	rows, err := c.DB.Query("SELECT " + auditColumns + " FROM audit_log ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+
+	result := &model.AuditVerification{OK: true}
+	prevHash := auditGenesisHash
+
+	err = scanAuditEntries(rows, func(e *model.AuditEntry) error {
+		result.Entries++
+		if !result.OK {
+			return nil
+		}
+
+		switch {
+		case e.PrevHash != prevHash:
+			result.OK = false
+			result.BrokenAtID = e.ID
+			result.Message = fmt.Sprintf("entry %d doesn't chain to the previous entry, entries were removed or reordered", e.ID)
+		case auditHash(e) != e.Hash:
+			result.OK = false
+			result.BrokenAtID = e.ID
+			result.Message = fmt.Sprintf("entry %d was modified after it was written", e.ID)
+		}
+
+		prevHash = e.Hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.OK {
+		result.Message = fmt.Sprintf("all %d entries are intact", result.Entries)
+	}
+
+	return result, nil
+}
+
+// ExportAuditLog writes the audit log as JSON lines to the file at path and returns
+// the number of entries written. An empty env exports all environments.
+func (c *Connections) ExportAuditLog(path, env string) (int64, error) {
+	if strings.TrimSpace(path) == "" {
+		return 0, errors.New("export path is required")
+	}
+
+	query := "SELECT " + auditColumns + " FROM audit_log"
+	args := []interface{}{}
+	if strings.TrimSpace(env) != "" {
+		query += " WHERE env = ?"
+		args = append(args, normalizeEnv(env))
+	}
+	query += " ORDER BY id ASC"
+
+	rows, err := c.DB.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		rows.Close()
+		return 0, errors.Wrap(err, "failed to create export file")
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+
+	var count int64
+	err = scanAuditEntries(rows, func(e *model.AuditEntry) error {
+		count++
+		return enc.Encode(e)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
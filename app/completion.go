@@ -0,0 +1,1074 @@
+package app
+
+import (
+	"context"
+	"dbmx/model"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Most suggestions returned for a cursor position
+const maxSuggestions = 100
+
+// Subqueries and CTEs nested deeper than this are not looked into for their columns
+const maxScopeDepth = 8
+
+// What is expected at the cursor
+type completionContext int
+
+const (
+	completeNothing completionContext = iota
+	completeStatement
+	completeRelation
+	completeAfterRelation
+	completeColumn
+	completeJoinCondition
+	completeInsertColumns
+)
+
+// Keywords which start a clause and what is expected after them
+var clauseContexts = map[string]completionContext{
+	"select":    completeColumn,
+	"distinct":  completeColumn,
+	"where":     completeColumn,
+	"and":       completeColumn,
+	"or":        completeColumn,
+	"not":       completeColumn,
+	"having":    completeColumn,
+	"by":        completeColumn,
+	"set":       completeColumn,
+	"returning": completeColumn,
+	"values":    completeColumn,
+	"case":      completeColumn,
+	"when":      completeColumn,
+	"then":      completeColumn,
+	"else":      completeColumn,
+	"on":        completeJoinCondition,
+	"from":      completeRelation,
+	"join":      completeRelation,
+	"into":      completeRelation,
+	"update":    completeRelation,
+	"table":     completeRelation,
+	"truncate":  completeRelation,
+	"limit":     completeNothing,
+	"offset":    completeNothing,
+	"fetch":     completeNothing,
+}
+
+// Keywords which can't be a relation name or an alias without quoting
+var reservedWords = map[string]bool{
+	"all": true, "and": true, "as": true, "asc": true, "between": true, "by": true, "case": true,
+	"conflict": true, "cross": true, "default": true, "delete": true, "desc": true, "distinct": true,
+	"do": true, "else": true, "end": true, "except": true, "fetch": true, "for": true, "from": true,
+	"full": true, "group": true, "having": true, "ilike": true, "in": true, "inner": true, "insert": true,
+	"intersect": true, "into": true, "is": true, "join": true, "lateral": true, "left": true, "like": true,
+	"limit": true, "natural": true, "not": true, "null": true, "nulls": true, "offset": true, "on": true,
+	"only": true, "or": true, "order": true, "outer": true, "returning": true, "right": true, "select": true,
+	"set": true, "table": true, "tablesample": true, "then": true, "union": true, "update": true,
+	"using": true, "values": true, "when": true, "where": true, "window": true, "with": true,
+}
+
+// Keywords which end the select list
+var selectListEnd = map[string]bool{
+	"from": true, "into": true, "where": true, "group": true, "having": true, "window": true,
+	"order": true, "limit": true, "offset": true, "union": true, "intersect": true, "except": true,
+	"fetch": true, "for": true,
+}
+
+var statementKeywords = []string{
+	"SELECT", "INSERT INTO", "UPDATE", "DELETE FROM", "WITH", "VALUES", "TABLE", "EXPLAIN", "EXPLAIN ANALYZE",
+	"CREATE TABLE", "CREATE INDEX", "CREATE VIEW", "ALTER TABLE", "DROP TABLE", "TRUNCATE", "COPY",
+	"BEGIN", "COMMIT", "ROLLBACK", "SHOW", "SET", "GRANT", "REVOKE", "VACUUM", "ANALYZE",
+}
+
+var afterRelationKeywords = []string{
+	"JOIN", "INNER JOIN", "LEFT JOIN", "RIGHT JOIN", "FULL JOIN", "CROSS JOIN", "ON", "USING", "AS",
+	"WHERE", "GROUP BY", "ORDER BY", "HAVING", "LIMIT", "OFFSET", "UNION", "UNION ALL", "WINDOW",
+	"SET", "RETURNING", "FOR UPDATE",
+}
+
+var expressionKeywords = []string{
+	"AND", "OR", "NOT", "IN", "IS NULL", "IS NOT NULL", "LIKE", "ILIKE", "BETWEEN", "EXISTS",
+	"CASE", "WHEN", "THEN", "ELSE", "END", "AS", "DISTINCT", "FROM", "WHERE", "GROUP BY", "ORDER BY",
+	"HAVING", "LIMIT", "ASC", "DESC", "NULLS FIRST", "NULLS LAST", "NULL", "TRUE", "FALSE", "CAST",
+	"OVER", "PARTITION BY", "FILTER",
+}
+
+var relationKeywords = []string{"LATERAL", "ONLY"}
+
+// scopeRelation is a relation a query reads from, as referenced in the query
+type scopeRelation struct {
+	// Alias, or the relation name when there is no alias
+	alias  string
+	schema string
+	name   string
+	// Relation kind of the catalog, or cte, subquery, function or unknown
+	kind    string
+	columns []model.Column
+}
+
+// isBase reports if the relation is a relation of the catalog
+func (r scopeRelation) isBase() bool {
+	switch r.kind {
+	case "cte", "subquery", "function", "unknown":
+		return false
+	}
+	return true
+}
+
+// completionParser resolves the relations and columns of one statement
+type completionParser struct {
+	tokens   []sqlToken
+	metadata *model.SchemaMetadata
+	// Index of the closing parenthesis of every opening one, or len(tokens) if it's unclosed
+	match map[int]int
+	// DELETE and MERGE read from relations after USING
+	usingIsRelation bool
+}
+
+func newCompletionParser(tokens []sqlToken, metadata *model.SchemaMetadata) *completionParser {
+	p := &completionParser{
+		tokens:   tokens,
+		metadata: metadata,
+		match:    make(map[int]int),
+	}
+
+	var open []int
+	for i, t := range tokens {
+		if t.kind != tokenPunct {
+			continue
+		}
+		switch t.text {
+		case "(":
+			open = append(open, i)
+		case ")":
+			if len(open) > 0 {
+				p.match[open[len(open)-1]] = i
+				open = open[:len(open)-1]
+			}
+		}
+	}
+	for _, i := range open {
+		p.match[i] = len(tokens)
+	}
+
+	for _, i := range p.level(0, len(tokens)) {
+		// The main command follows the CTEs
+		if t := tokens[i]; t.isWord("select", "insert", "update", "delete", "merge", "values", "table") {
+			p.usingIsRelation = t.isWord("delete", "merge")
+			break
+		}
+	}
+
+	return p
+}
+
+// level returns the indexes of the tokens in [lo, hi) which are not inside parentheses.
+// Parentheses themselves are included so that groups can be recognised.
+func (p *completionParser) level(lo, hi int) []int {
+	var indexes []int
+	for i := lo; i < hi; i++ {
+		indexes = append(indexes, i)
+		if p.tokens[i].text == "(" && p.tokens[i].kind == tokenPunct {
+			close := p.match[i]
+			if close >= hi {
+				break
+			}
+			indexes = append(indexes, close)
+			i = close
+		}
+	}
+	return indexes
+}
+
+// isName reports if the token can be a relation name or alias
+func isName(t sqlToken) bool {
+	return t.kind == tokenQuotedIdent || (t.kind == tokenWord && !reservedWords[t.lower()])
+}
+
+// findRelation looks a relation up in the metadata. Without a schema the search path
+// is tried in order, then any schema.
+func findRelation(metadata *model.SchemaMetadata, schema, name string) *model.Relation {
+	if schema != "" {
+		for i := range metadata.Relations {
+			if metadata.Relations[i].Schema == schema && metadata.Relations[i].Name == name {
+				return &metadata.Relations[i]
+			}
+		}
+		return nil
+	}
+
+	for _, sp := range metadata.SearchPath {
+		if r := findRelation(metadata, sp, name); r != nil {
+			return r
+		}
+	}
+
+	for i := range metadata.Relations {
+		if metadata.Relations[i].Name == name {
+			return &metadata.Relations[i]
+		}
+	}
+	return nil
+}
+
+// resolve turns a possibly qualified name into a relation, preferring CTEs
+func (p *completionParser) resolve(parts []string, ctes map[string]scopeRelation) scopeRelation {
+	name := parts[len(parts)-1]
+	if len(parts) == 1 {
+		if cte, exists := ctes[name]; exists {
+			return cte
+		}
+	}
+
+	schema := ""
+	if len(parts) > 1 {
+		schema = parts[len(parts)-2]
+	}
+
+	r := findRelation(p.metadata, schema, name)
+	if r == nil {
+		return scopeRelation{schema: schema, name: name, kind: "unknown"}
+	}
+	return scopeRelation{schema: r.Schema, name: r.Name, kind: r.Kind, columns: r.Columns}
+}
+
+// names returns the names inside the parenthesis group starting at open
+func (p *completionParser) names(open int) []string {
+	var names []string
+	for _, i := range p.level(open+1, p.match[open]) {
+		if isName(p.tokens[i]) {
+			names = append(names, p.tokens[i].name())
+		}
+	}
+	return names
+}
+
+// ctes returns the CTEs of the WITH clause at the start of the query in [lo, hi),
+// added to the ones already visible
+func (p *completionParser) ctes(lo, hi int, visible map[string]scopeRelation, depth int) map[string]scopeRelation {
+	lv := p.level(lo, hi)
+	if len(lv) == 0 || !p.tokens[lv[0]].isWord("with") {
+		return visible
+	}
+
+	ctes := make(map[string]scopeRelation, len(visible))
+	for name, cte := range visible {
+		ctes[name] = cte
+	}
+
+	j := 1
+	if j < len(lv) && p.tokens[lv[j]].isWord("recursive") {
+		j++
+	}
+
+	for j < len(lv) && isName(p.tokens[lv[j]]) {
+		cte := scopeRelation{name: p.tokens[lv[j]].name(), kind: "cte"}
+		cte.alias = cte.name
+		j++
+
+		var columnNames []string
+		if j < len(lv) && p.tokens[lv[j]].text == "(" {
+			columnNames = p.names(lv[j])
+			j += 2
+		}
+
+		for j < len(lv) && p.tokens[lv[j]].isWord("as", "not", "materialized") {
+			j++
+		}
+		if j >= len(lv) || p.tokens[lv[j]].text != "(" {
+			break
+		}
+
+		open := lv[j]
+		if columnNames != nil {
+			for _, name := range columnNames {
+				cte.columns = append(cte.columns, model.Column{Name: name})
+			}
+		} else if depth < maxScopeDepth {
+			cte.columns = p.outputColumns(open+1, p.match[open], ctes, depth+1)
+		}
+		ctes[cte.name] = cte
+
+		j += 2
+		if j < len(lv) && p.tokens[lv[j]].text == "," {
+			j++
+			continue
+		}
+		break
+	}
+
+	return ctes
+}
+
+// relations returns the relations the query in [lo, hi) reads from or writes to
+func (p *completionParser) relations(lo, hi int, ctes map[string]scopeRelation, depth int) []scopeRelation {
+	var relations []scopeRelation
+
+	lv := p.level(lo, hi)
+	for j := 0; j < len(lv); j++ {
+		t := p.tokens[lv[j]]
+		isTarget := t.isWord("into", "update", "table", "truncate")
+		if !isTarget && !t.isWord("from", "join") && !(t.isWord("using") && p.usingIsRelation) {
+			continue
+		}
+
+		var found []scopeRelation
+		found, j = p.relationList(lv, j+1, ctes, depth, !isTarget)
+		relations = append(relations, found...)
+		j--
+	}
+
+	return relations
+}
+
+// relationList parses a comma separated list of relation references starting at lv[j]
+// and returns the relations along with the position after the list. Functions and
+// subqueries are only allowed in FROM and JOIN.
+func (p *completionParser) relationList(lv []int, j int, ctes map[string]scopeRelation, depth int, fromItems bool) ([]scopeRelation, int) {
+	var relations []scopeRelation
+
+	for j < len(lv) {
+		t := p.tokens[lv[j]]
+		if t.isWord("lateral", "only", "table") {
+			j++
+			continue
+		}
+
+		var rel scopeRelation
+		switch {
+		case t.text == "(" && t.kind == tokenPunct && fromItems:
+			open := lv[j]
+			rel = scopeRelation{kind: "subquery"}
+			if depth < maxScopeDepth {
+				rel.columns = p.outputColumns(open+1, p.match[open], ctes, depth+1)
+			}
+			j += 2
+
+		case isName(t):
+			parts := []string{t.name()}
+			j++
+			for j+1 < len(lv) && p.tokens[lv[j]].text == "." && isName(p.tokens[lv[j+1]]) {
+				parts = append(parts, p.tokens[lv[j+1]].name())
+				j += 2
+			}
+
+			if fromItems && j < len(lv) && p.tokens[lv[j]].text == "(" {
+				// Set returning function, e.g. generate_series(1, 10)
+				rel = scopeRelation{name: parts[len(parts)-1], kind: "function"}
+				j += 2
+			} else {
+				rel = p.resolve(parts, ctes)
+			}
+
+		default:
+			return relations, j
+		}
+
+		if j < len(lv) && p.tokens[lv[j]].isWord("as") {
+			j++
+		}
+		if j < len(lv) && isName(p.tokens[lv[j]]) {
+			rel.alias = p.tokens[lv[j]].name()
+			j++
+
+			// Column aliases rename the columns in order
+			if fromItems && j < len(lv) && p.tokens[lv[j]].text == "(" {
+				columns := append([]model.Column(nil), rel.columns...)
+				for i, name := range p.names(lv[j]) {
+					if i < len(columns) {
+						columns[i].Name = name
+					} else {
+						columns = append(columns, model.Column{Name: name})
+					}
+				}
+				rel.columns = columns
+				j += 2
+			}
+		}
+		if rel.alias == "" {
+			rel.alias = rel.name
+		}
+
+		relations = append(relations, rel)
+
+		if j < len(lv) && p.tokens[lv[j]].text == "," {
+			j++
+			continue
+		}
+		break
+	}
+
+	return relations, j
+}
+
+// outputColumns returns the columns a query in [lo, hi) produces, as far as they can be
+// told from its select list
+func (p *completionParser) outputColumns(lo, hi int, ctes map[string]scopeRelation, depth int) []model.Column {
+	ctes = p.ctes(lo, hi, ctes, depth)
+
+	lv := p.level(lo, hi)
+	j := 0
+	for j < len(lv) && !p.tokens[lv[j]].isWord("select") {
+		j++
+	}
+	if j >= len(lv) {
+		return nil
+	}
+	j++
+
+	for j < len(lv) && p.tokens[lv[j]].isWord("all", "distinct") {
+		j++
+		if j < len(lv) && p.tokens[lv[j]].isWord("on") {
+			j += 3
+		}
+	}
+
+	// Split the select list into items
+	var items [][]int
+	var item []int
+	for ; j < len(lv); j++ {
+		t := p.tokens[lv[j]]
+		if t.kind == tokenWord && selectListEnd[t.lower()] {
+			break
+		}
+		if t.text == "," && t.kind == tokenPunct {
+			items = append(items, item)
+			item = nil
+			continue
+		}
+		item = append(item, lv[j])
+	}
+	if item != nil {
+		items = append(items, item)
+	}
+
+	var relations []scopeRelation
+	relationsRead := false
+	readRelations := func() []scopeRelation {
+		if !relationsRead {
+			relations = p.relations(lo, hi, ctes, depth)
+			relationsRead = true
+		}
+		return relations
+	}
+
+	var columns []model.Column
+	for _, item := range items {
+		n := len(item)
+		last := p.tokens[item[n-1]]
+
+		switch {
+		// * or alias.*
+		case last.text == "*":
+			for _, rel := range readRelations() {
+				if n == 1 || (n == 3 && p.tokens[item[0]].name() == rel.alias) {
+					columns = append(columns, rel.columns...)
+				}
+			}
+
+		// Expression AS name
+		case n >= 2 && p.tokens[item[n-2]].isWord("as"):
+			columns = append(columns, model.Column{Name: last.name()})
+
+		// Column or alias.column
+		case isName(last) && (n == 1 || (n == 3 && p.tokens[item[1]].text == ".")):
+			column := model.Column{Name: last.name()}
+			for _, rel := range readRelations() {
+				if n == 3 && p.tokens[item[0]].name() != rel.alias {
+					continue
+				}
+				for _, c := range rel.columns {
+					if c.Name == column.Name {
+						column = c
+					}
+				}
+			}
+			columns = append(columns, column)
+
+		// Expression followed by an alias without AS
+		case isName(last) && n >= 2:
+			columns = append(columns, model.Column{Name: last.name()})
+
+		// Function call, postgres names the column after the function
+		case last.text == ")" && n == 3 && isName(p.tokens[item[0]]):
+			columns = append(columns, model.Column{Name: p.tokens[item[0]].name()})
+		}
+	}
+
+	return columns
+}
+
+// suggestionSet collects the suggestions matching the word being typed
+type suggestionSet struct {
+	prefix      string
+	suggestions []model.Suggestion
+	seen        map[string]bool
+}
+
+// matchScore rates how well the label matches the word being typed
+func matchScore(label, prefix string) (int, bool) {
+	if prefix == "" {
+		return 0, true
+	}
+
+	l, p := strings.ToLower(label), strings.ToLower(prefix)
+	switch {
+	case l == p:
+		return 25, true
+	case strings.HasPrefix(l, p):
+		return 20, true
+	case strings.Contains(l, p):
+		return 5, true
+	}
+	return 0, false
+}
+
+func (s *suggestionSet) add(label, insert, kind, detail string, weight int) {
+	score, ok := matchScore(label, s.prefix)
+	if !ok {
+		return
+	}
+
+	key := kind + "\x00" + insert
+	if s.seen[key] {
+		return
+	}
+	s.seen[key] = true
+
+	s.suggestions = append(s.suggestions, model.Suggestion{
+		Label:  label,
+		Insert: insert,
+		Kind:   kind,
+		Detail: detail,
+		Score:  weight + score,
+	})
+}
+
+// addKeywords suggests the keywords, in lower case when the word being typed is lower case
+func (s *suggestionSet) addKeywords(keywords []string, weight int) {
+	lower := s.prefix != "" && s.prefix == strings.ToLower(s.prefix)
+	for _, k := range keywords {
+		insert := k
+		if lower {
+			insert = strings.ToLower(k)
+		}
+		s.add(insert, insert, "keyword", "", weight)
+	}
+}
+
+// quoteIdent quotes the identifier only when postgres would not read it back as is
+func quoteIdent(name string) string {
+	plain := name != "" && !reservedWords[name]
+	for i, r := range name {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (i > 0 && (r >= '0' && r <= '9' || r == '$'))) {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// relationKind returns the suggestion kind of a catalog relation kind
+func relationKind(kind string) string {
+	if strings.Contains(kind, "view") {
+		return "view"
+	}
+	return "table"
+}
+
+// onSearchPath reports if objects of the schema can be referenced without the schema
+func onSearchPath(metadata *model.SchemaMetadata, schema string) bool {
+	if schema == "pg_catalog" {
+		return true
+	}
+	for _, sp := range metadata.SearchPath {
+		if sp == schema {
+			return true
+		}
+	}
+	return false
+}
+
+// qualifiedName returns the name to reference a catalog object by
+func qualifiedName(metadata *model.SchemaMetadata, schema, name string) string {
+	if onSearchPath(metadata, schema) {
+		return quoteIdent(name)
+	}
+	return quoteIdent(schema) + "." + quoteIdent(name)
+}
+
+// relationAlias makes a short alias from the initials of the relation name
+// which is not already used in the query
+func relationAlias(name string, used map[string]bool) string {
+	alias := ""
+	for _, part := range strings.Split(name, "_") {
+		if part != "" {
+			r, _ := utf8.DecodeRuneInString(part)
+			alias += strings.ToLower(string(r))
+		}
+	}
+	if alias == "" || reservedWords[alias] {
+		alias = "t"
+	}
+
+	candidate := alias
+	for i := 2; used[candidate]; i++ {
+		candidate = alias + strconv.Itoa(i)
+	}
+	return candidate
+}
+
+// joinCondition returns the condition joining the child and parent relation through the key
+func joinCondition(fk model.ForeignKey, child, parent string) string {
+	var parts []string
+	for i := range fk.Columns {
+		if i < len(fk.RefColumns) {
+			parts = append(parts, quoteIdent(child)+"."+quoteIdent(fk.Columns[i])+" = "+quoteIdent(parent)+"."+quoteIdent(fk.RefColumns[i]))
+		}
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// references reports if the scope relation is the table on the given side of a key
+func references(rel scopeRelation, schema, table string) bool {
+	return rel.isBase() && rel.schema == schema && rel.name == table
+}
+
+// utf16ToByteOffset converts an editor offset in UTF-16 code units to a byte offset
+func utf16ToByteOffset(text string, offset int) int {
+	units := 0
+	for i, r := range text {
+		if units >= offset {
+			return i
+		}
+		units += utf16.RuneLen(r)
+	}
+	return len(text)
+}
+
+// byteToUTF16Offset converts a byte offset to an editor offset in UTF-16 code units
+func byteToUTF16Offset(text string, pos int) int {
+	units := 0
+	for i, r := range text {
+		if i >= pos {
+			break
+		}
+		units += utf16.RuneLen(r)
+	}
+	return units
+}
+
+// completeSQL suggests what can be typed at offset in text. It resolves the aliases,
+// CTEs and subqueries visible at the cursor and works out the clause the cursor is in.
+func completeSQL(metadata *model.SchemaMetadata, text string, offset int) *model.CompletionResult {
+	pos := utf16ToByteOffset(text, offset)
+	result := &model.CompletionResult{From: offset, To: offset, Suggestions: []model.Suggestion{}}
+
+	all := lexSQL(text)
+
+	// Nothing to suggest inside strings and quoted identifiers
+	for _, t := range all {
+		if (t.kind == tokenString || t.kind == tokenQuotedIdent) && t.start < pos && pos < t.end {
+			return result
+		}
+	}
+
+	// The word being typed is replaced as a whole
+	wordStart, wordEnd := pos, pos
+	for wordStart > 0 {
+		r, size := utf8.DecodeLastRuneInString(text[:wordStart])
+		if !isIdentChar(r) {
+			break
+		}
+		wordStart -= size
+	}
+	for wordEnd < len(text) {
+		r, size := utf8.DecodeRuneInString(text[wordEnd:])
+		if !isIdentChar(r) {
+			break
+		}
+		wordEnd += size
+	}
+	prefix := text[wordStart:pos]
+	result.From = byteToUTF16Offset(text, wordStart)
+	result.To = byteToUTF16Offset(text, wordEnd)
+
+	// Tokens of the statement the cursor is in
+	lo, hi := 0, len(all)
+	for i, t := range all {
+		if t.kind != tokenPunct || t.text != ";" {
+			continue
+		}
+		if t.end <= wordStart {
+			lo = i + 1
+		} else if t.start >= pos && hi == len(all) {
+			hi = i
+		}
+	}
+	tokens := all[lo:hi]
+
+	// An identifier followed by a dot right before the word qualifies it
+	qualifier := ""
+	contextStart := wordStart
+	if wordStart > 0 && text[wordStart-1] == '.' {
+		for _, t := range tokens {
+			if t.end == wordStart-1 && (t.kind == tokenWord || t.kind == tokenQuotedIdent) {
+				qualifier = t.name()
+				contextStart = t.start
+			}
+		}
+	}
+
+	before := 0
+	for before < len(tokens) && tokens[before].start < contextStart {
+		before++
+	}
+
+	// Nothing to suggest inside comments, which the lexer skips
+	gapStart := 0
+	if before > 0 {
+		gapStart = tokens[before-1].end
+	} else if lo > 0 {
+		gapStart = all[lo-1].end
+	}
+	if gap := text[gapStart:contextStart]; strings.LastIndex(gap, "/*") > strings.LastIndex(gap, "*/") {
+		return result
+	} else if i := strings.LastIndex(gap, "--"); i >= 0 && !strings.Contains(gap[i:], "\n") {
+		return result
+	}
+
+	p := newCompletionParser(tokens, metadata)
+
+	// Parentheses open at the cursor, innermost last
+	var open []int
+	for i := 0; i < before; i++ {
+		if tokens[i].kind != tokenPunct {
+			continue
+		}
+		switch tokens[i].text {
+		case "(":
+			open = append(open, i)
+		case ")":
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+		}
+	}
+
+	// Query levels around the cursor, innermost first, with the CTEs visible in them
+	type queryScope struct {
+		lo, hi    int
+		ctes      map[string]scopeRelation
+		relations []scopeRelation
+	}
+	ranges := [][2]int{{0, len(tokens)}}
+	for _, o := range open {
+		if o+1 < len(tokens) && tokens[o+1].isWord("select", "with", "values") {
+			ranges = append(ranges, [2]int{o + 1, p.match[o]})
+		}
+	}
+
+	scopes := make([]queryScope, len(ranges))
+	var ctes map[string]scopeRelation
+	for i, r := range ranges {
+		ctes = p.ctes(r[0], r[1], ctes, 0)
+		scopes[len(ranges)-1-i] = queryScope{lo: r[0], hi: r[1], ctes: ctes, relations: p.relations(r[0], r[1], ctes, 0)}
+	}
+	scope := scopes[0]
+
+	// The clause the cursor is in is told by the last clause keyword before it
+	levelBefore := p.level(scope.lo, before)
+	expect := completeStatement
+	clause := -1
+	for k := len(levelBefore) - 1; k >= 0; k-- {
+		t := p.tokens[levelBefore[k]]
+		if t.kind != tokenWord {
+			continue
+		}
+		if c, exists := clauseContexts[t.lower()]; exists {
+			expect, clause = c, k
+			break
+		}
+		if t.isWord("using") && p.usingIsRelation {
+			expect, clause = completeRelation, k
+			break
+		}
+	}
+	if clause < 0 && len(levelBefore) > 0 {
+		expect = completeNothing
+	}
+
+	var prev sqlToken
+	if before > 0 {
+		prev = tokens[before-1]
+	}
+	afterValue := before > 0 && (isName(prev) || prev.kind == tokenNumber || prev.kind == tokenString || prev.text == ")")
+
+	switch {
+	case prev.isWord("as"):
+		expect = completeNothing
+
+	case expect == completeRelation && qualifier == "" && clause < len(levelBefore)-1:
+		// A relation was already named, what follows is an alias or the next clause
+		if last := p.tokens[levelBefore[len(levelBefore)-1]]; last.text != "," {
+			expect = completeAfterRelation
+		}
+
+	case expect == completeJoinCondition && !prev.isWord("on"):
+		expect = completeColumn
+	}
+
+	// Column list of INSERT INTO table (...)
+	if len(open) > 0 {
+		o := open[len(open)-1]
+		k := o - 1
+		for k >= 0 && (isName(tokens[k]) || tokens[k].text == ".") {
+			k--
+		}
+		if k >= 0 && k < o-1 && tokens[k].isWord("into") {
+			expect = completeInsertColumns
+		}
+	}
+
+	set := &suggestionSet{prefix: prefix, seen: make(map[string]bool)}
+
+	// Aliases already used in the query, to pick new ones
+	used := make(map[string]bool)
+	for _, s := range scopes {
+		for _, rel := range s.relations {
+			used[rel.alias] = true
+		}
+	}
+
+	// Relations joined so far in the cursor's query, the last one is being joined
+	joined := p.relations(scope.lo, before, scope.ctes, 0)
+
+	addRelations := func(schema string, weight int) {
+		if schema == "" {
+			for name := range scope.ctes {
+				set.add(name, quoteIdent(name), "cte", "cte", weight+10)
+			}
+		}
+		for _, r := range metadata.Relations {
+			if schema != "" && r.Schema != schema {
+				continue
+			}
+			insert := qualifiedName(metadata, r.Schema, r.Name)
+			w := weight
+			if schema != "" {
+				insert = quoteIdent(r.Name)
+			} else if !onSearchPath(metadata, r.Schema) {
+				w -= 15
+			}
+			set.add(r.Name, insert, relationKind(r.Kind), r.Schema+" · "+r.Kind, w)
+		}
+	}
+
+	addFunctions := func(schema string, weight int) {
+		for _, fn := range metadata.Functions {
+			if schema != "" && fn.Schema != schema {
+				continue
+			}
+			insert := qualifiedName(metadata, fn.Schema, fn.Name)
+			w := weight
+			if schema != "" {
+				insert = quoteIdent(fn.Name)
+			} else if !onSearchPath(metadata, fn.Schema) {
+				w -= 15
+			}
+			detail := fn.Name + "(" + fn.Arguments + ")"
+			if fn.Result != "" {
+				detail += " → " + fn.Result
+			}
+			set.add(fn.Name, insert, "function", detail, w)
+		}
+	}
+
+	addColumns := func(rel scopeRelation, qualify bool, weight int) {
+		for _, c := range rel.columns {
+			insert := quoteIdent(c.Name)
+			if qualify {
+				insert = quoteIdent(rel.alias) + "." + insert
+			}
+			detail := c.Type
+			if rel.alias != "" {
+				detail = strings.TrimSpace(c.Type + " · " + rel.alias)
+			}
+			set.add(c.Name, insert, "column", detail, weight)
+		}
+	}
+
+	addScopeColumns := func() {
+		// Columns present in more than one relation are inserted qualified
+		counts := make(map[string]int)
+		for _, rel := range scope.relations {
+			for _, c := range rel.columns {
+				counts[c.Name]++
+			}
+		}
+
+		for i, s := range scopes {
+			weight := 80
+			if i > 0 {
+				weight = 60
+			}
+			for _, rel := range s.relations {
+				for _, c := range rel.columns {
+					qualify := rel.alias != "" && (i > 0 || counts[c.Name] > 1)
+					addColumns(scopeRelation{alias: rel.alias, columns: []model.Column{c}}, qualify, weight)
+				}
+				if rel.alias != "" {
+					set.add(rel.alias, quoteIdent(rel.alias), "alias", rel.name, weight-10)
+				}
+			}
+		}
+	}
+
+	// lookupAlias finds the relation an alias refers to, from the innermost query out
+	lookupAlias := func(alias string) (scopeRelation, bool) {
+		for _, s := range scopes {
+			for _, rel := range s.relations {
+				if rel.alias == alias {
+					return rel, true
+				}
+			}
+		}
+		return scopeRelation{}, false
+	}
+
+	isSchema := func(name string) bool {
+		for _, s := range metadata.Schemas {
+			if s == name {
+				return true
+			}
+		}
+		return name == "pg_catalog"
+	}
+
+	switch expect {
+	case completeStatement:
+		set.addKeywords(statementKeywords, 80)
+
+	case completeRelation:
+		if qualifier != "" {
+			if isSchema(qualifier) {
+				addRelations(qualifier, 85)
+			}
+			break
+		}
+
+		addRelations("", 80)
+		for _, s := range metadata.Schemas {
+			set.add(s, quoteIdent(s), "schema", "schema", 60)
+		}
+		set.addKeywords(relationKeywords, 20)
+
+		// Tables related to the ones already in the query, joined on their foreign key
+		if p.tokens[levelBefore[clause]].isWord("join") {
+			for _, fk := range metadata.ForeignKeys {
+				for _, rel := range joined {
+					var other, cond, alias string
+					switch {
+					case references(rel, fk.RefSchema, fk.RefTable):
+						alias = relationAlias(fk.Table, used)
+						other = qualifiedName(metadata, fk.Schema, fk.Table)
+						cond = joinCondition(fk, alias, rel.alias)
+					case references(rel, fk.Schema, fk.Table):
+						alias = relationAlias(fk.RefTable, used)
+						other = qualifiedName(metadata, fk.RefSchema, fk.RefTable)
+						cond = joinCondition(fk, rel.alias, alias)
+					default:
+						continue
+					}
+					insert := other + " " + alias + " ON " + cond
+					set.add(insert, insert, "join", fk.Name, 95)
+				}
+			}
+		}
+
+	case completeAfterRelation:
+		set.addKeywords(afterRelationKeywords, 80)
+
+	case completeJoinCondition, completeColumn:
+		if qualifier != "" {
+			if rel, exists := lookupAlias(qualifier); exists {
+				addColumns(scopeRelation{columns: rel.columns}, false, 90)
+			} else if isSchema(qualifier) {
+				addRelations(qualifier, 70)
+				addFunctions(qualifier, 70)
+			}
+			break
+		}
+
+		// Conditions joining the relation being joined to the ones before it
+		if expect == completeJoinCondition && len(joined) > 1 {
+			last := joined[len(joined)-1]
+			for _, fk := range metadata.ForeignKeys {
+				for _, rel := range joined[:len(joined)-1] {
+					var cond string
+					switch {
+					case references(last, fk.Schema, fk.Table) && references(rel, fk.RefSchema, fk.RefTable):
+						cond = joinCondition(fk, last.alias, rel.alias)
+					case references(rel, fk.Schema, fk.Table) && references(last, fk.RefSchema, fk.RefTable):
+						cond = joinCondition(fk, rel.alias, last.alias)
+					default:
+						continue
+					}
+					set.add(cond, cond, "join", fk.Name, 95)
+				}
+			}
+		}
+
+		addScopeColumns()
+		addFunctions("", 50)
+
+		keywordWeight := 40
+		if afterValue {
+			keywordWeight = 85
+		}
+		set.addKeywords(expressionKeywords, keywordWeight)
+
+	case completeInsertColumns:
+		if target := p.relations(0, before, scope.ctes, 0); len(target) > 0 {
+			addColumns(scopeRelation{columns: target[0].columns}, false, 90)
+		}
+	}
+
+	sort.SliceStable(set.suggestions, func(i, j int) bool {
+		a, b := set.suggestions[i], set.suggestions[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if len(a.Label) != len(b.Label) {
+			return len(a.Label) < len(b.Label)
+		}
+		return a.Label < b.Label
+	})
+
+	if len(set.suggestions) > maxSuggestions {
+		set.suggestions = set.suggestions[:maxSuggestions]
+	}
+	result.Suggestions = set.suggestions
+
+	return result
+}
+
+// CompleteSQL returns ranked suggestions for the cursor at offset in the editor text.
+// The offset counts UTF-16 code units like the editor does.
+func (c *Connections) CompleteSQL(activePoolID uuid.UUID, text string, offset int) (*model.CompletionResult, error) {
+	metadata, err := c.MC.Get(context.Background(), activePoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	return completeSQL(metadata, text, offset), nil
+}
@@ -0,0 +1,375 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"dbmx/model"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Statuses of a setting difference
+const (
+	settingChanged   = "changed"
+	settingOnlyLeft  = "only_left"
+	settingOnlyRight = "only_right"
+)
+
+// Units a setting value can be normalised to, largest first
+var (
+	memoryUnits = []struct {
+		name  string
+		bytes float64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"kB", 1 << 10}, {"B", 1}}
+
+	timeUnits = []struct {
+		name string
+		ms   float64
+	}{{"d", 24 * 60 * 60 * 1000}, {"h", 60 * 60 * 1000}, {"min", 60 * 1000}, {"s", 1000}, {"ms", 1}}
+)
+
+// unitSize returns the bytes or milliseconds of a pg_settings unit such as 8kB or min
+func unitSize(unit string) (float64, bool, bool) {
+	multiplier := 1.0
+	digits := strings.IndexFunc(unit, func(r rune) bool { return r < '0' || r > '9' })
+	if digits > 0 {
+		m, err := strconv.ParseFloat(unit[:digits], 64)
+		if err != nil {
+			return 0, false, false
+		}
+		multiplier, unit = m, unit[digits:]
+	}
+	for _, u := range memoryUnits {
+		if u.name == unit {
+			return multiplier * u.bytes, true, false
+		}
+	}
+	if unit == "us" {
+		return multiplier / 1000, false, true
+	}
+	for _, u := range timeUnits {
+		if u.name == unit {
+			return multiplier * u.ms, false, true
+		}
+	}
+	return 0, false, false
+}
+
+// normalizeSetting writes a value with its unit in the largest unit the value is a whole
+// number of, the way postgresql.conf would, so that servers with different block sizes
+// or values written in different units compare equal
+func normalizeSetting(value, unit string) string {
+	if unit == "" {
+		return value
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value + unit
+	}
+	// -1 and 0 usually mean disabled or no limit rather than an amount
+	if v <= 0 {
+		return value
+	}
+
+	size, memory, duration := unitSize(unit)
+	amount := v * size
+	switch {
+	case memory:
+		for _, u := range memoryUnits {
+			if math.Mod(amount, u.bytes) == 0 {
+				return fmt.Sprintf("%.0f%s", amount/u.bytes, u.name)
+			}
+		}
+	case duration:
+		for _, u := range timeUnits {
+			if math.Mod(amount, u.ms) == 0 {
+				return fmt.Sprintf("%.0f%s", amount/u.ms, u.name)
+			}
+		}
+		return strconv.FormatFloat(amount, 'f', -1, 64) + "ms"
+	}
+	return value + unit
+}
+
+// loadServerSettings reads pg_settings through the pool, ordered by category and name.
+// The configuration file of a setting is only visible to superusers.
+func loadServerSettings(ctx context.Context, pool *pgxpool.Pool) ([]model.ServerSetting, error) {
+	query := `
+		SELECT
+			name,
+			category,
+			COALESCE(setting, ''),
+			COALESCE(unit, ''),
+			source,
+			COALESCE(sourcefile, ''),
+			COALESCE(sourceline, 0),
+			pending_restart,
+			context,
+			vartype,
+			COALESCE(boot_val, ''),
+			COALESCE(reset_val, ''),
+			COALESCE(short_desc, ''),
+			COALESCE(extra_desc, '')
+		FROM pg_settings
+		ORDER BY category, name
+	`
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read server settings")
+	}
+	defer rows.Close()
+
+	var settings []model.ServerSetting
+	for rows.Next() {
+		var s model.ServerSetting
+		err := rows.Scan(&s.Name, &s.Category, &s.Value, &s.Unit, &s.Source, &s.SourceFile, &s.SourceLine, &s.PendingRestart, &s.Context, &s.Type, &s.BootValue, &s.ResetValue, &s.Description, &s.Details)
+		if err != nil {
+			return nil, err
+		}
+		s.Normalized = normalizeSetting(s.Value, s.Unit)
+		settings = append(settings, s)
+	}
+
+	return settings, rows.Err()
+}
+
+// sessionSource reports if the value of a setting was set by the connection rather
+// than by the server's configuration
+func sessionSource(source string) bool {
+	return source == "client" || source == "session"
+}
+
+// diffSettings compares the normalised values of two sets of settings
+func diffSettings(left, right []model.ServerSetting) ([]model.SettingDifference, int) {
+	rightByName := make(map[string]model.ServerSetting, len(right))
+	for _, s := range right {
+		rightByName[s.Name] = s
+	}
+
+	differences := []model.SettingDifference{}
+	same := 0
+	seen := make(map[string]bool, len(left))
+	for _, l := range left {
+		seen[l.Name] = true
+		r, exists := rightByName[l.Name]
+		if !exists {
+			differences = append(differences, model.SettingDifference{
+				Name: l.Name, Category: l.Category, Status: settingOnlyLeft,
+				Left: l.Normalized, LeftSource: l.Source, SessionOnly: sessionSource(l.Source),
+			})
+			continue
+		}
+		if l.Normalized == r.Normalized {
+			same++
+			continue
+		}
+		differences = append(differences, model.SettingDifference{
+			Name: l.Name, Category: l.Category, Status: settingChanged,
+			Left: l.Normalized, Right: r.Normalized, LeftSource: l.Source, RightSource: r.Source,
+			SessionOnly: sessionSource(l.Source) || sessionSource(r.Source),
+		})
+	}
+	for _, r := range right {
+		if !seen[r.Name] {
+			differences = append(differences, model.SettingDifference{
+				Name: r.Name, Category: r.Category, Status: settingOnlyRight,
+				Right: r.Normalized, RightSource: r.Source, SessionOnly: sessionSource(r.Source),
+			})
+		}
+	}
+
+	sort.SliceStable(differences, func(i, j int) bool {
+		if differences[i].Category != differences[j].Category {
+			return differences[i].Category < differences[j].Category
+		}
+		return differences[i].Name < differences[j].Name
+	})
+
+	return differences, same
+}
+
+// poolLabel names the pool's server in a diff by its connection name and database
+func (c *Connections) poolLabel(activePoolID uuid.UUID) string {
+	connID, dbName, _ := c.PM.Connection(activePoolID)
+	p, err := c.getPostgresConnection(connID)
+	if err != nil {
+		return dbName
+	}
+	return p.Name + "/" + dbName
+}
+
+// poolSettings reads the settings of an active pool
+func (c *Connections) poolSettings(activePoolID uuid.UUID) ([]model.ServerSetting, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+	return loadServerSettings(context.Background(), pool)
+}
+
+// GetServerSettings reads the settings of the pool's server grouped by category
+func (c *Connections) GetServerSettings(activePoolID uuid.UUID) ([]model.SettingsCategory, error) {
+	settings, err := c.poolSettings(activePoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	categories := []model.SettingsCategory{}
+	for _, s := range settings {
+		if len(categories) == 0 || categories[len(categories)-1].Name != s.Category {
+			categories = append(categories, model.SettingsCategory{Name: s.Category})
+		}
+		last := &categories[len(categories)-1]
+		last.Settings = append(last.Settings, s)
+	}
+
+	return categories, nil
+}
+
+// DiffServerSettings compares the settings of the servers of two active pools
+func (c *Connections) DiffServerSettings(leftPoolID, rightPoolID uuid.UUID) (*model.SettingsDiff, error) {
+	left, err := c.poolSettings(leftPoolID)
+	if err != nil {
+		return nil, err
+	}
+	right, err := c.poolSettings(rightPoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	differences, same := diffSettings(left, right)
+	return &model.SettingsDiff{
+		Left:        c.poolLabel(leftPoolID),
+		Right:       c.poolLabel(rightPoolID),
+		Differences: differences,
+		Same:        same,
+	}, nil
+}
+
+// SaveSettingsSnapshot saves the settings of the pool's server under a name
+func (c *Connections) SaveSettingsSnapshot(activePoolID uuid.UUID, name string) (*model.SettingsSnapshot, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("snapshot name is required")
+	}
+
+	settings, err := c.poolSettings(activePoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	connID, dbName, _ := c.PM.Connection(activePoolID)
+	p, err := c.getPostgresConnection(connID)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &model.SettingsSnapshot{
+		Name:                   name,
+		PostgresConnectionID:   &connID,
+		PostgresConnectionName: p.Name,
+		Database:               dbName,
+		CreatedAt:              time.Now().UTC().Format(time.RFC3339),
+		Settings:               settings,
+	}
+	for _, s := range settings {
+		if s.Name == "server_version" {
+			snapshot.ServerVersion = s.Value
+		}
+	}
+
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.DB.Exec(
+		"INSERT INTO settings_snapshots (name, postgres_conn_id, postgres_conn_name, database, server_version, created_at, settings) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		snapshot.Name, connID, snapshot.PostgresConnectionName, snapshot.Database, snapshot.ServerVersion, snapshot.CreatedAt, string(settingsJSON),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to save settings snapshot")
+	}
+	snapshot.ID, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// GetSettingsSnapshots lists the saved snapshots, newest first, without their settings
+func (c *Connections) GetSettingsSnapshots() ([]model.SettingsSnapshot, error) {
+	rows, err := c.DB.Query("SELECT id, name, postgres_conn_id, postgres_conn_name, database, server_version, created_at FROM settings_snapshots ORDER BY created_at DESC, id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := []model.SettingsSnapshot{}
+	for rows.Next() {
+		var s model.SettingsSnapshot
+		var connID sql.NullInt64
+		if err := rows.Scan(&s.ID, &s.Name, &connID, &s.PostgresConnectionName, &s.Database, &s.ServerVersion, &s.CreatedAt); err != nil {
+			return nil, errors.Wrap(err, "unable to read resultant rows into snapshot variable")
+		}
+		if connID.Valid {
+			s.PostgresConnectionID = &connID.Int64
+		}
+		snapshots = append(snapshots, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to read rows")
+	}
+
+	return snapshots, nil
+}
+
+func (c *Connections) DeleteSettingsSnapshot(id int64) (bool, error) {
+	_, err := c.DB.Exec("DELETE FROM settings_snapshots WHERE id = ?", id)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to delete settings snapshot")
+	}
+	return true, nil
+}
+
+// DiffSettingsSnapshot compares a saved snapshot, on the left, with the current
+// settings of the pool's server
+func (c *Connections) DiffSettingsSnapshot(activePoolID uuid.UUID, snapshotID int64) (*model.SettingsDiff, error) {
+	var name, createdAt, settingsJSON string
+	err := c.DB.QueryRow("SELECT name, created_at, settings FROM settings_snapshots WHERE id = ?", snapshotID).Scan(&name, &createdAt, &settingsJSON)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("settings snapshot not found")
+		}
+		return nil, err
+	}
+
+	var left []model.ServerSetting
+	if err := json.Unmarshal([]byte(settingsJSON), &left); err != nil {
+		return nil, errors.Wrap(err, "failed to read settings snapshot")
+	}
+
+	right, err := c.poolSettings(activePoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	differences, same := diffSettings(left, right)
+	return &model.SettingsDiff{
+		Left:        fmt.Sprintf("%s (%s)", name, createdAt),
+		Right:       c.poolLabel(activePoolID),
+		Differences: differences,
+		Same:        same,
+	}, nil
+}
@@ -0,0 +1,35 @@
+package app
+
+import "testing"
+
+func TestNormalizeSetting(t *testing.T) {
+	tests := []struct {
+		value string
+		unit  string
+		want  string
+	}{
+		{"on", "", "on"},
+		{"1024", "kB", "1MB"},
+		{"1536", "kB", "1536kB"},
+		{"8192", "8kB", "64MB"},
+		{"16384", "8kB", "128MB"},
+		{"1", "B", "1B"},
+		{"4", "MB", "4MB"},
+		{"60", "s", "1min"},
+		{"90", "s", "90s"},
+		{"1500", "ms", "1500ms"},
+		{"3600000", "ms", "1h"},
+		{"1440", "min", "1d"},
+		{"0", "ms", "0"},
+		{"-1", "kB", "-1"},
+		{"abc", "kB", "abckB"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value+tt.unit, func(t *testing.T) {
+			if got := normalizeSetting(tt.value, tt.unit); got != tt.want {
+				t.Errorf("normalizeSetting(%q, %q) = %q, want %q", tt.value, tt.unit, got, tt.want)
+			}
+		})
+	}
+}
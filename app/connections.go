@@ -4,16 +4,17 @@ import (
 	"context"
 	"database/sql"
 	"dbmx/model"
-	"encoding/json"
 	"fmt"
 	"log"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 )
@@ -21,12 +22,31 @@ import (
 type Connections struct {
 	DB *sql.DB
 	PM *PoolManager
+	RS *ResultStore
+	CM *CursorManager
+	MC *MetadataCache
+	JM *JobManager
+	LM *ListenerManager
+	SM *StreamManager
+	TM *TransferManager
+
+	// Queries waiting to be confirmed, keyed by confirmation token
+	confirmations map[string]pendingConfirmation
+	mu            sync.Mutex
 }
 
-func NewConnections(db *sql.DB, pm *PoolManager) *Connections {
+func NewConnections(db *sql.DB, pm *PoolManager, rs *ResultStore, cm *CursorManager, mc *MetadataCache, jm *JobManager, lm *ListenerManager, sm *StreamManager, tm *TransferManager) *Connections {
 	return &Connections{
-		DB: db,
-		PM: pm,
+		DB:            db,
+		PM:            pm,
+		RS:            rs,
+		CM:            cm,
+		MC:            mc,
+		JM:            jm,
+		LM:            lm,
+		SM:            sm,
+		TM:            tm,
+		confirmations: make(map[string]pendingConfirmation),
 	}
 }
 
@@ -44,7 +64,7 @@ func (m *Connections) GetSqlite3Version() string {
 func (m *Connections) GetPostgresConnections() ([]model.PostgresConnection, error) {
 	// Get all postgres connections
 	var connections []model.PostgresConnection
-	rows, err := m.DB.Query("SELECT * FROM postgres")
+	rows, err := m.DB.Query("SELECT id, name, host, port, username, password, env, colour, database, max_conns, min_conns, max_conn_lifetime, max_conn_idle_time, health_check_period, application_name FROM postgres")
 	if err != nil {
 		return nil, err
 	}
@@ -63,6 +83,12 @@ func (m *Connections) GetPostgresConnections() ([]model.PostgresConnection, erro
 			&connection.Env,
 			&connection.Colour,
 			&connection.Database,
+			&connection.MaxConns,
+			&connection.MinConns,
+			&connection.MaxConnLifetime,
+			&connection.MaxConnIdleTime,
+			&connection.HealthCheckPeriod,
+			&connection.ApplicationName,
 		)
 		if err != nil {
 			return nil, errors.Wrap(err, "unable to read resultant rows into connection variable")
@@ -77,6 +103,156 @@ func (m *Connections) GetPostgresConnections() ([]model.PostgresConnection, erro
 	return connections, nil
 }
 
+// getPostgresConnection reads a single saved postgres connection by its id
+func (c *Connections) getPostgresConnection(id int64) (*model.PostgresConnection, error) {
+	var p model.PostgresConnection
+	row := c.DB.QueryRow("SELECT id, name, host, port, username, password, env, colour, database, max_conns, min_conns, max_conn_lifetime, max_conn_idle_time, health_check_period, application_name FROM postgres WHERE id = ?", id)
+
+	err := row.Scan(&p.ID, &p.Name, &p.Host, &p.Port, &p.Username, &p.Password, &p.Env, &p.Colour, &p.Database, &p.MaxConns, &p.MinConns, &p.MaxConnLifetime, &p.MaxConnIdleTime, &p.HealthCheckPeriod, &p.ApplicationName)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Wrap(err, "postgres server not found")
+		} else {
+			return nil, err
+		}
+	}
+
+	return &p, nil
+}
+
+// setPoolDefaults fills the pool settings which are not set with the defaults
+func setPoolDefaults(p *model.PostgresConnection) {
+	if p.MaxConns <= 0 {
+		p.MaxConns = defaultMaxConns
+	}
+	if p.MinConns < 0 || p.MinConns > p.MaxConns {
+		p.MinConns = defaultMinConns
+	}
+	if p.MaxConnLifetime <= 0 {
+		p.MaxConnLifetime = int64(defaultMaxConnLifetime.Seconds())
+	}
+	if p.MaxConnIdleTime <= 0 {
+		p.MaxConnIdleTime = int64(defaultMaxConnIdleTime.Seconds())
+	}
+	if p.HealthCheckPeriod <= 0 {
+		p.HealthCheckPeriod = int64(defaultHealthCheckPeriod.Seconds())
+	}
+	if strings.TrimSpace(p.ApplicationName) == "" {
+		p.ApplicationName = defaultApplicationName
+	}
+}
+
+// newPoolConfig builds the pool config for a database of the postgres connection
+// with the session defaults of the connection's environment policy
+func (c *Connections) newPoolConfig(p *model.PostgresConnection, dbName string) (*pgxpool.Config, error) {
+	// Make a connection string
+	connString := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=require", p.Username, p.Password, p.Host, p.Port, dbName)
+
+	config, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := *p
+	setPoolDefaults(&settings)
+
+	config.MaxConns = settings.MaxConns
+	config.MinConns = settings.MinConns
+	config.MaxConnLifetime = time.Duration(settings.MaxConnLifetime) * time.Second
+	config.MaxConnIdleTime = time.Duration(settings.MaxConnIdleTime) * time.Second
+	config.HealthCheckPeriod = time.Duration(settings.HealthCheckPeriod) * time.Second
+	config.ConnConfig.RuntimeParams["application_name"] = settings.ApplicationName
+
+	policy, err := loadEnvPolicy(c.DB, p.Env)
+	if err != nil {
+		return nil, err
+	}
+	applyEnvPolicy(config, policy)
+
+	return config, nil
+}
+
+// connectPool returns the id of the pool already open for the connection and database,
+// or opens a new pool and adds it to the active pool manager
+func (c *Connections) connectPool(p *model.PostgresConnection, dbName string) (uuid.UUID, error) {
+	if poolID, exists := c.PM.FindPool(p.ID, dbName); exists {
+		return poolID, nil
+	}
+
+	config, err := c.newPoolConfig(p, dbName)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	activePoolID := uuid.New()
+
+	_, err = c.PM.AddPool(activePoolID, p.ID, dbName, config)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	// The first pool to a database since the app started cleans up after earlier runs
+	go c.dropOrphanPublications(activePoolID)
+
+	return activePoolID, nil
+}
+
+// attachTabs saves the active db properties in the tabs which don't have an active db
+// and marks those tabs as using the pool
+func (c *Connections) attachTabs(activePoolID uuid.UUID, activeDB, colour string, postgresConnID int64, dbName string) error {
+	var tabIDs []int64
+
+	// Save the active db properties in all the tabs with type editor if active db properties are null
+	rows, err := c.DB.Query("UPDATE tabs SET active_db_id = ?, active_db = ?, active_db_colour = ? WHERE active_db_id IS NULL AND type = 'editor' RETURNING id", activePoolID.String(), activeDB, colour)
+	if err != nil {
+		return err
+	}
+	ids, err := scanIDs(rows)
+	if err != nil {
+		return err
+	}
+	tabIDs = append(tabIDs, ids...)
+
+	// In case of table rows, find all the rows with type table where
+	// active_db_id is null and postgres_connection_id and database matches
+	// set the active pool id and active db properties in such tabs
+	rows, err = c.DB.Query("UPDATE tabs SET active_db_id = ?, active_db = ?, active_db_colour = ? WHERE active_db_id IS NULL AND type = 'table' AND postgres_conn_id = ? AND db_name = ? RETURNING id", activePoolID.String(), activeDB, colour, postgresConnID, dbName)
+	if err != nil {
+		return err
+	}
+	ids, err = scanIDs(rows)
+	if err != nil {
+		return err
+	}
+	tabIDs = append(tabIDs, ids...)
+
+	for _, tabID := range tabIDs {
+		c.PM.Retain(activePoolID, tabID)
+	}
+
+	return nil
+}
+
+// scanIDs reads a single integer id column from the rows and closes them
+func scanIDs(rows *sql.Rows) ([]int64, error) {
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
 func (m *Connections) TestConnectPostgres(p model.PostgresConnection) (bool, error) {
 	if p.Database == "" {
 		p.Database = "postgres"
@@ -124,12 +300,14 @@ func (c *Connections) AddPostgresConnection(p model.PostgresConnection) (bool, e
 		return false, errors.New("Connection name already exists. Please choose a different name")
 	}
 
-	insertStatement, err := c.DB.Prepare("INSERT INTO postgres (name, host, port, username, password, env, colour, database) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	setPoolDefaults(&p)
+
+	insertStatement, err := c.DB.Prepare("INSERT INTO postgres (name, host, port, username, password, env, colour, database, max_conns, min_conns, max_conn_lifetime, max_conn_idle_time, health_check_period, application_name) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return false, errors.Wrap(err, "failed to prepare query to insert new connection in postgres")
 	}
 
-	_, err = insertStatement.Exec(p.Name, p.Host, p.Port, p.Username, p.Password, p.Env, p.Colour, p.Database)
+	_, err = insertStatement.Exec(p.Name, p.Host, p.Port, p.Username, p.Password, p.Env, p.Colour, p.Database, p.MaxConns, p.MinConns, p.MaxConnLifetime, p.MaxConnIdleTime, p.HealthCheckPeriod, p.ApplicationName)
 	if err != nil {
 		return false, errors.Wrap(err, "failed to insert new connection in postgres")
 	}
@@ -137,12 +315,59 @@ func (c *Connections) AddPostgresConnection(p model.PostgresConnection) (bool, e
 	return true, nil
 }
 
+// UpdatePostgresConnection saves the edited connection, its pool settings included, and
+// rebuilds the config of its open pools. They reconnect with it the next time they are
+// used. An empty password keeps the saved one.
+func (c *Connections) UpdatePostgresConnection(p model.PostgresConnection) (bool, error) {
+	saved, err := c.getPostgresConnection(p.ID)
+	if err != nil {
+		return false, err
+	}
+
+	if p.Database == "" {
+		p.Database = "postgres"
+	}
+	if p.Password == "" {
+		p.Password = saved.Password
+	}
+
+	var exists bool
+	err = c.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM postgres WHERE name = ? AND id != ?)`, p.Name, p.ID).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, errors.New("Connection name already exists. Please choose a different name")
+	}
+
+	setPoolDefaults(&p)
+
+	_, err = c.DB.Exec("UPDATE postgres SET name = ?, host = ?, port = ?, username = ?, password = ?, env = ?, colour = ?, database = ?, max_conns = ?, min_conns = ?, max_conn_lifetime = ?, max_conn_idle_time = ?, health_check_period = ?, application_name = ? WHERE id = ?",
+		p.Name, p.Host, p.Port, p.Username, p.Password, p.Env, p.Colour, p.Database, p.MaxConns, p.MinConns, p.MaxConnLifetime, p.MaxConnIdleTime, p.HealthCheckPeriod, p.ApplicationName, p.ID)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to update connection in postgres")
+	}
+
+	err = c.reconfigureConnectionPools(&p)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
 func (c *Connections) RefreshPostgresDatabase(id int64, dbID, dbName, poolID string) (*model.Database, error) {
 	poolIDUUID, err := uuid.Parse(poolID)
 	if err != nil {
 		return nil, err
 	}
 
+	// Reload what changed in the schema since the last refresh
+	changes, err := c.MC.Refresh(context.TODO(), poolIDUUID)
+	if err != nil {
+		return nil, err
+	}
+
 	// Get all tables
 	tables, err := c.GetAllPostgresTables(poolIDUUID)
 	if err != nil {
@@ -156,6 +381,7 @@ func (c *Connections) RefreshPostgresDatabase(id int64, dbID, dbName, poolID str
 		PoolID:               poolID,
 		IsActive:             true,
 		Tables:               tables,
+		Changes:              changes,
 	}, nil
 }
 
@@ -163,27 +389,14 @@ func (c *Connections) RefreshPostgresDatabase(id int64, dbID, dbName, poolID str
 // id is the postgres connection id primary key in the sqlite3 database
 // dbID uniquely identifies the active database within a connection
 func (c *Connections) EstablishPostgresDatabaseConnection(id int64, dbName string) (*model.Database, error) {
-	// Query for a single row by ID
-	var name, host, port, username, password, colour string
-	row := c.DB.QueryRow("SELECT name, host, port, username, password, colour FROM postgres WHERE id = ?", id)
-
-	// Scan the result into variables
-	err := row.Scan(&name, &host, &port, &username, &password, &colour)
+	p, err := c.getPostgresConnection(id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, errors.Wrap(err, "postgres server not found")
-		} else {
-			return nil, err
-		}
+		return nil, err
 	}
 
-	// Make a connection string
-	connString := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=require", username, password, host, port, dbName)
-
-	activePoolID := uuid.New()
-
-	// Establish connection and add pool to active pool manager
-	_, err = c.PM.AddPool(activePoolID, connString)
+	// Reuse the pool of this database if it's already connected, otherwise
+	// establish connection and add pool to active pool manager
+	activePoolID, err := c.connectPool(p, dbName)
 	if err != nil {
 		return nil, err
 	}
@@ -200,18 +413,9 @@ func (c *Connections) EstablishPostgresDatabaseConnection(id int64, dbName strin
 		return nil, err
 	}
 
-	activeDB := name + " - " + dbName
+	activeDB := p.Name + " - " + dbName
 
-	// Save the active db properties in all the tabs with type editor if active db properties are null
-	_, err = c.DB.Exec("UPDATE tabs SET active_db_id = ?, active_db = ?, active_db_colour = ? WHERE active_db_id IS NULL AND type = 'editor'", activePoolID.String(), activeDB, colour)
-	if err != nil {
-		return nil, err
-	}
-
-	// In case of table rows, find all the rows with type table where
-	// active_db_id is null and postgres_connection_id and database matches
-	// set the active pool id and active db properties in such tabs
-	_, err = c.DB.Exec("UPDATE tabs SET active_db_id = ?, active_db = ?, active_db_colour = ? WHERE active_db_id IS NULL AND type = 'table' AND postgres_conn_id = ? AND db_name = ?", activePoolID.String(), activeDB, colour, id, dbName)
+	err = c.attachTabs(activePoolID, activeDB, p.Colour, id, dbName)
 	if err != nil {
 		return nil, err
 	}
@@ -219,8 +423,8 @@ func (c *Connections) EstablishPostgresDatabaseConnection(id int64, dbName strin
 	return &model.Database{
 		Name:                   dbName,
 		PostgresConnectionID:   id,
-		PostgresConnectionName: name,
-		Colour:                 colour,
+		PostgresConnectionName: p.Name,
+		Colour:                 p.Colour,
 		PoolID:                 activePoolID.String(),
 		IsActive:               true,
 		Tables:                 tables,
@@ -228,56 +432,38 @@ func (c *Connections) EstablishPostgresDatabaseConnection(id int64, dbName strin
 	}, nil
 }
 
-// This func is used to connect to a server
-func (c *Connections) EstablishPostgresConnection(id int64) ([]model.Database, error) {
-	// Query for a single row by ID
-	var name, host, port, username, password, database, colour string
-	row := c.DB.QueryRow("SELECT name, host, port, username, password, database, colour FROM postgres WHERE id = ?", id)
-
-	// Scan the result into variables
-	err := row.Scan(&name, &host, &port, &username, &password, &database, &colour)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, errors.Wrap(err, "postgres server not found")
-		} else {
-			return nil, err
-		}
+// defaultDatabase is the database the server's context connects to
+func defaultDatabase(p *model.PostgresConnection) string {
+	if database := strings.TrimSpace(p.Database); database != "" {
+		return database
 	}
+	return "postgres"
+}
 
-	database = strings.TrimSpace(database)
-
-	if database == "" {
-		database = "postgres"
-	}
-
-	// Make a connection string
-	connString := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=require", username, password, host, port, database)
-
-	activePoolID := uuid.New()
-
-	// Establish connection and add pool to active pool manager
-	_, err = c.PM.AddPool(activePoolID, connString)
+// This func is used to connect to a server
+func (c *Connections) EstablishPostgresConnection(id int64) ([]model.Database, error) {
+	p, err := c.getPostgresConnection(id)
 	if err != nil {
 		return nil, err
 	}
 
-	activeDB := name + " - " + database
+	database := defaultDatabase(p)
 
-	// Save the active db properties in all the tabs with type editor if active db properties are null
-	_, err = c.DB.Exec("UPDATE tabs SET active_db_id = ?, active_db = ?, active_db_colour = ? WHERE active_db_id IS NULL AND type = 'editor'", activePoolID.String(), activeDB, colour)
+	// Reuse the pool of this database if it's already connected, otherwise
+	// establish connection and add pool to active pool manager
+	activePoolID, err := c.connectPool(p, database)
 	if err != nil {
 		return nil, err
 	}
 
-	// In case of table rows, find all the rows with type table where
-	// active_db_id is null and postgres_connection_id and database matches
-	// set the active pool id and active db properties in such tabs
-	_, err = c.DB.Exec("UPDATE tabs SET active_db_id = ?, active_db = ?, active_db_colour = ? WHERE active_db_id IS NULL AND type = 'table' AND postgres_conn_id = ? AND db_name = ?", activePoolID.String(), activeDB, colour, id, database)
+	activeDB := p.Name + " - " + database
+
+	err = c.attachTabs(activePoolID, activeDB, p.Colour, id, database)
 	if err != nil {
 		return nil, err
 	}
 
-	return c.GetPostgresServerDatabases(id, activePoolID, database, name, colour)
+	return c.GetPostgresServerDatabases(id, activePoolID, database, p.Name, p.Colour)
 }
 
 // Here, pool means the active connection to the database server
@@ -339,34 +525,17 @@ func (c *Connections) GetPostgresServerDatabases(postgresConnectionID int64, act
 }
 
 func (c *Connections) GetAllPostgresTables(activePoolID uuid.UUID) ([]string, error) {
-	pool, exists := c.PM.GetPool(activePoolID)
-	if !exists {
-		return nil, errors.New("pool doesn't exist")
-	}
-
-	// Get all tables
-	rows, err := pool.Query(context.TODO(), "SELECT tablename FROM pg_tables WHERE schemaname = 'public'")
+	metadata, err := c.MC.Get(context.TODO(), activePoolID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	// Slice to hold results
+	// Tables of the public schema
 	var tables []string
-
-	// Iterate through the rows
-	for rows.Next() {
-		var table string
-		err := rows.Scan(&table)
-		if err != nil {
-			return nil, err
+	for _, r := range metadata.Relations {
+		if r.Schema == "public" && (r.Kind == "table" || r.Kind == "partitioned table") {
+			tables = append(tables, r.Name)
 		}
-		tables = append(tables, table)
-	}
-
-	// Check for any error encountered during iteration
-	if err = rows.Err(); err != nil {
-		return nil, err
 	}
 
 	return tables, nil
@@ -374,42 +543,21 @@ func (c *Connections) GetAllPostgresTables(activePoolID uuid.UUID) ([]string, er
 
 // Get all columns of the active database across all tables
 func (c *Connections) GetAllDatabaseColumns(activePoolID uuid.UUID) ([]string, error) {
-	pool, exists := c.PM.GetPool(activePoolID)
-	if !exists {
-		return nil, errors.New("pool doesn't exist")
-	}
-
-	// Get all columns
-	query := `
-		SELECT DISTINCT
-			column_name
-		FROM
-			information_schema.columns
-		WHERE
-			table_schema NOT IN ('information_schema', 'pg_catalog')
-	`
-	rows, err := pool.Query(context.TODO(), query)
+	metadata, err := c.MC.Get(context.TODO(), activePoolID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	// Slice to hold results
+	// Distinct column names
+	seen := make(map[string]bool)
 	var columns []string
-
-	// Iterate through the rows
-	for rows.Next() {
-		var column string
-		err := rows.Scan(&column)
-		if err != nil {
-			return nil, err
+	for _, r := range metadata.Relations {
+		for _, column := range r.Columns {
+			if !seen[column.Name] {
+				seen[column.Name] = true
+				columns = append(columns, column.Name)
+			}
 		}
-		columns = append(columns, column)
-	}
-
-	// Check for any error encountered during iteration
-	if err = rows.Err(); err != nil {
-		return nil, err
 	}
 
 	return columns, nil
@@ -420,6 +568,13 @@ func (c *Connections) TerminatePostgresDatabaseConnection(activePoolID string) (
 	if err != nil {
 		return false, err
 	}
+	// Close the cursors, jobs, listeners, streams and transfers first, closing the pool waits for their connections
+	c.CM.CloseForPool(activePoolIDUUID)
+	c.JM.CancelForPool(activePoolIDUUID)
+	c.LM.CloseForPool(activePoolIDUUID)
+	c.SM.CloseForPool(activePoolIDUUID)
+	c.TM.CancelForPool(activePoolIDUUID)
+
 	// Remove the db pool from active pools
 	err = c.PM.DeletePool(activePoolIDUUID)
 	if err != nil {
@@ -436,15 +591,17 @@ func (c *Connections) TerminatePostgresDatabaseConnection(activePoolID string) (
 }
 
 func (c *Connections) TerminateAllDatabaseConnections() error {
-	c.PM.mu.Lock()
-	defer c.PM.mu.Unlock()
-
 	activeDBIds := []string{}
 
-	for id, pool := range c.PM.Pools {
+	// Close the cursors, jobs, listeners, streams and transfers first, closing the pools waits for their connections
+	c.CM.CloseAll()
+	c.JM.CancelAll()
+	c.LM.CloseAll()
+	c.SM.CloseAll()
+	c.TM.CancelAll()
+
+	for _, id := range c.PM.CloseAll() {
 		activeDBIds = append(activeDBIds, id.String())
-		pool.Close()
-		delete(c.PM.Pools, id)
 	}
 
 	// Build placeholders (?, ?, ?)
@@ -491,23 +648,94 @@ func isWriteOperation(query string) bool {
 }
 
 func (c *Connections) ExecuteQuery(activePoolID uuid.UUID, query string, tabID int64) *model.QueryResult {
-	pool, exists := c.PM.GetPool(activePoolID)
-	if !exists {
+	return c.executeQuery(activePoolID, query, tabID, false)
+}
+
+// executeQuery runs the query after enforcing the environment policy of the pool.
+// Statements which need confirmation only run when confirmed is set.
+func (c *Connections) executeQuery(activePoolID uuid.UUID, query string, tabID int64, confirmed bool) *model.QueryResult {
+	if _, exists := c.PM.GetPool(activePoolID); !exists {
 		return &model.QueryResult{OK: false, Message: "pool doesn't exist"}
 	}
 
 	ctx := context.Background()
+	started := time.Now()
+
+	// Taken before running so a slower earlier run can't overwrite this run's result
+	seq := c.RS.NextSeq(tabID)
+
+	// Enforce the environment policy on the server side
+	policy, err := c.poolPolicy(activePoolID)
+	if err != nil {
+		return &model.QueryResult{OK: false, Message: err.Error()}
+	}
+
+	toConfirm, toConfirmInfo, err := checkPolicy(policy, query)
+	if err != nil {
+		c.audit(activePoolID, query, started, 0, auditBlocked, err)
+		return &model.QueryResult{OK: false, Message: err.Error()}
+	}
+
+	if len(toConfirm) > 0 && !confirmed {
+		confirmation, err := c.requestConfirmation(ctx, activePoolID, policy, query, toConfirm, toConfirmInfo)
+		if err != nil {
+			return &model.QueryResult{OK: false, Message: err.Error()}
+		}
+
+		return &model.QueryResult{
+			OK:                   false,
+			Message:              fmt.Sprintf("This query changes data on a %s connection and needs to be confirmed", policy.Env),
+			RequiresConfirmation: true,
+			Confirmation:         confirmation,
+		}
+	}
 
 	response := &model.QueryResult{OK: true}
 
+	// Running the tab again ends the cursor of its previous run
+	c.CM.Close(tabID)
+
 	normalizedQuery := strings.ToLower(strings.TrimSpace(query))
 
 	isWrite := isWriteOperation(normalizedQuery)
 
-	if isWrite {
+	var page *cursorPage
+	usedCursor := false
+	if isCursorQuery(query) {
+		// Stream large SELECTs through a server side cursor, returning only the first page
+		settings, err := loadResultSettings(c.DB)
+		if err != nil {
+			return &model.QueryResult{OK: false, Message: err.Error()}
+		}
+
+		page, err = c.runCursorQuery(ctx, activePoolID, tabID, seq, query, settings)
+		// A query writing through a function is stopped by the cursor's read only
+		// transaction before it changed anything, it runs without a cursor instead
+		usedCursor = !isReadOnlyViolation(err)
+		if usedCursor && err != nil {
+			c.audit(activePoolID, query, started, 0, auditError, err)
+			return &model.QueryResult{
+				OK:           true,
+				Message:      err.Error(),
+				RowsAffected: int64(0),
+				Columns:      []string{"Error"},
+				Rows:         [][]model.Cell{{model.Cell{Column: "Error", Value: err.Error()}}},
+			}
+		}
+	}
+
+	if usedCursor {
+		c.audit(activePoolID, query, started, int64(len(page.rows)), auditSuccess, nil)
+
+		response.Columns = page.columns
+		response.Rows = page.rows
+		response.HasMore = page.hasMore
+		response.LimitReached = page.limitReached
+	} else if isWrite {
 		// Use Exec for write operations
-		tag, err := pool.Exec(ctx, query)
+		tag, err := c.runWriteQuery(ctx, activePoolID, query)
 		if err != nil {
+			c.audit(activePoolID, query, started, 0, auditError, err)
 			return &model.QueryResult{
 				OK:           true,
 				Message:      err.Error(),
@@ -517,12 +745,19 @@ func (c *Connections) ExecuteQuery(activePoolID uuid.UUID, query string, tabID i
 			}
 		}
 		response.RowsAffected = tag.RowsAffected()
+		c.audit(activePoolID, query, started, response.RowsAffected, auditSuccess, nil)
+
+		// Schema changes make the cached metadata stale
+		if classifyQuery(query).Kind == statementDDL {
+			c.MC.Invalidate(activePoolID)
+		}
 		response.Columns = []string{"Rows Affected"}
 		response.Rows = [][]model.Cell{{model.Cell{Column: "Rows Affected", Value: fmt.Sprintf("%d", response.RowsAffected)}}}
 	} else {
 		// Use Query for read operations
-		resultRows, err := pool.Query(ctx, query)
+		columns, rows, err := c.runReadQuery(ctx, activePoolID, query)
 		if err != nil {
+			c.audit(activePoolID, query, started, 0, auditError, err)
 			return &model.QueryResult{
 				OK:           true,
 				Message:      err.Error(),
@@ -531,54 +766,9 @@ func (c *Connections) ExecuteQuery(activePoolID uuid.UUID, query string, tabID i
 				Rows:         [][]model.Cell{{model.Cell{Column: "Error", Value: err.Error()}}},
 			}
 		}
-		defer resultRows.Close()
-
-		columns := resultRows.FieldDescriptions()
-		columnNames := make([]string, len(columns))
-		for i, column := range columns {
-			columnNames[i] = string(column.Name)
-		}
-		response.Columns = columnNames
-
-		var rows [][]model.Cell
-
-		for resultRows.Next() {
-			row, err := resultRows.Values()
-			if err != nil {
-				return &model.QueryResult{OK: false, Message: err.Error()}
-			}
-
-			cells := []model.Cell{}
-			for i, cell := range row {
-				newCell := model.Cell{
-					Column: columnNames[i],
-				}
-				switch v := cell.(type) {
-				case []byte:
-					newCell.Value = string(v)
-				case time.Time:
-					newCell.Value = v.Format(time.RFC3339)
-				case nil:
-					newCell.Value = "NULL"
-				case [16]uint8:
-					newCell.Value = uuid.UUID(v).String()
-				case string:
-					if v == "" {
-						newCell.Value = "EMPTY"
-					}
-					newCell.Value = v
-				default:
-					newCell.Value = fmt.Sprintf("%v", v)
-				}
-				cells = append(cells, newCell)
-			}
-			rows = append(rows, cells)
-		}
-
-		if err := resultRows.Err(); err != nil {
-			return &model.QueryResult{OK: false, Message: err.Error()}
-		}
+		c.audit(activePoolID, query, started, int64(len(rows)), auditSuccess, nil)
 
+		response.Columns = columns
 		response.Rows = rows
 	}
 
@@ -587,19 +777,21 @@ func (c *Connections) ExecuteQuery(activePoolID uuid.UUID, query string, tabID i
 		Rows:    response.Rows,
 	}
 
-	go c.UpdateTabOutput(tabID, output)
+	c.RS.Enqueue(tabID, seq, output)
 
 	return response
 }
 
 func (c *Connections) GetTableData(activePoolID uuid.UUID, tabID int64, tableName, selectQuery, limit, offset, where, orderBy, groupBy string) *model.QueryResult {
-	pool, exists := c.PM.GetPool(activePoolID)
-	if !exists {
+	if _, exists := c.PM.GetPool(activePoolID); !exists {
 		return &model.QueryResult{OK: false, Message: "pool doesn't exist"}
 	}
 
 	ctx := context.Background()
 
+	// Taken before running so a slower earlier run can't overwrite this run's result
+	seq := c.RS.NextSeq(tabID)
+
 	response := &model.QueryResult{OK: true}
 
 	setLimit := strconv.Itoa(100)
@@ -637,8 +829,10 @@ func (c *Connections) GetTableData(activePoolID uuid.UUID, tabID int64, tableNam
 	}
 
 	// Use Query for read operations
-	resultRows, err := pool.Query(ctx, query)
+	started := time.Now()
+	columns, rows, err := c.runReadQuery(ctx, activePoolID, query)
 	if err != nil {
+		c.audit(activePoolID, query, started, 0, auditError, err)
 		return &model.QueryResult{
 			OK:           true,
 			Message:      err.Error(),
@@ -647,54 +841,10 @@ func (c *Connections) GetTableData(activePoolID uuid.UUID, tabID int64, tableNam
 			Rows:         [][]model.Cell{{model.Cell{Column: "Error", Value: err.Error()}}},
 		}
 	}
-	defer resultRows.Close()
-
-	columns := resultRows.FieldDescriptions()
-	columnNames := make([]string, len(columns))
-	for i, column := range columns {
-		columnNames[i] = string(column.Name)
-	}
-	response.Columns = columnNames
-
-	var rows [][]model.Cell
-
-	for resultRows.Next() {
-		row, err := resultRows.Values()
-		if err != nil {
-			return &model.QueryResult{OK: false, Message: err.Error()}
-		}
-
-		cells := []model.Cell{}
-		for i, cell := range row {
-			newCell := model.Cell{
-				Column: columnNames[i],
-			}
-			switch v := cell.(type) {
-			case []byte:
-				newCell.Value = string(v)
-			case time.Time:
-				newCell.Value = v.Format(time.RFC3339)
-			case nil:
-				newCell.Value = "NULL"
-			case [16]uint8:
-				newCell.Value = uuid.UUID(v).String()
-			case string:
-				if v == "" {
-					newCell.Value = "EMPTY"
-				}
-				newCell.Value = v
-			default:
-				newCell.Value = fmt.Sprintf("%v", v)
-			}
-			cells = append(cells, newCell)
-		}
-		rows = append(rows, cells)
-	}
 
-	if err := resultRows.Err(); err != nil {
-		return &model.QueryResult{OK: false, Message: err.Error()}
-	}
+	c.audit(activePoolID, query, started, int64(len(rows)), auditSuccess, nil)
 
+	response.Columns = columns
 	response.Rows = rows
 
 	output := &model.Output{
@@ -702,22 +852,14 @@ func (c *Connections) GetTableData(activePoolID uuid.UUID, tabID int64, tableNam
 		Rows:    response.Rows,
 	}
 
-	go c.UpdateTabOutput(tabID, output)
+	c.RS.Enqueue(tabID, seq, output)
 
 	return response
 }
 
+// UpdateTabOutput queues the output to be stored as the newest result of the tab
 func (c *Connections) UpdateTabOutput(tabID int64, output *model.Output) {
-	jsonOutput, err := json.Marshal(output)
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	query := `UPDATE tabs SET output = ? WHERE id = ?`
-	_, err = c.DB.Exec(query, string(jsonOutput), tabID)
-	if err != nil {
-		fmt.Println(err)
-	}
+	c.RS.Enqueue(tabID, c.RS.NextSeq(tabID), output)
 }
 
 func (c *Connections) GetTableInfo(activePoolID uuid.UUID, tableName string) (*model.TableInfo, error) {
@@ -998,5 +1140,67 @@ func (c *Connections) GetTableInfo(activePoolID uuid.UUID, tableName string) (*m
 
 	rules.Rows = ruleRows
 
-	return &model.TableInfo{Structure: structure, Indexes: indexes, Rules: rules}, nil
+	// Get row level security settings and policies
+	rowSecurity := model.RowSecurity{Policies: []model.Policy{}}
+
+	query = `
+		SELECT rel.relrowsecurity, rel.relforcerowsecurity
+		FROM pg_class rel
+		JOIN pg_namespace n ON n.oid = rel.relnamespace
+		WHERE rel.relname = $1
+		AND n.nspname = 'public'
+	`
+	err = pool.QueryRow(ctx, query, tableName).Scan(&rowSecurity.Enabled, &rowSecurity.Forced)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	query = `
+		SELECT
+			p.policyname,
+			p.cmd,
+			p.permissive = 'PERMISSIVE',
+			p.roles::text[],
+			COALESCE(p.qual, ''),
+			COALESCE(p.with_check, '')
+		FROM pg_policies p
+		WHERE p.tablename = $1
+		AND p.schemaname = 'public'
+		ORDER BY p.policyname;
+	`
+	resultRows, err = pool.Query(ctx, query, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer resultRows.Close()
+
+	for resultRows.Next() {
+		var policy model.Policy
+		err := resultRows.Scan(&policy.Name, &policy.Command, &policy.Permissive, &policy.Roles, &policy.Using, &policy.WithCheck)
+		if err != nil {
+			return nil, err
+		}
+		rowSecurity.Policies = append(rowSecurity.Policies, policy)
+	}
+
+	if err := resultRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &model.TableInfo{Structure: structure, Indexes: indexes, Rules: rules, RowSecurity: rowSecurity}, nil
+}
+
+// GetPoolStats returns the connection statistics of an active pool for the status bar
+func (c *Connections) GetPoolStats(activePoolID uuid.UUID) (*model.PoolStats, error) {
+	return c.PM.Stats(activePoolID)
+}
+
+// ReconnectPool checks the connection of an active pool and rebuilds it under the same id if it's broken
+func (c *Connections) ReconnectPool(activePoolID uuid.UUID) (bool, error) {
+	_, err := c.PM.Recover(activePoolID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
 }
@@ -0,0 +1,116 @@
+package app
+
+import (
+	"database/sql"
+	"testing"
+
+	"dbmx/model"
+
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// connectionsDB opens an in-memory store holding the saved connections table
+func connectionsDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: opens its own database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE postgres (
+			id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+			name VARCHAR NOT NULL,
+			host VARCHAR NOT NULL,
+			port VARCHAR NOT NULL,
+			username VARCHAR NOT NULL,
+			password VARCHAR NOT NULL,
+			env VARCHAR DEFAULT NULL,
+			colour VARCHAR DEFAULT NULL,
+			database VARCHAR NOT NULL DEFAULT 'postgres',
+			max_conns INTEGER NOT NULL DEFAULT 10,
+			min_conns INTEGER NOT NULL DEFAULT 0,
+			max_conn_lifetime INTEGER NOT NULL DEFAULT 3600,
+			max_conn_idle_time INTEGER NOT NULL DEFAULT 1800,
+			health_check_period INTEGER NOT NULL DEFAULT 60,
+			application_name VARCHAR NOT NULL DEFAULT 'dbmx'
+		);
+		INSERT INTO postgres (name, host, port, username, password, env, colour, database)
+		VALUES ('local', 'localhost', '5432', 'app', 'secret', 'development', 'green', 'shop'),
+			('prod', 'db.example.com', '5432', 'app', 'other', 'production', 'red', 'shop');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestUpdatePostgresConnection(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  model.PostgresConnection
+		want    model.PostgresConnection
+		wantErr string
+	}{
+		{
+			name: "keeps the saved password",
+			update: model.PostgresConnection{ID: 1, Name: "local", Host: "127.0.0.1", Port: "5433", Username: "admin", Env: "staging", Colour: "blue", Database: "crm",
+				MaxConns: 20, MinConns: 2, MaxConnLifetime: 600, MaxConnIdleTime: 60, HealthCheckPeriod: 30, ApplicationName: "reports"},
+			want: model.PostgresConnection{ID: 1, Name: "local", Host: "127.0.0.1", Port: "5433", Username: "admin", Password: "secret", Env: "staging", Colour: "blue", Database: "crm",
+				MaxConns: 20, MinConns: 2, MaxConnLifetime: 600, MaxConnIdleTime: 60, HealthCheckPeriod: 30, ApplicationName: "reports"},
+		},
+		{
+			name:   "new password and default settings",
+			update: model.PostgresConnection{ID: 1, Name: "renamed", Host: "localhost", Port: "5432", Username: "app", Password: "changed", Env: "development", MinConns: 50},
+			want: model.PostgresConnection{ID: 1, Name: "renamed", Host: "localhost", Port: "5432", Username: "app", Password: "changed", Env: "development", Database: "postgres",
+				MaxConns: defaultMaxConns, MinConns: defaultMinConns, MaxConnLifetime: 3600, MaxConnIdleTime: 1800, HealthCheckPeriod: 60, ApplicationName: defaultApplicationName},
+		},
+		{
+			name:    "name of another connection",
+			update:  model.PostgresConnection{ID: 1, Name: "prod", Host: "localhost", Port: "5432", Username: "app"},
+			wantErr: "Connection name already exists. Please choose a different name",
+		},
+		{
+			name:    "unknown connection",
+			update:  model.PostgresConnection{ID: 3, Name: "other", Host: "localhost", Port: "5432", Username: "app"},
+			wantErr: "postgres server not found: sql: no rows in result set",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Connections{DB: connectionsDB(t), PM: &PoolManager{pools: make(map[uuid.UUID]*managedPool)}}
+
+			ok, err := c.UpdatePostgresConnection(tt.update)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("UpdatePostgresConnection() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !ok {
+				t.Fatalf("UpdatePostgresConnection() = %v, %v", ok, err)
+			}
+
+			saved, err := c.getPostgresConnection(tt.update.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *saved != tt.want {
+				t.Errorf("saved %+v, want %+v", *saved, tt.want)
+			}
+
+			// The other connection is left alone
+			other, err := c.getPostgresConnection(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if other.Name != "prod" || other.Password != "other" {
+				t.Errorf("other connection changed to %+v", *other)
+			}
+		})
+	}
+}
@@ -0,0 +1,463 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"dbmx/model"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Used when the settings table doesn't have a value
+const (
+	defaultCursorPageSize = 500
+	defaultCursorRowLimit = 100000
+)
+
+// Name of the server side cursor, every cursor has a connection of its own
+const cursorName = "dbmx_cursor"
+
+// cursorBudget is how many connections of a pool open cursors may hold, the rest are
+// left for queries, listeners and jobs
+func cursorBudget(pool *pgxpool.Pool) int {
+	return max(int(pool.Config().MaxConns)/2, 1)
+}
+
+// tabCursor is an open server side cursor of a tab's query
+type tabCursor struct {
+	poolID uuid.UUID
+	// Sequence number of the run which opened the cursor
+	seq int64
+
+	// Dedicated connection and the transaction the cursor lives in
+	conn *pgxpool.Conn
+	tx   pgx.Tx
+
+	columns []string
+	// Row fetched ahead to know if there are more rows
+	pending []model.Cell
+	fetched int64
+	// Maximum rows fetched into memory before the cursor is closed
+	rowLimit     int64
+	limitReached bool
+
+	// Last time the cursor was opened or fetched from, guarded by the manager's mu
+	lastUsed time.Time
+
+	mu sync.Mutex
+}
+
+// cursorPage is a page of rows along with the cursor's state after reading it, taken
+// while the cursor is locked
+type cursorPage struct {
+	rows    [][]model.Cell
+	columns []string
+	hasMore bool
+	// Rows fetched so far and if the in memory row limit stopped the cursor
+	fetched      int64
+	limitReached bool
+}
+
+// CursorManager keeps the open server side cursors, at most one per tab
+type CursorManager struct {
+	cursors map[int64]*tabCursor
+	mu      sync.Mutex
+}
+
+func NewCursorManager() *CursorManager {
+	return &CursorManager{
+		cursors: make(map[int64]*tabCursor),
+	}
+}
+
+// isCursorQuery reports if the query can run through a cursor, which is
+// only possible for a single SELECT or VALUES statement
+func isCursorQuery(query string) bool {
+	statements := splitStatements(query)
+	if len(statements) != 1 {
+		return false
+	}
+
+	info := classifyStatement(statements[0])
+	if info.Kind != statementRead {
+		return false
+	}
+
+	switch info.Command {
+	case "SELECT", "VALUES", "TABLE":
+		return isIdempotentRead(query)
+	}
+	return false
+}
+
+// isReadOnlyViolation reports if the query failed because it tried to write in the
+// cursor's read only transaction
+func isReadOnlyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "25006"
+}
+
+// loadResultSettings reads the page size and in memory row limit of cursors
+func loadResultSettings(db *sql.DB) (*model.ResultSettings, error) {
+	settings := &model.ResultSettings{PageSize: defaultCursorPageSize, RowLimit: defaultCursorRowLimit}
+
+	rows, err := db.Query("SELECT key, value FROM settings WHERE key IN ('cursor_page_size', 'cursor_row_limit')")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			continue
+		}
+
+		switch key {
+		case "cursor_page_size":
+			settings.PageSize = int(n)
+		case "cursor_row_limit":
+			settings.RowLimit = n
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// Open closes the tab's previous cursor, declares a cursor for the query on a dedicated
+// connection and fetches the first page. The cursor stays open while it has more rows.
+func (cm *CursorManager) Open(ctx context.Context, pool *pgxpool.Pool, poolID uuid.UUID, tabID, seq int64, query string, settings *model.ResultSettings) (*tabCursor, *cursorPage, error) {
+	cm.Close(tabID)
+	cm.evict(poolID, cursorBudget(pool)-1)
+
+	conn, err := acquireConn(ctx, pool)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Read only, so that a query writing through a function fails instead of having its
+	// changes rolled back with the cursor's transaction
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		conn.Release()
+		return nil, nil, err
+	}
+
+	// The trailing semicolon is not allowed inside DECLARE
+	statement := splitStatements(query)[0].text
+
+	_, err = tx.Exec(ctx, fmt.Sprintf("DECLARE %s NO SCROLL CURSOR FOR %s", cursorName, statement))
+	if err != nil {
+		_ = tx.Rollback(ctx)
+		conn.Release()
+		return nil, nil, err
+	}
+
+	cursor := &tabCursor{
+		poolID:   poolID,
+		seq:      seq,
+		conn:     conn,
+		tx:       tx,
+		rowLimit: settings.RowLimit,
+	}
+
+	page, err := cursor.fetch(ctx, settings.PageSize)
+	if err != nil {
+		cursor.close()
+		return nil, nil, err
+	}
+
+	if !page.hasMore {
+		cursor.close()
+		return cursor, page, nil
+	}
+
+	// Another run of the tab may have opened its cursor in the meantime, the later run's
+	// cursor is kept and the other one closed
+	cm.mu.Lock()
+	replaced, exists := cm.cursors[tabID]
+	if exists && replaced.seq > seq {
+		cm.mu.Unlock()
+		cursor.close()
+		page.hasMore = false
+		return cursor, page, nil
+	}
+	cursor.lastUsed = time.Now()
+	cm.cursors[tabID] = cursor
+	cm.mu.Unlock()
+
+	if exists {
+		replaced.close()
+	}
+
+	return cursor, page, nil
+}
+
+// evict closes the least recently used cursors of the pool until at most keep are left
+// open. Their tabs keep the rows already fetched and have to run the query again for more.
+func (cm *CursorManager) evict(poolID uuid.UUID, keep int) {
+	for {
+		cm.mu.Lock()
+		var oldestTab int64
+		var oldest *tabCursor
+		open := 0
+		for tabID, cursor := range cm.cursors {
+			if cursor.poolID != poolID {
+				continue
+			}
+			open++
+			if oldest == nil || cursor.lastUsed.Before(oldest.lastUsed) {
+				oldestTab, oldest = tabID, cursor
+			}
+		}
+		cm.mu.Unlock()
+
+		if open <= keep {
+			return
+		}
+		cm.Close(oldestTab)
+	}
+}
+
+// Fetch reads the next n rows of the tab's cursor. The cursor is closed once it's
+// exhausted or the in memory row limit is reached.
+func (cm *CursorManager) Fetch(ctx context.Context, tabID int64, n int) (*tabCursor, *cursorPage, error) {
+	cm.mu.Lock()
+	cursor, exists := cm.cursors[tabID]
+	if exists {
+		cursor.lastUsed = time.Now()
+	}
+	cm.mu.Unlock()
+	if !exists {
+		return nil, nil, errors.New("the tab has no open cursor, run the query again")
+	}
+
+	page, err := cursor.fetch(ctx, n)
+	if err != nil || !page.hasMore {
+		cm.Close(tabID)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cursor, page, nil
+}
+
+// Close closes the tab's cursor and releases its connection
+func (cm *CursorManager) Close(tabID int64) {
+	cm.mu.Lock()
+	cursor, exists := cm.cursors[tabID]
+	delete(cm.cursors, tabID)
+	cm.mu.Unlock()
+
+	if exists {
+		cursor.close()
+	}
+}
+
+// CloseForPool closes every cursor of the pool, needed before the pool is closed
+// since closing a pool waits for its connections to be released
+func (cm *CursorManager) CloseForPool(poolID uuid.UUID) {
+	cm.mu.Lock()
+	var tabIDs []int64
+	for tabID, cursor := range cm.cursors {
+		if cursor.poolID == poolID {
+			tabIDs = append(tabIDs, tabID)
+		}
+	}
+	cm.mu.Unlock()
+
+	for _, tabID := range tabIDs {
+		cm.Close(tabID)
+	}
+}
+
+// CloseAll closes every open cursor
+func (cm *CursorManager) CloseAll() {
+	cm.mu.Lock()
+	cursors := cm.cursors
+	cm.cursors = make(map[int64]*tabCursor)
+	cm.mu.Unlock()
+
+	for _, cursor := range cursors {
+		cursor.close()
+	}
+}
+
+// fetch reads up to n rows and reports if the cursor has more rows after them
+func (tc *tabCursor) fetch(ctx context.Context, n int) (*cursorPage, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.tx == nil {
+		return nil, errors.New("cursor is closed")
+	}
+
+	if n <= 0 {
+		n = defaultCursorPageSize
+	}
+
+	// Don't go over the in memory row limit
+	if tc.rowLimit > 0 && tc.fetched+int64(n) > tc.rowLimit {
+		n = int(tc.rowLimit - tc.fetched)
+	}
+	if n <= 0 {
+		tc.limitReached = true
+		return tc.page(nil, false), nil
+	}
+
+	var rows [][]model.Cell
+	if tc.pending != nil {
+		rows = append(rows, tc.pending)
+		tc.pending = nil
+	}
+
+	// One row more than needed tells if there are more rows
+	resultRows, err := tc.tx.Query(ctx, fmt.Sprintf("FETCH FORWARD %d FROM %s", n-len(rows)+1, cursorName))
+	if err != nil {
+		return nil, err
+	}
+
+	columns, fetched, err := readCells(resultRows)
+	resultRows.Close()
+	if err != nil {
+		return nil, err
+	}
+	if tc.columns == nil {
+		tc.columns = columns
+	}
+
+	rows = append(rows, fetched...)
+
+	hasMore := len(rows) > n
+	if hasMore {
+		tc.pending = rows[n]
+		rows = rows[:n]
+	}
+
+	tc.fetched += int64(len(rows))
+	if hasMore && tc.rowLimit > 0 && tc.fetched >= tc.rowLimit {
+		hasMore = false
+		tc.limitReached = true
+	}
+
+	return tc.page(rows, hasMore), nil
+}
+
+// page bundles the rows with the cursor's state, tc.mu must be held
+func (tc *tabCursor) page(rows [][]model.Cell, hasMore bool) *cursorPage {
+	return &cursorPage{
+		rows:         rows,
+		columns:      tc.columns,
+		hasMore:      hasMore,
+		fetched:      tc.fetched,
+		limitReached: tc.limitReached,
+	}
+}
+
+// close ends the cursor's transaction and gives the connection back to the pool
+func (tc *tabCursor) close() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.tx == nil {
+		return
+	}
+
+	_ = tc.tx.Rollback(context.Background())
+	tc.conn.Release()
+	tc.tx = nil
+	tc.conn = nil
+}
+
+// runCursorQuery opens a cursor for the query on the active pool and fetches the first
+// page. If the connection to the server was lost the pool is rebuilt and it's tried once more.
+func (c *Connections) runCursorQuery(ctx context.Context, activePoolID uuid.UUID, tabID, seq int64, query string, settings *model.ResultSettings) (*cursorPage, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	_, page, err := c.CM.Open(ctx, pool, activePoolID, tabID, seq, query, settings)
+	if !isConnectionError(err) {
+		return page, err
+	}
+
+	pool, recoverErr := c.PM.Recover(activePoolID)
+	if recoverErr != nil {
+		return nil, err
+	}
+
+	_, page, err = c.CM.Open(ctx, pool, activePoolID, tabID, seq, query, settings)
+	return page, err
+}
+
+// FetchMore fetches the next n rows of the query running through the tab's cursor
+func (c *Connections) FetchMore(tabID int64, n int) *model.QueryResult {
+	cursor, page, err := c.CM.Fetch(context.Background(), tabID, n)
+	if err != nil {
+		return &model.QueryResult{OK: false, Message: err.Error()}
+	}
+
+	c.RS.EnqueueAppend(tabID, cursor.seq, page.rows)
+
+	result := &model.QueryResult{
+		OK:           true,
+		Columns:      page.columns,
+		Rows:         page.rows,
+		HasMore:      page.hasMore,
+		LimitReached: page.limitReached,
+	}
+	if page.limitReached {
+		result.Message = fmt.Sprintf("Stopped after %d rows, the in memory row limit", page.fetched)
+	}
+
+	return result
+}
+
+// CloseCursor closes the tab's cursor without fetching the rest of the rows
+func (c *Connections) CloseCursor(tabID int64) {
+	c.CM.Close(tabID)
+}
+
+func (c *Connections) GetResultSettings() (*model.ResultSettings, error) {
+	return loadResultSettings(c.DB)
+}
+
+func (c *Connections) SaveResultSettings(settings model.ResultSettings) (bool, error) {
+	if settings.PageSize <= 0 || settings.RowLimit <= 0 {
+		return false, errors.New("page size and row limit must be greater than 0")
+	}
+	if int64(settings.PageSize) > settings.RowLimit {
+		return false, errors.New("page size cannot be greater than the row limit")
+	}
+
+	query := `INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value`
+	_, err := c.DB.Exec(query, "cursor_page_size", strconv.Itoa(settings.PageSize))
+	if err != nil {
+		return false, err
+	}
+	_, err = c.DB.Exec(query, "cursor_row_limit", strconv.FormatInt(settings.RowLimit, 10))
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
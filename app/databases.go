@@ -0,0 +1,341 @@
+package app
+
+import (
+	"context"
+	"dbmx/model"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pkg/errors"
+)
+
+// SQLSTATE of "database is being accessed by other users"
+const objectInUse = "55006"
+
+// maintenancePool returns a pool of the server connected to a database other than
+// the given one, since a database can't be renamed, dropped or copied from a session
+// connected to it
+func (c *Connections) maintenancePool(p *model.PostgresConnection, avoid string) (uuid.UUID, error) {
+	for _, dbName := range []string{strings.TrimSpace(p.Database), "postgres", "template1"} {
+		if dbName == "" || dbName == avoid {
+			continue
+		}
+		return c.connectPool(p, dbName)
+	}
+	return uuid.Nil, errors.New("no database to connect to")
+}
+
+// closeDatabasePools closes the pools of the app connected to the database and
+// detaches the tabs using them
+func (c *Connections) closeDatabasePools(postgresConnID int64, dbName string) ([]string, error) {
+	closed := []string{}
+	for {
+		poolID, exists := c.PM.FindPool(postgresConnID, dbName)
+		if !exists {
+			return closed, nil
+		}
+
+		if _, err := c.TerminatePostgresDatabaseConnection(poolID.String()); err != nil {
+			return closed, err
+		}
+		closed = append(closed, poolID.String())
+	}
+}
+
+// databaseSessions lists the sessions other than the pool's own connected to the database
+func (c *Connections) databaseSessions(ctx context.Context, activePoolID uuid.UUID, dbName string) ([]model.DatabaseSession, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	query := `
+		SELECT
+			pid,
+			COALESCE(usename, ''),
+			COALESCE(application_name, ''),
+			COALESCE(client_addr::text, ''),
+			COALESCE(state, ''),
+			COALESCE(to_char(backend_start, 'YYYY-MM-DD"T"HH24:MI:SSOF'), ''),
+			COALESCE(query, '')
+		FROM pg_stat_activity
+		WHERE datname = $1 AND pid <> pg_backend_pid()
+		ORDER BY backend_start
+	`
+	rows, err := pool.Query(ctx, query, dbName)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list sessions")
+	}
+	defer rows.Close()
+
+	sessions := []model.DatabaseSession{}
+	for rows.Next() {
+		var s model.DatabaseSession
+		if err := rows.Scan(&s.PID, &s.User, &s.ApplicationName, &s.ClientAddr, &s.State, &s.BackendStart, &s.Query); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+// runDatabaseStatement runs CREATE, ALTER or DROP DATABASE from a maintenance pool.
+// busy is the database which must have no other sessions for the statement to
+// succeed; the app's own pools to it are closed and other sessions are only
+// terminated when terminate is set.
+func (c *Connections) runDatabaseStatement(postgresConnID int64, statement, busy string, terminate bool, token string) *model.DatabaseOperationResult {
+	p, err := c.getPostgresConnection(postgresConnID)
+	if err != nil {
+		return &model.DatabaseOperationResult{OK: false, Message: err.Error()}
+	}
+
+	ctx := context.Background()
+	started := time.Now()
+
+	poolID, err := c.maintenancePool(p, busy)
+	if err != nil {
+		return &model.DatabaseOperationResult{OK: false, Message: err.Error()}
+	}
+	pool, exists := c.PM.GetPool(poolID)
+	if !exists {
+		return &model.DatabaseOperationResult{OK: false, Message: "pool doesn't exist"}
+	}
+
+	policy, err := loadEnvPolicy(c.DB, p.Env)
+	if err != nil {
+		return &model.DatabaseOperationResult{OK: false, Message: err.Error()}
+	}
+
+	toConfirm, toConfirmInfo, err := checkPolicy(policy, statement)
+	if err != nil {
+		c.audit(poolID, statement, started, 0, auditBlocked, err)
+		return &model.DatabaseOperationResult{OK: false, Message: err.Error()}
+	}
+
+	if len(toConfirm) > 0 && !c.consumeConfirmation(poolID, statement, token) {
+		confirmation, err := c.requestConfirmation(ctx, poolID, policy, statement, toConfirm, toConfirmInfo)
+		if err != nil {
+			return &model.DatabaseOperationResult{OK: false, Message: err.Error()}
+		}
+
+		return &model.DatabaseOperationResult{
+			OK:                   false,
+			Message:              fmt.Sprintf("This statement changes databases on a %s connection and needs to be confirmed", policy.Env),
+			RequiresConfirmation: true,
+			Confirmation:         confirmation,
+		}
+	}
+
+	// Other sessions have to be gone. Idle connections of the app's own pools are closed
+	// along with the pools, so they don't count.
+	result := &model.DatabaseOperationResult{ClosedPools: []string{}}
+	sessions, err := c.databaseSessions(ctx, poolID, busy)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+	if !terminate {
+		own := map[uint32]bool{}
+		for _, id := range c.PM.PoolsForConnection(postgresConnID) {
+			if _, dbName, _ := c.PM.Connection(id); dbName == busy {
+				for _, pid := range c.PM.IdlePIDs(id) {
+					own[pid] = true
+				}
+			}
+		}
+		others := []model.DatabaseSession{}
+		for _, s := range sessions {
+			if !own[uint32(s.PID)] {
+				others = append(others, s)
+			}
+		}
+
+		if len(others) > 0 {
+			result.Message = fmt.Sprintf("%d other sessions are connected to %s", len(others), busy)
+			result.RequiresTermination = true
+			result.Sessions = others
+			return result
+		}
+	}
+
+	// The statement runs now, the app's own pools go first
+	result.ClosedPools, err = c.closeDatabasePools(postgresConnID, busy)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+
+	if terminate {
+		sessions, err = c.databaseSessions(ctx, poolID, busy)
+		if err != nil {
+			result.Message = err.Error()
+			return result
+		}
+
+		for _, s := range sessions {
+			query := fmt.Sprintf("SELECT pg_terminate_backend(%d)", s.PID)
+			started := time.Now()
+			if _, err := pool.Exec(ctx, query); err != nil {
+				c.audit(poolID, query, started, 0, auditError, err)
+				result.Message = fmt.Sprintf("failed to terminate session %d: %s", s.PID, err.Error())
+				return result
+			}
+			c.audit(poolID, query, started, 1, auditSuccess, nil)
+		}
+	}
+
+	started = time.Now()
+	if _, err := pool.Exec(ctx, statement); err != nil {
+		c.audit(poolID, statement, started, 0, auditError, err)
+
+		// A session may have connected meanwhile
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == objectInUse {
+			result.RequiresTermination = true
+			result.Sessions, _ = c.databaseSessions(ctx, poolID, busy)
+		}
+		result.Message = err.Error()
+		return result
+	}
+	c.audit(poolID, statement, started, 0, auditSuccess, nil)
+
+	result.OK = true
+	return result
+}
+
+// createDatabaseStatement renders CREATE DATABASE for the spec
+func createDatabaseStatement(spec model.DatabaseSpec) (string, error) {
+	name := strings.TrimSpace(spec.Name)
+	if name == "" {
+		return "", errors.New("the database needs a name")
+	}
+
+	statement := "CREATE DATABASE " + quoteIdent(name)
+	if owner := strings.TrimSpace(spec.Owner); owner != "" {
+		statement += " OWNER " + quoteIdent(owner)
+	}
+
+	template := strings.TrimSpace(spec.Template)
+	encoding := strings.TrimSpace(spec.Encoding)
+	locale := strings.TrimSpace(spec.Locale)
+
+	// template1 may have a different encoding or locale, template0 takes any
+	if template == "" && (encoding != "" || locale != "") {
+		template = "template0"
+	}
+	if template != "" {
+		statement += " TEMPLATE " + quoteIdent(template)
+	}
+	if encoding != "" {
+		statement += " ENCODING " + quoteLiteral(encoding)
+	}
+	if locale != "" {
+		statement += " LOCALE " + quoteLiteral(locale)
+	}
+
+	return statement, nil
+}
+
+// GetDatabaseSessions lists the sessions connected to a database of the server
+func (c *Connections) GetDatabaseSessions(postgresConnectionID int64, dbName string) ([]model.DatabaseSession, error) {
+	p, err := c.getPostgresConnection(postgresConnectionID)
+	if err != nil {
+		return nil, err
+	}
+
+	poolID, err := c.maintenancePool(p, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.databaseSessions(context.Background(), poolID, dbName)
+}
+
+// CreateDatabase creates a database on the server. A template database must have no
+// other sessions, they are terminated when terminate is set.
+func (c *Connections) CreateDatabase(postgresConnectionID int64, spec model.DatabaseSpec, terminate bool, token string) *model.DatabaseOperationResult {
+	statement, err := createDatabaseStatement(spec)
+	if err != nil {
+		return &model.DatabaseOperationResult{OK: false, Message: err.Error()}
+	}
+
+	template := strings.TrimSpace(spec.Template)
+	if template == "" {
+		template = "template1"
+	}
+
+	result := c.runDatabaseStatement(postgresConnectionID, statement, template, terminate, token)
+	if result.OK {
+		result.Message = fmt.Sprintf("Database %s created", spec.Name)
+	}
+	return result
+}
+
+// CloneDatabase creates a copy of a database using it as the template. Copying needs
+// every other session of the source to be closed, they are terminated when terminate is set.
+func (c *Connections) CloneDatabase(postgresConnectionID int64, source, target, owner string, terminate bool, token string) *model.DatabaseOperationResult {
+	if strings.TrimSpace(source) == "" {
+		return &model.DatabaseOperationResult{OK: false, Message: "the database to clone is required"}
+	}
+
+	return c.CreateDatabase(postgresConnectionID, model.DatabaseSpec{Name: target, Owner: owner, Template: strings.TrimSpace(source)}, terminate, token)
+}
+
+// RenameDatabase renames a database which no other session is connected to. Tabs
+// of the database keep pointing to it under the new name.
+func (c *Connections) RenameDatabase(postgresConnectionID int64, dbName, newName string, terminate bool, token string) *model.DatabaseOperationResult {
+	dbName, newName = strings.TrimSpace(dbName), strings.TrimSpace(newName)
+	if dbName == "" || newName == "" {
+		return &model.DatabaseOperationResult{OK: false, Message: "the database and its new name are required"}
+	}
+
+	statement := fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", quoteIdent(dbName), quoteIdent(newName))
+
+	result := c.runDatabaseStatement(postgresConnectionID, statement, dbName, terminate, token)
+	if !result.OK {
+		return result
+	}
+
+	_, err := c.DB.Exec("UPDATE tabs SET db_name = ? WHERE postgres_conn_id = ? AND db_name = ?", newName, postgresConnectionID, dbName)
+	if err != nil {
+		result.Message = fmt.Sprintf("Database renamed to %s, but updating its tabs failed: %s", newName, err.Error())
+		return result
+	}
+
+	if err := c.MC.Forget(postgresConnectionID, dbName); err != nil {
+		fmt.Println("Error forgetting schema metadata:", err)
+	}
+
+	result.Message = fmt.Sprintf("Database %s renamed to %s", dbName, newName)
+	return result
+}
+
+// DropDatabase drops a database. confirmName has to be the database name typed by
+// the user. Other sessions are terminated when terminate is set.
+func (c *Connections) DropDatabase(postgresConnectionID int64, dbName, confirmName string, terminate bool, token string) *model.DatabaseOperationResult {
+	dbName = strings.TrimSpace(dbName)
+	if dbName == "" {
+		return &model.DatabaseOperationResult{OK: false, Message: "the database is required"}
+	}
+	if confirmName != dbName {
+		return &model.DatabaseOperationResult{OK: false, Message: fmt.Sprintf("type %s to confirm dropping the database", dbName)}
+	}
+
+	statement := "DROP DATABASE " + quoteIdent(dbName)
+
+	result := c.runDatabaseStatement(postgresConnectionID, statement, dbName, terminate, token)
+	if !result.OK {
+		return result
+	}
+
+	if err := c.MC.Forget(postgresConnectionID, dbName); err != nil {
+		fmt.Println("Error forgetting schema metadata:", err)
+	}
+
+	result.Message = fmt.Sprintf("Database %s dropped", dbName)
+	return result
+}
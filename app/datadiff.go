@@ -0,0 +1,557 @@
+package app
+
+import (
+	"context"
+	"dbmx/model"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Statuses of a differing row
+const (
+	rowOnlySource = "only_source"
+	rowOnlyTarget = "only_target"
+	rowChanged    = "changed"
+)
+
+const (
+	defaultChunkRows = 10000
+	maxDiffChunks    = 100000
+
+	// Differing rows listed, the script is only generated when all of them are
+	maxDiffRows = 10000
+
+	// Differing chunks whose rows are read at a time
+	chunksPerRead = 10
+)
+
+// Settings making both servers print values the same way, whatever their own defaults
+var canonicalOutput = []string{
+	"SET LOCAL TimeZone = 'UTC'",
+	"SET LOCAL DateStyle = 'ISO, YMD'",
+	"SET LOCAL IntervalStyle = 'postgres'",
+	"SET LOCAL extra_float_digits = 3",
+	"SET LOCAL bytea_output = 'hex'",
+}
+
+// dataDiffPlan is what both sides of a diff are read with
+type dataDiffPlan struct {
+	source string
+	target string
+	// Key columns come first in the compared columns
+	keys    []string
+	columns []string
+	chunks  int
+}
+
+// chunkHash sums the hashes of a chunk's rows, so that the order the rows are read in
+// doesn't matter
+type chunkHash struct {
+	rows int64
+	sum  string
+}
+
+// chunkExpression puts a row in a chunk by the hash of its key, the same on any server
+func (p *dataDiffPlan) chunkExpression() string {
+	return fmt.Sprintf("mod(('x' || substr(md5(ROW(%s)::text), 1, 8))::bit(32)::int & 2147483647, %d)", quoteIdents(p.keys), p.chunks)
+}
+
+// diffSnapshot starts a read-only transaction reading a single snapshot of the pool's
+// database with the canonical output settings
+func diffSnapshot(ctx context.Context, pool *pgxpool.Pool) (pgx.Tx, error) {
+	tx, err := pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	for _, statement := range canonicalOutput {
+		if _, err := tx.Exec(ctx, statement); err != nil {
+			tx.Rollback(ctx)
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// chunkHashes hashes the rows of the table chunk by chunk
+func chunkHashes(ctx context.Context, tx pgx.Tx, table string, plan *dataDiffPlan) (map[int32]chunkHash, error) {
+	query := `
+		SELECT chunk, count(*), sum(('x' || substr(hash, 1, 15))::bit(60)::bigint)::text
+		FROM (
+			SELECT ` + plan.chunkExpression() + ` AS chunk, md5(ROW(` + quoteIdents(plan.columns) + `)::text) AS hash
+			FROM ` + table + `
+		) hashed
+		GROUP BY chunk
+	`
+	rows, err := tx.Query(ctx, query)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to hash the rows of %s", table)
+	}
+	defer rows.Close()
+
+	hashes := make(map[int32]chunkHash)
+	for rows.Next() {
+		var chunk int32
+		var h chunkHash
+		if err := rows.Scan(&chunk, &h.rows, &h.sum); err != nil {
+			return nil, err
+		}
+		hashes[chunk] = h
+	}
+
+	return hashes, rows.Err()
+}
+
+// readChunks reads the compared columns of the rows in the chunks as text, keyed by
+// the text of their primary key
+func readChunks(ctx context.Context, tx pgx.Tx, table string, plan *dataDiffPlan, chunks []int32) (map[string][]*string, error) {
+	var columns []string
+	for _, column := range plan.columns {
+		columns = append(columns, quoteIdent(column)+"::text")
+	}
+	query := "SELECT ROW(" + quoteIdents(plan.keys) + ")::text, " + strings.Join(columns, ", ") +
+		" FROM " + table + " WHERE " + plan.chunkExpression() + " = ANY($1)"
+
+	rows, err := tx.Query(ctx, query, chunks)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the rows of %s", table)
+	}
+	defer rows.Close()
+
+	values := make(map[string][]*string)
+	for rows.Next() {
+		var key string
+		row := make([]*string, len(plan.columns))
+		dest := []any{&key}
+		for i := range row {
+			dest = append(dest, &row[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		values[key] = row
+	}
+
+	return values, rows.Err()
+}
+
+// sameValue reports if both values are NULL or equal
+func sameValue(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// compareRows compares the rows read from both sides, ordered by key
+func compareRows(plan *dataDiffPlan, source, target map[string][]*string) []model.DataDiffRow {
+	keys := make([]string, 0, len(source)+len(target))
+	for key := range source {
+		keys = append(keys, key)
+	}
+	for key := range target {
+		if _, exists := source[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var differences []model.DataDiffRow
+	for _, key := range keys {
+		s, inSource := source[key]
+		t, inTarget := target[key]
+
+		row := model.DataDiffRow{Status: rowChanged}
+		switch {
+		case !inTarget:
+			row.Status = rowOnlySource
+		case !inSource:
+			row.Status = rowOnlyTarget
+		}
+
+		values := s
+		if values == nil {
+			values = t
+		}
+		for i := range plan.keys {
+			row.Key = append(row.Key, *values[i])
+		}
+
+		changed := false
+		for i, name := range plan.columns {
+			column := model.DataDiffColumn{Name: name}
+			if inSource {
+				column.Source = s[i]
+			}
+			if inTarget {
+				column.Target = t[i]
+			}
+			if inSource && inTarget && !sameValue(s[i], t[i]) {
+				column.Changed = true
+				changed = true
+			}
+			row.Columns = append(row.Columns, column)
+		}
+
+		if row.Status == rowChanged && !changed {
+			continue
+		}
+		differences = append(differences, row)
+	}
+
+	return differences
+}
+
+// sqlValue renders a value read as text as a literal the column's type accepts
+func sqlValue(value *string) string {
+	if value == nil {
+		return "NULL"
+	}
+	return quoteLiteral(*value)
+}
+
+// syncStatements renders the statements making the target's rows match the source's,
+// each of them affecting exactly one row. Deletes go first and inserts last, so that
+// values of unique columns moving between rows are free by the time they are written.
+func syncStatements(plan *dataDiffPlan, rows []model.DataDiffRow) []string {
+	keyCondition := func(row model.DataDiffRow) string {
+		var conditions []string
+		for i, key := range plan.keys {
+			conditions = append(conditions, quoteIdent(key)+" = "+quoteLiteral(row.Key[i]))
+		}
+		return strings.Join(conditions, " AND ")
+	}
+
+	var deletes, updates, inserts []string
+	for _, row := range rows {
+		switch row.Status {
+		case rowOnlyTarget:
+			deletes = append(deletes, "DELETE FROM "+plan.target+" WHERE "+keyCondition(row))
+
+		case rowChanged:
+			var assignments []string
+			for _, column := range row.Columns {
+				if column.Changed {
+					assignments = append(assignments, quoteIdent(column.Name)+" = "+sqlValue(column.Source))
+				}
+			}
+			updates = append(updates, "UPDATE "+plan.target+" SET "+strings.Join(assignments, ", ")+" WHERE "+keyCondition(row))
+
+		case rowOnlySource:
+			var values []string
+			for _, column := range row.Columns {
+				values = append(values, sqlValue(column.Source))
+			}
+			inserts = append(inserts, "INSERT INTO "+plan.target+" ("+quoteIdents(plan.columns)+") VALUES ("+strings.Join(values, ", ")+")")
+		}
+	}
+
+	return append(append(append([]string{}, deletes...), updates...), inserts...)
+}
+
+// dataDiff compares the rows of the table on both pools
+func (c *Connections) dataDiff(ctx context.Context, sourcePoolID, targetPoolID uuid.UUID, spec model.DataDiffSpec) (*model.DataDiff, error) {
+	source, exists := c.PM.GetPool(sourcePoolID)
+	if !exists {
+		return nil, errors.New("source pool doesn't exist")
+	}
+	target, exists := c.PM.GetPool(targetPoolID)
+	if !exists {
+		return nil, errors.New("target pool doesn't exist")
+	}
+
+	// The sync statements are written against the live tables, their columns and keys
+	// can't come from an older stored copy
+	for _, poolID := range []uuid.UUID{sourcePoolID, targetPoolID} {
+		if _, err := c.MC.Refresh(ctx, poolID); err != nil {
+			return nil, err
+		}
+	}
+	sourceMetadata, err := c.MC.Get(ctx, sourcePoolID)
+	if err != nil {
+		return nil, err
+	}
+	sourceRel, err := tableRelation(sourceMetadata, strings.TrimSpace(spec.SourceTable))
+	if err != nil {
+		return nil, err
+	}
+	targetName := strings.TrimSpace(spec.TargetTable)
+	if targetName == "" {
+		targetName = tabTableName(sourceRel.Schema, sourceRel.Name)
+	}
+	targetMetadata, err := c.MC.Get(ctx, targetPoolID)
+	if err != nil {
+		return nil, err
+	}
+	targetRel, err := tableRelation(targetMetadata, targetName)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sourceRel.PrimaryKey) == 0 {
+		return nil, errors.Errorf("%s has no primary key to match its rows by", spec.SourceTable)
+	}
+
+	diff := &model.DataDiff{
+		Source:            c.poolLabel(sourcePoolID),
+		Target:            c.poolLabel(targetPoolID),
+		Table:             tabTableName(targetRel.Schema, targetRel.Name),
+		KeyColumns:        sourceRel.PrimaryKey,
+		SourceOnlyColumns: []string{},
+		TargetOnlyColumns: []string{},
+		Rows:              []model.DataDiffRow{},
+		Statements:        []string{},
+	}
+	plan := &dataDiffPlan{
+		source: quoteIdent(sourceRel.Schema) + "." + quoteIdent(sourceRel.Name),
+		target: quoteIdent(targetRel.Schema) + "." + quoteIdent(targetRel.Name),
+		keys:   sourceRel.PrimaryKey,
+	}
+
+	inTarget := make(map[string]bool, len(targetRel.Columns))
+	for _, column := range targetRel.Columns {
+		inTarget[column.Name] = true
+	}
+	isKey := make(map[string]bool, len(plan.keys))
+	for _, key := range plan.keys {
+		if !inTarget[key] {
+			return nil, errors.Errorf("the target has no key column %s", key)
+		}
+		isKey[key] = true
+	}
+	plan.columns = append(plan.columns, plan.keys...)
+	inSource := make(map[string]bool, len(sourceRel.Columns))
+	for _, column := range sourceRel.Columns {
+		inSource[column.Name] = true
+		switch {
+		case isKey[column.Name]:
+		case inTarget[column.Name]:
+			plan.columns = append(plan.columns, column.Name)
+		default:
+			diff.SourceOnlyColumns = append(diff.SourceOnlyColumns, column.Name)
+		}
+	}
+	for _, column := range targetRel.Columns {
+		if !inSource[column.Name] {
+			diff.TargetOnlyColumns = append(diff.TargetOnlyColumns, column.Name)
+		}
+	}
+	diff.Columns = plan.columns
+
+	// Enough chunks for the larger side to have about chunkRows rows in each
+	chunkRows := spec.ChunkRows
+	if chunkRows <= 0 {
+		chunkRows = defaultChunkRows
+	}
+	var estimate int64
+	for _, side := range []struct {
+		pool *pgxpool.Pool
+		oid  int64
+	}{{source, sourceRel.OID}, {target, targetRel.OID}} {
+		var rows int64
+		if err := side.pool.QueryRow(ctx, "SELECT reltuples::bigint FROM pg_class WHERE oid = $1", side.oid).Scan(&rows); err == nil {
+			estimate = max(estimate, rows)
+		}
+	}
+	plan.chunks = int(min(max(int64(math.Ceil(float64(estimate)/float64(chunkRows))), 1), maxDiffChunks))
+	diff.Chunks = plan.chunks
+
+	sourceTx, err := diffSnapshot(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	defer sourceTx.Rollback(ctx)
+	targetTx, err := diffSnapshot(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	defer targetTx.Rollback(ctx)
+
+	sourceHashes, err := chunkHashes(ctx, sourceTx, plan.source, plan)
+	if err != nil {
+		return nil, err
+	}
+	targetHashes, err := chunkHashes(ctx, targetTx, plan.target, plan)
+	if err != nil {
+		return nil, err
+	}
+
+	var differing []int32
+	for chunk, h := range sourceHashes {
+		diff.SourceRows += h.rows
+		if targetHashes[chunk] != h {
+			differing = append(differing, chunk)
+		}
+	}
+	for chunk, h := range targetHashes {
+		diff.TargetRows += h.rows
+		if _, exists := sourceHashes[chunk]; !exists {
+			differing = append(differing, chunk)
+		}
+	}
+	sort.Slice(differing, func(i, j int) bool { return differing[i] < differing[j] })
+	diff.DifferingChunks = len(differing)
+
+	for start := 0; start < len(differing); start += chunksPerRead {
+		chunks := differing[start:min(start+chunksPerRead, len(differing))]
+
+		sourceRows, err := readChunks(ctx, sourceTx, plan.source, plan, chunks)
+		if err != nil {
+			return nil, err
+		}
+		targetRows, err := readChunks(ctx, targetTx, plan.target, plan, chunks)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range compareRows(plan, sourceRows, targetRows) {
+			switch row.Status {
+			case rowOnlySource:
+				diff.OnlySource++
+			case rowOnlyTarget:
+				diff.OnlyTarget++
+			case rowChanged:
+				diff.Changed++
+			}
+			if len(diff.Rows) < maxDiffRows {
+				diff.Rows = append(diff.Rows, row)
+			} else {
+				diff.Truncated = true
+			}
+		}
+	}
+
+	if !diff.Truncated {
+		diff.Statements = syncStatements(plan, diff.Rows)
+		if len(diff.Statements) > 0 {
+			diff.Script = strings.Join(diff.Statements, ";\n") + ";\n"
+		}
+	}
+
+	return diff, nil
+}
+
+// DiffTableData compares the rows of a table on two pools by primary key, along with the
+// script making the target's rows match the source's
+func (c *Connections) DiffTableData(sourcePoolID, targetPoolID uuid.UUID, spec model.DataDiffSpec) (*model.DataDiff, error) {
+	return c.dataDiff(context.Background(), sourcePoolID, targetPoolID, spec)
+}
+
+// syncConfirmation summarises the script by the rows the diff found, every statement
+// changes exactly one row so there is nothing to dry run
+func syncConfirmation(policy *model.EnvPolicy, diff *model.DataDiff) *model.Confirmation {
+	confirmation := &model.Confirmation{
+		Env:   policy.Env,
+		Token: uuid.New().String(),
+	}
+
+	for _, change := range []struct {
+		command string
+		rows    int64
+		what    string
+	}{
+		{"DELETE", diff.OnlyTarget, "only the target has"},
+		{"UPDATE", diff.Changed, "which differ"},
+		{"INSERT", diff.OnlySource, "only the source has"},
+	} {
+		if change.rows == 0 {
+			continue
+		}
+		rows := change.rows
+		confirmation.Statements = append(confirmation.Statements, model.StatementConfirmation{
+			Statement:  fmt.Sprintf("%s the %d rows of %s %s", change.command, rows, diff.Table, change.what),
+			Command:    change.command,
+			Kind:       statementDML,
+			DryRunRows: &rows,
+		})
+	}
+
+	return confirmation
+}
+
+// SyncTableData compares the table again and applies the synchronisation script to the
+// target in a single transaction. When the target's environment policy asks for
+// confirmation the token returned in the confirmation has to be passed, the token only
+// applies while the rows are still the ones that were confirmed.
+func (c *Connections) SyncTableData(sourcePoolID, targetPoolID uuid.UUID, spec model.DataDiffSpec, token string) *model.DataSyncResult {
+	ctx := context.Background()
+	started := time.Now()
+
+	diff, err := c.dataDiff(ctx, sourcePoolID, targetPoolID, spec)
+	if err != nil {
+		return &model.DataSyncResult{OK: false, Message: err.Error()}
+	}
+	if diff.Truncated {
+		return &model.DataSyncResult{OK: false, Message: fmt.Sprintf("more than %d rows differ, copy the table instead", maxDiffRows)}
+	}
+	if len(diff.Statements) == 0 {
+		return &model.DataSyncResult{OK: true, Message: fmt.Sprintf("%s is already in sync", diff.Table)}
+	}
+
+	policy, err := c.poolPolicy(targetPoolID)
+	if err != nil {
+		return &model.DataSyncResult{OK: false, Message: err.Error()}
+	}
+
+	toConfirm, _, err := checkPolicy(policy, diff.Script)
+	if err != nil {
+		c.audit(targetPoolID, diff.Script, started, 0, auditBlocked, err)
+		return &model.DataSyncResult{OK: false, Message: err.Error()}
+	}
+
+	if len(toConfirm) > 0 && !c.consumeConfirmation(targetPoolID, diff.Script, token) {
+		confirmation := syncConfirmation(policy, diff)
+		c.rememberConfirmation(targetPoolID, diff.Script, confirmation.Token)
+
+		return &model.DataSyncResult{
+			OK:                   false,
+			Message:              fmt.Sprintf("This script changes %s on a %s connection and needs to be confirmed", diff.Table, policy.Env),
+			RequiresConfirmation: true,
+			Confirmation:         confirmation,
+		}
+	}
+
+	target, exists := c.PM.GetPool(targetPoolID)
+	if !exists {
+		return &model.DataSyncResult{OK: false, Message: "target pool doesn't exist"}
+	}
+
+	started = time.Now()
+	tx, err := target.Begin(ctx)
+	if err != nil {
+		return &model.DataSyncResult{OK: false, Message: err.Error()}
+	}
+	defer tx.Rollback(ctx)
+
+	for _, statement := range diff.Statements {
+		tag, err := tx.Exec(ctx, statement)
+		if err == nil && tag.RowsAffected() != 1 {
+			err = errors.Errorf("%s changed since it was compared, compare it again", diff.Table)
+		}
+		if err != nil {
+			c.audit(targetPoolID, diff.Script, started, 0, auditError, err)
+			return &model.DataSyncResult{OK: false, Message: err.Error()}
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.audit(targetPoolID, diff.Script, started, 0, auditError, err)
+		return &model.DataSyncResult{OK: false, Message: err.Error()}
+	}
+	c.audit(targetPoolID, diff.Script, started, int64(len(diff.Statements)), auditSuccess, nil)
+
+	return &model.DataSyncResult{
+		OK:       true,
+		Message:  fmt.Sprintf("%s synced, %d rows inserted, %d updated and %d deleted", diff.Table, diff.OnlySource, diff.Changed, diff.OnlyTarget),
+		Inserted: diff.OnlySource,
+		Updated:  diff.Changed,
+		Deleted:  diff.OnlyTarget,
+	}
+}
@@ -0,0 +1,84 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+
+	"dbmx/model"
+)
+
+func TestSyncStatements(t *testing.T) {
+	text := func(s string) *string { return &s }
+
+	plan := &dataDiffPlan{
+		source:  "app.users",
+		target:  "app.users",
+		keys:    []string{"id"},
+		columns: []string{"id", "name", "note"},
+	}
+	compositePlan := &dataDiffPlan{
+		source:  "app.members",
+		target:  "archive.members",
+		keys:    []string{"team", "member"},
+		columns: []string{"team", "member", "role"},
+	}
+
+	tests := []struct {
+		name string
+		plan *dataDiffPlan
+		rows []model.DataDiffRow
+		want []string
+	}{
+		{"no differences", plan, nil, []string{}},
+		{
+			"deletes, then updates, then inserts",
+			plan,
+			[]model.DataDiffRow{
+				{Status: rowOnlySource, Key: []string{"1"}, Columns: []model.DataDiffColumn{
+					{Name: "id", Source: text("1")},
+					{Name: "name", Source: text("O'Brien")},
+					{Name: "note"},
+				}},
+				{Status: rowChanged, Key: []string{"2"}, Columns: []model.DataDiffColumn{
+					{Name: "id", Source: text("2"), Target: text("2")},
+					{Name: "name", Source: text("b"), Target: text("b")},
+					{Name: "note", Target: text("old"), Changed: true},
+				}},
+				{Status: rowOnlyTarget, Key: []string{"3"}, Columns: []model.DataDiffColumn{
+					{Name: "id", Target: text("3")},
+					{Name: "name", Target: text("c")},
+					{Name: "note"},
+				}},
+			},
+			[]string{
+				"DELETE FROM app.users WHERE id = '3'",
+				"UPDATE app.users SET note = NULL WHERE id = '2'",
+				"INSERT INTO app.users (id, name, note) VALUES ('1', 'O''Brien', NULL)",
+			},
+		},
+		{
+			"composite key",
+			compositePlan,
+			[]model.DataDiffRow{
+				{Status: rowChanged, Key: []string{"a", "b"}, Columns: []model.DataDiffColumn{
+					{Name: "team", Source: text("a"), Target: text("a")},
+					{Name: "member", Source: text("b"), Target: text("b")},
+					{Name: "role", Source: text("owner"), Target: text("member"), Changed: true},
+				}},
+				{Status: rowOnlyTarget, Key: []string{"a", "c"}},
+			},
+			[]string{
+				`DELETE FROM archive.members WHERE team = 'a' AND member = 'c'`,
+				`UPDATE archive.members SET role = 'owner' WHERE team = 'a' AND member = 'b'`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := syncStatements(tt.plan, tt.rows); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("syncStatements() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,440 @@
+package app
+
+import (
+	"context"
+	"dbmx/model"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Serial types aren't in pg_type, they are shorthands for an integer with a sequence
+var serialTypes = map[string]bool{
+	"smallserial": true,
+	"serial2":     true,
+	"serial":      true,
+	"serial4":     true,
+	"bigserial":   true,
+	"serial8":     true,
+}
+
+// Identity columns have to be one of these
+var identityTypes = map[string]bool{
+	"smallint": true,
+	"integer":  true,
+	"bigint":   true,
+}
+
+var referentialActions = map[string]bool{
+	"NO ACTION":   true,
+	"RESTRICT":    true,
+	"CASCADE":     true,
+	"SET NULL":    true,
+	"SET DEFAULT": true,
+}
+
+var partitionStrategies = map[string]bool{
+	"range": true,
+	"list":  true,
+	"hash":  true,
+}
+
+var typeKinds = map[string]string{
+	"b": "base",
+	"c": "composite",
+	"d": "domain",
+	"e": "enum",
+	"p": "pseudo",
+	"r": "range",
+	"m": "multirange",
+}
+
+// quoteIdents quotes each of the names and joins them into a list
+func quoteIdents(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteIdent(name)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// keyExpressions quotes the keys which are columns of the table and parenthesizes
+// the others as expressions
+func keyExpressions(keys []string, columns map[string]bool) string {
+	var exprs []string
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if columns[key] {
+			key = quoteIdent(key)
+		} else if !strings.HasPrefix(key, "(") {
+			key = "(" + key + ")"
+		}
+		exprs = append(exprs, key)
+	}
+	return strings.Join(exprs, ", ")
+}
+
+// resolveColumnTypes checks every column type against pg_type, returning the name the
+// server knows it by
+func resolveColumnTypes(ctx context.Context, pool *pgxpool.Pool, columns []model.ColumnSpec) ([]model.ColumnType, error) {
+	query := `
+		SELECT format_type(t.oid, NULL), t.typtype::text
+		FROM pg_type t
+		WHERE t.oid = to_regtype($1)
+	`
+
+	var types []model.ColumnType
+	for _, column := range columns {
+		typeName := strings.TrimSpace(column.Type)
+		if serialTypes[strings.ToLower(typeName)] {
+			types = append(types, model.ColumnType{Column: column.Name, Type: strings.ToLower(typeName), Kind: "serial"})
+			continue
+		}
+
+		ct := model.ColumnType{Column: column.Name}
+		var kind string
+		err := pool.QueryRow(ctx, query, typeName).Scan(&ct.Type, &kind)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errors.Errorf("type %s of column %s doesn't exist", typeName, column.Name)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid type %s of column %s", typeName, column.Name)
+		}
+		ct.Kind = typeKinds[kind]
+		if ct.Kind == "pseudo" {
+			return nil, errors.Errorf("column %s can't be of the pseudo-type %s", column.Name, ct.Type)
+		}
+
+		types = append(types, ct)
+	}
+
+	return types, nil
+}
+
+// renderCreateTable renders the spec to the statements creating the table. types are
+// the resolved column types in the order of the columns.
+func renderCreateTable(spec model.TableSpec, types []model.ColumnType) ([]string, error) {
+	schema := strings.TrimSpace(spec.Schema)
+	if schema == "" {
+		schema = "public"
+	}
+	name := strings.TrimSpace(spec.Name)
+	if name == "" {
+		return nil, errors.New("the table needs a name")
+	}
+	if len(spec.Columns) == 0 {
+		return nil, errors.New("the table needs at least one column")
+	}
+	table := quoteIdent(schema) + "." + quoteIdent(name)
+
+	columns := make(map[string]bool, len(spec.Columns))
+	hasColumns := func(what string, names []string) error {
+		if len(names) == 0 {
+			return errors.Errorf("%s needs at least one column", what)
+		}
+		for _, n := range names {
+			if !columns[n] {
+				return errors.Errorf("%s uses column %s which is not in the table", what, n)
+			}
+		}
+		return nil
+	}
+
+	var definitions []string
+	for i, column := range spec.Columns {
+		column.Name = strings.TrimSpace(column.Name)
+		if column.Name == "" {
+			return nil, errors.Errorf("column %d needs a name", i+1)
+		}
+		if columns[column.Name] {
+			return nil, errors.Errorf("column %s is defined twice", column.Name)
+		}
+		columns[column.Name] = true
+
+		t := types[i]
+		definition := quoteIdent(column.Name) + " " + strings.TrimSpace(column.Type)
+
+		if identity := strings.ToLower(strings.TrimSpace(column.Identity)); identity != "" {
+			if identity != "always" && identity != "by default" {
+				return nil, errors.Errorf("identity of column %s has to be always or by default", column.Name)
+			}
+			if !identityTypes[t.Type] {
+				return nil, errors.Errorf("identity column %s has to be smallint, integer or bigint", column.Name)
+			}
+			if column.Default != "" {
+				return nil, errors.Errorf("identity column %s can't have a default", column.Name)
+			}
+			definition += " GENERATED " + strings.ToUpper(identity) + " AS IDENTITY"
+		}
+
+		if column.Default != "" {
+			if t.Kind == "serial" {
+				return nil, errors.Errorf("serial column %s can't have a default", column.Name)
+			}
+			definition += " DEFAULT " + column.Default
+		}
+		if column.NotNull {
+			definition += " NOT NULL"
+		}
+
+		definitions = append(definitions, definition)
+	}
+
+	if len(spec.PrimaryKey) > 0 {
+		if err := hasColumns("the primary key", spec.PrimaryKey); err != nil {
+			return nil, err
+		}
+		definitions = append(definitions, "PRIMARY KEY ("+quoteIdents(spec.PrimaryKey)+")")
+	}
+
+	constraint := func(name string) string {
+		if name = strings.TrimSpace(name); name != "" {
+			return "CONSTRAINT " + quoteIdent(name) + " "
+		}
+		return ""
+	}
+
+	for i, unique := range spec.Uniques {
+		if err := hasColumns(fmt.Sprintf("unique constraint %d", i+1), unique.Columns); err != nil {
+			return nil, err
+		}
+		definitions = append(definitions, constraint(unique.Name)+"UNIQUE ("+quoteIdents(unique.Columns)+")")
+	}
+
+	for i, check := range spec.Checks {
+		if strings.TrimSpace(check.Expression) == "" {
+			return nil, errors.Errorf("check constraint %d needs an expression", i+1)
+		}
+		definitions = append(definitions, constraint(check.Name)+"CHECK ("+strings.TrimSpace(check.Expression)+")")
+	}
+
+	for i, fk := range spec.ForeignKeys {
+		what := fmt.Sprintf("foreign key %d", i+1)
+		if err := hasColumns(what, fk.Columns); err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(fk.RefTable) == "" {
+			return nil, errors.Errorf("%s needs the referenced table", what)
+		}
+		if len(fk.RefColumns) > 0 && len(fk.RefColumns) != len(fk.Columns) {
+			return nil, errors.Errorf("%s references %d columns with %d", what, len(fk.RefColumns), len(fk.Columns))
+		}
+
+		refSchema := strings.TrimSpace(fk.RefSchema)
+		if refSchema == "" {
+			refSchema = "public"
+		}
+		definition := constraint(fk.Name) + "FOREIGN KEY (" + quoteIdents(fk.Columns) + ") REFERENCES " + quoteIdent(refSchema) + "." + quoteIdent(strings.TrimSpace(fk.RefTable))
+		if len(fk.RefColumns) > 0 {
+			definition += " (" + quoteIdents(fk.RefColumns) + ")"
+		}
+
+		for _, action := range []struct{ event, action string }{{"DELETE", fk.OnDelete}, {"UPDATE", fk.OnUpdate}} {
+			a := strings.ToUpper(strings.Join(strings.Fields(action.action), " "))
+			if a == "" || a == "NO ACTION" {
+				continue
+			}
+			if !referentialActions[a] {
+				return nil, errors.Errorf("%s has an unknown ON %s action %s", what, action.event, action.action)
+			}
+			definition += " ON " + action.event + " " + a
+		}
+
+		definitions = append(definitions, definition)
+	}
+
+	ddl := "CREATE TABLE " + table + " (\n    " + strings.Join(definitions, ",\n    ") + "\n)"
+
+	if p := spec.Partition; p != nil {
+		strategy := strings.ToLower(strings.TrimSpace(p.Strategy))
+		if !partitionStrategies[strategy] {
+			return nil, errors.Errorf("unknown partitioning strategy %s, use range, list or hash", p.Strategy)
+		}
+		if len(p.Columns) == 0 {
+			return nil, errors.New("the partition key needs at least one column")
+		}
+
+		// Unique constraints of a partitioned table have to include the partition key
+		keys := [][]string{spec.PrimaryKey}
+		for _, unique := range spec.Uniques {
+			keys = append(keys, unique.Columns)
+		}
+		for _, key := range keys {
+			if len(key) == 0 {
+				continue
+			}
+			included := make(map[string]bool)
+			for _, k := range key {
+				included[k] = true
+			}
+			for _, pc := range p.Columns {
+				if !included[strings.TrimSpace(pc)] {
+					return nil, errors.Errorf("unique constraints and the primary key have to include the partition key column %s", pc)
+				}
+			}
+		}
+
+		ddl += " PARTITION BY " + strings.ToUpper(strategy) + " (" + keyExpressions(p.Columns, columns) + ")"
+	}
+
+	statements := []string{ddl}
+
+	for i, index := range spec.Indexes {
+		if len(index.Columns) == 0 {
+			return nil, errors.Errorf("index %d needs at least one column", i+1)
+		}
+
+		stmt := "CREATE"
+		if index.Unique {
+			stmt += " UNIQUE"
+		}
+		stmt += " INDEX"
+		if n := strings.TrimSpace(index.Name); n != "" {
+			stmt += " " + quoteIdent(n)
+		}
+		stmt += " ON " + table
+		if method := strings.ToLower(strings.TrimSpace(index.Method)); method != "" {
+			if !indexMethods[method] {
+				return nil, errors.Errorf("unknown index method %s", index.Method)
+			}
+			stmt += " USING " + method
+		}
+		stmt += " (" + keyExpressions(index.Columns, columns) + ")"
+		if where := strings.TrimSpace(index.Where); where != "" {
+			stmt += " WHERE " + where
+		}
+
+		statements = append(statements, stmt)
+	}
+
+	if spec.Comment != "" {
+		statements = append(statements, fmt.Sprintf("COMMENT ON TABLE %s IS %s", table, quoteLiteral(spec.Comment)))
+	}
+	for _, column := range spec.Columns {
+		if column.Comment != "" {
+			statements = append(statements, fmt.Sprintf("COMMENT ON COLUMN %s.%s IS %s", table, quoteIdent(strings.TrimSpace(column.Name)), quoteLiteral(column.Comment)))
+		}
+	}
+
+	return statements, nil
+}
+
+// createTablePlan validates the spec against the server and renders its DDL
+func (c *Connections) createTablePlan(ctx context.Context, activePoolID uuid.UUID, spec model.TableSpec) (*model.CreateTablePlan, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	types, err := resolveColumnTypes(ctx, pool, spec.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	statements, err := renderCreateTable(spec, types)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := strings.TrimSpace(spec.Schema)
+	if schema == "" {
+		schema = "public"
+	}
+
+	return &model.CreateTablePlan{
+		Table:      tabTableName(schema, strings.TrimSpace(spec.Name)),
+		Statements: statements,
+		Script:     strings.Join(statements, ";\n\n") + ";\n",
+		Types:      types,
+	}, nil
+}
+
+// PreviewCreateTable validates the table spec and returns the DDL creating it
+func (c *Connections) PreviewCreateTable(activePoolID uuid.UUID, spec model.TableSpec) (*model.CreateTablePlan, error) {
+	return c.createTablePlan(context.Background(), activePoolID, spec)
+}
+
+// CreateTable creates the table of the spec in a single transaction and returns the
+// refreshed tables of the database. When the environment policy asks for confirmation
+// the token returned in the confirmation has to be passed.
+func (c *Connections) CreateTable(activePoolID uuid.UUID, spec model.TableSpec, token string) *model.CreateTableResult {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return &model.CreateTableResult{OK: false, Message: "pool doesn't exist"}
+	}
+
+	ctx := context.Background()
+	started := time.Now()
+
+	plan, err := c.createTablePlan(ctx, activePoolID, spec)
+	if err != nil {
+		return &model.CreateTableResult{OK: false, Message: err.Error()}
+	}
+
+	policy, err := c.poolPolicy(activePoolID)
+	if err != nil {
+		return &model.CreateTableResult{OK: false, Message: err.Error()}
+	}
+
+	toConfirm, toConfirmInfo, err := checkPolicy(policy, plan.Script)
+	if err != nil {
+		c.audit(activePoolID, plan.Script, started, 0, auditBlocked, err)
+		return &model.CreateTableResult{OK: false, Message: err.Error()}
+	}
+
+	if len(toConfirm) > 0 && !c.consumeConfirmation(activePoolID, plan.Script, token) {
+		confirmation, err := c.requestConfirmation(ctx, activePoolID, policy, plan.Script, toConfirm, toConfirmInfo)
+		if err != nil {
+			return &model.CreateTableResult{OK: false, Message: err.Error()}
+		}
+
+		return &model.CreateTableResult{
+			OK:                   false,
+			Message:              fmt.Sprintf("Creating %s on a %s connection needs to be confirmed", plan.Table, policy.Env),
+			RequiresConfirmation: true,
+			Confirmation:         confirmation,
+		}
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return &model.CreateTableResult{OK: false, Message: err.Error()}
+	}
+	defer tx.Rollback(ctx)
+
+	batch := c.newAuditBatch(activePoolID)
+	for _, stmt := range plan.Statements {
+		started := time.Now()
+		_, err := tx.Exec(ctx, stmt)
+		batch.add(stmt, started)
+		if err != nil {
+			batch.flush(err)
+			return &model.CreateTableResult{OK: false, Message: err.Error()}
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		batch.flush(err)
+		return &model.CreateTableResult{OK: false, Message: err.Error()}
+	}
+	batch.flush(nil)
+
+	result := &model.CreateTableResult{OK: true, Message: fmt.Sprintf("%s created", plan.Table)}
+
+	// Pick up the new table for the sidebar
+	if _, err := c.MC.Refresh(ctx, activePoolID); err != nil {
+		result.Message += ", refreshing the tables failed: " + err.Error()
+		return result
+	}
+	result.Tables, err = c.GetAllPostgresTables(activePoolID)
+	if err != nil {
+		result.Message += ", refreshing the tables failed: " + err.Error()
+	}
+
+	return result
+}
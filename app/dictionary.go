@@ -0,0 +1,482 @@
+package app
+
+import (
+	"context"
+	"dbmx/model"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Data dictionary formats
+const (
+	dictionaryMarkdown = "markdown"
+	dictionaryHTML     = "html"
+)
+
+// Characters not allowed in the file name of a schema's markdown file
+var fileNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+var constraintTypes = map[string]string{
+	"p": "primary key",
+	"f": "foreign key",
+	"u": "unique",
+	"c": "check",
+	"x": "exclusion",
+	"t": "trigger",
+}
+
+type dictionaryConstraint struct {
+	name       string
+	kind       string
+	definition string
+}
+
+// dictionaryTable is a relation with everything the data dictionary shows about it
+type dictionaryTable struct {
+	relation    model.Relation
+	foreignKeys []model.ForeignKey
+	constraints []dictionaryConstraint
+
+	// -1 when the table was never analyzed
+	rowEstimate int64
+	totalBytes  int64
+	tableBytes  int64
+	indexBytes  int64
+}
+
+// dictionary is the documented database grouped by schema
+type dictionary struct {
+	database    string
+	generatedAt string
+	schemas     []string
+	tables      map[string][]*dictionaryTable
+}
+
+// loadDictionary collects the relations of the database along with their constraints,
+// row estimates and sizes. An empty schema documents all schemas.
+func loadDictionary(ctx context.Context, pool *pgxpool.Pool, metadata *model.SchemaMetadata, database, schema string) (*dictionary, error) {
+	d := &dictionary{
+		database:    database,
+		generatedAt: time.Now().UTC().Format(time.RFC3339),
+		tables:      make(map[string][]*dictionaryTable),
+	}
+
+	byOID := make(map[int64]*dictionaryTable)
+	var oids []int64
+	for _, r := range metadata.Relations {
+		if schema != "" && r.Schema != schema {
+			continue
+		}
+
+		t := &dictionaryTable{relation: r, rowEstimate: -1}
+		for _, fk := range metadata.ForeignKeys {
+			if fk.Schema == r.Schema && fk.Table == r.Name {
+				t.foreignKeys = append(t.foreignKeys, fk)
+			}
+		}
+
+		if len(d.tables[r.Schema]) == 0 {
+			d.schemas = append(d.schemas, r.Schema)
+		}
+		d.tables[r.Schema] = append(d.tables[r.Schema], t)
+		byOID[r.OID] = t
+		oids = append(oids, r.OID)
+	}
+
+	if len(oids) == 0 {
+		return nil, errors.New("no tables or views to document")
+	}
+
+	// Row estimates and sizes
+	query := `
+		SELECT
+			c.oid::bigint,
+			CASE WHEN c.relkind IN ('v', 'f') THEN -1 ELSE c.reltuples::bigint END,
+			pg_total_relation_size(c.oid),
+			pg_relation_size(c.oid),
+			pg_indexes_size(c.oid)
+		FROM pg_class c
+		WHERE c.oid::bigint = ANY($1)
+	`
+	rows, err := pool.Query(ctx, query, oids)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read table sizes")
+	}
+	for rows.Next() {
+		var oid, rowEstimate, totalBytes, tableBytes, indexBytes int64
+		if err := rows.Scan(&oid, &rowEstimate, &totalBytes, &tableBytes, &indexBytes); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if t, exists := byOID[oid]; exists {
+			t.rowEstimate, t.totalBytes, t.tableBytes, t.indexBytes = rowEstimate, totalBytes, tableBytes, indexBytes
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Constraints as they would be written in CREATE TABLE
+	query = `
+		SELECT con.conrelid::bigint, con.conname, con.contype::text, pg_get_constraintdef(con.oid, true)
+		FROM pg_constraint con
+		WHERE con.conrelid::bigint = ANY($1)
+		ORDER BY con.conrelid, con.contype, con.conname
+	`
+	rows, err = pool.Query(ctx, query, oids)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read constraints")
+	}
+	for rows.Next() {
+		var oid int64
+		var kind string
+		var constraint dictionaryConstraint
+		if err := rows.Scan(&oid, &constraint.name, &kind, &constraint.definition); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		constraint.kind = constraintTypes[kind]
+		if t, exists := byOID[oid]; exists {
+			t.constraints = append(t.constraints, constraint)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(d.schemas)
+	return d, nil
+}
+
+// formatBytes formats a size the way pg_size_pretty does
+func formatBytes(bytes int64) string {
+	units := []string{"bytes", "kB", "MB", "GB", "TB"}
+	size := float64(bytes)
+	unit := 0
+	for size >= 10*1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d bytes", bytes)
+	}
+	return fmt.Sprintf("%.0f %s", size, units[unit])
+}
+
+// formatRows formats a row estimate, which is unknown for views and tables never analyzed
+func formatRows(estimate int64) string {
+	if estimate < 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d", estimate)
+}
+
+// markdownCell escapes text for a markdown table cell
+func markdownCell(text string) string {
+	text = strings.ReplaceAll(text, "|", `\|`)
+	text = strings.ReplaceAll(text, "\r\n", "<br>")
+	return strings.ReplaceAll(text, "\n", "<br>")
+}
+
+// columnKeys describes the key columns of a table, e.g. PK or FK
+func columnKeys(t *dictionaryTable, column string) string {
+	var keys []string
+	for _, pk := range t.relation.PrimaryKey {
+		if pk == column {
+			keys = append(keys, "PK")
+		}
+	}
+	for _, fk := range t.foreignKeys {
+		for _, c := range fk.Columns {
+			if c == column {
+				keys = append(keys, "FK")
+			}
+		}
+	}
+	return strings.Join(keys, ", ")
+}
+
+// fkTarget describes the target of a foreign key
+func fkTarget(fk model.ForeignKey) string {
+	return fmt.Sprintf("%s.%s (%s)", fk.RefSchema, fk.RefTable, strings.Join(fk.RefColumns, ", "))
+}
+
+// renderDictionaryMarkdown renders the tables of a schema as one markdown document
+func renderDictionaryMarkdown(d *dictionary, schema string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# Schema `%s`\n\n", schema)
+	fmt.Fprintf(&b, "Database `%s`, generated %s.\n\n", d.database, d.generatedAt)
+
+	b.WriteString("| Name | Kind | Rows (estimate) | Total size | Description |\n")
+	b.WriteString("| --- | --- | --- | --- | --- |\n")
+	for _, t := range d.tables[schema] {
+		r := t.relation
+		fmt.Fprintf(&b, "| [%s](#%s) | %s | %s | %s | %s |\n", markdownCell(r.Name), markdownAnchor(r.Name), r.Kind, formatRows(t.rowEstimate), formatBytes(t.totalBytes), markdownCell(firstLine(r.Comment)))
+	}
+
+	for _, t := range d.tables[schema] {
+		r := t.relation
+		fmt.Fprintf(&b, "\n## %s\n\n", r.Name)
+		if r.Comment != "" {
+			fmt.Fprintf(&b, "%s\n\n", r.Comment)
+		}
+		fmt.Fprintf(&b, "%s, %s rows (estimate), %s in total: table %s, indexes %s.\n\n", strings.ToUpper(r.Kind[:1])+r.Kind[1:], formatRows(t.rowEstimate), formatBytes(t.totalBytes), formatBytes(t.tableBytes), formatBytes(t.indexBytes))
+
+		b.WriteString("### Columns\n\n")
+		b.WriteString("| # | Column | Type | Nullable | Default | Key | Description |\n")
+		b.WriteString("| --- | --- | --- | --- | --- | --- | --- |\n")
+		for _, c := range r.Columns {
+			nullable := "no"
+			if c.Nullable {
+				nullable = "yes"
+			}
+			def := ""
+			if c.Default != "" {
+				def = "`" + c.Default + "`"
+			}
+			fmt.Fprintf(&b, "| %d | %s | `%s` | %s | %s | %s | %s |\n", c.Position, markdownCell(c.Name), c.Type, nullable, markdownCell(def), columnKeys(t, c.Name), markdownCell(c.Comment))
+		}
+
+		if len(t.constraints) > 0 {
+			b.WriteString("\n### Constraints\n\n")
+			b.WriteString("| Name | Type | Definition |\n")
+			b.WriteString("| --- | --- | --- |\n")
+			for _, con := range t.constraints {
+				fmt.Fprintf(&b, "| %s | %s | `%s` |\n", markdownCell(con.name), con.kind, markdownCell(con.definition))
+			}
+		}
+
+		if len(t.foreignKeys) > 0 {
+			b.WriteString("\n### Foreign keys\n\n")
+			b.WriteString("| Name | Columns | References |\n")
+			b.WriteString("| --- | --- | --- |\n")
+			for _, fk := range t.foreignKeys {
+				fmt.Fprintf(&b, "| %s | %s | %s |\n", markdownCell(fk.Name), markdownCell(strings.Join(fk.Columns, ", ")), markdownCell(fkTarget(fk)))
+			}
+		}
+
+		if len(r.Indexes) > 0 {
+			b.WriteString("\n### Indexes\n\n")
+			b.WriteString("| Name | Method | Unique | Definition |\n")
+			b.WriteString("| --- | --- | --- | --- |\n")
+			for _, index := range r.Indexes {
+				unique := "no"
+				if index.Unique {
+					unique = "yes"
+				}
+				fmt.Fprintf(&b, "| %s | %s | %s | `%s` |\n", markdownCell(index.Name), index.Method, unique, markdownCell(index.Definition))
+			}
+		}
+	}
+
+	return b.String()
+}
+
+// markdownAnchor returns the anchor markdown renderers give a heading
+func markdownAnchor(heading string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(heading) {
+		switch {
+		case r == ' ':
+			b.WriteRune('-')
+		case r == '-' || r == '_' || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r > 127:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(text, "\n")
+	return line
+}
+
+// dictionaryPage is the layout of the html data dictionary, the index on the left
+// is filtered by the search box without any external scripts
+const dictionaryPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>%s data dictionary</title>
+<style>
+body { margin: 0; font: 14px/1.45 -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; color: #1f2328; display: flex; }
+nav { position: sticky; top: 0; height: 100vh; overflow: auto; width: 280px; flex: none; border-right: 1px solid #d0d7de; padding: 12px; box-sizing: border-box; background: #f6f8fa; }
+nav input { width: 100%%; padding: 6px 8px; box-sizing: border-box; margin-bottom: 8px; }
+nav a { display: block; padding: 2px 4px; color: #0969da; text-decoration: none; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; }
+nav .schema { font-weight: 600; margin-top: 10px; }
+main { padding: 16px 32px; flex: 1; min-width: 0; }
+table { border-collapse: collapse; margin: 8px 0 16px; }
+th, td { border: 1px solid #d0d7de; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #f6f8fa; }
+code { font-family: ui-monospace, Menlo, Consolas, monospace; font-size: 12px; }
+section { border-top: 1px solid #d0d7de; padding-top: 8px; }
+.meta { color: #656d76; }
+</style>
+</head>
+<body>
+<nav>
+<input id="search" type="search" placeholder="Search tables and columns">
+%s
+</nav>
+<main>
+<h1>%s</h1>
+<p class="meta">Generated %s.</p>
+%s
+</main>
+<script>
+document.getElementById('search').addEventListener('input', function (e) {
+  var q = e.target.value.toLowerCase();
+  document.querySelectorAll('nav a').forEach(function (a) {
+    var hit = !q || a.dataset.search.indexOf(q) >= 0;
+    a.style.display = hit ? '' : 'none';
+    document.getElementById(a.getAttribute('href').slice(1)).style.display = hit ? '' : 'none';
+  });
+});
+</script>
+</body>
+</html>
+`
+
+// renderDictionaryHTML renders all schemas as a single html page with a searchable index
+func renderDictionaryHTML(d *dictionary) string {
+	var nav, body strings.Builder
+	esc := html.EscapeString
+
+	for _, schema := range d.schemas {
+		fmt.Fprintf(&nav, "<div class=\"schema\">%s</div>\n", esc(schema))
+		fmt.Fprintf(&body, "<h2>Schema %s</h2>\n", esc(schema))
+
+		for _, t := range d.tables[schema] {
+			r := t.relation
+			id := "t-" + markdownAnchor(r.Schema+"-"+r.Name)
+
+			// The index is searched by table and column names
+			search := []string{r.Name, r.Comment}
+			for _, c := range r.Columns {
+				search = append(search, c.Name)
+			}
+			fmt.Fprintf(&nav, "<a href=\"#%s\" data-search=\"%s\">%s</a>\n", id, esc(strings.ToLower(strings.Join(search, " "))), esc(r.Name))
+
+			fmt.Fprintf(&body, "<section id=\"%s\">\n<h3>%s.%s</h3>\n", id, esc(r.Schema), esc(r.Name))
+			if r.Comment != "" {
+				fmt.Fprintf(&body, "<p>%s</p>\n", esc(r.Comment))
+			}
+			fmt.Fprintf(&body, "<p class=\"meta\">%s, %s rows (estimate), %s in total: table %s, indexes %s.</p>\n", esc(r.Kind), formatRows(t.rowEstimate), formatBytes(t.totalBytes), formatBytes(t.tableBytes), formatBytes(t.indexBytes))
+
+			body.WriteString("<table>\n<tr><th>#</th><th>Column</th><th>Type</th><th>Nullable</th><th>Default</th><th>Key</th><th>Description</th></tr>\n")
+			for _, c := range r.Columns {
+				nullable := "no"
+				if c.Nullable {
+					nullable = "yes"
+				}
+				fmt.Fprintf(&body, "<tr><td>%d</td><td>%s</td><td><code>%s</code></td><td>%s</td><td><code>%s</code></td><td>%s</td><td>%s</td></tr>\n", c.Position, esc(c.Name), esc(c.Type), nullable, esc(c.Default), columnKeys(t, c.Name), esc(c.Comment))
+			}
+			body.WriteString("</table>\n")
+
+			if len(t.constraints) > 0 {
+				body.WriteString("<h4>Constraints</h4>\n<table>\n<tr><th>Name</th><th>Type</th><th>Definition</th></tr>\n")
+				for _, con := range t.constraints {
+					fmt.Fprintf(&body, "<tr><td>%s</td><td>%s</td><td><code>%s</code></td></tr>\n", esc(con.name), esc(con.kind), esc(con.definition))
+				}
+				body.WriteString("</table>\n")
+			}
+
+			if len(t.foreignKeys) > 0 {
+				body.WriteString("<h4>Foreign keys</h4>\n<table>\n<tr><th>Name</th><th>Columns</th><th>References</th></tr>\n")
+				for _, fk := range t.foreignKeys {
+					target := "t-" + markdownAnchor(fk.RefSchema+"-"+fk.RefTable)
+					fmt.Fprintf(&body, "<tr><td>%s</td><td>%s</td><td><a href=\"#%s\">%s</a></td></tr>\n", esc(fk.Name), esc(strings.Join(fk.Columns, ", ")), target, esc(fkTarget(fk)))
+				}
+				body.WriteString("</table>\n")
+			}
+
+			if len(r.Indexes) > 0 {
+				body.WriteString("<h4>Indexes</h4>\n<table>\n<tr><th>Name</th><th>Method</th><th>Unique</th><th>Definition</th></tr>\n")
+				for _, index := range r.Indexes {
+					unique := "no"
+					if index.Unique {
+						unique = "yes"
+					}
+					fmt.Fprintf(&body, "<tr><td>%s</td><td>%s</td><td>%s</td><td><code>%s</code></td></tr>\n", esc(index.Name), esc(index.Method), unique, esc(index.Definition))
+				}
+				body.WriteString("</table>\n")
+			}
+
+			body.WriteString("</section>\n")
+		}
+	}
+
+	return fmt.Sprintf(dictionaryPage, esc(d.database), nav.String(), esc(d.database), d.generatedAt, body.String())
+}
+
+// ExportDataDictionary documents the tables and views of the pool's database into the
+// directory, as one markdown file per schema or a single index.html. An empty schema
+// documents all schemas. It returns the paths of the files written.
+func (c *Connections) ExportDataDictionary(activePoolID uuid.UUID, format, dir, schema string) ([]string, error) {
+	if strings.TrimSpace(dir) == "" {
+		return nil, errors.New("export directory is required")
+	}
+
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format != dictionaryMarkdown && format != dictionaryHTML {
+		return nil, errors.Errorf("unknown format %s, use markdown or html", format)
+	}
+
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+	_, dbName, _ := c.PM.Connection(activePoolID)
+
+	ctx := context.Background()
+
+	// Documentation has to match the server, not an older stored copy
+	if _, err := c.MC.Refresh(ctx, activePoolID); err != nil {
+		return nil, err
+	}
+	metadata, err := c.MC.Get(ctx, activePoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := loadDictionary(ctx, pool, metadata, dbName, strings.TrimSpace(schema))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "failed to create export directory")
+	}
+
+	var files []string
+	if format == dictionaryHTML {
+		path := filepath.Join(dir, "index.html")
+		if err := os.WriteFile(path, []byte(renderDictionaryHTML(d)), 0o644); err != nil {
+			return nil, errors.Wrap(err, "failed to write data dictionary")
+		}
+		return append(files, path), nil
+	}
+
+	for _, s := range d.schemas {
+		path := filepath.Join(dir, fileNameUnsafe.ReplaceAllString(s, "_")+".md")
+		if err := os.WriteFile(path, []byte(renderDictionaryMarkdown(d, s)), 0o644); err != nil {
+			return nil, errors.Wrap(err, "failed to write data dictionary")
+		}
+		files = append(files, path)
+	}
+
+	return files, nil
+}
@@ -0,0 +1,438 @@
+package app
+
+import (
+	"context"
+	"dbmx/model"
+	"fmt"
+	"html"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// ERD export formats
+const (
+	erdMermaid = "mermaid"
+	erdDOT     = "dot"
+	erdSVG     = "svg"
+)
+
+// Hops around the chosen table when none are given
+const defaultERDHops = 1
+
+// Characters mermaid doesn't allow in entity and attribute names
+var mermaidUnsafe = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// buildERD collects the tables and foreign keys of the diagram from the metadata
+func buildERD(metadata *model.SchemaMetadata, options model.ERDOptions) (*model.ERDGraph, error) {
+	graph := &model.ERDGraph{Options: options, Nodes: []model.ERDNode{}, Edges: []model.ERDEdge{}}
+
+	relations := make(map[string]*model.Relation)
+	for i := range metadata.Relations {
+		r := &metadata.Relations[i]
+		if r.Kind != "table" && r.Kind != "partitioned table" {
+			continue
+		}
+		if options.Schema != "" && r.Schema != options.Schema {
+			continue
+		}
+		relations[r.Schema+"."+r.Name] = r
+	}
+
+	var fks []model.ForeignKey
+	for _, fk := range metadata.ForeignKeys {
+		if relations[fk.Schema+"."+fk.Table] != nil && relations[fk.RefSchema+"."+fk.RefTable] != nil {
+			fks = append(fks, fk)
+		}
+	}
+
+	included := make(map[string]bool)
+	if options.Table == "" {
+		for id := range relations {
+			included[id] = true
+		}
+	} else {
+		table := options.Table
+		if options.Schema != "" && !strings.Contains(table, ".") {
+			table = options.Schema + "." + table
+		}
+
+		focus, err := tableRelation(metadata, table)
+		if err != nil {
+			return nil, err
+		}
+		start := focus.Schema + "." + focus.Name
+		if relations[start] == nil {
+			return nil, errors.Errorf("table %s is not in schema %s", options.Table, options.Schema)
+		}
+
+		hops := options.Hops
+		if hops <= 0 {
+			hops = defaultERDHops
+		}
+
+		// Walk the foreign keys in both directions
+		included[start] = true
+		frontier := []string{start}
+		for hop := 0; hop < hops && len(frontier) > 0; hop++ {
+			var next []string
+			for _, id := range frontier {
+				for _, fk := range fks {
+					child, parent := fk.Schema+"."+fk.Table, fk.RefSchema+"."+fk.RefTable
+					for _, neighbour := range []string{child, parent} {
+						if (child == id || parent == id) && !included[neighbour] {
+							included[neighbour] = true
+							next = append(next, neighbour)
+						}
+					}
+				}
+			}
+			frontier = next
+		}
+	}
+
+	ids := make([]string, 0, len(included))
+	for id := range included {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		r := relations[id]
+
+		primary := make(map[string]bool)
+		for _, column := range r.PrimaryKey {
+			primary[column] = true
+		}
+		foreign := make(map[string]bool)
+		for _, fk := range fks {
+			if fk.Schema == r.Schema && fk.Table == r.Name {
+				for _, column := range fk.Columns {
+					foreign[column] = true
+				}
+			}
+		}
+
+		node := model.ERDNode{ID: id, Schema: r.Schema, Name: r.Name, Kind: r.Kind, Columns: []model.ERDColumn{}}
+		for _, c := range r.Columns {
+			node.Columns = append(node.Columns, model.ERDColumn{
+				Name:       c.Name,
+				Type:       c.Type,
+				Nullable:   c.Nullable,
+				PrimaryKey: primary[c.Name],
+				ForeignKey: foreign[c.Name],
+			})
+		}
+		graph.Nodes = append(graph.Nodes, node)
+	}
+
+	for _, fk := range fks {
+		from, to := fk.Schema+"."+fk.Table, fk.RefSchema+"."+fk.RefTable
+		if !included[from] || !included[to] {
+			continue
+		}
+
+		edge := model.ERDEdge{Name: fk.Name, From: from, To: to, Columns: fk.Columns, RefColumns: fk.RefColumns}
+		child := relations[from]
+		for _, column := range fk.Columns {
+			for _, c := range child.Columns {
+				if c.Name == column && c.Nullable {
+					edge.Optional = true
+				}
+			}
+		}
+		graph.Edges = append(graph.Edges, edge)
+	}
+
+	return graph, nil
+}
+
+// mermaidName makes an entity or attribute name mermaid accepts
+func mermaidName(name string) string {
+	name = strings.Trim(mermaidUnsafe.ReplaceAllString(name, "_"), "_")
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// erdNodeName is the name a node is shown with, unqualified for the public schema
+func erdNodeName(node model.ERDNode) string {
+	return tabTableName(node.Schema, node.Name)
+}
+
+// renderMermaid renders the diagram as a mermaid erDiagram
+func renderMermaid(graph *model.ERDGraph) string {
+	var b strings.Builder
+	b.WriteString("erDiagram\n")
+
+	names := make(map[string]string, len(graph.Nodes))
+	for _, node := range graph.Nodes {
+		name := mermaidName(erdNodeName(node))
+		names[node.ID] = name
+
+		fmt.Fprintf(&b, "    %s {\n", name)
+		for _, c := range node.Columns {
+			var keys []string
+			if c.PrimaryKey {
+				keys = append(keys, "PK")
+			}
+			if c.ForeignKey {
+				keys = append(keys, "FK")
+			}
+			fmt.Fprintf(&b, "        %s %s", mermaidName(c.Type), mermaidName(c.Name))
+			if len(keys) > 0 {
+				fmt.Fprintf(&b, " %s", strings.Join(keys, ", "))
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("    }\n")
+	}
+
+	for _, edge := range graph.Edges {
+		parent := "||"
+		if edge.Optional {
+			parent = "|o"
+		}
+		fmt.Fprintf(&b, "    %s %s--o{ %s : %q\n", names[edge.To], parent, names[edge.From], edge.Name)
+	}
+
+	return b.String()
+}
+
+// renderDOT renders the diagram as a graphviz digraph with a table per node
+func renderDOT(graph *model.ERDGraph) string {
+	var b strings.Builder
+	b.WriteString("digraph erd {\n")
+	b.WriteString("    graph [rankdir=LR];\n")
+	b.WriteString("    node [shape=plain, fontname=\"Helvetica\", fontsize=10];\n")
+	b.WriteString("    edge [fontname=\"Helvetica\", fontsize=9, arrowhead=tee, arrowtail=crow, dir=both];\n\n")
+
+	ports := make(map[string]map[string]int, len(graph.Nodes))
+	for _, node := range graph.Nodes {
+		ports[node.ID] = make(map[string]int, len(node.Columns))
+
+		fmt.Fprintf(&b, "    %q [label=<<table border=\"0\" cellborder=\"1\" cellspacing=\"0\" cellpadding=\"4\">", node.ID)
+		fmt.Fprintf(&b, "<tr><td bgcolor=\"#dde4ee\"><b>%s</b></td></tr>", html.EscapeString(erdNodeName(node)))
+		for i, c := range node.Columns {
+			ports[node.ID][c.Name] = i
+			label := html.EscapeString(c.Name + " : " + c.Type)
+			if c.PrimaryKey {
+				label = "<u>" + label + "</u>"
+			}
+			if c.ForeignKey {
+				label = "<i>" + label + "</i>"
+			}
+			fmt.Fprintf(&b, "<tr><td port=\"c%d\" align=\"left\">%s</td></tr>", i, label)
+		}
+		b.WriteString("</table>>];\n")
+	}
+
+	if len(graph.Edges) > 0 {
+		b.WriteString("\n")
+	}
+	for _, edge := range graph.Edges {
+		from, to := "", ""
+		if len(edge.Columns) > 0 {
+			from = fmt.Sprintf(":c%d", ports[edge.From][edge.Columns[0]])
+		}
+		if len(edge.RefColumns) > 0 {
+			to = fmt.Sprintf(":c%d", ports[edge.To][edge.RefColumns[0]])
+		}
+		style := ""
+		if edge.Optional {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(&b, "    %q%s -> %q%s [label=%q%s];\n", edge.From, from, edge.To, to, edge.Name, style)
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Sizes of the svg layout in pixels
+const (
+	svgCharWidth   = 7
+	svgRowHeight   = 18
+	svgHeader      = 24
+	svgPadding     = 8
+	svgGap         = 60
+	svgMargin      = 20
+	svgMinBoxWidth = 120
+)
+
+// svgBox is the position of a node in the svg
+type svgBox struct {
+	x, y, width, height int
+}
+
+// renderSVG lays the tables out on a grid and draws the foreign keys as lines
+// from the key column to the referenced column, without any external resources
+func renderSVG(graph *model.ERDGraph) string {
+	n := len(graph.Nodes)
+	perRow := int(math.Ceil(math.Sqrt(float64(n))))
+	if perRow == 0 {
+		perRow = 1
+	}
+
+	boxes := make(map[string]svgBox, n)
+	rows := make(map[string]map[string]int, n)
+
+	// Column widths and row heights of the grid
+	colWidths := make([]int, perRow)
+	rowHeights := make([]int, (n+perRow-1)/perRow)
+	for i, node := range graph.Nodes {
+		width := len([]rune(erdNodeName(node)))
+		for _, c := range node.Columns {
+			width = max(width, len([]rune(c.Name+" : "+c.Type))+4)
+		}
+		width = max(width*svgCharWidth+2*svgPadding, svgMinBoxWidth)
+		height := svgHeader + len(node.Columns)*svgRowHeight + svgPadding
+
+		colWidths[i%perRow] = max(colWidths[i%perRow], width)
+		rowHeights[i/perRow] = max(rowHeights[i/perRow], height)
+		boxes[node.ID] = svgBox{width: width, height: height}
+	}
+
+	totalWidth, totalHeight := svgMargin, svgMargin
+	for _, w := range colWidths {
+		totalWidth += w + svgGap
+	}
+	for _, h := range rowHeights {
+		totalHeight += h + svgGap
+	}
+
+	for i, node := range graph.Nodes {
+		box := boxes[node.ID]
+		box.x = svgMargin
+		for col := 0; col < i%perRow; col++ {
+			box.x += colWidths[col] + svgGap
+		}
+		box.y = svgMargin
+		for row := 0; row < i/perRow; row++ {
+			box.y += rowHeights[row] + svgGap
+		}
+		boxes[node.ID] = box
+
+		rows[node.ID] = make(map[string]int, len(node.Columns))
+		for j, c := range node.Columns {
+			rows[node.ID][c.Name] = j
+		}
+	}
+
+	// y of the middle of a column row, or of the header if the column is unknown
+	rowY := func(id string, columns []string) int {
+		box := boxes[id]
+		if len(columns) > 0 {
+			if j, exists := rows[id][columns[0]]; exists {
+				return box.y + svgHeader + j*svgRowHeight + svgRowHeight/2 + 2
+			}
+		}
+		return box.y + svgHeader/2
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="Helvetica, Arial, sans-serif" font-size="12">`+"\n", totalWidth, totalHeight, totalWidth, totalHeight)
+	b.WriteString(`  <defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="8" markerHeight="8" orient="auto-start-reverse"><path d="M 0 0 L 10 5 L 0 10 z" fill="#55606e"/></marker></defs>` + "\n")
+	fmt.Fprintf(&b, `  <rect width="%d" height="%d" fill="#ffffff"/>`+"\n", totalWidth, totalHeight)
+
+	// Lines go below the boxes
+	for _, edge := range graph.Edges {
+		from, to := boxes[edge.From], boxes[edge.To]
+		y1, y2 := rowY(edge.From, edge.Columns), rowY(edge.To, edge.RefColumns)
+
+		// Leave from the side facing the parent
+		x1, x2 := from.x+from.width, to.x
+		if to.x+to.width/2 < from.x+from.width/2 {
+			x1, x2 = from.x, to.x+to.width
+		}
+
+		dash := ""
+		if edge.Optional {
+			dash = ` stroke-dasharray="5,3"`
+		}
+		fmt.Fprintf(&b, `  <path d="M %d %d C %d %d, %d %d, %d %d" fill="none" stroke="#55606e" stroke-width="1.2"%s marker-end="url(#arrow)"><title>%s</title></path>`+"\n",
+			x1, y1, (x1+x2)/2, y1, (x1+x2)/2, y2, x2, y2, dash, html.EscapeString(edge.Name))
+	}
+
+	for _, node := range graph.Nodes {
+		box := boxes[node.ID]
+		fmt.Fprintf(&b, `  <g>`+"\n")
+		fmt.Fprintf(&b, `    <rect x="%d" y="%d" width="%d" height="%d" rx="4" fill="#ffffff" stroke="#8a96a8"/>`+"\n", box.x, box.y, box.width, box.height)
+		fmt.Fprintf(&b, `    <rect x="%d" y="%d" width="%d" height="%d" rx="4" fill="#dde4ee" stroke="#8a96a8"/>`+"\n", box.x, box.y, box.width, svgHeader)
+		fmt.Fprintf(&b, `    <text x="%d" y="%d" font-weight="bold">%s</text>`+"\n", box.x+svgPadding, box.y+svgHeader-8, html.EscapeString(erdNodeName(node)))
+
+		for j, c := range node.Columns {
+			y := box.y + svgHeader + (j+1)*svgRowHeight - 4
+			style := ""
+			switch {
+			case c.PrimaryKey:
+				style = ` font-weight="bold"`
+			case c.ForeignKey:
+				style = ` font-style="italic"`
+			}
+			marker := ""
+			switch {
+			case c.PrimaryKey && c.ForeignKey:
+				marker = "PF "
+			case c.PrimaryKey:
+				marker = "PK "
+			case c.ForeignKey:
+				marker = "FK "
+			default:
+				marker = "   "
+			}
+			fmt.Fprintf(&b, `    <text x="%d" y="%d"%s xml:space="preserve"><tspan fill="#8a96a8">%s</tspan>%s <tspan fill="#55606e">%s</tspan></text>`+"\n",
+				box.x+svgPadding, y, style, marker, html.EscapeString(c.Name), html.EscapeString(c.Type))
+		}
+		b.WriteString("  </g>\n")
+	}
+
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+// GetERD returns the diagram of the pool's database limited by the options
+func (c *Connections) GetERD(activePoolID uuid.UUID, options model.ERDOptions) (*model.ERDGraph, error) {
+	metadata, err := c.MC.Get(context.Background(), activePoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildERD(metadata, options)
+}
+
+// ExportERD renders the diagram as mermaid, dot or svg. The result is written to the
+// file at path as well, unless path is empty.
+func (c *Connections) ExportERD(activePoolID uuid.UUID, options model.ERDOptions, format, path string) (string, error) {
+	graph, err := c.GetERD(activePoolID, options)
+	if err != nil {
+		return "", err
+	}
+
+	var output string
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case erdMermaid:
+		output = renderMermaid(graph)
+	case erdDOT:
+		output = renderDOT(graph)
+	case erdSVG:
+		output = renderSVG(graph)
+	default:
+		return "", errors.Errorf("unknown format %s, use mermaid, dot or svg", format)
+	}
+
+	if strings.TrimSpace(path) != "" {
+		err = os.WriteFile(path, []byte(output), 0o644)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to write export file")
+		}
+	}
+
+	return output, nil
+}
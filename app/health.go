@@ -0,0 +1,769 @@
+package app
+
+import (
+	"context"
+	"dbmx/model"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Severities of health findings, most severe first
+const (
+	severityCritical = "critical"
+	severityWarning  = "warning"
+	severityInfo     = "info"
+)
+
+var severityRank = map[string]int{
+	severityCritical: 0,
+	severityWarning:  1,
+	severityInfo:     2,
+}
+
+const (
+	// Bloat is reported once it is this large and this share of the relation
+	bloatMinBytes = 10 * 1024 * 1024
+	bloatMinRatio = 0.3
+
+	// Share of the sequence's range used before it is reported, and reported as critical
+	sequenceWarnRatio     = 0.75
+	sequenceCriticalRatio = 0.9
+
+	// Transaction age past which a table is reported as critical, about half of
+	// the 2^31 transactions after which the server stops accepting writes
+	wraparoundCriticalAge = 1_000_000_000
+
+	// Database cache hit ratio below which shared_buffers is reported as too small
+	cacheHitMinRatio = 0.99
+)
+
+// healthIndex is an index along with what's needed to compare it with the other indexes of its table
+type healthIndex struct {
+	usage   model.IndexUsage
+	primary bool
+	columns []string
+	// Column numbers and operator classes of the index, 0 for expressions
+	keys        []string
+	classes     []string
+	expressions string
+	predicate   string
+}
+
+// droppable reports if the index can be dropped without losing a constraint
+func (i *healthIndex) droppable() bool {
+	return !i.usage.Unique && !i.usage.Constraint && !i.primary
+}
+
+// healthName quotes a schema qualified name for the fix statements
+func healthName(schema, name string) string {
+	return quoteIdent(schema) + "." + quoteIdent(name)
+}
+
+// formatRatio formats a ratio between 0 and 1 as a percentage
+func formatRatio(ratio float64) string {
+	if ratio < 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%.1f%%", ratio*100)
+}
+
+// loadTableSizes reads the sizes of the tables with their bloat estimated from the
+// average column widths in pg_stats, assuming the default fillfactor
+func loadTableSizes(ctx context.Context, pool *pgxpool.Pool, blockSize int64) ([]model.TableSize, error) {
+	query := `
+		WITH widths AS (
+			SELECT s.schemaname, s.tablename, SUM((1 - s.null_frac) * s.avg_width) AS width
+			FROM pg_stats s
+			WHERE NOT s.inherited
+			GROUP BY s.schemaname, s.tablename
+		)
+		SELECT
+			n.nspname,
+			c.relname,
+			c.reltuples::bigint,
+			pg_relation_size(c.oid),
+			COALESCE(pg_total_relation_size(NULLIF(c.reltoastrelid, 0)), 0),
+			pg_indexes_size(c.oid),
+			pg_total_relation_size(c.oid),
+			CASE WHEN w.width IS NULL OR c.reltuples <= 0 THEN -1
+			ELSE GREATEST(c.relpages::bigint - CEIL(c.reltuples * (28 + w.width) / ($1::bigint - 24))::bigint, 0) * $1::bigint END
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN widths w ON w.schemaname = n.nspname AND w.tablename = c.relname
+		WHERE c.relkind IN ('r', 'm') AND ` + systemSchemaFilter + `
+		ORDER BY pg_total_relation_size(c.oid) DESC, n.nspname, c.relname
+	`
+	rows, err := pool.Query(ctx, query, blockSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read table sizes")
+	}
+	defer rows.Close()
+
+	tables := []model.TableSize{}
+	for rows.Next() {
+		var t model.TableSize
+		if err := rows.Scan(&t.Schema, &t.Name, &t.RowEstimate, &t.TableBytes, &t.ToastBytes, &t.IndexBytes, &t.TotalBytes, &t.BloatBytes); err != nil {
+			return nil, err
+		}
+		if t.RowEstimate < 0 {
+			t.RowEstimate = -1
+		}
+		tables = append(tables, t)
+	}
+
+	return tables, rows.Err()
+}
+
+// loadIndexes reads the indexes with their scans and, for btree indexes, bloat
+// estimated from the average width of their columns
+func loadIndexes(ctx context.Context, pool *pgxpool.Pool, blockSize int64) ([]*healthIndex, error) {
+	query := `
+		WITH widths AS (
+			SELECT i.indexrelid, SUM(s.avg_width) AS width, COUNT(*) AS known
+			FROM pg_index i
+			JOIN pg_class t ON t.oid = i.indrelid
+			JOIN pg_namespace n ON n.oid = t.relnamespace
+			JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+			JOIN pg_stats s ON s.schemaname = n.nspname AND s.tablename = t.relname AND s.attname = a.attname AND NOT s.inherited
+			GROUP BY i.indexrelid
+		)
+		SELECT
+			n.nspname,
+			t.relname,
+			ic.relname,
+			am.amname,
+			pg_relation_size(ic.oid),
+			COALESCE(st.idx_scan, 0),
+			CASE WHEN am.amname <> 'btree' OR i.indexprs IS NOT NULL OR w.width IS NULL OR w.known <> i.indnatts OR ic.reltuples <= 0 THEN -1
+			ELSE GREATEST(ic.relpages::bigint - 1 - CEIL(ic.reltuples * (12 + w.width) / (($1::bigint - 24) * 0.9))::bigint, 0) * $1::bigint END,
+			i.indisunique,
+			i.indisprimary,
+			EXISTS (SELECT 1 FROM pg_constraint con WHERE con.conindid = i.indexrelid),
+			ARRAY(
+				SELECT CASE WHEN k.attnum = 0 THEN 'expression' ELSE a.attname::text END
+				FROM unnest(string_to_array(i.indkey::text, ' ')::int2[]) WITH ORDINALITY k(attnum, ord)
+				LEFT JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+				ORDER BY k.ord
+			),
+			i.indkey::text,
+			i.indclass::text,
+			COALESCE(pg_get_expr(i.indexprs, i.indrelid), ''),
+			COALESCE(pg_get_expr(i.indpred, i.indrelid), '')
+		FROM pg_index i
+		JOIN pg_class ic ON ic.oid = i.indexrelid
+		JOIN pg_class t ON t.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		JOIN pg_am am ON am.oid = ic.relam
+		LEFT JOIN pg_stat_user_indexes st ON st.indexrelid = i.indexrelid
+		LEFT JOIN widths w ON w.indexrelid = i.indexrelid
+		WHERE ic.relkind = 'i' AND ` + systemSchemaFilter + `
+		ORDER BY pg_relation_size(ic.oid) DESC, n.nspname, t.relname, ic.relname
+	`
+	rows, err := pool.Query(ctx, query, blockSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read indexes")
+	}
+	defer rows.Close()
+
+	var indexes []*healthIndex
+	for rows.Next() {
+		var i healthIndex
+		var keys, classes string
+		u := &i.usage
+		if err := rows.Scan(&u.Schema, &u.Table, &u.Name, &u.Method, &u.Bytes, &u.Scans, &u.BloatBytes, &u.Unique, &i.primary, &u.Constraint, &i.columns, &keys, &classes, &i.expressions, &i.predicate); err != nil {
+			return nil, err
+		}
+		i.keys = strings.Fields(keys)
+		i.classes = strings.Fields(classes)
+		indexes = append(indexes, &i)
+	}
+
+	return indexes, rows.Err()
+}
+
+// isPrefix reports if the prefix matches the start of the values
+func isPrefix(prefix, values []string) bool {
+	if len(prefix) > len(values) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != values[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// indexFindings reports unused, bloated, duplicate and redundant indexes
+func indexFindings(indexes []*healthIndex) []model.HealthFinding {
+	var findings []model.HealthFinding
+
+	dropIndex := func(i *healthIndex) string {
+		return fmt.Sprintf("DROP INDEX CONCURRENTLY %s;", healthName(i.usage.Schema, i.usage.Name))
+	}
+
+	for _, i := range indexes {
+		u := i.usage
+		if u.Scans == 0 && i.droppable() {
+			severity := severityInfo
+			if u.Bytes >= bloatMinBytes {
+				severity = severityWarning
+			}
+			findings = append(findings, model.HealthFinding{
+				Category: "unused_index",
+				Severity: severity,
+				Object:   healthName(u.Schema, u.Name),
+				Detail:   fmt.Sprintf("Index on %s (%s) was never scanned since the statistics were last reset and takes %s", healthName(u.Schema, u.Table), strings.Join(i.columns, ", "), formatBytes(u.Bytes)),
+				Fix:      dropIndex(i),
+			})
+		}
+
+		if u.BloatBytes >= bloatMinBytes && float64(u.BloatBytes) >= bloatMinRatio*float64(u.Bytes) {
+			findings = append(findings, model.HealthFinding{
+				Category: "index_bloat",
+				Severity: severityWarning,
+				Object:   healthName(u.Schema, u.Name),
+				Detail:   fmt.Sprintf("About %s of the %s index is bloat", formatBytes(u.BloatBytes), formatBytes(u.Bytes)),
+				Fix:      fmt.Sprintf("REINDEX INDEX CONCURRENTLY %s;", healthName(u.Schema, u.Name)),
+			})
+		}
+	}
+
+	// Only indexes of the same table, method, expressions and predicate can cover each other
+	groups := make(map[string][]*healthIndex)
+	var groupKeys []string
+	for _, i := range indexes {
+		key := strings.Join([]string{i.usage.Schema, i.usage.Table, i.usage.Method, i.expressions, i.predicate}, "\x00")
+		if len(groups[key]) == 0 {
+			groupKeys = append(groupKeys, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	// Each index is reported once, as a duplicate before as redundant
+	reported := make(map[*healthIndex]bool)
+
+	for _, key := range groupKeys {
+		group := groups[key]
+		for x, a := range group {
+			for _, b := range group[x+1:] {
+				if len(a.keys) != len(b.keys) || !isPrefix(a.keys, b.keys) || !isPrefix(a.classes, b.classes) {
+					continue
+				}
+
+				// Drop the one which doesn't back a constraint, or is scanned less
+				drop, keep := b, a
+				if !b.droppable() || (a.droppable() && a.usage.Scans < b.usage.Scans) {
+					drop, keep = a, b
+				}
+				if !drop.droppable() || reported[drop] || reported[keep] {
+					continue
+				}
+				reported[drop] = true
+				findings = append(findings, model.HealthFinding{
+					Category: "duplicate_index",
+					Severity: severityWarning,
+					Object:   healthName(drop.usage.Schema, drop.usage.Name),
+					Detail:   fmt.Sprintf("Indexes the same columns (%s) of %s as %s", strings.Join(drop.columns, ", "), healthName(drop.usage.Schema, drop.usage.Table), keep.usage.Name),
+					Fix:      dropIndex(drop),
+				})
+			}
+		}
+	}
+
+	// A btree index on the leading columns of another is redundant
+	for _, key := range groupKeys {
+		group := groups[key]
+		for _, a := range group {
+			if reported[a] || a.usage.Method != "btree" || a.expressions != "" || !a.droppable() {
+				continue
+			}
+			for _, b := range group {
+				if reported[b] || len(a.keys) >= len(b.keys) || !isPrefix(a.keys, b.keys) || !isPrefix(a.classes, b.classes) {
+					continue
+				}
+				reported[a] = true
+				findings = append(findings, model.HealthFinding{
+					Category: "redundant_index",
+					Severity: severityInfo,
+					Object:   healthName(a.usage.Schema, a.usage.Name),
+					Detail:   fmt.Sprintf("Its columns (%s) lead %s (%s) on %s", strings.Join(a.columns, ", "), b.usage.Name, strings.Join(b.columns, ", "), healthName(a.usage.Schema, a.usage.Table)),
+					Fix:      dropIndex(a),
+				})
+				break
+			}
+		}
+	}
+
+	return findings
+}
+
+// tableFindings reports bloated tables
+func tableFindings(tables []model.TableSize) []model.HealthFinding {
+	var findings []model.HealthFinding
+	for _, t := range tables {
+		if t.BloatBytes >= bloatMinBytes && float64(t.BloatBytes) >= bloatMinRatio*float64(t.TableBytes) {
+			findings = append(findings, model.HealthFinding{
+				Category: "table_bloat",
+				Severity: severityWarning,
+				Object:   healthName(t.Schema, t.Name),
+				Detail:   fmt.Sprintf("About %s of the %s table is bloat, VACUUM FULL holds an ACCESS EXCLUSIVE lock while it rewrites the table", formatBytes(t.BloatBytes), formatBytes(t.TableBytes)),
+				Fix:      fmt.Sprintf("VACUUM FULL %s;", healthName(t.Schema, t.Name)),
+			})
+		}
+	}
+	return findings
+}
+
+// primaryKeyFindings reports tables without a primary key. A unique index on not null
+// columns is suggested as the key when there is one.
+func primaryKeyFindings(ctx context.Context, pool *pgxpool.Pool) ([]model.HealthFinding, error) {
+	query := `
+		SELECT
+			n.nspname,
+			c.relname,
+			COALESCE((
+				SELECT ic.relname
+				FROM pg_index i
+				JOIN pg_class ic ON ic.oid = i.indexrelid
+				JOIN pg_am am ON am.oid = ic.relam
+				WHERE i.indrelid = c.oid AND i.indisunique AND am.amname = 'btree'
+					AND i.indpred IS NULL AND i.indexprs IS NULL
+					AND NOT EXISTS (
+						SELECT 1 FROM pg_attribute a
+						WHERE a.attrelid = c.oid AND a.attnum = ANY(i.indkey) AND NOT a.attnotnull
+					)
+				ORDER BY ic.relname
+				LIMIT 1
+			), ''),
+			EXISTS (SELECT 1 FROM pg_attribute a WHERE a.attrelid = c.oid AND a.attname = 'id' AND NOT a.attisdropped)
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'r' AND NOT c.relispartition AND ` + systemSchemaFilter + `
+			AND NOT EXISTS (SELECT 1 FROM pg_constraint con WHERE con.conrelid = c.oid AND con.contype = 'p')
+		ORDER BY n.nspname, c.relname
+	`
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read tables without a primary key")
+	}
+	defer rows.Close()
+
+	var findings []model.HealthFinding
+	for rows.Next() {
+		var schema, table, index string
+		var hasID bool
+		if err := rows.Scan(&schema, &table, &index, &hasID); err != nil {
+			return nil, err
+		}
+
+		name := healthName(schema, table)
+		finding := model.HealthFinding{
+			Category: "missing_primary_key",
+			Severity: severityWarning,
+			Object:   name,
+			Detail:   "Table has no primary key, rows can't be told apart reliably and logical replication can't replicate its updates and deletes",
+		}
+		switch {
+		case index != "":
+			finding.Detail += fmt.Sprintf(", the unique index %s can become the key", index)
+			finding.Fix = fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s PRIMARY KEY USING INDEX %s;", name, quoteIdent(table+"_pkey"), quoteIdent(index))
+		case hasID:
+			finding.Fix = fmt.Sprintf("ALTER TABLE %s ADD PRIMARY KEY (id);", name)
+		default:
+			finding.Fix = fmt.Sprintf("ALTER TABLE %s ADD COLUMN id bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY;", name)
+		}
+		findings = append(findings, finding)
+	}
+
+	return findings, rows.Err()
+}
+
+// foreignKeyFindings reports foreign keys whose columns don't lead an index, deleting
+// or updating a referenced row then scans the whole referencing table
+func foreignKeyFindings(ctx context.Context, pool *pgxpool.Pool) ([]model.HealthFinding, error) {
+	query := `
+		SELECT
+			n.nspname,
+			c.relname,
+			con.conname,
+			ARRAY(
+				SELECT a.attname::text
+				FROM unnest(con.conkey) WITH ORDINALITY k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum
+				ORDER BY k.ord
+			),
+			pg_relation_size(c.oid)
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE con.contype = 'f' AND ` + systemSchemaFilter + `
+			AND NOT EXISTS (
+				SELECT 1 FROM pg_index i
+				WHERE i.indrelid = con.conrelid AND i.indpred IS NULL
+					AND (string_to_array(i.indkey::text, ' ')::int2[])[1:cardinality(con.conkey)] @> con.conkey
+			)
+		ORDER BY n.nspname, c.relname, con.conname
+	`
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read foreign keys without an index")
+	}
+	defer rows.Close()
+
+	var findings []model.HealthFinding
+	for rows.Next() {
+		var schema, table, constraint string
+		var columns []string
+		var bytes int64
+		if err := rows.Scan(&schema, &table, &constraint, &columns, &bytes); err != nil {
+			return nil, err
+		}
+
+		severity := severityInfo
+		if bytes >= bloatMinBytes {
+			severity = severityWarning
+		}
+		findings = append(findings, model.HealthFinding{
+			Category: "unindexed_foreign_key",
+			Severity: severity,
+			Object:   healthName(schema, table),
+			Detail:   fmt.Sprintf("No index leads with the columns (%s) of the foreign key %s, changes to the referenced rows scan the %s table", strings.Join(columns, ", "), constraint, formatBytes(bytes)),
+			Fix:      fmt.Sprintf("CREATE INDEX CONCURRENTLY ON %s (%s);", healthName(schema, table), quoteIdents(columns)),
+		})
+	}
+
+	return findings, rows.Err()
+}
+
+// sequenceFindings reports sequences which used most of their range, limited by the
+// type of the column they feed when it is narrower than the sequence
+func sequenceFindings(ctx context.Context, pool *pgxpool.Pool) ([]model.HealthFinding, error) {
+	query := `
+		SELECT
+			s.schemaname,
+			s.sequencename,
+			s.data_type::text,
+			s.last_value,
+			s.min_value,
+			s.max_value,
+			s.increment_by,
+			COALESCE(tn.nspname, ''),
+			COALESCE(t.relname, ''),
+			COALESCE(a.attname, ''),
+			COALESCE(format_type(a.atttypid, NULL), '')
+		FROM pg_sequences s
+		JOIN pg_namespace n ON n.nspname = s.schemaname
+		JOIN pg_class sc ON sc.relnamespace = n.oid AND sc.relname = s.sequencename
+		LEFT JOIN pg_depend d ON d.classid = 'pg_class'::regclass AND d.objid = sc.oid
+			AND d.refclassid = 'pg_class'::regclass AND d.deptype IN ('a', 'i')
+		LEFT JOIN pg_class t ON t.oid = d.refobjid
+		LEFT JOIN pg_namespace tn ON tn.oid = t.relnamespace
+		LEFT JOIN pg_attribute a ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+		WHERE s.last_value IS NOT NULL AND ` + systemSchemaFilter + `
+		ORDER BY s.schemaname, s.sequencename
+	`
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read sequences")
+	}
+	defer rows.Close()
+
+	columnLimits := map[string][2]int64{
+		"smallint": {math.MinInt16, math.MaxInt16},
+		"integer":  {math.MinInt32, math.MaxInt32},
+	}
+
+	var findings []model.HealthFinding
+	for rows.Next() {
+		var schema, sequence, dataType, tableSchema, table, column, columnType string
+		var last, min, max, increment int64
+		if err := rows.Scan(&schema, &sequence, &dataType, &last, &min, &max, &increment, &tableSchema, &table, &column, &columnType); err != nil {
+			return nil, err
+		}
+
+		// The column overflows before the sequence does
+		columnBound := false
+		if limits, narrow := columnLimits[columnType]; narrow {
+			if increment > 0 && limits[1] < max {
+				max, columnBound = limits[1], true
+			}
+			if increment < 0 && limits[0] > min {
+				min, columnBound = limits[0], true
+			}
+		}
+
+		var used float64
+		if increment > 0 {
+			used = (float64(last) - float64(min)) / (float64(max) - float64(min))
+		} else {
+			used = (float64(max) - float64(last)) / (float64(max) - float64(min))
+		}
+		if used < sequenceWarnRatio {
+			continue
+		}
+
+		severity := severityWarning
+		if used >= sequenceCriticalRatio {
+			severity = severityCritical
+		}
+
+		name := healthName(schema, sequence)
+		detail := fmt.Sprintf("Sequence used %s of its range, last value %d", formatRatio(used), last)
+		if columnBound {
+			detail += fmt.Sprintf(", limited by the %s column %s.%s", columnType, table, column)
+		}
+
+		var fixes []string
+		if columnBound {
+			fixes = append(fixes, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE bigint;", healthName(tableSchema, table), quoteIdent(column)))
+		}
+		switch {
+		case dataType != "bigint":
+			fixes = append(fixes, fmt.Sprintf("ALTER SEQUENCE %s AS bigint;", name))
+		case columnBound:
+		case increment > 0 && max < math.MaxInt64:
+			fixes = append(fixes, fmt.Sprintf("ALTER SEQUENCE %s MAXVALUE %d;", name, int64(math.MaxInt64)))
+		case increment < 0 && min > math.MinInt64:
+			fixes = append(fixes, fmt.Sprintf("ALTER SEQUENCE %s MINVALUE %d;", name, int64(math.MinInt64)))
+		default:
+			detail += ", it already spans the whole bigint range"
+		}
+
+		findings = append(findings, model.HealthFinding{
+			Category: "sequence_exhaustion",
+			Severity: severity,
+			Object:   name,
+			Detail:   detail,
+			Fix:      strings.Join(fixes, "\n"),
+		})
+	}
+
+	return findings, rows.Err()
+}
+
+// wraparoundFindings reports tables whose oldest unfrozen transaction is older than
+// autovacuum_freeze_max_age, autovacuum should have frozen them by then
+func wraparoundFindings(ctx context.Context, pool *pgxpool.Pool) ([]model.HealthFinding, error) {
+	query := `
+		SELECT n.nspname, c.relname, ages.age, current_setting('autovacuum_freeze_max_age')::bigint
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_class toast ON toast.oid = c.reltoastrelid
+		CROSS JOIN LATERAL (
+			SELECT GREATEST(age(c.relfrozenxid), COALESCE(age(toast.relfrozenxid), 0))::bigint AS age
+		) ages
+		WHERE c.relkind IN ('r', 'm') AND ` + systemSchemaFilter + `
+			AND ages.age > current_setting('autovacuum_freeze_max_age')::bigint
+		ORDER BY ages.age DESC
+	`
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read transaction ages")
+	}
+	defer rows.Close()
+
+	var findings []model.HealthFinding
+	for rows.Next() {
+		var schema, table string
+		var age, freezeMaxAge int64
+		if err := rows.Scan(&schema, &table, &age, &freezeMaxAge); err != nil {
+			return nil, err
+		}
+
+		severity := severityWarning
+		if age >= wraparoundCriticalAge {
+			severity = severityCritical
+		}
+		findings = append(findings, model.HealthFinding{
+			Category: "wraparound",
+			Severity: severity,
+			Object:   healthName(schema, table),
+			Detail:   fmt.Sprintf("Oldest unfrozen transaction is %d transactions old, past autovacuum_freeze_max_age of %d", age, freezeMaxAge),
+			Fix:      fmt.Sprintf("VACUUM (FREEZE) %s;", healthName(schema, table)),
+		})
+	}
+
+	return findings, rows.Err()
+}
+
+// buildHealthReport collects the sizes and findings of the pool's database
+func buildHealthReport(ctx context.Context, pool *pgxpool.Pool, database string) (*model.HealthReport, error) {
+	report := &model.HealthReport{
+		Database:    database,
+		GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+		Findings:    []model.HealthFinding{},
+	}
+
+	var blockSize, sharedBuffers int64
+	var statsReset *time.Time
+	query := `
+		SELECT
+			current_setting('block_size')::bigint,
+			pg_size_bytes(current_setting('shared_buffers')),
+			COALESCE((SELECT blks_hit::float8 / NULLIF(blks_hit + blks_read, 0) FROM pg_stat_database WHERE datname = current_database()), -1),
+			COALESCE((SELECT SUM(heap_blks_hit)::float8 / NULLIF(SUM(heap_blks_hit) + SUM(heap_blks_read), 0) FROM pg_statio_user_tables), -1),
+			COALESCE((SELECT SUM(idx_blks_hit)::float8 / NULLIF(SUM(idx_blks_hit) + SUM(idx_blks_read), 0) FROM pg_statio_user_indexes), -1),
+			(SELECT stats_reset FROM pg_stat_database WHERE datname = current_database())
+	`
+	err := pool.QueryRow(ctx, query).Scan(&blockSize, &sharedBuffers, &report.CacheHit.Database, &report.CacheHit.Tables, &report.CacheHit.Indexes, &statsReset)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read cache hit ratios")
+	}
+	if statsReset != nil {
+		report.StatsReset = statsReset.UTC().Format(time.RFC3339)
+	}
+
+	report.Tables, err = loadTableSizes(ctx, pool, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	report.Findings = append(report.Findings, tableFindings(report.Tables)...)
+
+	indexes, err := loadIndexes(ctx, pool, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	report.Indexes = []model.IndexUsage{}
+	for _, i := range indexes {
+		report.Indexes = append(report.Indexes, i.usage)
+	}
+	report.Findings = append(report.Findings, indexFindings(indexes)...)
+
+	for _, find := range []func(context.Context, *pgxpool.Pool) ([]model.HealthFinding, error){
+		primaryKeyFindings,
+		foreignKeyFindings,
+		sequenceFindings,
+		wraparoundFindings,
+	} {
+		findings, err := find(ctx, pool)
+		if err != nil {
+			return nil, err
+		}
+		report.Findings = append(report.Findings, findings...)
+	}
+
+	if ratio := report.CacheHit.Database; ratio >= 0 && ratio < cacheHitMinRatio {
+		report.Findings = append(report.Findings, model.HealthFinding{
+			Category: "cache_hit",
+			Severity: severityWarning,
+			Detail:   fmt.Sprintf("Only %s of the blocks read came from shared buffers (tables %s, indexes %s), shared_buffers is %s and takes effect after a restart", formatRatio(ratio), formatRatio(report.CacheHit.Tables), formatRatio(report.CacheHit.Indexes), formatBytes(sharedBuffers)),
+			Fix:      fmt.Sprintf("ALTER SYSTEM SET shared_buffers = '%dMB';", sharedBuffers*2/(1024*1024)),
+		})
+	}
+
+	sort.SliceStable(report.Findings, func(i, j int) bool {
+		return severityRank[report.Findings[i].Severity] < severityRank[report.Findings[j].Severity]
+	})
+
+	return report, nil
+}
+
+// renderHealthMarkdown renders the health report as a markdown document
+func renderHealthMarkdown(report *model.HealthReport) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# Health report for `%s`\n\n", report.Database)
+	fmt.Fprintf(&b, "Generated %s.", report.GeneratedAt)
+	if report.StatsReset != "" {
+		fmt.Fprintf(&b, " Statistics were last reset %s.", report.StatsReset)
+	}
+	b.WriteString("\n\n")
+
+	b.WriteString("## Findings\n\n")
+	if len(report.Findings) == 0 {
+		b.WriteString("Nothing found.\n")
+	} else {
+		b.WriteString("| Severity | Category | Object | Detail | Fix |\n")
+		b.WriteString("| --- | --- | --- | --- | --- |\n")
+		for _, f := range report.Findings {
+			fix := ""
+			if f.Fix != "" {
+				fix = "`" + f.Fix + "`"
+			}
+			fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n", f.Severity, f.Category, markdownCell(f.Object), markdownCell(f.Detail), markdownCell(fix))
+		}
+
+		// An index can be both unused and a duplicate, its fix is listed once
+		b.WriteString("\n### Suggested fixes\n\n```sql\n")
+		listed := make(map[string]bool)
+		for _, f := range report.Findings {
+			if f.Fix != "" && !listed[f.Fix] {
+				listed[f.Fix] = true
+				fmt.Fprintf(&b, "-- %s: %s\n%s\n", f.Category, f.Object, f.Fix)
+			}
+		}
+		b.WriteString("```\n")
+	}
+
+	b.WriteString("\n## Cache hit ratios\n\n")
+	b.WriteString("| Database | Tables | Indexes |\n")
+	b.WriteString("| --- | --- | --- |\n")
+	fmt.Fprintf(&b, "| %s | %s | %s |\n", formatRatio(report.CacheHit.Database), formatRatio(report.CacheHit.Tables), formatRatio(report.CacheHit.Indexes))
+
+	bloat := func(bytes int64) string {
+		if bytes < 0 {
+			return "unknown"
+		}
+		return formatBytes(bytes)
+	}
+
+	b.WriteString("\n## Tables\n\n")
+	b.WriteString("| Table | Rows (estimate) | Table | TOAST | Indexes | Total | Bloat (estimate) |\n")
+	b.WriteString("| --- | --- | --- | --- | --- | --- | --- |\n")
+	for _, t := range report.Tables {
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s | %s |\n", markdownCell(t.Schema+"."+t.Name), formatRows(t.RowEstimate), formatBytes(t.TableBytes), formatBytes(t.ToastBytes), formatBytes(t.IndexBytes), formatBytes(t.TotalBytes), bloat(t.BloatBytes))
+	}
+
+	b.WriteString("\n## Indexes\n\n")
+	b.WriteString("| Index | Table | Method | Size | Scans | Bloat (estimate) |\n")
+	b.WriteString("| --- | --- | --- | --- | --- | --- |\n")
+	for _, i := range report.Indexes {
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %d | %s |\n", markdownCell(i.Schema+"."+i.Name), markdownCell(i.Table), i.Method, formatBytes(i.Bytes), i.Scans, bloat(i.BloatBytes))
+	}
+
+	return b.String()
+}
+
+// GetHealthReport reports the storage of the pool's database and the problems found in
+// it, each with a statement to fix it
+func (c *Connections) GetHealthReport(activePoolID uuid.UUID) (*model.HealthReport, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+	_, dbName, _ := c.PM.Connection(activePoolID)
+
+	return buildHealthReport(context.Background(), pool, dbName)
+}
+
+// ExportHealthReport writes the health report of the pool's database as markdown to
+// the path and returns the path
+func (c *Connections) ExportHealthReport(activePoolID uuid.UUID, path string) (string, error) {
+	if strings.TrimSpace(path) == "" {
+		return "", errors.New("export path is required")
+	}
+
+	report, err := c.GetHealthReport(activePoolID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", errors.Wrap(err, "failed to create export directory")
+	}
+	if err := os.WriteFile(path, []byte(renderHealthMarkdown(report)), 0o644); err != nil {
+		return "", errors.Wrap(err, "failed to write health report")
+	}
+
+	return path, nil
+}
@@ -0,0 +1,168 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+
+	"dbmx/model"
+)
+
+func TestIndexFindings(t *testing.T) {
+	const mb = 1024 * 1024
+
+	// index builds a btree index of app.orders on the numbered columns, scanned once
+	index := func(name string, keys ...string) *healthIndex {
+		classes := make([]string, len(keys))
+		for i := range classes {
+			classes[i] = "1978"
+		}
+		return &healthIndex{
+			usage:   model.IndexUsage{Schema: "app", Table: "orders", Name: name, Method: "btree", Bytes: mb, Scans: 1},
+			columns: keys,
+			keys:    keys,
+			classes: classes,
+		}
+	}
+	with := func(i *healthIndex, change func(i *healthIndex)) *healthIndex {
+		change(i)
+		return i
+	}
+
+	type finding struct {
+		category string
+		severity string
+		object   string
+		fix      string
+	}
+
+	tests := []struct {
+		name    string
+		indexes []*healthIndex
+		want    []finding
+	}{
+		{"healthy", []*healthIndex{index("a", "1"), index("b", "2")}, nil},
+		{
+			"unused",
+			[]*healthIndex{
+				with(index("small", "1"), func(i *healthIndex) { i.usage.Scans = 0 }),
+				with(index("large", "2"), func(i *healthIndex) { i.usage.Scans, i.usage.Bytes = 0, 20*mb }),
+				with(index("unique", "3"), func(i *healthIndex) { i.usage.Scans, i.usage.Unique = 0, true }),
+				with(index("pkey", "4"), func(i *healthIndex) { i.usage.Scans, i.primary = 0, true }),
+			},
+			[]finding{
+				{"unused_index", severityInfo, "app.small", "DROP INDEX CONCURRENTLY app.small;"},
+				{"unused_index", severityWarning, "app.large", "DROP INDEX CONCURRENTLY app.large;"},
+			},
+		},
+		{
+			"bloat",
+			[]*healthIndex{
+				with(index("bloated", "1"), func(i *healthIndex) { i.usage.Bytes, i.usage.BloatBytes = 40*mb, 20*mb }),
+				with(index("large", "2"), func(i *healthIndex) { i.usage.Bytes, i.usage.BloatBytes = 100*mb, 20*mb }),
+				with(index("small", "3"), func(i *healthIndex) { i.usage.Bytes, i.usage.BloatBytes = 2*mb, mb }),
+			},
+			[]finding{
+				{"index_bloat", severityWarning, "app.bloated", "REINDEX INDEX CONCURRENTLY app.bloated;"},
+			},
+		},
+		{
+			"duplicate scanned less",
+			[]*healthIndex{
+				with(index("a", "1", "2"), func(i *healthIndex) { i.usage.Scans = 10 }),
+				index("b", "1", "2"),
+			},
+			[]finding{
+				{"duplicate_index", severityWarning, "app.b", "DROP INDEX CONCURRENTLY app.b;"},
+			},
+		},
+		{
+			"duplicate of a constraint",
+			[]*healthIndex{
+				with(index("a", "1"), func(i *healthIndex) { i.usage.Scans = 10 }),
+				with(index("b", "1"), func(i *healthIndex) { i.usage.Constraint = true }),
+			},
+			[]finding{
+				{"duplicate_index", severityWarning, "app.a", "DROP INDEX CONCURRENTLY app.a;"},
+			},
+		},
+		{
+			"duplicate constraints",
+			[]*healthIndex{
+				with(index("a", "1"), func(i *healthIndex) { i.usage.Unique = true }),
+				with(index("b", "1"), func(i *healthIndex) { i.usage.Constraint = true }),
+			},
+			nil,
+		},
+		{
+			"other operator class",
+			[]*healthIndex{
+				index("a", "1"),
+				with(index("b", "1"), func(i *healthIndex) { i.classes = []string{"3128"} }),
+			},
+			nil,
+		},
+		{
+			"redundant",
+			[]*healthIndex{index("a", "1"), index("b", "1", "2")},
+			[]finding{
+				{"redundant_index", severityInfo, "app.a", "DROP INDEX CONCURRENTLY app.a;"},
+			},
+		},
+		{
+			"not leading",
+			[]*healthIndex{index("a", "2"), index("b", "1", "2")},
+			nil,
+		},
+		{
+			"redundant of another method",
+			[]*healthIndex{
+				with(index("a", "1"), func(i *healthIndex) { i.usage.Method = "hash" }),
+				with(index("b", "1", "2"), func(i *healthIndex) { i.usage.Method = "hash" }),
+			},
+			nil,
+		},
+		{
+			"redundant with another predicate",
+			[]*healthIndex{
+				index("a", "1"),
+				with(index("b", "1", "2"), func(i *healthIndex) { i.predicate = "(deleted IS NULL)" }),
+			},
+			nil,
+		},
+		{
+			"redundant on another table",
+			[]*healthIndex{
+				index("a", "1"),
+				with(index("b", "1", "2"), func(i *healthIndex) { i.usage.Table = "items" }),
+			},
+			nil,
+		},
+		{
+			"duplicate of a redundant index",
+			[]*healthIndex{
+				with(index("a", "1"), func(i *healthIndex) { i.usage.Scans = 10 }),
+				index("b", "1"),
+				index("c", "1", "2"),
+			},
+			[]finding{
+				{"duplicate_index", severityWarning, "app.b", "DROP INDEX CONCURRENTLY app.b;"},
+				{"redundant_index", severityInfo, "app.a", "DROP INDEX CONCURRENTLY app.a;"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []finding
+			for _, f := range indexFindings(tt.indexes) {
+				if f.Detail == "" {
+					t.Errorf("%s of %s has no detail", f.Category, f.Object)
+				}
+				got = append(got, finding{f.Category, f.Severity, f.Object, f.Fix})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("indexFindings() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
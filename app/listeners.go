@@ -0,0 +1,431 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"dbmx/model"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Events emitted to the frontend by listen tabs
+const (
+	NotificationEvent  = "listen:notification"
+	ListenerStateEvent = "listen:state"
+)
+
+// Notifications kept per tab, the oldest are dropped once the buffer is full
+const listenBufferSize = 1000
+
+// tabListener is the dedicated connection of a listen tab. The connection waits for
+// notifications in the background, the wait is stopped whenever the connection has to
+// run LISTEN or UNLISTEN.
+type tabListener struct {
+	tabID  int64
+	poolID uuid.UUID
+	conn   *pgxpool.Conn
+
+	// Serialises the commands run on the connection
+	cmdMu sync.Mutex
+	// Stops the wait and is closed once the wait returned
+	stop    context.CancelFunc
+	waiting chan struct{}
+
+	// Guards the fields below, which the wait writes to
+	mu       sync.Mutex
+	channels map[string]struct{}
+	buffer   []model.Notification
+	next     int
+	dropped  int64
+	err      string
+}
+
+// ListenerManager keeps the listeners of the listen tabs, at most one per tab
+type ListenerManager struct {
+	PM *PoolManager
+
+	listeners map[int64]*tabListener
+	mu        sync.Mutex
+}
+
+func NewListenerManager(pm *PoolManager) *ListenerManager {
+	return &ListenerManager{
+		PM:        pm,
+		listeners: make(map[int64]*tabListener),
+	}
+}
+
+// prettyPayload indents the payload when it is JSON
+func prettyPayload(payload string) string {
+	if !json.Valid([]byte(payload)) {
+		return ""
+	}
+	var b bytes.Buffer
+	if err := json.Indent(&b, []byte(payload), "", "  "); err != nil {
+		return ""
+	}
+	return b.String()
+}
+
+// push adds a notification to the ring buffer
+func (tl *tabListener) push(n model.Notification) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if len(tl.buffer) < listenBufferSize {
+		tl.buffer = append(tl.buffer, n)
+		return
+	}
+	tl.buffer[tl.next] = n
+	tl.next = (tl.next + 1) % listenBufferSize
+	tl.dropped++
+}
+
+// state returns the channels and the buffered notifications, oldest first
+func (tl *tabListener) state() model.ListenerState {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	state := model.ListenerState{
+		TabID:         tl.tabID,
+		PoolID:        tl.poolID.String(),
+		Channels:      []string{},
+		Notifications: make([]model.Notification, 0, len(tl.buffer)),
+		Dropped:       tl.dropped,
+		Error:         tl.err,
+	}
+	for channel := range tl.channels {
+		state.Channels = append(state.Channels, channel)
+	}
+	sort.Strings(state.Channels)
+	state.Notifications = append(state.Notifications, tl.buffer[tl.next:]...)
+	state.Notifications = append(state.Notifications, tl.buffer[:tl.next]...)
+
+	return state
+}
+
+// resume waits for notifications in the background until paused
+func (lm *ListenerManager) resume(tl *tabListener) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tl.stop = cancel
+	tl.waiting = make(chan struct{})
+	go lm.wait(ctx, tl, tl.waiting)
+}
+
+// pause stops the wait so the connection can run a command
+func (tl *tabListener) pause() {
+	if tl.stop == nil {
+		return
+	}
+	tl.stop()
+	<-tl.waiting
+	tl.stop = nil
+}
+
+// wait emits the notifications received by the connection until the wait is stopped
+// or the connection is lost
+func (lm *ListenerManager) wait(ctx context.Context, tl *tabListener, waiting chan struct{}) {
+	defer close(waiting)
+
+	for {
+		n, err := tl.conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			tl.mu.Lock()
+			tl.err = err.Error()
+			tl.mu.Unlock()
+			lm.PM.emit(ListenerStateEvent, tl.state())
+			return
+		}
+
+		notification := model.Notification{
+			TabID:      tl.tabID,
+			Channel:    n.Channel,
+			Payload:    n.Payload,
+			Pretty:     prettyPayload(n.Payload),
+			PID:        n.PID,
+			ReceivedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		}
+		tl.push(notification)
+		lm.PM.emit(NotificationEvent, notification)
+	}
+}
+
+// run runs a command on the listener's connection while the wait is paused
+func (lm *ListenerManager) run(tl *tabListener, command string) error {
+	tl.cmdMu.Lock()
+	defer tl.cmdMu.Unlock()
+
+	tl.pause()
+	defer lm.resume(tl)
+
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	_, err := tl.conn.Exec(ctx, command)
+	return err
+}
+
+// Listen subscribes the tab to the channels, acquiring a connection from the pool for
+// the tab's first channels
+func (lm *ListenerManager) Listen(ctx context.Context, pool *pgxpool.Pool, poolID uuid.UUID, tabID int64, channels []string) (model.ListenerState, error) {
+	lm.mu.Lock()
+	tl, exists := lm.listeners[tabID]
+	lm.mu.Unlock()
+
+	// A tab listens on one pool, and a lost connection is replaced
+	if exists && (tl.poolID != poolID || tl.state().Error != "") {
+		lm.Close(tabID)
+		exists = false
+	}
+
+	if !exists {
+		conn, err := acquireConn(ctx, pool)
+		if err != nil {
+			return model.ListenerState{}, err
+		}
+		tl = &tabListener{
+			tabID:    tabID,
+			poolID:   poolID,
+			conn:     conn,
+			channels: make(map[string]struct{}),
+		}
+
+		// A concurrent call for the tab may have set up its listener meanwhile, the
+		// one registered first is kept and the other connection goes back
+		lm.mu.Lock()
+		if current, registered := lm.listeners[tabID]; registered {
+			tl, exists = current, true
+		} else {
+			lm.listeners[tabID] = tl
+		}
+		lm.mu.Unlock()
+
+		if exists {
+			conn.Release()
+		}
+	}
+
+	var statements []string
+	for _, channel := range channels {
+		statements = append(statements, "LISTEN "+quoteIdent(channel))
+	}
+	if err := lm.run(tl, strings.Join(statements, "; ")); err != nil {
+		if !exists {
+			lm.Close(tabID)
+		}
+		return model.ListenerState{}, err
+	}
+
+	tl.mu.Lock()
+	for _, channel := range channels {
+		tl.channels[channel] = struct{}{}
+	}
+	tl.mu.Unlock()
+
+	return tl.state(), nil
+}
+
+// Unlisten unsubscribes the tab from the channels, or from every channel when none
+// are given. The connection is kept until the tab is closed.
+func (lm *ListenerManager) Unlisten(tabID int64, channels []string) (model.ListenerState, error) {
+	lm.mu.Lock()
+	tl, exists := lm.listeners[tabID]
+	lm.mu.Unlock()
+	if !exists {
+		return model.ListenerState{}, errors.New("tab isn't listening")
+	}
+
+	command := "UNLISTEN *"
+	if len(channels) > 0 {
+		var statements []string
+		for _, channel := range channels {
+			statements = append(statements, "UNLISTEN "+quoteIdent(channel))
+		}
+		command = strings.Join(statements, "; ")
+	}
+	if err := lm.run(tl, command); err != nil {
+		return model.ListenerState{}, err
+	}
+
+	tl.mu.Lock()
+	if len(channels) == 0 {
+		tl.channels = make(map[string]struct{})
+	}
+	for _, channel := range channels {
+		delete(tl.channels, channel)
+	}
+	tl.mu.Unlock()
+
+	return tl.state(), nil
+}
+
+// State returns the channels and notifications of the tab's listener
+func (lm *ListenerManager) State(tabID int64) (model.ListenerState, bool) {
+	lm.mu.Lock()
+	tl, exists := lm.listeners[tabID]
+	lm.mu.Unlock()
+	if !exists {
+		return model.ListenerState{}, false
+	}
+	return tl.state(), true
+}
+
+// Close unsubscribes the tab's connection from every channel and releases it to its pool
+func (lm *ListenerManager) Close(tabID int64) {
+	lm.mu.Lock()
+	tl, exists := lm.listeners[tabID]
+	delete(lm.listeners, tabID)
+	lm.mu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	tl.cmdMu.Lock()
+	defer tl.cmdMu.Unlock()
+	tl.pause()
+
+	// A pooled connection must not keep receiving the tab's notifications
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	if _, err := tl.conn.Exec(ctx, "UNLISTEN *"); err != nil {
+		// The connection can't be trusted anymore, the pool drops it instead of reusing it
+		_ = tl.conn.Conn().Close(ctx)
+	}
+	tl.conn.Release()
+}
+
+// CloseForPool closes the listeners of the pool, needed before the pool is closed
+// since closing a pool waits for its connections to be released
+func (lm *ListenerManager) CloseForPool(poolID uuid.UUID) {
+	lm.mu.Lock()
+	var tabIDs []int64
+	for tabID, tl := range lm.listeners {
+		if tl.poolID == poolID {
+			tabIDs = append(tabIDs, tabID)
+		}
+	}
+	lm.mu.Unlock()
+
+	for _, tabID := range tabIDs {
+		lm.Close(tabID)
+	}
+}
+
+// CloseAll closes every listener
+func (lm *ListenerManager) CloseAll() {
+	lm.mu.Lock()
+	var tabIDs []int64
+	for tabID := range lm.listeners {
+		tabIDs = append(tabIDs, tabID)
+	}
+	lm.mu.Unlock()
+
+	for _, tabID := range tabIDs {
+		lm.Close(tabID)
+	}
+}
+
+// saveChannels keeps the channels of a listen tab as its editor content so that the
+// tab can listen again once reopened
+func (c *Connections) saveChannels(state model.ListenerState) error {
+	channelsJSON, err := json.Marshal(state.Channels)
+	if err != nil {
+		return err
+	}
+	_, err = c.DB.Exec("UPDATE tabs SET editor = ? WHERE id = ? AND type = 'listen'", string(channelsJSON), state.TabID)
+	return err
+}
+
+// ListenChannels subscribes a listen tab to the channels. Notifications are emitted with
+// the listen:notification event, and listen:state when the connection is lost.
+func (c *Connections) ListenChannels(activePoolID uuid.UUID, tabID int64, channels []string) (*model.ListenerState, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	var names []string
+	for _, channel := range channels {
+		if channel = strings.TrimSpace(channel); channel != "" {
+			names = append(names, channel)
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("at least one channel is required")
+	}
+
+	state, err := c.LM.Listen(context.Background(), pool, activePoolID, tabID, names)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.saveChannels(state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// UnlistenChannels unsubscribes a listen tab from the channels, or from all of them
+// when none are given
+func (c *Connections) UnlistenChannels(tabID int64, channels []string) (*model.ListenerState, error) {
+	state, err := c.LM.Unlisten(tabID, channels)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.saveChannels(state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// GetListener returns the channels of a listen tab and the notifications it received
+func (c *Connections) GetListener(tabID int64) (*model.ListenerState, error) {
+	state, exists := c.LM.State(tabID)
+	if !exists {
+		return nil, errors.New("tab isn't listening")
+	}
+	return &state, nil
+}
+
+// CloseListener stops a listen tab's listener and releases its connection
+func (c *Connections) CloseListener(tabID int64) {
+	c.LM.Close(tabID)
+}
+
+// SendNotification sends a test notification on the channel through the pool
+func (c *Connections) SendNotification(activePoolID uuid.UUID, channel, payload string) (bool, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return false, errors.New("pool doesn't exist")
+	}
+
+	channel = strings.TrimSpace(channel)
+	if channel == "" {
+		return false, errors.New("channel is required")
+	}
+
+	started := time.Now()
+	_, err := pool.Exec(context.Background(), "SELECT pg_notify($1, $2)", channel, payload)
+
+	statement := fmt.Sprintf("SELECT pg_notify(%s, %s)", quoteLiteral(channel), quoteLiteral(payload))
+	if err != nil {
+		c.audit(activePoolID, statement, started, 0, auditError, err)
+		return false, err
+	}
+	c.audit(activePoolID, statement, started, 0, auditSuccess, nil)
+
+	return true, nil
+}
@@ -0,0 +1,350 @@
+package app
+
+import (
+	"context"
+	"dbmx/model"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Seconds a session can stay idle in a transaction while holding locks before it's flagged
+const idleInTransactionLimit = 60
+
+// Backend signals a blocker can be sent, and the function sending them
+var backendSignals = map[string]string{
+	"cancel":    "pg_cancel_backend",
+	"terminate": "pg_terminate_backend",
+}
+
+// heldLock is a row of pg_locks
+type heldLock struct {
+	pid int32
+	model.SessionLock
+}
+
+// ownLock reports if the lock is the one every transaction holds on its own id, which
+// only matters when another session waits for it
+func ownLock(l model.SessionLock) bool {
+	return l.Granted && (l.LockType == "virtualxid" || l.LockType == "transactionid")
+}
+
+// loadLocks reads the locks of every session but the pool's own. Relations of other
+// databases can't be named from this one.
+func loadLocks(ctx context.Context, pool *pgxpool.Pool) ([]heldLock, error) {
+	query := `
+		SELECT
+			l.pid,
+			l.locktype,
+			l.mode,
+			l.granted,
+			CASE
+				WHEN l.relation IS NOT NULL THEN
+					CASE WHEN l.database IN (0, d.oid) THEN l.relation::regclass::text ELSE format('relation %s of %s', l.relation, COALESCE(od.datname, l.database::text)) END ||
+					CASE l.locktype WHEN 'tuple' THEN format(' tuple (%s,%s)', l.page, l.tuple) WHEN 'page' THEN format(' page %s', l.page) ELSE '' END
+				WHEN l.locktype = 'transactionid' THEN 'transaction ' || l.transactionid
+				WHEN l.locktype = 'virtualxid' THEN 'virtual transaction ' || l.virtualxid
+				ELSE concat_ws(' ', l.locktype, l.classid, l.objid, l.objsubid)
+			END
+		FROM pg_locks l
+		CROSS JOIN (SELECT oid FROM pg_database WHERE datname = current_database()) d
+		LEFT JOIN pg_database od ON od.oid = l.database
+		WHERE l.pid IS NOT NULL AND l.pid <> pg_backend_pid()
+		ORDER BY l.pid, l.granted, 5
+	`
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read pg_locks")
+	}
+	defer rows.Close()
+
+	var locks []heldLock
+	for rows.Next() {
+		var l heldLock
+		if err := rows.Scan(&l.pid, &l.LockType, &l.Mode, &l.Granted, &l.Object); err != nil {
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+
+	return locks, rows.Err()
+}
+
+// loadLockSessions reads the sessions of the server along with the sessions blocking
+// the ones waiting for a lock
+func loadLockSessions(ctx context.Context, pool *pgxpool.Pool) ([]model.LockSession, error) {
+	query := `
+		SELECT
+			a.pid,
+			COALESCE(a.usename, ''),
+			COALESCE(a.datname, ''),
+			COALESCE(a.application_name, ''),
+			COALESCE(a.client_addr::text, ''),
+			COALESCE(a.backend_type, ''),
+			COALESCE(a.backend_start::text, ''),
+			COALESCE(a.state, ''),
+			COALESCE(a.wait_event_type || ': ' || a.wait_event, ''),
+			COALESCE(a.query, ''),
+			COALESCE(EXTRACT(EPOCH FROM now() - a.xact_start)::float8, -1),
+			COALESCE(EXTRACT(EPOCH FROM now() - a.state_change)::float8, -1),
+			CASE WHEN a.wait_event_type = 'Lock' THEN pg_blocking_pids(a.pid) ELSE '{}'::int[] END
+		FROM pg_stat_activity a
+		WHERE a.pid <> pg_backend_pid()
+	`
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read pg_stat_activity")
+	}
+	defer rows.Close()
+
+	var sessions []model.LockSession
+	for rows.Next() {
+		var s model.LockSession
+		err := rows.Scan(&s.PID, &s.User, &s.Database, &s.ApplicationName, &s.ClientAddr, &s.BackendType, &s.BackendStart, &s.State, &s.WaitEvent, &s.Query, &s.TransactionSeconds, &s.StateSeconds, &s.BlockedBy)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+// countBlocked counts the sessions waiting for the session directly or through others
+func countBlocked(pid int32, byPID map[int32]*model.LockSession) int {
+	seen := map[int32]bool{pid: true}
+	stack := []int32{pid}
+	for len(stack) > 0 {
+		s := byPID[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		for _, waiter := range s.Blocking {
+			if !seen[waiter] {
+				seen[waiter] = true
+				stack = append(stack, waiter)
+			}
+		}
+	}
+	return len(seen) - 1
+}
+
+// buildLockGraph links the waiting sessions to their blockers and suggests the root
+// blockers to act on. Sessions waiting in a cycle have no root blocker, the server's
+// deadlock detection cancels one of them.
+func buildLockGraph(sessions []model.LockSession, locks []heldLock) *model.LockGraph {
+	graph := &model.LockGraph{
+		GeneratedAt:       time.Now().UTC().Format(time.RFC3339),
+		Sessions:          []model.LockSession{},
+		Waits:             []model.LockWait{},
+		RootBlockers:      []int32{},
+		IdleInTransaction: []int32{},
+		Suggestions:       []model.LockAction{},
+	}
+
+	byPID := make(map[int32]*model.LockSession, len(sessions))
+	for i := range sessions {
+		byPID[sessions[i].PID] = &sessions[i]
+	}
+	locksByPID := make(map[int32][]model.SessionLock)
+	for _, l := range locks {
+		locksByPID[l.pid] = append(locksByPID[l.pid], l.SessionLock)
+	}
+
+	involved := make(map[int32]bool)
+	order := make([]int32, 0, len(sessions))
+	for i := range sessions {
+		s := &sessions[i]
+		order = append(order, s.PID)
+		if len(s.BlockedBy) == 0 {
+			continue
+		}
+
+		// A session waits for one lock at a time
+		var wait model.SessionLock
+		for _, l := range locksByPID[s.PID] {
+			if !l.Granted {
+				wait = l
+				break
+			}
+		}
+
+		for _, blocker := range s.BlockedBy {
+			b, exists := byPID[blocker]
+			if !exists {
+				// Prepared transactions hold locks without a session, reported as pid 0
+				state := "unknown"
+				if blocker == 0 {
+					state = "prepared transaction"
+				}
+				b = &model.LockSession{PID: blocker, State: state, TransactionSeconds: -1, StateSeconds: -1}
+				byPID[blocker] = b
+				order = append(order, blocker)
+			}
+			b.Blocking = append(b.Blocking, s.PID)
+
+			edge := model.LockWait{Waiter: s.PID, Blocker: blocker, Object: wait.Object, WaitMode: wait.Mode}
+			for _, l := range locksByPID[blocker] {
+				if l.Granted && l.Object == wait.Object {
+					edge.BlockerMode = l.Mode
+					break
+				}
+			}
+			graph.Waits = append(graph.Waits, edge)
+			involved[s.PID], involved[blocker] = true, true
+		}
+	}
+
+	for _, pid := range order {
+		s := byPID[pid]
+		for _, l := range locksByPID[pid] {
+			if !ownLock(l) {
+				s.Locks = append(s.Locks, l)
+			}
+		}
+
+		s.RootBlocker = len(s.Blocking) > 0 && len(s.BlockedBy) == 0
+		if len(s.Blocking) > 0 {
+			s.BlockedCount = countBlocked(pid, byPID)
+		}
+
+		s.IdleInTransaction = strings.HasPrefix(s.State, "idle in transaction") && s.StateSeconds >= idleInTransactionLimit && len(s.Locks) > 0
+		if s.IdleInTransaction {
+			graph.IdleInTransaction = append(graph.IdleInTransaction, pid)
+			involved[pid] = true
+		}
+
+		if !involved[pid] {
+			continue
+		}
+		if s.BlockedBy == nil {
+			s.BlockedBy = []int32{}
+		}
+		if s.Blocking == nil {
+			s.Blocking = []int32{}
+		}
+		if s.Locks == nil {
+			s.Locks = []model.SessionLock{}
+		}
+		graph.Sessions = append(graph.Sessions, *s)
+
+		if !s.RootBlocker {
+			continue
+		}
+		graph.RootBlockers = append(graph.RootBlockers, pid)
+
+		// A prepared transaction has no backend, it has to be committed or rolled back
+		if pid == 0 {
+			continue
+		}
+		action := model.LockAction{PID: pid, BackendStart: s.BackendStart, Action: "cancel", Unblocks: s.BlockedCount}
+		switch {
+		case strings.HasPrefix(s.State, "idle in transaction"):
+			// Cancelling only stops a running query, an idle transaction keeps its locks
+			action.Action = "terminate"
+			action.Reason = fmt.Sprintf("Idle in a transaction for %.0fs while holding the locks", s.StateSeconds)
+		case s.State == "active":
+			action.Reason = "Running a query while holding the locks, cancelling it rolls back its transaction"
+		default:
+			action.Action = "terminate"
+			action.Reason = fmt.Sprintf("Holding the locks in state %q", s.State)
+		}
+		graph.Suggestions = append(graph.Suggestions, action)
+	}
+
+	sort.SliceStable(graph.Sessions, func(i, j int) bool {
+		return graph.Sessions[i].BlockedCount > graph.Sessions[j].BlockedCount
+	})
+	sort.SliceStable(graph.Suggestions, func(i, j int) bool {
+		return graph.Suggestions[i].Unblocks > graph.Suggestions[j].Unblocks
+	})
+
+	return graph
+}
+
+// GetLockGraph builds the wait-for graph of the pool's server, its root blockers and
+// the backends to cancel or terminate to unblock the waiting sessions
+func (c *Connections) GetLockGraph(activePoolID uuid.UUID) (*model.LockGraph, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	ctx := context.Background()
+	sessions, err := loadLockSessions(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	locks, err := loadLocks(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildLockGraph(sessions, locks), nil
+}
+
+// SignalBackend cancels the query of a backend or terminates it. backendStart is the
+// one the lock graph reported, so that a new session reusing the pid is left alone.
+// Every action has to be confirmed with the returned token.
+func (c *Connections) SignalBackend(activePoolID uuid.UUID, pid int32, backendStart, action, token string) *model.LockActionResult {
+	function, exists := backendSignals[action]
+	if !exists {
+		return &model.LockActionResult{OK: false, Message: fmt.Sprintf("unknown action %s", action)}
+	}
+
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return &model.LockActionResult{OK: false, Message: "pool doesn't exist"}
+	}
+
+	ctx := context.Background()
+	started := time.Now()
+	statement := fmt.Sprintf("SELECT %s(pid) FROM pg_stat_activity WHERE pid = %d AND backend_start::text = %s", function, pid, quoteLiteral(backendStart))
+
+	// The statement is a SELECT to the parser, the policy is applied to the action itself
+	policy, err := c.poolPolicy(activePoolID)
+	if err != nil {
+		return &model.LockActionResult{OK: false, Message: err.Error()}
+	}
+	if policy.ReadOnly || (policy.BlockDestructive && action == "terminate") {
+		err := fmt.Errorf("%s is blocked on %s connections", function, policy.Env)
+		c.audit(activePoolID, statement, started, 0, auditBlocked, err)
+		return &model.LockActionResult{OK: false, Message: err.Error()}
+	}
+
+	if !c.consumeConfirmation(activePoolID, statement, token) {
+		infos := []statementInfo{{Command: strings.ToUpper(action), Kind: statementOther}}
+		confirmation, err := c.requestConfirmation(ctx, activePoolID, policy, statement, splitStatements(statement), infos)
+		if err != nil {
+			return &model.LockActionResult{OK: false, Message: err.Error()}
+		}
+
+		return &model.LockActionResult{
+			OK:                   false,
+			Message:              fmt.Sprintf("Confirm to %s backend %d", action, pid),
+			RequiresConfirmation: true,
+			Confirmation:         confirmation,
+		}
+	}
+
+	started = time.Now()
+	var signalled bool
+	if err := pool.QueryRow(ctx, statement).Scan(&signalled); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.audit(activePoolID, statement, started, 0, auditSuccess, nil)
+			return &model.LockActionResult{OK: false, Message: fmt.Sprintf("backend %d has already ended", pid)}
+		}
+		c.audit(activePoolID, statement, started, 0, auditError, err)
+		return &model.LockActionResult{OK: false, Message: err.Error()}
+	}
+	c.audit(activePoolID, statement, started, 1, auditSuccess, nil)
+
+	if !signalled {
+		return &model.LockActionResult{OK: false, Message: fmt.Sprintf("the server didn't %s backend %d", action, pid)}
+	}
+	return &model.LockActionResult{OK: true, Message: fmt.Sprintf("Sent %s to backend %d", action, pid)}
+}
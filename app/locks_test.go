@@ -0,0 +1,162 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+
+	"dbmx/model"
+)
+
+func TestBuildLockGraph(t *testing.T) {
+	session := func(pid int32, state string, stateSeconds float64, blockedBy ...int32) model.LockSession {
+		return model.LockSession{PID: pid, State: state, StateSeconds: stateSeconds, BackendStart: "start", BlockedBy: blockedBy}
+	}
+	lock := func(pid int32, object, mode string, granted bool) heldLock {
+		return heldLock{pid: pid, SessionLock: model.SessionLock{LockType: "relation", Object: object, Mode: mode, Granted: granted}}
+	}
+	own := func(pid int32) heldLock {
+		return heldLock{pid: pid, SessionLock: model.SessionLock{LockType: "virtualxid", Object: "virtualxid", Mode: "ExclusiveLock", Granted: true}}
+	}
+
+	type suggestion struct {
+		pid      int32
+		action   string
+		unblocks int
+	}
+
+	tests := []struct {
+		name              string
+		sessions          []model.LockSession
+		locks             []heldLock
+		sessionPIDs       []int32
+		waits             []model.LockWait
+		rootBlockers      []int32
+		idleInTransaction []int32
+		suggestions       []suggestion
+	}{
+		{
+			name:     "nothing waits",
+			sessions: []model.LockSession{session(1, "active", 1), session(2, "idle", 5)},
+			locks:    []heldLock{own(1), lock(1, "app.users", "AccessShareLock", true)},
+		},
+		{
+			name: "chain behind an idle transaction",
+			sessions: []model.LockSession{
+				session(3, "active", 5, 2),
+				session(2, "active", 10, 1),
+				session(1, "idle in transaction", 120),
+			},
+			locks: []heldLock{
+				own(1), lock(1, "app.users", "RowExclusiveLock", true),
+				own(2), lock(2, "app.users", "AccessExclusiveLock", false),
+				own(3), lock(3, "app.users", "AccessShareLock", false),
+			},
+			sessionPIDs: []int32{1, 2, 3},
+			waits: []model.LockWait{
+				{Waiter: 3, Blocker: 2, Object: "app.users", WaitMode: "AccessShareLock"},
+				{Waiter: 2, Blocker: 1, Object: "app.users", WaitMode: "AccessExclusiveLock", BlockerMode: "RowExclusiveLock"},
+			},
+			rootBlockers:      []int32{1},
+			idleInTransaction: []int32{1},
+			suggestions:       []suggestion{{1, "terminate", 2}},
+		},
+		{
+			name: "running blockers",
+			sessions: []model.LockSession{
+				session(1, "active", 30),
+				session(2, "active", 5, 1),
+				session(3, "idle", 300),
+				session(4, "active", 5, 3),
+				session(5, "active", 5, 3),
+			},
+			locks: []heldLock{
+				lock(1, "app.users", "ShareLock", true),
+				lock(2, "app.users", "RowExclusiveLock", false),
+				lock(3, "app.orders", "ExclusiveLock", true),
+				lock(4, "app.orders", "AccessShareLock", false),
+				lock(5, "app.orders", "AccessShareLock", false),
+			},
+			sessionPIDs: []int32{3, 1, 2, 4, 5},
+			waits: []model.LockWait{
+				{Waiter: 2, Blocker: 1, Object: "app.users", WaitMode: "RowExclusiveLock", BlockerMode: "ShareLock"},
+				{Waiter: 4, Blocker: 3, Object: "app.orders", WaitMode: "AccessShareLock", BlockerMode: "ExclusiveLock"},
+				{Waiter: 5, Blocker: 3, Object: "app.orders", WaitMode: "AccessShareLock", BlockerMode: "ExclusiveLock"},
+			},
+			rootBlockers: []int32{1, 3},
+			suggestions:  []suggestion{{3, "terminate", 2}, {1, "cancel", 1}},
+		},
+		{
+			name:        "prepared transaction",
+			sessions:    []model.LockSession{session(2, "active", 5, 0)},
+			locks:       []heldLock{lock(2, "app.users", "AccessExclusiveLock", false)},
+			sessionPIDs: []int32{0, 2},
+			waits: []model.LockWait{
+				{Waiter: 2, Blocker: 0, Object: "app.users", WaitMode: "AccessExclusiveLock"},
+			},
+			rootBlockers: []int32{0},
+		},
+		{
+			name: "deadlock",
+			sessions: []model.LockSession{
+				session(1, "active", 1, 2),
+				session(2, "active", 1, 1),
+			},
+			sessionPIDs: []int32{1, 2},
+			waits: []model.LockWait{
+				{Waiter: 1, Blocker: 2},
+				{Waiter: 2, Blocker: 1},
+			},
+		},
+		{
+			name: "idle transactions",
+			sessions: []model.LockSession{
+				session(1, "idle in transaction", 120),
+				session(2, "idle in transaction", 10),
+				session(3, "idle in transaction (aborted)", 600),
+			},
+			locks: []heldLock{
+				own(1), lock(1, "app.users", "RowExclusiveLock", true),
+				own(2), lock(2, "app.users", "RowExclusiveLock", true),
+				own(3),
+			},
+			sessionPIDs:       []int32{1},
+			idleInTransaction: []int32{1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			graph := buildLockGraph(tt.sessions, tt.locks)
+
+			pids := []int32{}
+			for _, s := range graph.Sessions {
+				pids = append(pids, s.PID)
+				for _, l := range s.Locks {
+					if ownLock(l) {
+						t.Errorf("session %d lists its own %s lock", s.PID, l.LockType)
+					}
+				}
+			}
+			var suggestions []suggestion
+			for _, s := range graph.Suggestions {
+				suggestions = append(suggestions, suggestion{s.PID, s.Action, s.Unblocks})
+			}
+
+			if want := append([]int32{}, tt.sessionPIDs...); !reflect.DeepEqual(pids, want) {
+				t.Errorf("sessions = %v, want %v", pids, want)
+			}
+			if want := append([]model.LockWait{}, tt.waits...); !reflect.DeepEqual(graph.Waits, want) {
+				t.Errorf("waits = %+v, want %+v", graph.Waits, want)
+			}
+			if want := append([]int32{}, tt.rootBlockers...); !reflect.DeepEqual(graph.RootBlockers, want) {
+				t.Errorf("root blockers = %v, want %v", graph.RootBlockers, want)
+			}
+			if want := append([]int32{}, tt.idleInTransaction...); !reflect.DeepEqual(graph.IdleInTransaction, want) {
+				t.Errorf("idle in transaction = %v, want %v", graph.IdleInTransaction, want)
+			}
+			if !reflect.DeepEqual(suggestions, tt.suggestions) {
+				t.Errorf("suggestions = %+v, want %+v", suggestions, tt.suggestions)
+			}
+		})
+	}
+}
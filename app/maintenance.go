@@ -0,0 +1,443 @@
+package app
+
+import (
+	"context"
+	"dbmx/model"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Events emitted to the frontend while maintenance jobs run
+const (
+	MaintenanceProgressEvent = "maintenance:progress"
+	MaintenanceDoneEvent     = "maintenance:done"
+)
+
+// States of a maintenance job
+const (
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+const (
+	// How often the progress of a running job is polled
+	progressInterval = time.Second
+
+	// Finished jobs are listed for this long
+	finishedJobTTL = time.Hour
+)
+
+// Progress of the job's backend from whichever pg_stat_progress_* view reports it.
+// Analyze reports from PostgreSQL 13 on, on older servers the query fails and the
+// job only reports its state.
+const progressQuery = `
+	SELECT 'vacuum', phase, heap_blks_scanned, heap_blks_total FROM pg_stat_progress_vacuum WHERE pid = $1
+	UNION ALL
+	SELECT 'analyze', phase, sample_blks_scanned, sample_blks_total FROM pg_stat_progress_analyze WHERE pid = $1
+	UNION ALL
+	SELECT 'create_index', phase,
+		CASE WHEN blocks_total > 0 THEN blocks_done ELSE tuples_done END,
+		CASE WHEN blocks_total > 0 THEN blocks_total ELSE tuples_total END
+	FROM pg_stat_progress_create_index WHERE pid = $1
+	UNION ALL
+	SELECT 'cluster', phase, heap_blks_scanned, heap_blks_total FROM pg_stat_progress_cluster WHERE pid = $1
+`
+
+// maintenanceJob is a running or finished job with what's needed to cancel it
+type maintenanceJob struct {
+	job    model.MaintenanceJob
+	poolID uuid.UUID
+	pool   *pgxpool.Pool
+	// Backend running the statement
+	pid       uint32
+	cancel    context.CancelFunc
+	cancelled bool
+	finished  time.Time
+}
+
+// JobManager keeps the maintenance jobs. Every job runs on a connection of its own,
+// outside of a transaction block since VACUUM and the CONCURRENTLY variants can't
+// run in one.
+type JobManager struct {
+	PM *PoolManager
+
+	jobs map[string]*maintenanceJob
+	mu   sync.Mutex
+}
+
+func NewJobManager(pm *PoolManager) *JobManager {
+	return &JobManager{
+		PM:   pm,
+		jobs: make(map[string]*maintenanceJob),
+	}
+}
+
+// snapshot returns a copy of the job safe to hand out
+func (jm *JobManager) snapshot(id string) (model.MaintenanceJob, bool) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	mj, exists := jm.jobs[id]
+	if !exists {
+		return model.MaintenanceJob{}, false
+	}
+	return mj.job, true
+}
+
+// start runs the statement on a dedicated connection of the pool in the background
+func (jm *JobManager) start(activePoolID uuid.UUID, pool *pgxpool.Pool, operation, statement string, done func(job model.MaintenanceJob, started time.Time, err error)) (model.MaintenanceJob, error) {
+	conn, err := acquireConn(context.Background(), pool)
+	if err != nil {
+		return model.MaintenanceJob{}, err
+	}
+
+	// Maintenance runs for as long as it needs to, the environment's statement timeout
+	// is meant for queries
+	if _, err := conn.Exec(context.Background(), "SET statement_timeout = 0"); err != nil {
+		conn.Release()
+		return model.MaintenanceJob{}, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := time.Now()
+
+	mj := &maintenanceJob{
+		job: model.MaintenanceJob{
+			ID:        uuid.New().String(),
+			PoolID:    activePoolID.String(),
+			Operation: operation,
+			Statement: statement,
+			State:     jobRunning,
+			StartedAt: started.UTC().Format(time.RFC3339),
+			Progress:  model.MaintenanceProgress{Percent: -1},
+		},
+		poolID: activePoolID,
+		pool:   pool,
+		pid:    conn.Conn().PgConn().PID(),
+		cancel: cancel,
+	}
+
+	jm.mu.Lock()
+	for id, old := range jm.jobs {
+		if !old.finished.IsZero() && time.Since(old.finished) > finishedJobTTL {
+			delete(jm.jobs, id)
+		}
+	}
+	jm.jobs[mj.job.ID] = mj
+	job := mj.job
+	jm.mu.Unlock()
+
+	polling := make(chan struct{})
+	go jm.pollProgress(ctx, mj, polling)
+
+	go func() {
+		_, err := conn.Exec(ctx, statement)
+		releaseUntimed(conn)
+		cancel()
+		<-polling
+
+		jm.mu.Lock()
+		mj.finished = time.Now()
+		mj.job.FinishedAt = mj.finished.UTC().Format(time.RFC3339)
+		switch {
+		case mj.cancelled:
+			mj.job.State = jobCancelled
+		case err != nil:
+			mj.job.State = jobFailed
+			mj.job.Error = err.Error()
+		default:
+			mj.job.State = jobSucceeded
+			if mj.job.Progress.Total > 0 {
+				mj.job.Progress.Done = mj.job.Progress.Total
+			}
+			mj.job.Progress.Percent = 100
+		}
+		job := mj.job
+		jm.mu.Unlock()
+
+		done(job, started, err)
+		jm.PM.emit(MaintenanceDoneEvent, job)
+	}()
+
+	return job, nil
+}
+
+// releaseUntimed restores the pool's statement timeout on a connection which ran
+// without one and gives it back, a connection which can't be reset is closed instead
+func releaseUntimed(conn *pgxpool.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	if _, err := conn.Exec(ctx, "RESET statement_timeout"); err != nil {
+		_ = conn.Conn().Close(ctx)
+	}
+	conn.Release()
+}
+
+// pollProgress reads the progress of the job's backend until the job ends
+func (jm *JobManager) pollProgress(ctx context.Context, mj *maintenanceJob, polling chan struct{}) {
+	defer close(polling)
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var progress model.MaintenanceProgress
+		err := mj.pool.QueryRow(ctx, progressQuery, int64(mj.pid)).Scan(&progress.View, &progress.Phase, &progress.Done, &progress.Total)
+		if err != nil {
+			// Nothing reported yet, or by this server version
+			progress = model.MaintenanceProgress{Phase: jobRunning}
+		}
+		progress.Percent = -1
+		if progress.Total > 0 {
+			progress.Percent = float64(progress.Done) * 100 / float64(progress.Total)
+		}
+
+		jm.mu.Lock()
+		mj.job.Progress = progress
+		job := mj.job
+		jm.mu.Unlock()
+
+		jm.PM.emit(MaintenanceProgressEvent, job)
+	}
+}
+
+// Cancel cancels the statement of a running job
+func (jm *JobManager) Cancel(id string) error {
+	jm.mu.Lock()
+	mj, exists := jm.jobs[id]
+	if !exists {
+		jm.mu.Unlock()
+		return errors.New("job doesn't exist")
+	}
+	if mj.job.State != jobRunning {
+		jm.mu.Unlock()
+		return errors.Errorf("job already %s", mj.job.State)
+	}
+	mj.cancelled = true
+	jm.mu.Unlock()
+
+	// The server stops the statement, the context makes sure the job doesn't wait on it
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	_, _ = mj.pool.Exec(ctx, "SELECT pg_cancel_backend($1)", int64(mj.pid))
+	mj.cancel()
+
+	return nil
+}
+
+// CancelForPool cancels the jobs running on the pool, needed before the pool is
+// closed since closing a pool waits for its connections to be released
+func (jm *JobManager) CancelForPool(poolID uuid.UUID) {
+	jm.mu.Lock()
+	var ids []string
+	for id, mj := range jm.jobs {
+		if mj.poolID == poolID && mj.job.State == jobRunning {
+			ids = append(ids, id)
+		}
+	}
+	jm.mu.Unlock()
+
+	for _, id := range ids {
+		_ = jm.Cancel(id)
+	}
+}
+
+// CancelAll cancels every running job
+func (jm *JobManager) CancelAll() {
+	jm.mu.Lock()
+	var ids []string
+	for id, mj := range jm.jobs {
+		if mj.job.State == jobRunning {
+			ids = append(ids, id)
+		}
+	}
+	jm.mu.Unlock()
+
+	for _, id := range ids {
+		_ = jm.Cancel(id)
+	}
+}
+
+// List returns the running jobs and the recently finished ones, newest first
+func (jm *JobManager) List() []model.MaintenanceJob {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	jobs := []model.MaintenanceJob{}
+	for _, mj := range jm.jobs {
+		jobs = append(jobs, mj.job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt > jobs[j].StartedAt
+	})
+	return jobs
+}
+
+// maintenanceStatement renders the statement of a maintenance operation
+func maintenanceStatement(spec model.MaintenanceSpec) (string, error) {
+	schema := strings.TrimSpace(spec.Schema)
+	if schema == "" {
+		schema = "public"
+	}
+	table := strings.TrimSpace(spec.Table)
+	index := strings.TrimSpace(spec.Index)
+
+	qualified := func(name string) string {
+		return quoteIdent(schema) + "." + quoteIdent(name)
+	}
+
+	operation := strings.ToLower(strings.TrimSpace(spec.Operation))
+	if table == "" && !(operation == "reindex" && index != "") {
+		return "", errors.Errorf("%s needs a table", operation)
+	}
+	if spec.Concurrently && operation != "reindex" && operation != "refresh" {
+		return "", errors.New("only reindex and refresh can run concurrently")
+	}
+
+	switch operation {
+	case "vacuum":
+		var options []string
+		if spec.Full {
+			options = append(options, "FULL")
+		}
+		if spec.Freeze {
+			options = append(options, "FREEZE")
+		}
+		if spec.Analyze {
+			options = append(options, "ANALYZE")
+		}
+		statement := "VACUUM "
+		if len(options) > 0 {
+			statement += "(" + strings.Join(options, ", ") + ") "
+		}
+		return statement + qualified(table), nil
+
+	case "analyze":
+		return "ANALYZE " + qualified(table), nil
+
+	case "reindex":
+		concurrently := ""
+		if spec.Concurrently {
+			concurrently = "CONCURRENTLY "
+		}
+		if index != "" {
+			return "REINDEX INDEX " + concurrently + qualified(index), nil
+		}
+		return "REINDEX TABLE " + concurrently + qualified(table), nil
+
+	case "cluster":
+		statement := "CLUSTER " + qualified(table)
+		if index != "" {
+			statement += " USING " + quoteIdent(index)
+		}
+		return statement, nil
+
+	case "refresh":
+		statement := "REFRESH MATERIALIZED VIEW "
+		if spec.Concurrently {
+			statement += "CONCURRENTLY "
+		}
+		return statement + qualified(table), nil
+	}
+
+	return "", errors.Errorf("unknown maintenance operation %s", spec.Operation)
+}
+
+// StartMaintenance starts a maintenance operation in the background. Its progress is
+// emitted with the maintenance:progress event and its end with maintenance:done.
+// When the environment policy asks for confirmation the token returned in the
+// confirmation has to be passed.
+func (c *Connections) StartMaintenance(activePoolID uuid.UUID, spec model.MaintenanceSpec, token string) (*model.MaintenanceJob, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	statement, err := maintenanceStatement(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	started := time.Now()
+
+	policy, err := c.poolPolicy(activePoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	toConfirm, toConfirmInfo, err := checkPolicy(policy, statement)
+	if err != nil {
+		c.audit(activePoolID, statement, started, 0, auditBlocked, err)
+		return nil, err
+	}
+
+	if len(toConfirm) > 0 && !c.consumeConfirmation(activePoolID, statement, token) {
+		confirmation, err := c.requestConfirmation(ctx, activePoolID, policy, statement, toConfirm, toConfirmInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		return &model.MaintenanceJob{
+			Operation:            spec.Operation,
+			Statement:            statement,
+			RequiresConfirmation: true,
+			Confirmation:         confirmation,
+		}, nil
+	}
+
+	job, err := c.JM.start(activePoolID, pool, strings.ToLower(strings.TrimSpace(spec.Operation)), statement, func(job model.MaintenanceJob, started time.Time, err error) {
+		outcome := auditSuccess
+		if err != nil {
+			outcome = auditError
+		}
+		c.audit(activePoolID, statement, started, 0, outcome, err)
+
+		// VACUUM FULL, CLUSTER and REINDEX change the sizes and indexes the cache knows
+		if job.State == jobSucceeded {
+			c.MC.Invalidate(activePoolID)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// CancelMaintenance cancels a running maintenance job
+func (c *Connections) CancelMaintenance(jobID string) (bool, error) {
+	if err := c.JM.Cancel(jobID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetMaintenanceJobs lists the running and recently finished maintenance jobs
+func (c *Connections) GetMaintenanceJobs() []model.MaintenanceJob {
+	return c.JM.List()
+}
+
+// GetMaintenanceJob returns a maintenance job by id
+func (c *Connections) GetMaintenanceJob(jobID string) (*model.MaintenanceJob, error) {
+	job, exists := c.JM.snapshot(jobID)
+	if !exists {
+		return nil, errors.Errorf("job %s doesn't exist", jobID)
+	}
+	return &job, nil
+}
@@ -0,0 +1,789 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"dbmx/model"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Schemas which never hold user objects
+const systemSchemaFilter = `n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%' AND n.nspname NOT LIKE 'pg_temp_%'`
+
+// Functions considered by the cache, including the built in ones of pg_catalog
+const functionFilter = `n.nspname <> 'information_schema' AND n.nspname NOT LIKE 'pg_toast%' AND n.nspname NOT LIKE 'pg_temp_%' AND p.proname NOT LIKE '\_%'`
+
+var relationKinds = map[string]string{
+	"r": "table",
+	"p": "partitioned table",
+	"v": "view",
+	"m": "materialized view",
+	"f": "foreign table",
+}
+
+var functionKinds = map[string]string{
+	"f": "function",
+	"a": "aggregate",
+	"w": "window",
+	"p": "procedure",
+}
+
+// metadataKey identifies a database, pools come and go but the cache stays
+type metadataKey struct {
+	postgresConnID int64
+	database       string
+}
+
+// cachedRelation is a relation with the foreign keys defined on it, as stored
+type cachedRelation struct {
+	Marker      string             `json:"-"`
+	Relation    model.Relation     `json:"relation"`
+	ForeignKeys []model.ForeignKey `json:"foreignKeys"`
+}
+
+// cachedMetadata is the cached metadata of one database
+type cachedMetadata struct {
+	relations       map[int64]cachedRelation
+	searchPath      []string
+	schemas         []string
+	functions       []model.Function
+	functionsMarker string
+
+	// Snapshot handed out to readers, rebuilt after every refresh
+	metadata *model.SchemaMetadata
+	// Set when the metadata may be out of date and is refreshed on next use
+	stale bool
+
+	mu sync.Mutex
+	// Serialises refreshes of the database
+	refreshMu sync.Mutex
+}
+
+// MetadataCache keeps the schema metadata of every database in the local store so
+// it's available right away, even without a connection. Refreshes only reload the
+// relations whose catalog rows changed since the last refresh.
+type MetadataCache struct {
+	DB *sql.DB
+	PM *PoolManager
+
+	entries map[metadataKey]*cachedMetadata
+	mu      sync.Mutex
+}
+
+func NewMetadataCache(db *sql.DB, pm *PoolManager) *MetadataCache {
+	return &MetadataCache{
+		DB:      db,
+		PM:      pm,
+		entries: make(map[metadataKey]*cachedMetadata),
+	}
+}
+
+// key returns the database the pool is connected to
+func (mc *MetadataCache) key(activePoolID uuid.UUID) (metadataKey, error) {
+	connID, dbName, exists := mc.PM.Connection(activePoolID)
+	if !exists {
+		return metadataKey{}, errors.New("pool doesn't exist")
+	}
+	return metadataKey{postgresConnID: connID, database: dbName}, nil
+}
+
+// entry returns the cache entry of the database, reading it from the local store on first use
+func (mc *MetadataCache) entry(key metadataKey) (*cachedMetadata, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if entry, exists := mc.entries[key]; exists {
+		return entry, nil
+	}
+
+	entry, err := mc.loadStored(key)
+	if err != nil {
+		return nil, err
+	}
+
+	mc.entries[key] = entry
+	return entry, nil
+}
+
+// Get returns the metadata of the pool's database. Stored metadata is returned right
+// away and refreshed in the background, only a database never seen before waits for the server.
+func (mc *MetadataCache) Get(ctx context.Context, activePoolID uuid.UUID) (*model.SchemaMetadata, error) {
+	key, err := mc.key(activePoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := mc.entry(key)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.mu.Lock()
+	metadata, stale := entry.metadata, entry.stale
+	entry.stale = false
+	entry.mu.Unlock()
+
+	if metadata == nil {
+		if _, err := mc.Refresh(ctx, activePoolID); err != nil {
+			return nil, err
+		}
+
+		entry.mu.Lock()
+		metadata = entry.metadata
+		entry.mu.Unlock()
+		return metadata, nil
+	}
+
+	if stale {
+		go func() {
+			if _, err := mc.Refresh(context.Background(), activePoolID); err != nil {
+				fmt.Println("Error refreshing schema metadata:", err)
+			}
+		}()
+	}
+
+	return metadata, nil
+}
+
+// GetStored returns the stored metadata of a database without connecting to it,
+// or nil if it was never loaded
+func (mc *MetadataCache) GetStored(postgresConnID int64, dbName string) (*model.SchemaMetadata, error) {
+	entry, err := mc.entry(metadataKey{postgresConnID: postgresConnID, database: dbName})
+	if err != nil {
+		return nil, err
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	return entry.metadata, nil
+}
+
+// Invalidate marks the metadata of the pool's database as out of date,
+// it's refreshed on next use
+func (mc *MetadataCache) Invalidate(activePoolID uuid.UUID) {
+	key, err := mc.key(activePoolID)
+	if err != nil {
+		return
+	}
+
+	mc.mu.Lock()
+	entry, exists := mc.entries[key]
+	mc.mu.Unlock()
+
+	if exists {
+		entry.mu.Lock()
+		entry.stale = true
+		entry.mu.Unlock()
+	}
+}
+
+// Forget removes the metadata of a database which was dropped or renamed, both from
+// memory and from the local store
+func (mc *MetadataCache) Forget(postgresConnID int64, dbName string) error {
+	mc.mu.Lock()
+	delete(mc.entries, metadataKey{postgresConnID: postgresConnID, database: dbName})
+	mc.mu.Unlock()
+
+	_, err := mc.DB.Exec("DELETE FROM schema_cache WHERE postgres_conn_id = ? AND database = ?", postgresConnID, dbName)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete stored schema metadata")
+	}
+	return nil
+}
+
+// Refresh compares the change markers of the catalog with the stored ones, reloads
+// the relations which were added or changed and reports the differences
+func (mc *MetadataCache) Refresh(ctx context.Context, activePoolID uuid.UUID) (*model.MetadataChanges, error) {
+	pool, exists := mc.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	key, err := mc.key(activePoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := mc.entry(key)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.refreshMu.Lock()
+	defer entry.refreshMu.Unlock()
+
+	entry.mu.Lock()
+	firstLoad := entry.metadata == nil
+	relations := make(map[int64]cachedRelation, len(entry.relations))
+	for oid, rel := range entry.relations {
+		relations[oid] = rel
+	}
+	functions, functionsMarker := entry.functions, entry.functionsMarker
+	entry.mu.Unlock()
+
+	markers, err := loadRelationMarkers(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := &model.MetadataChanges{
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []string{},
+	}
+
+	var toLoad []int64
+	for oid, marker := range markers {
+		old, exists := relations[oid]
+		switch {
+		case !exists:
+			toLoad = append(toLoad, oid)
+			changes.Added = append(changes.Added, marker.schema+"."+marker.name)
+		case old.Marker != marker.marker:
+			toLoad = append(toLoad, oid)
+			changes.Changed = append(changes.Changed, marker.schema+"."+marker.name)
+		}
+	}
+
+	var removed []int64
+	for oid, old := range relations {
+		if _, exists := markers[oid]; !exists {
+			removed = append(removed, oid)
+			changes.Removed = append(changes.Removed, old.Relation.Schema+"."+old.Relation.Name)
+			delete(relations, oid)
+		}
+	}
+
+	loaded, err := loadRelations(ctx, pool, toLoad)
+	if err != nil {
+		return nil, err
+	}
+	for oid, rel := range loaded {
+		rel.Marker = markers[oid].marker
+		relations[oid] = rel
+	}
+
+	var searchPath []string
+	err = pool.QueryRow(ctx, "SELECT current_schemas(false)::text[]").Scan(&searchPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read search path")
+	}
+
+	schemas, err := loadSchemas(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	var marker string
+	err = pool.QueryRow(ctx, `SELECT COALESCE(md5(string_agg(p.oid::text || ':' || p.xmin::text, ',' ORDER BY p.oid)), '') FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace WHERE `+functionFilter).Scan(&marker)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read function markers")
+	}
+	if marker != functionsMarker {
+		functions, err = loadFunctions(ctx, pool)
+		if err != nil {
+			return nil, err
+		}
+		functionsMarker = marker
+		changes.FunctionsChanged = !firstLoad
+	}
+
+	changes.RefreshedAt = time.Now().UTC().Format(time.RFC3339)
+
+	err = mc.store(key, searchPath, schemas, functions, functionsMarker, changes.RefreshedAt, loaded, removed)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.mu.Lock()
+	entry.relations = relations
+	entry.searchPath = searchPath
+	entry.schemas = schemas
+	entry.functions = functions
+	entry.functionsMarker = functionsMarker
+	entry.metadata = entry.snapshot()
+	entry.stale = false
+	entry.mu.Unlock()
+
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Changed)
+
+	return changes, nil
+}
+
+// snapshot builds the metadata handed out to readers, relations ordered by schema and name
+func (cm *cachedMetadata) snapshot() *model.SchemaMetadata {
+	metadata := &model.SchemaMetadata{
+		SearchPath: cm.searchPath,
+		Schemas:    cm.schemas,
+		Functions:  cm.functions,
+	}
+
+	for _, rel := range cm.relations {
+		metadata.Relations = append(metadata.Relations, rel.Relation)
+		metadata.ForeignKeys = append(metadata.ForeignKeys, rel.ForeignKeys...)
+	}
+
+	sort.Slice(metadata.Relations, func(i, j int) bool {
+		a, b := metadata.Relations[i], metadata.Relations[j]
+		if a.Schema != b.Schema {
+			return a.Schema < b.Schema
+		}
+		return a.Name < b.Name
+	})
+	sort.Slice(metadata.ForeignKeys, func(i, j int) bool {
+		a, b := metadata.ForeignKeys[i], metadata.ForeignKeys[j]
+		if a.Schema != b.Schema {
+			return a.Schema < b.Schema
+		}
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		return a.Name < b.Name
+	})
+
+	return metadata
+}
+
+// loadStored reads the stored metadata of the database. The entry is empty if there is none.
+func (mc *MetadataCache) loadStored(key metadataKey) (*cachedMetadata, error) {
+	entry := &cachedMetadata{relations: make(map[int64]cachedRelation)}
+
+	var searchPathJSON, schemasJSON, functionsJSON string
+	row := mc.DB.QueryRow("SELECT search_path, schemas, functions, functions_marker FROM schema_cache WHERE postgres_conn_id = ? AND database = ?", key.postgresConnID, key.database)
+	err := row.Scan(&searchPathJSON, &schemasJSON, &functionsJSON, &entry.functionsMarker)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return entry, nil
+		}
+		return nil, errors.Wrap(err, "failed to read stored schema metadata")
+	}
+
+	if err := json.Unmarshal([]byte(searchPathJSON), &entry.searchPath); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(schemasJSON), &entry.schemas); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(functionsJSON), &entry.functions); err != nil {
+		return nil, err
+	}
+
+	rows, err := mc.DB.Query("SELECT oid, marker, data FROM schema_cache_relations WHERE postgres_conn_id = ? AND database = ?", key.postgresConnID, key.database)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var oid int64
+		var marker, data string
+		if err := rows.Scan(&oid, &marker, &data); err != nil {
+			return nil, err
+		}
+
+		var rel cachedRelation
+		if err := json.Unmarshal([]byte(data), &rel); err != nil {
+			return nil, err
+		}
+		rel.Marker = marker
+		entry.relations[oid] = rel
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Stored metadata may be out of date, it's checked against the server on first use
+	entry.metadata = entry.snapshot()
+	entry.stale = true
+
+	return entry, nil
+}
+
+// store writes the refreshed parts of the metadata to the local store
+func (mc *MetadataCache) store(key metadataKey, searchPath, schemas []string, functions []model.Function, functionsMarker, refreshedAt string, loaded map[int64]cachedRelation, removed []int64) error {
+	searchPathJSON, err := json.Marshal(searchPath)
+	if err != nil {
+		return err
+	}
+	schemasJSON, err := json.Marshal(schemas)
+	if err != nil {
+		return err
+	}
+	functionsJSON, err := json.Marshal(functions)
+	if err != nil {
+		return err
+	}
+
+	tx, err := mc.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO schema_cache (postgres_conn_id, database, search_path, schemas, functions, functions_marker, refreshed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (postgres_conn_id, database) DO UPDATE SET
+			search_path = excluded.search_path,
+			schemas = excluded.schemas,
+			functions = excluded.functions,
+			functions_marker = excluded.functions_marker,
+			refreshed_at = excluded.refreshed_at
+	`
+	_, err = tx.Exec(query, key.postgresConnID, key.database, string(searchPathJSON), string(schemasJSON), string(functionsJSON), functionsMarker, refreshedAt)
+	if err != nil {
+		return errors.Wrap(err, "failed to store schema metadata")
+	}
+
+	for _, oid := range removed {
+		_, err = tx.Exec("DELETE FROM schema_cache_relations WHERE postgres_conn_id = ? AND database = ? AND oid = ?", key.postgresConnID, key.database, oid)
+		if err != nil {
+			return err
+		}
+	}
+
+	query = `
+		INSERT INTO schema_cache_relations (postgres_conn_id, database, oid, schema, name, kind, marker, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (postgres_conn_id, database, oid) DO UPDATE SET
+			schema = excluded.schema,
+			name = excluded.name,
+			kind = excluded.kind,
+			marker = excluded.marker,
+			data = excluded.data
+	`
+	for oid, rel := range loaded {
+		data, err := json.Marshal(rel)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(query, key.postgresConnID, key.database, oid, rel.Relation.Schema, rel.Relation.Name, rel.Relation.Kind, rel.Marker, string(data))
+		if err != nil {
+			return errors.Wrap(err, "failed to store relation metadata")
+		}
+	}
+
+	return tx.Commit()
+}
+
+// relationMarker identifies the state of a relation's catalog rows
+type relationMarker struct {
+	schema string
+	name   string
+	marker string
+}
+
+// loadRelationMarkers reads a marker for every relation. It hashes the transaction ids
+// of the catalog rows describing the relation, which change with every ALTER, COMMENT,
+// constraint or index change, so only changed relations have to be read again.
+func loadRelationMarkers(ctx context.Context, pool *pgxpool.Pool) (map[int64]relationMarker, error) {
+	query := `
+		SELECT
+			c.oid::bigint,
+			n.nspname,
+			c.relname,
+			md5(concat_ws('|',
+				c.xmin::text,
+				n.xmin::text,
+				(SELECT string_agg(a.xmin::text, ',' ORDER BY a.attnum) FROM pg_attribute a WHERE a.attrelid = c.oid AND a.attnum > 0),
+				(SELECT string_agg(d.xmin::text, ',' ORDER BY d.adnum) FROM pg_attrdef d WHERE d.adrelid = c.oid),
+				(SELECT string_agg(con.xmin::text, ',' ORDER BY con.oid) FROM pg_constraint con WHERE con.conrelid = c.oid),
+				(SELECT string_agg(i.xmin::text || '/' || ic.xmin::text, ',' ORDER BY i.indexrelid) FROM pg_index i JOIN pg_class ic ON ic.oid = i.indexrelid WHERE i.indrelid = c.oid),
+				(SELECT string_agg(ds.xmin::text, ',' ORDER BY ds.objsubid) FROM pg_description ds WHERE ds.objoid = c.oid AND ds.classoid = 'pg_class'::regclass)
+			))
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f')
+		AND ` + systemSchemaFilter
+
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read relation markers")
+	}
+	defer rows.Close()
+
+	markers := make(map[int64]relationMarker)
+	for rows.Next() {
+		var oid int64
+		var m relationMarker
+		if err := rows.Scan(&oid, &m.schema, &m.name, &m.marker); err != nil {
+			return nil, err
+		}
+		markers[oid] = m
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return markers, nil
+}
+
+// loadSchemas reads the schemas which can hold user objects
+func loadSchemas(ctx context.Context, pool *pgxpool.Pool) ([]string, error) {
+	rows, err := pool.Query(ctx, `SELECT n.nspname FROM pg_namespace n WHERE `+systemSchemaFilter+` ORDER BY n.nspname`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read schemas")
+	}
+	defer rows.Close()
+
+	var schemas []string
+	for rows.Next() {
+		var schema string
+		if err := rows.Scan(&schema); err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, schema)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return schemas, nil
+}
+
+// loadRelations reads the relations with the given oids along with their columns,
+// primary keys, foreign keys and indexes
+func loadRelations(ctx context.Context, pool *pgxpool.Pool, oids []int64) (map[int64]cachedRelation, error) {
+	relations := make(map[int64]cachedRelation)
+	if len(oids) == 0 {
+		return relations, nil
+	}
+
+	// Relations and columns
+	query := `
+		SELECT
+			c.oid::bigint,
+			n.nspname,
+			c.relname,
+			c.relkind::text,
+			COALESCE(obj_description(c.oid, 'pg_class'), ''),
+			a.attname,
+			format_type(a.atttypid, a.atttypmod),
+			NOT a.attnotnull,
+			COALESCE(pg_get_expr(d.adbin, d.adrelid), ''),
+			a.attnum,
+			COALESCE(col_description(c.oid, a.attnum), '')
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped
+		LEFT JOIN pg_attrdef d ON d.adrelid = c.oid AND d.adnum = a.attnum
+		WHERE c.oid::bigint = ANY($1)
+		ORDER BY c.oid, a.attnum
+	`
+	rows, err := pool.Query(ctx, query, oids)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read relations")
+	}
+	for rows.Next() {
+		var oid int64
+		var rel model.Relation
+		var kind string
+		var columnName, columnType, columnDefault, columnComment *string
+		var nullable *bool
+		var position *int
+		err := rows.Scan(&oid, &rel.Schema, &rel.Name, &kind, &rel.Comment, &columnName, &columnType, &nullable, &columnDefault, &position, &columnComment)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		cached, exists := relations[oid]
+		if !exists {
+			rel.OID = oid
+			rel.Kind = relationKinds[kind]
+			cached = cachedRelation{Relation: rel}
+		}
+
+		// Relations without columns come back with a NULL column
+		if columnName != nil {
+			cached.Relation.Columns = append(cached.Relation.Columns, model.Column{
+				Name:     *columnName,
+				Type:     *columnType,
+				Nullable: *nullable,
+				Default:  *columnDefault,
+				Position: *position,
+				Comment:  *columnComment,
+			})
+		}
+		relations[oid] = cached
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Primary and foreign keys with their columns in key order
+	query = `
+		SELECT
+			con.conrelid::bigint,
+			con.contype::text,
+			con.conname,
+			ARRAY(
+				SELECT a.attname::text FROM unnest(con.conkey) WITH ORDINALITY k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum
+				ORDER BY k.ord
+			),
+			COALESCE(rn.nspname, ''),
+			COALESCE(rc.relname, ''),
+			ARRAY(
+				SELECT a.attname::text FROM unnest(con.confkey) WITH ORDINALITY k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = con.confrelid AND a.attnum = k.attnum
+				ORDER BY k.ord
+			)
+		FROM pg_constraint con
+		LEFT JOIN pg_class rc ON rc.oid = con.confrelid
+		LEFT JOIN pg_namespace rn ON rn.oid = rc.relnamespace
+		WHERE con.contype IN ('p', 'f')
+		AND con.conrelid::bigint = ANY($1)
+		ORDER BY con.conrelid, con.conname
+	`
+	rows, err = pool.Query(ctx, query, oids)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read keys")
+	}
+	for rows.Next() {
+		var oid int64
+		var kind string
+		var fk model.ForeignKey
+		err := rows.Scan(&oid, &kind, &fk.Name, &fk.Columns, &fk.RefSchema, &fk.RefTable, &fk.RefColumns)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		cached, exists := relations[oid]
+		if !exists {
+			continue
+		}
+
+		if kind == "p" {
+			cached.Relation.PrimaryKey = fk.Columns
+		} else {
+			fk.Schema = cached.Relation.Schema
+			fk.Table = cached.Relation.Name
+			cached.ForeignKeys = append(cached.ForeignKeys, fk)
+		}
+		relations[oid] = cached
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Indexes with their key columns or expressions
+	query = `
+		SELECT
+			i.indrelid::bigint,
+			ic.relname,
+			i.indisunique,
+			i.indisprimary,
+			am.amname,
+			pg_get_indexdef(i.indexrelid),
+			ARRAY(
+				SELECT pg_get_indexdef(i.indexrelid, k.n, true)
+				FROM generate_series(1, i.indnkeyatts) k(n)
+				ORDER BY k.n
+			)
+		FROM pg_index i
+		JOIN pg_class ic ON ic.oid = i.indexrelid
+		JOIN pg_am am ON am.oid = ic.relam
+		WHERE i.indrelid::bigint = ANY($1)
+		ORDER BY i.indrelid, ic.relname
+	`
+	rows, err = pool.Query(ctx, query, oids)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read indexes")
+	}
+	for rows.Next() {
+		var oid int64
+		var index model.Index
+		err := rows.Scan(&oid, &index.Name, &index.Unique, &index.Primary, &index.Method, &index.Definition, &index.Columns)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		cached, exists := relations[oid]
+		if !exists {
+			continue
+		}
+		cached.Relation.Indexes = append(cached.Relation.Indexes, index)
+		relations[oid] = cached
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return relations, nil
+}
+
+// loadFunctions reads all functions along with their signatures
+func loadFunctions(ctx context.Context, pool *pgxpool.Pool) ([]model.Function, error) {
+	query := `
+		SELECT
+			n.nspname,
+			p.proname,
+			pg_get_function_arguments(p.oid),
+			COALESCE(pg_get_function_result(p.oid), ''),
+			p.prokind::text
+		FROM pg_proc p
+		JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE ` + functionFilter + `
+		ORDER BY n.nspname, p.proname
+	`
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read functions")
+	}
+	defer rows.Close()
+
+	var functions []model.Function
+	for rows.Next() {
+		var fn model.Function
+		var kind string
+		err := rows.Scan(&fn.Schema, &fn.Name, &fn.Arguments, &fn.Result, &kind)
+		if err != nil {
+			return nil, err
+		}
+		fn.Kind = functionKinds[kind]
+		functions = append(functions, fn)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return functions, nil
+}
+
+// RefreshSchemaMetadata checks the pool's database for schema changes, reloads what
+// changed and reports it
+func (c *Connections) RefreshSchemaMetadata(activePoolID uuid.UUID) (*model.MetadataChanges, error) {
+	return c.MC.Refresh(context.Background(), activePoolID)
+}
+
+// GetSchemaMetadata returns the schema metadata of the pool's database
+func (c *Connections) GetSchemaMetadata(activePoolID uuid.UUID) (*model.SchemaMetadata, error) {
+	return c.MC.Get(context.Background(), activePoolID)
+}
+
+// GetStoredSchemaMetadata returns the stored schema metadata of a database without
+// connecting to it, nil if it was never loaded
+func (c *Connections) GetStoredSchemaMetadata(postgresConnectionID int64, dbName string) (*model.SchemaMetadata, error) {
+	return c.MC.GetStored(postgresConnectionID, dbName)
+}
@@ -0,0 +1,257 @@
+package app
+
+import (
+	"context"
+	"dbmx/model"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Child rows shown per referencing table
+	defaultChildPreviewRows = 5
+
+	// Child rows are counted up to this many
+	maxChildRowCount = 10000
+)
+
+// tabTableName names a table the way the sidebar does for table tabs, unqualified
+// for the public schema
+func tabTableName(schema, name string) string {
+	if schema == "public" {
+		return name
+	}
+	return schema + "." + name
+}
+
+// splitTableName splits a table name as table tabs use it into its schema and name
+func splitTableName(tableName string) (string, string) {
+	schema, name := "public", tableName
+	if i := strings.LastIndex(tableName, "."); i > 0 {
+		schema, name = tableName[:i], tableName[i+1:]
+	}
+	return strings.Trim(schema, `"`), strings.Trim(name, `"`)
+}
+
+// tableRelation finds the relation shown by a table tab. Table tabs name tables of the
+// public schema, a schema qualified name is accepted as well.
+func tableRelation(metadata *model.SchemaMetadata, tableName string) (*model.Relation, error) {
+	schema, name := splitTableName(tableName)
+
+	rel := findRelation(metadata, schema, name)
+	if rel == nil {
+		return nil, errors.Errorf("table %s doesn't exist", tableName)
+	}
+	return rel, nil
+}
+
+// quoteLiteral quotes the value as a sql string literal
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// rowValues returns the values of the columns in the row. It reports false if
+// any of them is NULL, in which case the row references nothing.
+func rowValues(row []model.Cell, columns []string) ([]string, bool, error) {
+	cells := make(map[string]model.Cell, len(row))
+	for _, cell := range row {
+		cells[cell.Column] = cell
+	}
+
+	values := make([]string, len(columns))
+	for i, column := range columns {
+		cell, exists := cells[column]
+		if !exists {
+			return nil, false, errors.Errorf("the row has no column %s", column)
+		}
+		if cell.Null {
+			return nil, false, nil
+		}
+		values[i] = cell.Value
+	}
+
+	return values, true, nil
+}
+
+// keyCondition matches the columns of the relation to the values. It returns the
+// condition with parameters cast to the column types for running it, and with
+// literals for the filter of a table tab.
+func keyCondition(rel *model.Relation, columns, values []string) (string, []any, string) {
+	types := make(map[string]string, len(rel.Columns))
+	for _, c := range rel.Columns {
+		types[c.Name] = c.Type
+	}
+
+	var conditions, filters []string
+	var args []any
+	for i, column := range columns {
+		cast := ""
+		if t := types[column]; t != "" {
+			cast = "::" + t
+		}
+		args = append(args, values[i])
+		conditions = append(conditions, fmt.Sprintf("%s = $%d%s", quoteIdent(column), len(args), cast))
+		filters = append(filters, fmt.Sprintf("%s = %s", quoteIdent(column), quoteLiteral(values[i])))
+	}
+
+	return strings.Join(conditions, " AND "), args, strings.Join(filters, " AND ")
+}
+
+// GetReferencedRow follows the foreign key of the table which includes the column and
+// returns the parent row the given row points to
+func (c *Connections) GetReferencedRow(activePoolID uuid.UUID, tableName, column string, row []model.Cell) (*model.ReferencedRow, error) {
+	ctx := context.Background()
+
+	metadata, err := c.MC.Get(ctx, activePoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	child, err := tableRelation(metadata, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	var fk *model.ForeignKey
+	for i := range metadata.ForeignKeys {
+		candidate := &metadata.ForeignKeys[i]
+		if candidate.Schema != child.Schema || candidate.Table != child.Name {
+			continue
+		}
+		for _, col := range candidate.Columns {
+			if col == column {
+				fk = candidate
+			}
+		}
+		if fk != nil {
+			break
+		}
+	}
+	if fk == nil {
+		return nil, errors.Errorf("column %s of %s is not part of a foreign key", column, tableName)
+	}
+
+	parent := findRelation(metadata, fk.RefSchema, fk.RefTable)
+	if parent == nil {
+		return nil, errors.Errorf("table %s.%s doesn't exist", fk.RefSchema, fk.RefTable)
+	}
+
+	result := &model.ReferencedRow{
+		ForeignKey: *fk,
+		Table:      tabTableName(parent.Schema, parent.Name),
+	}
+
+	values, ok, err := rowValues(row, fk.Columns)
+	if err != nil || !ok {
+		return result, err
+	}
+
+	condition, args, filter := keyCondition(parent, fk.RefColumns, values)
+	result.Where = filter
+
+	query := fmt.Sprintf("SELECT * FROM %s.%s WHERE %s LIMIT 1", quoteIdent(parent.Schema), quoteIdent(parent.Name), condition)
+
+	started := time.Now()
+	columns, rows, err := c.runReadQuery(ctx, activePoolID, query, args...)
+	if err != nil {
+		c.audit(activePoolID, query, started, 0, auditError, err)
+		return nil, err
+	}
+	c.audit(activePoolID, query, started, int64(len(rows)), auditSuccess, nil)
+
+	result.Columns = columns
+	if len(rows) > 0 {
+		result.Row = rows[0]
+	}
+
+	return result, nil
+}
+
+// GetReferencingRows lists the tables with a foreign key to the table, along with the
+// number of rows referencing the given row and a preview of them
+func (c *Connections) GetReferencingRows(activePoolID uuid.UUID, tableName string, row []model.Cell, previewLimit int) ([]model.ChildRows, error) {
+	ctx := context.Background()
+
+	if previewLimit <= 0 {
+		previewLimit = defaultChildPreviewRows
+	}
+
+	metadata, err := c.MC.Get(ctx, activePoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	parent, err := tableRelation(metadata, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	children := []model.ChildRows{}
+	for _, fk := range metadata.ForeignKeys {
+		if fk.RefSchema != parent.Schema || fk.RefTable != parent.Name {
+			continue
+		}
+
+		child := findRelation(metadata, fk.Schema, fk.Table)
+		if child == nil {
+			continue
+		}
+
+		values, ok, err := rowValues(row, fk.RefColumns)
+		if err != nil {
+			return nil, err
+		}
+
+		result := model.ChildRows{
+			ForeignKey: fk,
+			Table:      tabTableName(child.Schema, child.Name),
+		}
+		if !ok {
+			children = append(children, result)
+			continue
+		}
+
+		condition, args, filter := keyCondition(child, fk.Columns, values)
+		result.Where = filter
+
+		from := fmt.Sprintf("%s.%s WHERE %s", quoteIdent(child.Schema), quoteIdent(child.Name), condition)
+
+		// Count only up to a limit, children of a popular row can be many
+		query := fmt.Sprintf("SELECT count(*) FROM (SELECT 1 FROM %s LIMIT %d) AS children", from, maxChildRowCount+1)
+		started := time.Now()
+		_, counts, err := c.runReadQuery(ctx, activePoolID, query, args...)
+		if err != nil {
+			c.audit(activePoolID, query, started, 0, auditError, err)
+			return nil, err
+		}
+		c.audit(activePoolID, query, started, 1, auditSuccess, nil)
+
+		if len(counts) > 0 && len(counts[0]) > 0 {
+			result.Count, _ = strconv.ParseInt(counts[0][0].Value, 10, 64)
+		}
+		if result.Count > maxChildRowCount {
+			result.Count = maxChildRowCount
+			result.CountCapped = true
+		}
+
+		if result.Count > 0 {
+			query = fmt.Sprintf("SELECT * FROM %s LIMIT %d", from, previewLimit)
+			started = time.Now()
+			result.Columns, result.Preview, err = c.runReadQuery(ctx, activePoolID, query, args...)
+			if err != nil {
+				c.audit(activePoolID, query, started, 0, auditError, err)
+				return nil, err
+			}
+			c.audit(activePoolID, query, started, int64(len(result.Preview)), auditSuccess, nil)
+		}
+
+		children = append(children, result)
+	}
+
+	return children, nil
+}
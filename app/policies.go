@@ -0,0 +1,393 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"dbmx/model"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// How long a confirmation token returned by ExecuteQuery stays valid
+const confirmationTTL = 5 * time.Minute
+
+// pendingConfirmation is a query waiting to be confirmed by the user
+type pendingConfirmation struct {
+	poolID  uuid.UUID
+	query   string
+	expires time.Time
+}
+
+// normalizeEnv makes environment names like "Production " and "production" match
+func normalizeEnv(env string) string {
+	return strings.ToLower(strings.TrimSpace(env))
+}
+
+// loadEnvPolicy reads the policy of the environment. Environments without a policy
+// get a policy which doesn't restrict anything.
+func loadEnvPolicy(db *sql.DB, env string) (*model.EnvPolicy, error) {
+	// Statements against environments nobody has configured are still audited
+	policy := &model.EnvPolicy{Env: normalizeEnv(env), Audit: true}
+
+	row := db.QueryRow("SELECT read_only, confirm_writes, block_unsafe_writes, block_destructive, statement_timeout_ms, lock_timeout_ms, audit, redact_literals FROM env_policies WHERE env = ?", policy.Env)
+	err := row.Scan(&policy.ReadOnly, &policy.ConfirmWrites, &policy.BlockUnsafeWrites, &policy.BlockDestructive, &policy.StatementTimeoutMs, &policy.LockTimeoutMs, &policy.Audit, &policy.RedactLiterals)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return policy, nil
+		}
+		return nil, errors.Wrap(err, "failed to read environment policy")
+	}
+
+	return policy, nil
+}
+
+// applyEnvPolicy sets the session defaults required by the policy on the pool config
+func applyEnvPolicy(config *pgxpool.Config, policy *model.EnvPolicy) {
+	params := config.ConnConfig.RuntimeParams
+
+	if policy.ReadOnly {
+		params["default_transaction_read_only"] = "on"
+	}
+	if policy.StatementTimeoutMs > 0 {
+		params["statement_timeout"] = fmt.Sprintf("%d", policy.StatementTimeoutMs)
+	}
+	if policy.LockTimeoutMs > 0 {
+		params["lock_timeout"] = fmt.Sprintf("%d", policy.LockTimeoutMs)
+	}
+}
+
+func (c *Connections) GetEnvPolicies() ([]model.EnvPolicy, error) {
+	rows, err := c.DB.Query("SELECT env, read_only, confirm_writes, block_unsafe_writes, block_destructive, statement_timeout_ms, lock_timeout_ms, audit, redact_literals FROM env_policies ORDER BY env")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var policies []model.EnvPolicy
+	for rows.Next() {
+		var policy model.EnvPolicy
+		err := rows.Scan(&policy.Env, &policy.ReadOnly, &policy.ConfirmWrites, &policy.BlockUnsafeWrites, &policy.BlockDestructive, &policy.StatementTimeoutMs, &policy.LockTimeoutMs, &policy.Audit, &policy.RedactLiterals)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read resultant rows into policy variable")
+		}
+		policies = append(policies, policy)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to read rows")
+	}
+
+	return policies, nil
+}
+
+// SaveEnvPolicy creates or updates the policy of an environment and applies it to the open pools
+func (c *Connections) SaveEnvPolicy(policy model.EnvPolicy) (bool, error) {
+	policy.Env = normalizeEnv(policy.Env)
+	if policy.Env == "" {
+		return false, errors.New("environment name is required")
+	}
+	if policy.StatementTimeoutMs < 0 || policy.LockTimeoutMs < 0 {
+		return false, errors.New("timeouts cannot be negative")
+	}
+
+	query := `
+		INSERT INTO env_policies (env, read_only, confirm_writes, block_unsafe_writes, block_destructive, statement_timeout_ms, lock_timeout_ms, audit, redact_literals)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (env) DO UPDATE SET
+			read_only = excluded.read_only,
+			confirm_writes = excluded.confirm_writes,
+			block_unsafe_writes = excluded.block_unsafe_writes,
+			block_destructive = excluded.block_destructive,
+			statement_timeout_ms = excluded.statement_timeout_ms,
+			lock_timeout_ms = excluded.lock_timeout_ms,
+			audit = excluded.audit,
+			redact_literals = excluded.redact_literals
+	`
+	_, err := c.DB.Exec(query, policy.Env, policy.ReadOnly, policy.ConfirmWrites, policy.BlockUnsafeWrites, policy.BlockDestructive, policy.StatementTimeoutMs, policy.LockTimeoutMs, policy.Audit, policy.RedactLiterals)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to save environment policy")
+	}
+
+	err = c.reconfigurePools(policy.Env)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (c *Connections) DeleteEnvPolicy(env string) (bool, error) {
+	env = normalizeEnv(env)
+
+	_, err := c.DB.Exec("DELETE FROM env_policies WHERE env = ?", env)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to delete environment policy")
+	}
+
+	err = c.reconfigurePools(env)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// reconfigurePools rebuilds the config of every open pool of the environment so that
+// the session defaults of the policy are applied when the pools reconnect
+func (c *Connections) reconfigurePools(env string) error {
+	rows, err := c.DB.Query("SELECT id FROM postgres WHERE lower(trim(env)) = ?", env)
+	if err != nil {
+		return err
+	}
+	connIDs, err := scanIDs(rows)
+	if err != nil {
+		return err
+	}
+
+	for _, connID := range connIDs {
+		if len(c.PM.PoolsForConnection(connID)) == 0 {
+			continue
+		}
+
+		p, err := c.getPostgresConnection(connID)
+		if err != nil {
+			return err
+		}
+
+		err = c.reconfigureConnectionPools(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reconfigureConnectionPools rebuilds the config of every open pool of the connection
+// from its saved settings and environment policy
+func (c *Connections) reconfigureConnectionPools(p *model.PostgresConnection) error {
+	for _, poolID := range c.PM.PoolsForConnection(p.ID) {
+		_, dbName, exists := c.PM.Connection(poolID)
+		if !exists {
+			continue
+		}
+
+		config, err := c.newPoolConfig(p, dbName)
+		if err != nil {
+			return err
+		}
+
+		err = c.PM.Reconfigure(poolID, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// poolPolicy returns the environment policy of the connection the pool belongs to
+func (c *Connections) poolPolicy(activePoolID uuid.UUID) (*model.EnvPolicy, error) {
+	connID, _, exists := c.PM.Connection(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	p, err := c.getPostgresConnection(connID)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadEnvPolicy(c.DB, p.Env)
+}
+
+// overridesReadOnly reports if a statement tries to leave read-only mode for the session,
+// including a SELECT calling set_config
+func overridesReadOnly(stmt sqlStatement) bool {
+	for i, t := range stmt.tokens {
+		switch {
+		case t.isWord("default_transaction_read_only", "transaction_read_only", "set_config"):
+			return true
+		case t.isWord("role", "authorization") && setsSession(stmt.tokens[:i]):
+			return true
+		case t.isWord("read") && i+1 < len(stmt.tokens) && stmt.tokens[i+1].isWord("write"):
+			return true
+		case t.isWord("reset") && i+1 < len(stmt.tokens) && stmt.tokens[i+1].isWord("all"):
+			return true
+		}
+	}
+	return false
+}
+
+// setsSession reports if the tokens before ROLE or AUTHORIZATION end in SET or RESET,
+// optionally followed by SESSION or LOCAL, so that a column named role isn't mistaken
+func setsSession(before []sqlToken) bool {
+	for i := len(before) - 1; i >= 0; i-- {
+		switch {
+		case before[i].isWord("session", "local"):
+			continue
+		case before[i].isWord("set", "reset"):
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// blockedStatement reports why the policy blocks the statement, if it does
+func blockedStatement(policy *model.EnvPolicy, info statementInfo) error {
+	if policy.BlockDestructive && (info.Command == "DROP" || info.Command == "TRUNCATE") {
+		return fmt.Errorf("%s is blocked on %s connections", info.Command, policy.Env)
+	}
+
+	if policy.BlockUnsafeWrites && (info.Command == "UPDATE" || info.Command == "DELETE") && !info.HasWhere {
+		return fmt.Errorf("%s without a WHERE clause is blocked on %s connections", info.Command, policy.Env)
+	}
+
+	return nil
+}
+
+// checkPolicy rejects statements which the policy blocks, and returns the statements
+// which have to be confirmed before the query can run
+func checkPolicy(policy *model.EnvPolicy, query string) ([]sqlStatement, []statementInfo, error) {
+	var confirm []sqlStatement
+	var confirmInfo []statementInfo
+
+	for _, stmt := range splitStatements(query) {
+		info := classifyStatement(stmt)
+
+		if policy.ReadOnly && overridesReadOnly(stmt) {
+			return nil, nil, fmt.Errorf("%s connections are read-only, %s is not allowed to leave read-only mode", policy.Env, info.Command)
+		}
+
+		if info.Kind == statementRead {
+			continue
+		}
+
+		if policy.ReadOnly && info.Kind != statementOther {
+			return nil, nil, fmt.Errorf("%s connections are read-only, %s is not allowed", policy.Env, info.Command)
+		}
+
+		// Data modifying expressions of a WITH are checked on their own
+		if err := blockedStatement(policy, info); err != nil {
+			return nil, nil, err
+		}
+		for _, inner := range cteStatements(stmt) {
+			if err := blockedStatement(policy, classifyStatement(inner)); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if policy.ConfirmWrites && (info.Kind == statementDML || info.Kind == statementDDL) {
+			confirm = append(confirm, stmt)
+			confirmInfo = append(confirmInfo, info)
+		}
+	}
+
+	return confirm, confirmInfo, nil
+}
+
+// dryRunRows runs the statement in a transaction which is always rolled back and
+// returns the number of rows it would affect
+func dryRunRows(ctx context.Context, pool *pgxpool.Pool, statement string) (int64, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, statement)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// requestConfirmation builds the confirmation for the statements and remembers the
+// query so that it can be executed once the returned token is passed back
+func (c *Connections) requestConfirmation(ctx context.Context, activePoolID uuid.UUID, policy *model.EnvPolicy, query string, statements []sqlStatement, infos []statementInfo) (*model.Confirmation, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	confirmation := &model.Confirmation{
+		Env:   policy.Env,
+		Token: uuid.New().String(),
+	}
+
+	for i, stmt := range statements {
+		sc := model.StatementConfirmation{
+			Statement: stmt.text,
+			Command:   infos[i].Command,
+			Kind:      infos[i].Kind,
+		}
+
+		// Show how many rows an UPDATE or DELETE is going to touch
+		if infos[i].Command == "UPDATE" || infos[i].Command == "DELETE" {
+			started := time.Now()
+			rows, err := dryRunRows(ctx, pool, stmt.text)
+			c.audit(activePoolID, stmt.text, started, rows, auditDryRun, err)
+			if err != nil {
+				sc.DryRunError = err.Error()
+			} else {
+				sc.DryRunRows = &rows
+			}
+		}
+
+		confirmation.Statements = append(confirmation.Statements, sc)
+	}
+
+	c.rememberConfirmation(activePoolID, query, confirmation.Token)
+
+	return confirmation, nil
+}
+
+// rememberConfirmation keeps the query until the token is passed back or it expires
+func (c *Connections) rememberConfirmation(activePoolID uuid.UUID, query, token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Drop tokens which were never used
+	for token, pending := range c.confirmations {
+		if time.Now().After(pending.expires) {
+			delete(c.confirmations, token)
+		}
+	}
+
+	c.confirmations[token] = pendingConfirmation{
+		poolID:  activePoolID,
+		query:   query,
+		expires: time.Now().Add(confirmationTTL),
+	}
+}
+
+// consumeConfirmation checks that the token was issued for this exact query on this pool
+func (c *Connections) consumeConfirmation(activePoolID uuid.UUID, query, token string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending, exists := c.confirmations[token]
+	if !exists {
+		return false
+	}
+	delete(c.confirmations, token)
+
+	return pending.poolID == activePoolID && pending.query == query && time.Now().Before(pending.expires)
+}
+
+// ExecuteConfirmedQuery executes a query after the user confirmed it. The token is the
+// one returned in the confirmation by ExecuteQuery and can only be used once.
+func (c *Connections) ExecuteConfirmedQuery(activePoolID uuid.UUID, query string, tabID int64, token string) *model.QueryResult {
+	if !c.consumeConfirmation(activePoolID, query, token) {
+		return &model.QueryResult{OK: false, Message: "confirmation is invalid or has expired, run the query again"}
+	}
+
+	return c.executeQuery(activePoolID, query, tabID, true)
+}
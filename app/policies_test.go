@@ -0,0 +1,74 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+
+	"dbmx/model"
+)
+
+func TestCheckPolicy(t *testing.T) {
+	readOnly := &model.EnvPolicy{Env: "production", ReadOnly: true}
+	guarded := &model.EnvPolicy{Env: "staging", ConfirmWrites: true, BlockUnsafeWrites: true, BlockDestructive: true}
+	open := &model.EnvPolicy{Env: "development"}
+
+	tests := []struct {
+		name    string
+		policy  *model.EnvPolicy
+		query   string
+		confirm []string
+		wantErr string
+	}{
+		{"read on read-only", readOnly, "SELECT * FROM users; SHOW work_mem", nil, ""},
+		{"session setting on read-only", readOnly, "SET search_path = public", nil, ""},
+		{"column named role on read-only", readOnly, "SELECT role FROM members", nil, ""},
+		{"write on read-only", readOnly, "SELECT 1; DELETE FROM users WHERE id = 1", nil, "production connections are read-only, DELETE is not allowed"},
+		{"ddl on read-only", readOnly, "CREATE TABLE t (id int)", nil, "production connections are read-only, CREATE is not allowed"},
+		{"modifying cte on read-only", readOnly, "WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d", nil, "production connections are read-only, SELECT is not allowed"},
+		{"read write transaction on read-only", readOnly, "BEGIN READ WRITE", nil, "production connections are read-only, BEGIN is not allowed to leave read-only mode"},
+		{"read-only setting on read-only", readOnly, "SET default_transaction_read_only = off", nil, "production connections are read-only, SET is not allowed to leave read-only mode"},
+		{"set_config on read-only", readOnly, "SELECT set_config('transaction_read_only', 'off', false)", nil, "production connections are read-only, SELECT is not allowed to leave read-only mode"},
+		{"set role on read-only", readOnly, "SET SESSION ROLE admin", nil, "production connections are read-only, SET is not allowed to leave read-only mode"},
+		{"reset all on read-only", readOnly, "RESET ALL", nil, "production connections are read-only, RESET is not allowed to leave read-only mode"},
+		{"read on guarded", guarded, "SELECT 1", nil, ""},
+		{"writes to confirm", guarded, "UPDATE users SET a = 1 WHERE id = 1; SELECT 1; CREATE INDEX ON users (a)", []string{"UPDATE users SET a = 1 WHERE id = 1", "CREATE INDEX ON users (a)"}, ""},
+		{"update without where", guarded, "UPDATE users SET a = 1", nil, "UPDATE without a WHERE clause is blocked on staging connections"},
+		{"delete without where", guarded, "DELETE FROM users", nil, "DELETE without a WHERE clause is blocked on staging connections"},
+		{"drop", guarded, "DROP TABLE users", nil, "DROP is blocked on staging connections"},
+		{"truncate", guarded, "TRUNCATE users", nil, "TRUNCATE is blocked on staging connections"},
+		{"delete without where in a cte", guarded, "WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d", nil, "DELETE without a WHERE clause is blocked on staging connections"},
+		{"update without where in a nested cte", guarded, "WITH a AS (WITH u AS (UPDATE users SET a = 1 RETURNING id) SELECT * FROM u) SELECT * FROM a", nil, "UPDATE without a WHERE clause is blocked on staging connections"},
+		{
+			"delete with where in a cte to confirm", guarded, "WITH d AS (DELETE FROM users WHERE id = 1 RETURNING *) SELECT * FROM d",
+			[]string{"WITH d AS (DELETE FROM users WHERE id = 1 RETURNING *) SELECT * FROM d"}, "",
+		},
+		{"other statements aren't confirmed", guarded, "BEGIN; SET lock_timeout = 0", nil, ""},
+		{"anything on open", open, "DROP TABLE users; DELETE FROM users", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			confirm, infos, err := checkPolicy(tt.policy, tt.query)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("checkPolicy(%q) error = %v, want %q", tt.query, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkPolicy(%q) failed: %v", tt.query, err)
+			}
+
+			var got []string
+			for _, stmt := range confirm {
+				got = append(got, stmt.text)
+			}
+			if !reflect.DeepEqual(got, tt.confirm) {
+				t.Errorf("checkPolicy(%q) confirms %q, want %q", tt.query, got, tt.confirm)
+			}
+			if len(infos) != len(confirm) {
+				t.Errorf("checkPolicy(%q) returned %d infos for %d statements", tt.query, len(infos), len(confirm))
+			}
+		})
+	}
+}
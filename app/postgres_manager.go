@@ -2,57 +2,502 @@ package app
 
 import (
 	"context"
+	"dbmx/model"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
+// Pool settings used when a connection doesn't define its own
+const (
+	defaultMaxConns          = 10
+	defaultMinConns          = 0
+	defaultMaxConnLifetime   = time.Hour
+	defaultMaxConnIdleTime   = 30 * time.Minute
+	defaultHealthCheckPeriod = time.Minute
+	defaultApplicationName   = "dbmx"
+
+	// How often the pool manager looks for idle pools to evict
+	reapInterval = time.Minute
+
+	// How often the pool manager checks for a system wake and retries lost pools
+	watchInterval = 15 * time.Second
+
+	// How long a ping may take before the pool is considered dead
+	pingTimeout = 5 * time.Second
+
+	// How long to wait for a free connection when every connection of the pool is in use
+	acquireTimeout = 15 * time.Second
+)
+
+// Connection states emitted to the frontend with the pool:state event
+const (
+	PoolStateEvent = "pool:state"
+
+	poolStateConnected    = "connected"
+	poolStateReconnecting = "reconnecting"
+	poolStateLost         = "lost"
+)
+
+// managedPool holds a pool along with what is needed to reuse, evict and reopen it
+type managedPool struct {
+	// pool is nil while the pool is evicted, it is reopened from config on next use
+	pool   *pgxpool.Pool
+	config *pgxpool.Config
+
+	// The postgres connection id and database this pool is connected to
+	postgresConnID int64
+	database       string
+
+	// Tabs currently using this pool
+	tabs     map[int64]struct{}
+	lastUsed time.Time
+
+	// Connection state of the pool, serialised by recoverMu while it's rebuilt
+	state     string
+	recoverMu sync.Mutex
+}
+
 type PoolManager struct {
-	Pools map[uuid.UUID]*pgxpool.Pool
-	mu    sync.RWMutex
+	pools map[uuid.UUID]*managedPool
+	mu    sync.Mutex
+
+	// Wails runtime context used to emit connection state events
+	ctx context.Context
 }
 
 func NewPoolManager() *PoolManager {
-	return &PoolManager{
-		Pools: make(map[uuid.UUID]*pgxpool.Pool),
+	pm := &PoolManager{
+		pools: make(map[uuid.UUID]*managedPool),
 	}
+
+	go pm.reapIdlePools()
+	go pm.watchConnections()
+
+	return pm
+}
+
+// SetContext sets the wails runtime context used to emit events to the frontend
+func (pm *PoolManager) SetContext(ctx context.Context) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.ctx = ctx
 }
 
-func (pm *PoolManager) AddPool(id uuid.UUID, connString string) (*pgxpool.Pool, error) {
+func (pm *PoolManager) AddPool(id uuid.UUID, postgresConnID int64, database string, config *pgxpool.Config) (*pgxpool.Pool, error) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	pool, err := pgxpool.New(context.Background(), connString)
+	pool, err := pgxpool.NewWithConfig(context.Background(), config)
 	if err != nil {
 		return nil, err
 	}
-	pm.Pools[id] = pool
+	pm.pools[id] = &managedPool{
+		pool:           pool,
+		config:         config,
+		postgresConnID: postgresConnID,
+		database:       database,
+		tabs:           make(map[int64]struct{}),
+		lastUsed:       time.Now(),
+		state:          poolStateConnected,
+	}
 	return pool, nil
 }
 
+// FindPool returns the id of an existing pool for the postgres connection and database
+func (pm *PoolManager) FindPool(postgresConnID int64, database string) (uuid.UUID, bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for id, mp := range pm.pools {
+		if mp.postgresConnID == postgresConnID && mp.database == database {
+			return id, true
+		}
+	}
+	return uuid.Nil, false
+}
+
+// GetPool returns the pool for the id, reopening it if it was evicted while idle
 func (pm *PoolManager) GetPool(id uuid.UUID) (*pgxpool.Pool, bool) {
-	pm.mu.RLock()
-	defer pm.mu.RUnlock()
-	pool, exists := pm.Pools[id]
-	return pool, exists
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	mp, exists := pm.pools[id]
+	if !exists {
+		return nil, false
+	}
+
+	if mp.pool == nil {
+		pool, err := pgxpool.NewWithConfig(context.Background(), mp.config)
+		if err != nil {
+			return nil, false
+		}
+		mp.pool = pool
+	}
+
+	mp.lastUsed = time.Now()
+	return mp.pool, true
 }
 
 func (pm *PoolManager) DeletePool(id uuid.UUID) error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	pool, exists := pm.Pools[id]
+	mp, exists := pm.pools[id]
 	if !exists {
 		return errors.New("connection does not exist")
 	}
 
 	// Close the pool before deleting it
-	pool.Close()
+	if mp.pool != nil {
+		mp.pool.Close()
+	}
 
 	// Remove the pool from the map
-	delete(pm.Pools, id)
+	delete(pm.pools, id)
+
+	return nil
+}
+
+// CloseAll closes and removes every pool and returns the ids of the removed pools
+func (pm *PoolManager) CloseAll() []uuid.UUID {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	ids := []uuid.UUID{}
+	for id, mp := range pm.pools {
+		if mp.pool != nil {
+			mp.pool.Close()
+		}
+		delete(pm.pools, id)
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// Retain marks the pool as being used by the tab
+func (pm *PoolManager) Retain(id uuid.UUID, tabID int64) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	mp, exists := pm.pools[id]
+	if !exists {
+		return
+	}
+	mp.tabs[tabID] = struct{}{}
+	mp.lastUsed = time.Now()
+}
+
+// Release marks the tab as no longer using any pool
+func (pm *PoolManager) Release(tabID int64) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, mp := range pm.pools {
+		delete(mp.tabs, tabID)
+	}
+}
+
+// Stats returns the pgxpool statistics of the pool without reopening it if it's evicted
+func (pm *PoolManager) Stats(id uuid.UUID) (*model.PoolStats, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	mp, exists := pm.pools[id]
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	stats := &model.PoolStats{
+		PoolID:   id.String(),
+		Database: mp.database,
+		MaxConns: mp.config.MaxConns,
+		TabCount: len(mp.tabs),
+		LastUsed: mp.lastUsed.Format(time.RFC3339),
+		Evicted:  mp.pool == nil,
+		State:    mp.state,
+	}
+
+	if mp.pool == nil {
+		return stats, nil
+	}
+
+	s := mp.pool.Stat()
+	stats.TotalConns = s.TotalConns()
+	stats.AcquiredConns = s.AcquiredConns()
+	stats.IdleConns = s.IdleConns()
+	stats.ConstructingConns = s.ConstructingConns()
+	stats.AcquireCount = s.AcquireCount()
+	stats.AcquireDurationMs = s.AcquireDuration().Milliseconds()
+	stats.EmptyAcquireCount = s.EmptyAcquireCount()
+	stats.CanceledAcquireCount = s.CanceledAcquireCount()
+	stats.NewConnsCount = s.NewConnsCount()
+	stats.MaxLifetimeDestroyCount = s.MaxLifetimeDestroyCount()
+	stats.MaxIdleDestroyCount = s.MaxIdleDestroyCount()
+
+	return stats, nil
+}
+
+// reapIdlePools periodically closes pools which no tab is using and which have been
+// idle for longer than their idle timeout. The pool id stays valid and the pool is
+// reopened by GetPool when it's needed again.
+func (pm *PoolManager) reapIdlePools() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pm.mu.Lock()
+		for _, mp := range pm.pools {
+			if mp.pool == nil || len(mp.tabs) > 0 {
+				continue
+			}
+
+			idleTimeout := mp.config.MaxConnIdleTime
+			if idleTimeout <= 0 {
+				idleTimeout = defaultMaxConnIdleTime
+			}
+
+			if time.Since(mp.lastUsed) < idleTimeout || mp.pool.Stat().AcquiredConns() > 0 {
+				continue
+			}
+
+			mp.pool.Close()
+			mp.pool = nil
+		}
+		pm.mu.Unlock()
+	}
+}
+
+// Recover checks that the pool can still reach the server and if it can't, rebuilds it
+// under the same id from its stored config. The rebuilt pool is returned.
+func (pm *PoolManager) Recover(id uuid.UUID) (*pgxpool.Pool, error) {
+	pm.mu.Lock()
+	mp, exists := pm.pools[id]
+	pm.mu.Unlock()
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	// Only one rebuild of a pool at a time, callers waiting here will find the rebuilt pool alive
+	mp.recoverMu.Lock()
+	defer mp.recoverMu.Unlock()
+
+	pm.mu.Lock()
+	pool := mp.pool
+	pm.mu.Unlock()
+
+	if pool != nil && pingPool(pool) == nil {
+		pm.setState(id, mp, poolStateConnected, "")
+		return pool, nil
+	}
+
+	pm.setState(id, mp, poolStateReconnecting, "")
+
+	newPool, err := pgxpool.NewWithConfig(context.Background(), mp.config)
+	if err == nil {
+		err = pingPool(newPool)
+		if err != nil {
+			newPool.Close()
+		}
+	}
+	if err != nil {
+		pm.setState(id, mp, poolStateLost, err.Error())
+		return nil, err
+	}
+
+	pm.mu.Lock()
+	// The pool may have been terminated while it was being rebuilt
+	if current, exists := pm.pools[id]; !exists || current != mp {
+		pm.mu.Unlock()
+		newPool.Close()
+		return nil, errors.New("pool doesn't exist")
+	}
+	oldPool := mp.pool
+	mp.pool = newPool
+	mp.lastUsed = time.Now()
+	pm.mu.Unlock()
+
+	// Close waits for acquired connections to be released so don't block on it
+	if oldPool != nil {
+		go oldPool.Close()
+	}
+
+	pm.setState(id, mp, poolStateConnected, "")
+
+	return newPool, nil
+}
+
+// setState records the connection state of the pool and emits it to the frontend when it changes
+func (pm *PoolManager) setState(id uuid.UUID, mp *managedPool, state, message string) {
+	pm.mu.Lock()
+	changed := mp.state != state
+	mp.state = state
+	ctx := pm.ctx
+	pm.mu.Unlock()
+
+	if !changed || ctx == nil {
+		return
+	}
+
+	runtime.EventsEmit(ctx, PoolStateEvent, model.PoolState{
+		PoolID:               id.String(),
+		PostgresConnectionID: mp.postgresConnID,
+		Database:             mp.database,
+		State:                state,
+		Message:              message,
+	})
+}
+
+// emit sends an event to the frontend, once the wails runtime context is set
+func (pm *PoolManager) emit(name string, data any) {
+	pm.mu.Lock()
+	ctx := pm.ctx
+	pm.mu.Unlock()
+
+	if ctx == nil {
+		return
+	}
+	runtime.EventsEmit(ctx, name, data)
+}
+
+// acquireConn takes a dedicated connection from the pool, giving up after acquireTimeout
+// instead of waiting for as long as cursors, listeners and jobs hold every connection
+func acquireConn(ctx context.Context, pool *pgxpool.Pool) (*pgxpool.Conn, error) {
+	acquireCtx, cancel := context.WithTimeout(ctx, acquireTimeout)
+	defer cancel()
+
+	conn, err := pool.Acquire(acquireCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(acquireCtx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("all %d connections of the pool are in use by open results, listeners or jobs, close some of them or raise the connection's max connections", pool.Config().MaxConns)
+	}
+	return conn, err
+}
+
+// pingPool checks if the pool can still reach the server
+func pingPool(pool *pgxpool.Pool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	return pool.Ping(ctx)
+}
+
+// watchConnections detects the system waking up from sleep by a jump in the wall clock
+// between ticks and then checks every open pool. Pools which were lost are retried on
+// every tick until they come back.
+func (pm *PoolManager) watchConnections() {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	// Round(0) strips the monotonic reading which doesn't advance while the system sleeps
+	lastTick := time.Now().Round(0)
+
+	for range ticker.C {
+		now := time.Now().Round(0)
+		woke := now.Sub(lastTick) > 3*watchInterval
+		lastTick = now
+
+		pm.mu.Lock()
+		var ids []uuid.UUID
+		for id, mp := range pm.pools {
+			if mp.pool == nil && mp.state != poolStateLost {
+				continue
+			}
+			if woke || mp.state == poolStateLost {
+				ids = append(ids, id)
+			}
+		}
+		pm.mu.Unlock()
+
+		for _, id := range ids {
+			_, _ = pm.Recover(id)
+		}
+	}
+}
+
+// Connection returns the postgres connection id and database the pool is connected to
+func (pm *PoolManager) Connection(id uuid.UUID) (int64, string, bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	mp, exists := pm.pools[id]
+	if !exists {
+		return 0, "", false
+	}
+	return mp.postgresConnID, mp.database, true
+}
+
+// PoolsForConnection returns the ids of all pools of the postgres connection
+func (pm *PoolManager) PoolsForConnection(postgresConnID int64) []uuid.UUID {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	var ids []uuid.UUID
+	for id, mp := range pm.pools {
+		if mp.postgresConnID == postgresConnID {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Reconfigure replaces the config of the pool. The current pool is closed and
+// reopened with the new config by GetPool the next time it's used.
+func (pm *PoolManager) Reconfigure(id uuid.UUID, config *pgxpool.Config) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	mp, exists := pm.pools[id]
+	if !exists {
+		return errors.New("pool doesn't exist")
+	}
+
+	mp.config = config
+	if mp.pool != nil {
+		// Close waits for acquired connections to be released so don't block on it
+		go mp.pool.Close()
+		mp.pool = nil
+	}
 
 	return nil
 }
+
+// IdlePIDs returns the backend pids of the pool's idle connections without reopening
+// the pool if it's evicted
+func (pm *PoolManager) IdlePIDs(id uuid.UUID) []uint32 {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	mp, exists := pm.pools[id]
+	if !exists || mp.pool == nil {
+		return nil
+	}
+
+	var pids []uint32
+	for _, conn := range mp.pool.AcquireAllIdle(context.Background()) {
+		pids = append(pids, conn.Conn().PgConn().PID())
+		conn.Release()
+	}
+	return pids
+}
+
+// ReplicationConfig returns the connection config of the pool for a logical replication
+// connection, which can't be acquired from the pool itself
+func (pm *PoolManager) ReplicationConfig(id uuid.UUID) (*pgconn.Config, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	mp, exists := pm.pools[id]
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	config := mp.config.ConnConfig.Config.Copy()
+	config.RuntimeParams["replication"] = "database"
+	return config, nil
+}
@@ -0,0 +1,203 @@
+package app
+
+import (
+	"context"
+	"database/sql/driver"
+	"dbmx/model"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Statements which may modify data even though they start like a read
+var writeInReadRegex = regexp.MustCompile(`(?i)\b(insert|update|delete|merge|into|nextval|setval|analyze|lock)\b|\bfor\s+(update|share|no\s+key\s+update|key\s+share)\b`)
+
+// isIdempotentRead reports if the query is a single statement which only reads data,
+// so it's safe to run it again
+func isIdempotentRead(query string) bool {
+	statements := splitStatements(query)
+	if len(statements) != 1 {
+		return false
+	}
+
+	info := classifyStatement(statements[0])
+	if info.Kind != statementRead {
+		return false
+	}
+
+	// FETCH moves a cursor, so running it again reads other rows
+	switch strings.Fields(info.Command)[0] {
+	case "SELECT", "SHOW", "EXPLAIN", "VALUES", "TABLE":
+	default:
+		return false
+	}
+
+	return !writeInReadRegex.MatchString(statements[0].text)
+}
+
+// isConnectionError reports if the error was caused by a broken connection to the server
+// rather than by the query itself
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if pgconn.SafeToRetry(err) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// Class 08 is connection exception, 57P01-57P03 are server shutdowns and restarts
+		return strings.HasPrefix(pgErr.Code, "08") || pgErr.Code == "57P01" || pgErr.Code == "57P02" || pgErr.Code == "57P03"
+	}
+
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	return strings.Contains(err.Error(), "conn closed")
+}
+
+// notSent reports if the query failed before any of it was sent to the server, so that
+// running it again can't repeat what it did
+func notSent(err error) bool {
+	if pgconn.SafeToRetry(err) {
+		return true
+	}
+
+	var connectErr *pgconn.ConnectError
+	return errors.As(err, &connectErr)
+}
+
+// queryCells runs a read query on the pool and reads all resulting rows into cells
+func queryCells(ctx context.Context, pool *pgxpool.Pool, query string, args ...any) ([]string, [][]model.Cell, error) {
+	resultRows, err := pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resultRows.Close()
+
+	return readCells(resultRows)
+}
+
+// readCells reads all rows into cells and returns them along with the column names
+func readCells(resultRows pgx.Rows) ([]string, [][]model.Cell, error) {
+	columns := resultRows.FieldDescriptions()
+	columnNames := make([]string, len(columns))
+	for i, column := range columns {
+		columnNames[i] = string(column.Name)
+	}
+
+	var rows [][]model.Cell
+
+	for resultRows.Next() {
+		row, err := resultRows.Values()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		cells := []model.Cell{}
+		for i, cell := range row {
+			cells = append(cells, model.Cell{
+				Column: columnNames[i],
+				Value:  cellValue(cell),
+				Null:   cell == nil,
+			})
+		}
+		rows = append(rows, cells)
+	}
+
+	if err := resultRows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return columnNames, rows, nil
+}
+
+// cellValue formats a value read from postgres for display in the grid
+func cellValue(cell any) string {
+	switch v := cell.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		// Keeps the fractional seconds so that the value still matches the stored one
+		return v.Format(time.RFC3339Nano)
+	case nil:
+		return "NULL"
+	case [16]uint8:
+		return uuid.UUID(v).String()
+	case string:
+		return v
+	case driver.Valuer:
+		// pgtype values such as numeric and interval encode to their postgres text
+		value, err := v.Value()
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		if value == nil {
+			return "NULL"
+		}
+		return cellValue(value)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// runReadQuery runs a read query on the active pool. If the connection to the server was
+// lost, the pool is rebuilt under the same id and an idempotent query is retried once, as
+// long as it never reached the server. A read may still call a function which writes.
+func (c *Connections) runReadQuery(ctx context.Context, activePoolID uuid.UUID, query string, args ...any) ([]string, [][]model.Cell, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, nil, errors.New("pool doesn't exist")
+	}
+
+	columns, rows, err := queryCells(ctx, pool, query, args...)
+	if !isConnectionError(err) {
+		return columns, rows, err
+	}
+
+	pool, recoverErr := c.PM.Recover(activePoolID)
+	if recoverErr != nil || !notSent(err) || !isIdempotentRead(query) {
+		return nil, nil, err
+	}
+
+	return queryCells(ctx, pool, query, args...)
+}
+
+// runWriteQuery runs a write query on the active pool. Writes are never retried but a
+// lost connection still triggers a rebuild of the pool so the next query works.
+func (c *Connections) runWriteQuery(ctx context.Context, activePoolID uuid.UUID, query string, args ...any) (pgconn.CommandTag, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return pgconn.CommandTag{}, errors.New("pool doesn't exist")
+	}
+
+	tag, err := pool.Exec(ctx, query, args...)
+	if isConnectionError(err) {
+		_, _ = c.PM.Recover(activePoolID)
+	}
+
+	return tag, err
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"io"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pkg/errors"
+)
+
+func TestIsIdempotentRead(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT * FROM users", true},
+		{"  select id from users where id = 1;  ", true},
+		{"SHOW work_mem", true},
+		{"VALUES (1), (2)", true},
+		{"TABLE users", true},
+		{"EXPLAIN SELECT 1", true},
+		{"WITH t AS (SELECT 1) SELECT * FROM t", true},
+		{"", false},
+		{"SELECT 1; SELECT 2", false},
+		{"FETCH 10 FROM c", false},
+		{"EXPLAIN ANALYZE SELECT 1", false},
+		{"SELECT * INTO copy FROM users", false},
+		{"SELECT nextval('users_id_seq')", false},
+		{"SELECT * FROM users FOR UPDATE", false},
+		{"SELECT * FROM users FOR NO KEY UPDATE", false},
+		{"WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d", false},
+		{"UPDATE users SET a = 1 WHERE id = 1", false},
+		{"BEGIN", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := isIdempotentRead(tt.query); got != tt.want {
+				t.Errorf("isIdempotentRead(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+// retryableError is an error pgconn reports as safe to retry
+type retryableError struct{ safe bool }
+
+func (e retryableError) Error() string     { return "conn busy" }
+func (e retryableError) SafeToRetry() bool { return e.safe }
+
+func TestNotSent(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"safe to retry", retryableError{safe: true}, true},
+		{"wrapped safe to retry", errors.Wrap(retryableError{safe: true}, "failed to run query"), true},
+		{"not safe to retry", retryableError{safe: false}, false},
+		{"connect error", &pgconn.ConnectError{}, true},
+		{"connection lost", io.ErrUnexpectedEOF, false},
+		{"server shutdown", &pgconn.PgError{Code: "57P01"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := notSent(tt.err); got != tt.want {
+				t.Errorf("notSent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package app
+
+import (
+	"context"
+	"dbmx/model"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// WAL an inactive slot or a slot close to being lost can keep before it's flagged
+const slotRetainedLimit = 1 << 30
+
+// slotWarning tells why a slot fills the server's disk, empty when it doesn't
+func slotWarning(s model.ReplicationSlot) string {
+	switch {
+	case s.WalStatus == "lost":
+		return "The slot lost WAL it still needed and can no longer be used"
+	case s.WalStatus == "unreserved":
+		return "The slot keeps more WAL than max_slot_wal_keep_size and is about to lose it"
+	case s.SafeWalBytes >= 0 && s.SafeWalBytes < slotRetainedLimit:
+		return fmt.Sprintf("Only %s of WAL can be written before the slot is lost", formatBytes(s.SafeWalBytes))
+	case !s.Active && s.RetainedBytes >= slotRetainedLimit:
+		return fmt.Sprintf("The slot is inactive and keeps %s of WAL", formatBytes(s.RetainedBytes))
+	case s.WalStatus == "extended":
+		return "The slot keeps more WAL than max_wal_size"
+	}
+	return ""
+}
+
+// loadStandbys reads the standbys streaming from the server, lagging behind the given position
+func loadStandbys(ctx context.Context, pool *pgxpool.Pool, current string) ([]model.ReplicationStandby, error) {
+	query := `
+		SELECT
+			pid,
+			COALESCE(application_name, ''),
+			COALESCE(client_addr::text, ''),
+			COALESCE(state, ''),
+			COALESCE(sync_state, ''),
+			COALESCE(sent_lsn::text, ''),
+			COALESCE(write_lsn::text, ''),
+			COALESCE(flush_lsn::text, ''),
+			COALESCE(replay_lsn::text, ''),
+			COALESCE(pg_wal_lsn_diff($1::pg_lsn, sent_lsn), 0)::bigint,
+			COALESCE(pg_wal_lsn_diff($1::pg_lsn, replay_lsn), 0)::bigint,
+			COALESCE(EXTRACT(EPOCH FROM write_lag)::float8, -1),
+			COALESCE(EXTRACT(EPOCH FROM flush_lag)::float8, -1),
+			COALESCE(EXTRACT(EPOCH FROM replay_lag)::float8, -1)
+		FROM pg_stat_replication
+		ORDER BY application_name, pid
+	`
+	rows, err := pool.Query(ctx, query, current)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read pg_stat_replication")
+	}
+	defer rows.Close()
+
+	standbys := []model.ReplicationStandby{}
+	for rows.Next() {
+		var s model.ReplicationStandby
+		err := rows.Scan(&s.PID, &s.ApplicationName, &s.ClientAddr, &s.State, &s.SyncState, &s.SentLSN, &s.WriteLSN, &s.FlushLSN, &s.ReplayLSN, &s.SendLagBytes, &s.ReplayLagBytes, &s.WriteLagSeconds, &s.FlushLagSeconds, &s.ReplayLagSeconds)
+		if err != nil {
+			return nil, err
+		}
+		standbys = append(standbys, s)
+	}
+
+	return standbys, rows.Err()
+}
+
+// loadSlots reads the replication slots and the WAL they keep behind the given position.
+// wal_status and safe_wal_size only exist since PostgreSQL 13.
+func loadSlots(ctx context.Context, pool *pgxpool.Pool, current string) ([]model.ReplicationSlot, error) {
+	query := `
+		SELECT
+			slot_name,
+			slot_type,
+			COALESCE(plugin, ''),
+			COALESCE(database, ''),
+			active,
+			COALESCE(active_pid, 0),
+			temporary,
+			COALESCE(pg_wal_lsn_diff($1::pg_lsn, restart_lsn), 0)::bigint,
+			COALESCE(to_jsonb(s) ->> 'wal_status', ''),
+			COALESCE((to_jsonb(s) ->> 'safe_wal_size')::bigint, -1)
+		FROM pg_replication_slots s
+		ORDER BY slot_name
+	`
+	rows, err := pool.Query(ctx, query, current)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read pg_replication_slots")
+	}
+	defer rows.Close()
+
+	slots := []model.ReplicationSlot{}
+	for rows.Next() {
+		var s model.ReplicationSlot
+		err := rows.Scan(&s.Name, &s.Type, &s.Plugin, &s.Database, &s.Active, &s.ActivePID, &s.Temporary, &s.RetainedBytes, &s.WalStatus, &s.SafeWalBytes)
+		if err != nil {
+			return nil, err
+		}
+		s.Warning = slotWarning(s)
+		s.Filling = s.Warning != ""
+		slots = append(slots, s)
+	}
+
+	return slots, rows.Err()
+}
+
+// loadWalReceiver reads the standby's connection to its upstream server, nil when the
+// receiver isn't running. The columns were renamed across versions.
+func loadWalReceiver(ctx context.Context, pool *pgxpool.Pool) (*model.WalReceiver, error) {
+	query := `
+		SELECT
+			pid,
+			COALESCE(status, ''),
+			COALESCE(to_jsonb(r) ->> 'sender_host', ''),
+			COALESCE((to_jsonb(r) ->> 'sender_port')::int, 0),
+			COALESCE(slot_name, ''),
+			COALESCE(to_jsonb(r) ->> 'flushed_lsn', to_jsonb(r) ->> 'received_lsn', ''),
+			COALESCE(to_char(last_msg_receipt_time, 'YYYY-MM-DD"T"HH24:MI:SSOF'), '')
+		FROM pg_stat_wal_receiver r
+	`
+	var r model.WalReceiver
+	err := pool.QueryRow(ctx, query).Scan(&r.PID, &r.Status, &r.SenderHost, &r.SenderPort, &r.SlotName, &r.FlushedLSN, &r.LastMessageReceipt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to read pg_stat_wal_receiver")
+	}
+	return &r, nil
+}
+
+// replicationStatus reads the replication state of the server through the pool
+func replicationStatus(ctx context.Context, pool *pgxpool.Pool) (*model.ReplicationStatus, error) {
+	status := &model.ReplicationStatus{ReplayDelaySeconds: -1}
+
+	if err := pool.QueryRow(ctx, "SELECT pg_is_in_recovery()").Scan(&status.InRecovery); err != nil {
+		return nil, err
+	}
+
+	if status.InRecovery {
+		query := `
+			SELECT
+				COALESCE(pg_last_wal_receive_lsn()::text, ''),
+				COALESCE(pg_last_wal_replay_lsn()::text, ''),
+				COALESCE(pg_wal_lsn_diff(pg_last_wal_receive_lsn(), pg_last_wal_replay_lsn()), 0)::bigint,
+				COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())::float8, -1),
+				pg_is_wal_replay_paused()
+		`
+		err := pool.QueryRow(ctx, query).Scan(&status.ReceiveLSN, &status.ReplayLSN, &status.ReplayLagBytes, &status.ReplayDelaySeconds, &status.ReplayPaused)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the recovery status")
+		}
+		status.CurrentLSN = status.ReplayLSN
+
+		status.Receiver, err = loadWalReceiver(ctx, pool)
+		if err != nil {
+			return nil, err
+		}
+	} else if err := pool.QueryRow(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&status.CurrentLSN); err != nil {
+		return nil, err
+	}
+
+	// Without a position there is nothing to measure the lag against
+	current := status.CurrentLSN
+	if current == "" {
+		current = "0/0"
+	}
+
+	var err error
+	status.Standbys, err = loadStandbys(ctx, pool, current)
+	if err != nil {
+		return nil, err
+	}
+	status.Slots, err = loadSlots(ctx, pool, current)
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// GetReplicationStatus reads the replication state of the server: its standbys and
+// slots on a primary, and the receiver and replay lag on a standby
+func (c *Connections) GetReplicationStatus(postgresConnectionID int64) (*model.ReplicationStatus, error) {
+	p, err := c.getPostgresConnection(postgresConnectionID)
+	if err != nil {
+		return nil, err
+	}
+
+	poolID, err := c.connectPool(p, defaultDatabase(p))
+	if err != nil {
+		return nil, err
+	}
+	pool, exists := c.PM.GetPool(poolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	status, err := replicationStatus(context.Background(), pool)
+	if err != nil {
+		return nil, err
+	}
+	status.PostgresConnectionID = postgresConnectionID
+
+	return status, nil
+}
+
+// DropReplicationSlot drops a slot so the server can remove the WAL it keeps. confirmName
+// has to be the slot name typed by the user, and a slot in use can't be dropped.
+func (c *Connections) DropReplicationSlot(postgresConnectionID int64, slot, confirmName, token string) *model.ReplicationSlotResult {
+	slot = strings.TrimSpace(slot)
+	if slot == "" {
+		return &model.ReplicationSlotResult{OK: false, Message: "the slot is required"}
+	}
+	if confirmName != slot {
+		return &model.ReplicationSlotResult{OK: false, Message: fmt.Sprintf("type %s to confirm dropping the slot", slot)}
+	}
+
+	p, err := c.getPostgresConnection(postgresConnectionID)
+	if err != nil {
+		return &model.ReplicationSlotResult{OK: false, Message: err.Error()}
+	}
+
+	ctx := context.Background()
+	started := time.Now()
+
+	poolID, err := c.connectPool(p, defaultDatabase(p))
+	if err != nil {
+		return &model.ReplicationSlotResult{OK: false, Message: err.Error()}
+	}
+	pool, exists := c.PM.GetPool(poolID)
+	if !exists {
+		return &model.ReplicationSlotResult{OK: false, Message: "pool doesn't exist"}
+	}
+
+	statement := fmt.Sprintf("SELECT pg_drop_replication_slot(%s)", quoteLiteral(slot))
+
+	// The statement is a SELECT to the parser, the policy is applied as for a DROP
+	policy, err := loadEnvPolicy(c.DB, p.Env)
+	if err != nil {
+		return &model.ReplicationSlotResult{OK: false, Message: err.Error()}
+	}
+	if policy.ReadOnly || policy.BlockDestructive {
+		err := fmt.Errorf("dropping replication slots is blocked on %s connections", policy.Env)
+		c.audit(poolID, statement, started, 0, auditBlocked, err)
+		return &model.ReplicationSlotResult{OK: false, Message: err.Error()}
+	}
+
+	var active bool
+	var activePID int32
+	err = pool.QueryRow(ctx, "SELECT active, COALESCE(active_pid, 0) FROM pg_replication_slots WHERE slot_name = $1", slot).Scan(&active, &activePID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return &model.ReplicationSlotResult{OK: false, Message: fmt.Sprintf("slot %s doesn't exist", slot)}
+		}
+		return &model.ReplicationSlotResult{OK: false, Message: err.Error()}
+	}
+	if active {
+		return &model.ReplicationSlotResult{OK: false, Message: fmt.Sprintf("slot %s is in use by session %d", slot, activePID)}
+	}
+
+	if policy.ConfirmWrites && !c.consumeConfirmation(poolID, statement, token) {
+		infos := []statementInfo{{Command: "DROP", Kind: statementDDL}}
+		confirmation, err := c.requestConfirmation(ctx, poolID, policy, statement, splitStatements(statement), infos)
+		if err != nil {
+			return &model.ReplicationSlotResult{OK: false, Message: err.Error()}
+		}
+
+		return &model.ReplicationSlotResult{
+			OK:                   false,
+			Message:              fmt.Sprintf("Dropping a replication slot on a %s connection needs to be confirmed", policy.Env),
+			RequiresConfirmation: true,
+			Confirmation:         confirmation,
+		}
+	}
+
+	started = time.Now()
+	if _, err := pool.Exec(ctx, statement); err != nil {
+		c.audit(poolID, statement, started, 0, auditError, err)
+		return &model.ReplicationSlotResult{OK: false, Message: err.Error()}
+	}
+	c.audit(poolID, statement, started, 0, auditSuccess, nil)
+
+	return &model.ReplicationSlotResult{OK: true, Message: fmt.Sprintf("Replication slot %s dropped", slot)}
+}
@@ -0,0 +1,434 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"dbmx/model"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Rows stored per compressed chunk of a result
+	resultChunkSize = 1000
+
+	// Results are cut off after this many rows and marked as truncated
+	maxStoredResultRows = 50000
+
+	// Rows returned when a tab is opened, further pages are loaded on demand
+	defaultResultPageSize = 500
+)
+
+// resultJob is a result waiting to be written for a tab
+type resultJob struct {
+	tabID  int64
+	seq    int64
+	output *model.Output
+
+	// Rows fetched later from a cursor, appended to the result of the same run
+	appendRows [][]model.Cell
+}
+
+// resultQueue is the write queue of a tab. Sends happen outside of the store's lock,
+// the queue's own lock keeps them from racing with closing it.
+type resultQueue struct {
+	jobs   chan resultJob
+	closed bool
+	mu     sync.RWMutex
+	// Closed once every queued job was written
+	drained chan struct{}
+}
+
+// send queues the job, it's dropped when the queue was closed in the meantime
+func (q *resultQueue) send(job resultJob) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return
+	}
+	q.jobs <- job
+}
+
+// close stops the queue and waits for the jobs already queued to be written
+func (q *resultQueue) close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	<-q.drained
+}
+
+// ResultStore persists query results of tabs in chunks, separate from the tabs table.
+// Writes of a tab go through the tab's own queue in the order they were issued, and
+// every result carries the sequence number of the run that produced it so that a run
+// which finishes late never overwrites the result of a newer run.
+type ResultStore struct {
+	DB *sql.DB
+
+	// Last sequence number handed out per tab
+	seqs   map[int64]int64
+	queues map[int64]*resultQueue
+	mu     sync.Mutex
+}
+
+func NewResultStore(db *sql.DB) *ResultStore {
+	return &ResultStore{
+		DB:     db,
+		seqs:   make(map[int64]int64),
+		queues: make(map[int64]*resultQueue),
+	}
+}
+
+// NextSeq returns the sequence number for a new run in the tab. It has to be taken
+// when the run starts, not when it finishes.
+func (rs *ResultStore) NextSeq(tabID int64) int64 {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	seq, exists := rs.seqs[tabID]
+	if !exists {
+		// Continue after the result already stored for the tab
+		err := rs.DB.QueryRow("SELECT seq FROM tab_results WHERE tab_id = ?", tabID).Scan(&seq)
+		if err != nil && err != sql.ErrNoRows {
+			fmt.Println(err)
+		}
+	}
+
+	seq++
+	rs.seqs[tabID] = seq
+	return seq
+}
+
+// Enqueue queues the result of a run to be written for the tab
+func (rs *ResultStore) Enqueue(tabID, seq int64, output *model.Output) {
+	rs.queue(tabID).send(resultJob{tabID: tabID, seq: seq, output: output})
+}
+
+// EnqueueAppend queues rows to be appended to the stored result of the run
+func (rs *ResultStore) EnqueueAppend(tabID, seq int64, rows [][]model.Cell) {
+	rs.queue(tabID).send(resultJob{tabID: tabID, seq: seq, appendRows: rows})
+}
+
+// queue returns the write queue of the tab, starting it on first use. Only the lookup
+// holds the store's lock, a full queue blocks the sender alone.
+func (rs *ResultStore) queue(tabID int64) *resultQueue {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	queue, exists := rs.queues[tabID]
+	if !exists {
+		queue = &resultQueue{jobs: make(chan resultJob, 16), drained: make(chan struct{})}
+		rs.queues[tabID] = queue
+		go rs.drain(queue)
+	}
+	return queue
+}
+
+// drain writes the queued results of a tab one after the other until the queue is closed
+func (rs *ResultStore) drain(queue *resultQueue) {
+	defer close(queue.drained)
+
+	for job := range queue.jobs {
+		var err error
+		if job.output != nil {
+			err = rs.save(job)
+		} else {
+			err = rs.append(job)
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// save writes the result unless a newer run of the tab has already been stored
+func (rs *ResultStore) save(job resultJob) error {
+	columns := job.output.Columns
+	rows := job.output.Rows
+
+	totalRows := int64(len(rows))
+	truncated := false
+	if len(rows) > maxStoredResultRows {
+		rows = rows[:maxStoredResultRows]
+		truncated = true
+	}
+
+	columnsJSON, err := json.Marshal(columns)
+	if err != nil {
+		return err
+	}
+
+	tx, err := rs.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only replace an older result
+	query := `
+		INSERT INTO tab_results (tab_id, seq, columns, total_rows, stored_rows, truncated, chunk_size, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (tab_id) DO UPDATE SET
+			seq = excluded.seq,
+			columns = excluded.columns,
+			total_rows = excluded.total_rows,
+			stored_rows = excluded.stored_rows,
+			truncated = excluded.truncated,
+			chunk_size = excluded.chunk_size,
+			created_at = excluded.created_at
+		WHERE excluded.seq > tab_results.seq
+	`
+	result, err := tx.Exec(query, job.tabID, job.seq, string(columnsJSON), totalRows, len(rows), truncated, resultChunkSize, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return errors.Wrap(err, "failed to save tab result")
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		// A newer run already stored its result
+		return nil
+	}
+
+	_, err = tx.Exec("DELETE FROM tab_result_chunks WHERE tab_id = ?", job.tabID)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i*resultChunkSize < len(rows); i++ {
+		end := min((i+1)*resultChunkSize, len(rows))
+
+		data, err := compressRows(rows[i*resultChunkSize : end])
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO tab_result_chunks (tab_id, chunk_index, data) VALUES (?, ?, ?)", job.tabID, i, data)
+		if err != nil {
+			return errors.Wrap(err, "failed to save tab result chunk")
+		}
+	}
+
+	return tx.Commit()
+}
+
+// append adds rows to the stored result if it's still the result of the job's run
+func (rs *ResultStore) append(job resultJob) error {
+	tx, err := rs.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var seq, totalRows, storedRows int64
+	var truncated bool
+	var chunkSize int
+	err = tx.QueryRow("SELECT seq, total_rows, stored_rows, truncated, chunk_size FROM tab_results WHERE tab_id = ?", job.tabID).Scan(&seq, &totalRows, &storedRows, &truncated, &chunkSize)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	// A newer run replaced the result
+	if seq != job.seq {
+		return nil
+	}
+
+	rows := job.appendRows
+	totalRows += int64(len(rows))
+	if storedRows+int64(len(rows)) > maxStoredResultRows {
+		rows = rows[:maxStoredResultRows-storedRows]
+		truncated = true
+	}
+
+	// Fill up the last chunk if it's partial, then add new chunks
+	chunkIndex := int(storedRows) / chunkSize
+	if partial := int(storedRows) % chunkSize; partial > 0 && len(rows) > 0 {
+		var data []byte
+		err = tx.QueryRow("SELECT data FROM tab_result_chunks WHERE tab_id = ? AND chunk_index = ?", job.tabID, chunkIndex).Scan(&data)
+		if err != nil {
+			return err
+		}
+
+		lastRows, err := decompressRows(data)
+		if err != nil {
+			return err
+		}
+
+		fill := min(chunkSize-partial, len(rows))
+		data, err = compressRows(append(lastRows, rows[:fill]...))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE tab_result_chunks SET data = ? WHERE tab_id = ? AND chunk_index = ?", data, job.tabID, chunkIndex)
+		if err != nil {
+			return err
+		}
+
+		rows = rows[fill:]
+		chunkIndex++
+	}
+
+	for i := 0; i*chunkSize < len(rows); i++ {
+		end := min((i+1)*chunkSize, len(rows))
+
+		data, err := compressRows(rows[i*chunkSize : end])
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO tab_result_chunks (tab_id, chunk_index, data) VALUES (?, ?, ?)", job.tabID, chunkIndex+i, data)
+		if err != nil {
+			return errors.Wrap(err, "failed to save tab result chunk")
+		}
+	}
+
+	storedRows = min(storedRows+int64(len(job.appendRows)), maxStoredResultRows)
+	_, err = tx.Exec("UPDATE tab_results SET total_rows = ?, stored_rows = ?, truncated = ? WHERE tab_id = ?", totalRows, storedRows, truncated, job.tabID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Page reads rows [offset, offset+limit) of the stored result of the tab.
+// It returns nil if the tab has no stored result.
+func (rs *ResultStore) Page(tabID int64, offset, limit int) (*model.ResultPage, error) {
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = defaultResultPageSize
+	}
+
+	page := &model.ResultPage{TabID: tabID, Offset: offset}
+
+	var columnsJSON string
+	var chunkSize int
+	row := rs.DB.QueryRow("SELECT seq, columns, total_rows, stored_rows, truncated, chunk_size FROM tab_results WHERE tab_id = ?", tabID)
+	err := row.Scan(&page.Seq, &columnsJSON, &page.TotalRows, &page.StoredRows, &page.Truncated, &chunkSize)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal([]byte(columnsJSON), &page.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(offset) >= page.StoredRows || chunkSize <= 0 {
+		return page, nil
+	}
+
+	// Only decompress the chunks covering the page
+	firstChunk := offset / chunkSize
+	lastChunk := (offset + limit - 1) / chunkSize
+
+	rows, err := rs.DB.Query("SELECT chunk_index, data FROM tab_result_chunks WHERE tab_id = ? AND chunk_index BETWEEN ? AND ? ORDER BY chunk_index", tabID, firstChunk, lastChunk)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chunkIndex int
+		var data []byte
+		err := rows.Scan(&chunkIndex, &data)
+		if err != nil {
+			return nil, err
+		}
+
+		chunkRows, err := decompressRows(data)
+		if err != nil {
+			return nil, err
+		}
+
+		// Position of the page within this chunk
+		chunkStart := chunkIndex * chunkSize
+		from := max(offset-chunkStart, 0)
+		to := min(offset+limit-chunkStart, len(chunkRows))
+		if from < to {
+			page.Rows = append(page.Rows, chunkRows[from:to]...)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// Delete removes the stored result of the tab and stops its queue
+func (rs *ResultStore) Delete(tabID int64) error {
+	rs.mu.Lock()
+	queue, exists := rs.queues[tabID]
+	delete(rs.queues, tabID)
+	delete(rs.seqs, tabID)
+	rs.mu.Unlock()
+
+	// Writes still queued would land after the delete
+	if exists {
+		queue.close()
+	}
+
+	// Chunks are removed by the foreign key cascade
+	_, err := rs.DB.Exec("DELETE FROM tab_results WHERE tab_id = ?", tabID)
+	return err
+}
+
+func compressRows(rows [][]model.Cell) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+
+	err := json.NewEncoder(zw).Encode(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompressRows(data []byte) ([][]model.Cell, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows [][]model.Cell
+	err = json.Unmarshal(raw, &rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
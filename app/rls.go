@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	"dbmx/model"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RunQueryAsRole runs a single query as another role to show what row level security
+// lets that role see or change. It runs in a transaction which is always rolled back,
+// so data changing statements leave nothing behind. The environment policy still applies,
+// when it asks for confirmation the token returned in the confirmation has to be passed.
+func (c *Connections) RunQueryAsRole(activePoolID uuid.UUID, query, role, token string) *model.QueryResult {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return &model.QueryResult{OK: false, Message: "pool doesn't exist"}
+	}
+
+	role = strings.TrimSpace(role)
+	if role == "" {
+		return &model.QueryResult{OK: false, Message: "the role to run the query as is required"}
+	}
+
+	statements := splitStatements(query)
+	if len(statements) != 1 {
+		return &model.QueryResult{OK: false, Message: "only a single statement can be run as another role"}
+	}
+	if info := classifyStatement(statements[0]); info.Kind != statementRead && info.Kind != statementDML {
+		return &model.QueryResult{OK: false, Message: fmt.Sprintf("%s can't be run as another role, only queries and data changes are", info.Command)}
+	}
+
+	ctx := context.Background()
+	started := time.Now()
+
+	// Functions called by the query may reach outside of the rolled back transaction
+	policy, err := c.poolPolicy(activePoolID)
+	if err != nil {
+		return &model.QueryResult{OK: false, Message: err.Error()}
+	}
+
+	toConfirm, toConfirmInfo, err := checkPolicy(policy, query)
+	if err != nil {
+		c.audit(activePoolID, query, started, 0, auditBlocked, err)
+		return &model.QueryResult{OK: false, Message: err.Error()}
+	}
+
+	if len(toConfirm) > 0 && !c.consumeConfirmation(activePoolID, query, token) {
+		confirmation, err := c.requestConfirmation(ctx, activePoolID, policy, query, toConfirm, toConfirmInfo)
+		if err != nil {
+			return &model.QueryResult{OK: false, Message: err.Error()}
+		}
+
+		return &model.QueryResult{
+			OK:                   false,
+			Message:              fmt.Sprintf("This query changes data on a %s connection and needs to be confirmed, even though it's rolled back", policy.Env),
+			RequiresConfirmation: true,
+			Confirmation:         confirmation,
+		}
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return &model.QueryResult{OK: false, Message: err.Error()}
+	}
+	defer tx.Rollback(ctx)
+
+	// Only lasts until the rollback, the pooled connection keeps its own role
+	if _, err := tx.Exec(ctx, "SET LOCAL ROLE "+quoteIdent(role)); err != nil {
+		return &model.QueryResult{OK: false, Message: err.Error()}
+	}
+
+	resultRows, err := tx.Query(ctx, statements[0].text)
+	if err != nil {
+		c.audit(activePoolID, statements[0].text, started, 0, auditDryRun, err)
+		return &model.QueryResult{OK: false, Message: err.Error()}
+	}
+	columns, rows, err := readCells(resultRows)
+	resultRows.Close()
+	if err != nil {
+		c.audit(activePoolID, statements[0].text, started, 0, auditDryRun, err)
+		return &model.QueryResult{OK: false, Message: err.Error()}
+	}
+
+	rowsAffected := resultRows.CommandTag().RowsAffected()
+	c.audit(activePoolID, statements[0].text, started, rowsAffected, auditDryRun, nil)
+
+	response := &model.QueryResult{
+		OK:           true,
+		Columns:      columns,
+		Rows:         rows,
+		RowsAffected: rowsAffected,
+		Message:      fmt.Sprintf("Ran as %s and rolled back", role),
+	}
+
+	// Data changes without RETURNING only report how many rows the role could touch
+	if len(columns) == 0 {
+		response.Columns = []string{"Rows Affected"}
+		response.Rows = [][]model.Cell{{model.Cell{Column: "Rows Affected", Value: fmt.Sprintf("%d", rowsAffected)}}}
+	}
+
+	return response
+}
@@ -0,0 +1,692 @@
+package app
+
+import (
+	"context"
+	"dbmx/model"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Shown in place of passwords in previews and the audit log
+const maskedPassword = "'********'"
+
+// Privileges which apply to each kind of object, in the order of the matrix
+var objectPrivileges = map[string][]string{
+	"database": {"CONNECT", "CREATE", "TEMPORARY"},
+	"schema":   {"USAGE", "CREATE"},
+	"table":    {"SELECT", "INSERT", "UPDATE", "DELETE", "TRUNCATE", "REFERENCES", "TRIGGER"},
+	"column":   {"SELECT", "INSERT", "UPDATE", "REFERENCES"},
+	"sequence": {"USAGE", "SELECT", "UPDATE"},
+	"function": {"EXECUTE"},
+}
+
+// GRANT object types and the privileges they take
+var grantObjects = map[string]string{
+	"table":         "table",
+	"sequence":      "sequence",
+	"function":      "function",
+	"schema":        "schema",
+	"database":      "database",
+	"all tables":    "table",
+	"all sequences": "sequence",
+	"all functions": "function",
+}
+
+var defaultACLTypes = map[string]string{
+	"r": "table",
+	"S": "sequence",
+	"f": "function",
+	"T": "type",
+	"n": "schema",
+}
+
+// privilegeChecks renders the has_*_privilege calls for the privileges as an array
+func privilegeChecks(function, object string, privileges []string) string {
+	checks := make([]string, len(privileges))
+	for i, privilege := range privileges {
+		checks[i] = fmt.Sprintf("%s($1::name, %s, '%s')", function, object, privilege)
+	}
+	return "ARRAY[" + strings.Join(checks, ", ") + "]"
+}
+
+// aclOf renders the direct and grantable privileges of the role in the acl
+func aclOf(acl string) string {
+	return fmt.Sprintf(`
+		ARRAY(SELECT a.privilege_type FROM aclexplode(%[1]s) a WHERE a.grantee = r.oid ORDER BY 1),
+		ARRAY(SELECT a.privilege_type FROM aclexplode(%[1]s) a WHERE a.grantee = r.oid AND a.is_grantable ORDER BY 1)`, acl)
+}
+
+// loadPrivilegeRows runs a privilege query returning the object type, schema, name,
+// column, the has_*_privilege results for the privileges and the role's direct and
+// grantable privileges
+func loadPrivilegeRows(ctx context.Context, pool *pgxpool.Pool, query string, privileges []string, args ...any) ([]model.PrivilegeRow, error) {
+	rows, err := pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read privileges")
+	}
+	defer rows.Close()
+
+	var result []model.PrivilegeRow
+	for rows.Next() {
+		var row model.PrivilegeRow
+		var effective []bool
+		if err := rows.Scan(&row.ObjectType, &row.Schema, &row.Name, &row.Column, &effective, &row.Direct, &row.Grantable); err != nil {
+			return nil, err
+		}
+		if kind, exists := relationKinds[row.ObjectType]; exists {
+			row.ObjectType = kind
+		} else if row.ObjectType == "S" {
+			row.ObjectType = "sequence"
+		}
+
+		row.Effective = make(map[string]bool, len(privileges))
+		for i, privilege := range privileges {
+			row.Effective[privilege] = effective[i]
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+// GetRoles lists the roles of the server with their memberships, leaving out the
+// predefined pg_ roles
+func (c *Connections) GetRoles(activePoolID uuid.UUID) ([]model.Role, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	ctx := context.Background()
+
+	query := `
+		SELECT
+			r.rolname, r.rolsuper, r.rolcreatedb, r.rolcreaterole, r.rolinherit, r.rolcanlogin,
+			r.rolreplication, r.rolbypassrls, r.rolconnlimit,
+			COALESCE(to_char(r.rolvaliduntil, 'YYYY-MM-DD"T"HH24:MI:SSOF'), ''),
+			COALESCE(shobj_description(r.oid, 'pg_authid'), '')
+		FROM pg_roles r
+		WHERE r.rolname NOT LIKE 'pg\_%'
+		ORDER BY r.rolname
+	`
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list roles")
+	}
+
+	roles := []model.Role{}
+	index := make(map[string]int)
+	for rows.Next() {
+		r := model.Role{MemberOf: []model.RoleMembership{}, Members: []model.RoleMembership{}}
+		err := rows.Scan(&r.Name, &r.Superuser, &r.CreateDB, &r.CreateRole, &r.Inherit, &r.Login, &r.Replication, &r.BypassRLS, &r.ConnectionLimit, &r.ValidUntil, &r.Comment)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[r.Name] = len(roles)
+		roles = append(roles, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT g.rolname, m.rolname, am.admin_option
+		FROM pg_auth_members am
+		JOIN pg_roles g ON g.oid = am.roleid
+		JOIN pg_roles m ON m.oid = am.member
+		ORDER BY g.rolname, m.rolname
+	`
+	rows, err = pool.Query(ctx, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list role memberships")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var group, member string
+		var admin bool
+		if err := rows.Scan(&group, &member, &admin); err != nil {
+			return nil, err
+		}
+		if i, exists := index[member]; exists {
+			roles[i].MemberOf = append(roles[i].MemberOf, model.RoleMembership{Role: group, AdminOption: admin})
+		}
+		if i, exists := index[group]; exists {
+			roles[i].Members = append(roles[i].Members, model.RoleMembership{Role: member, AdminOption: admin})
+		}
+	}
+
+	return roles, rows.Err()
+}
+
+// GetPrivilegeMatrix returns the effective privileges of the role on the database and
+// on the schemas, tables, columns with column privileges, sequences and functions in
+// it. An empty schema covers all schemas.
+func (c *Connections) GetPrivilegeMatrix(activePoolID uuid.UUID, role, schema string) (*model.PrivilegeMatrix, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	ctx := context.Background()
+
+	var roleExists bool
+	if err := pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", role).Scan(&roleExists); err != nil {
+		return nil, err
+	}
+	if !roleExists {
+		return nil, errors.Errorf("role %s doesn't exist", role)
+	}
+
+	// Every query has the role as $1 and the schema as $2
+	roleRow := `(SELECT oid FROM pg_roles WHERE rolname = $1) r`
+	schemaFilter := `($2::text = '' OR n.nspname = $2::text)`
+
+	queries := []struct {
+		query      string
+		privileges []string
+	}{
+		{
+			query: `
+				SELECT 'database', '', d.datname, '', ` + privilegeChecks("has_database_privilege", "d.oid", objectPrivileges["database"]) + `,` +
+				aclOf("COALESCE(d.datacl, acldefault('d', d.datdba))") + `
+				FROM pg_database d, ` + roleRow + `
+				WHERE d.datname = current_database() AND $2::text IS NOT NULL
+			`,
+			privileges: objectPrivileges["database"],
+		},
+		{
+			query: `
+				SELECT 'schema', n.nspname, n.nspname, '', ` + privilegeChecks("has_schema_privilege", "n.oid", objectPrivileges["schema"]) + `,` +
+				aclOf("COALESCE(n.nspacl, acldefault('n', n.nspowner))") + `
+				FROM pg_namespace n, ` + roleRow + `
+				WHERE ` + systemSchemaFilter + ` AND ` + schemaFilter + `
+				ORDER BY n.nspname
+			`,
+			privileges: objectPrivileges["schema"],
+		},
+		{
+			query: `
+				SELECT c.relkind::text, n.nspname, c.relname, '', ` + privilegeChecks("has_table_privilege", "c.oid", objectPrivileges["table"]) + `,` +
+				aclOf("COALESCE(c.relacl, acldefault('r', c.relowner))") + `
+				FROM pg_class c
+				JOIN pg_namespace n ON n.oid = c.relnamespace, ` + roleRow + `
+				WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f') AND ` + systemSchemaFilter + ` AND ` + schemaFilter + `
+				ORDER BY n.nspname, c.relname
+			`,
+			privileges: objectPrivileges["table"],
+		},
+		{
+			// Only columns with privileges of their own, the others follow their table
+			query: `
+				SELECT 'column', n.nspname, c.relname, a.attname, ` + privilegeChecks("has_column_privilege", "c.oid, a.attnum", objectPrivileges["column"]) + `,` +
+				aclOf("a.attacl") + `
+				FROM pg_attribute a
+				JOIN pg_class c ON c.oid = a.attrelid
+				JOIN pg_namespace n ON n.oid = c.relnamespace, ` + roleRow + `
+				WHERE a.attnum > 0 AND NOT a.attisdropped AND a.attacl IS NOT NULL AND ` + systemSchemaFilter + ` AND ` + schemaFilter + `
+				ORDER BY n.nspname, c.relname, a.attnum
+			`,
+			privileges: objectPrivileges["column"],
+		},
+		{
+			query: `
+				SELECT c.relkind::text, n.nspname, c.relname, '', ` + privilegeChecks("has_sequence_privilege", "c.oid", objectPrivileges["sequence"]) + `,` +
+				aclOf("COALESCE(c.relacl, acldefault('s', c.relowner))") + `
+				FROM pg_class c
+				JOIN pg_namespace n ON n.oid = c.relnamespace, ` + roleRow + `
+				WHERE c.relkind = 'S' AND ` + systemSchemaFilter + ` AND ` + schemaFilter + `
+				ORDER BY n.nspname, c.relname
+			`,
+			privileges: objectPrivileges["sequence"],
+		},
+		{
+			query: `
+				SELECT 'function', n.nspname, p.proname || '(' || pg_get_function_identity_arguments(p.oid) || ')', '', ` + privilegeChecks("has_function_privilege", "p.oid", objectPrivileges["function"]) + `,` +
+				aclOf("COALESCE(p.proacl, acldefault('f', p.proowner))") + `
+				FROM pg_proc p
+				JOIN pg_namespace n ON n.oid = p.pronamespace, ` + roleRow + `
+				WHERE ` + systemSchemaFilter + ` AND ` + schemaFilter + `
+				ORDER BY n.nspname, p.proname
+			`,
+			privileges: objectPrivileges["function"],
+		},
+	}
+
+	matrix := &model.PrivilegeMatrix{Role: role, Rows: []model.PrivilegeRow{}}
+	for _, q := range queries {
+		rows, err := loadPrivilegeRows(ctx, pool, q.query, q.privileges, role, schema)
+		if err != nil {
+			return nil, err
+		}
+		matrix.Rows = append(matrix.Rows, rows...)
+	}
+
+	return matrix, nil
+}
+
+// GetDefaultPrivileges lists the privileges granted on objects created in the future
+func (c *Connections) GetDefaultPrivileges(activePoolID uuid.UUID) ([]model.DefaultPrivilege, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	query := `
+		SELECT
+			pg_get_userbyid(d.defaclrole),
+			COALESCE(n.nspname, ''),
+			d.defaclobjtype::text,
+			CASE WHEN a.grantee = 0 THEN 'PUBLIC' ELSE pg_get_userbyid(a.grantee) END,
+			a.privilege_type,
+			a.is_grantable
+		FROM pg_default_acl d
+		LEFT JOIN pg_namespace n ON n.oid = d.defaclnamespace,
+		aclexplode(d.defaclacl) a
+		ORDER BY 1, 2, 3, 4, 5
+	`
+	rows, err := pool.Query(context.Background(), query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read default privileges")
+	}
+	defer rows.Close()
+
+	privileges := []model.DefaultPrivilege{}
+	for rows.Next() {
+		var owner, schema, objectType, grantee, privilege string
+		var grantable bool
+		if err := rows.Scan(&owner, &schema, &objectType, &grantee, &privilege, &grantable); err != nil {
+			return nil, err
+		}
+
+		// Rows are ordered, consecutive ones of the same grant are merged
+		last := len(privileges) - 1
+		if last < 0 || privileges[last].Owner != owner || privileges[last].Schema != schema || privileges[last].ObjectType != defaultACLTypes[objectType] || privileges[last].Grantee != grantee {
+			privileges = append(privileges, model.DefaultPrivilege{
+				Owner:      owner,
+				Schema:     schema,
+				ObjectType: defaultACLTypes[objectType],
+				Grantee:    grantee,
+				Privileges: []string{},
+				Grantable:  []string{},
+			})
+			last++
+		}
+
+		privileges[last].Privileges = append(privileges[last].Privileges, privilege)
+		if grantable {
+			privileges[last].Grantable = append(privileges[last].Grantable, privilege)
+		}
+	}
+
+	return privileges, rows.Err()
+}
+
+// roleStatement is a statement of a role change, with the password masked for display
+type roleStatement struct {
+	text    string
+	display string
+}
+
+// roleAttributes renders the attributes of the role spec for CREATE or ALTER ROLE.
+// It returns the clause with the password and the one with it masked.
+func roleAttributes(spec model.RoleSpec) (string, string) {
+	flag := func(set bool, name string) string {
+		if set {
+			return name
+		}
+		return "NO" + name
+	}
+
+	attributes := []string{
+		flag(spec.Superuser, "SUPERUSER"),
+		flag(spec.CreateDB, "CREATEDB"),
+		flag(spec.CreateRole, "CREATEROLE"),
+		flag(spec.Inherit, "INHERIT"),
+		flag(spec.Login, "LOGIN"),
+		flag(spec.Replication, "REPLICATION"),
+		flag(spec.BypassRLS, "BYPASSRLS"),
+	}
+
+	limit := spec.ConnectionLimit
+	if limit <= 0 {
+		limit = -1
+	}
+	attributes = append(attributes, fmt.Sprintf("CONNECTION LIMIT %d", limit))
+
+	if validUntil := strings.TrimSpace(spec.ValidUntil); validUntil != "" {
+		attributes = append(attributes, "VALID UNTIL "+quoteLiteral(validUntil))
+	} else {
+		attributes = append(attributes, "VALID UNTIL 'infinity'")
+	}
+
+	clause := strings.Join(attributes, " ")
+	if spec.Password == "" {
+		return clause, clause
+	}
+	return clause + " PASSWORD " + quoteLiteral(spec.Password), clause + " PASSWORD " + maskedPassword
+}
+
+// grantee quotes a role receiving or losing a privilege, PUBLIC is a keyword
+func grantee(name string) string {
+	name = strings.TrimSpace(name)
+	if strings.EqualFold(name, "public") {
+		return "PUBLIC"
+	}
+	return quoteIdent(name)
+}
+
+// grantStatement renders a GRANT or REVOKE
+func grantStatement(grant bool, spec model.GrantSpec) (string, error) {
+	if len(spec.Grantees) == 0 {
+		return "", errors.New("at least one grantee is required")
+	}
+	grantees := make([]string, len(spec.Grantees))
+	for i, g := range spec.Grantees {
+		grantees[i] = grantee(g)
+	}
+
+	objectType := strings.ToLower(strings.TrimSpace(spec.ObjectType))
+	name := strings.TrimSpace(spec.Name)
+	schema := strings.TrimSpace(spec.Schema)
+
+	// Membership of a role
+	if objectType == "role" {
+		if name == "" {
+			return "", errors.New("the role to grant is required")
+		}
+		if grant {
+			stmt := fmt.Sprintf("GRANT %s TO %s", quoteIdent(name), strings.Join(grantees, ", "))
+			if spec.WithGrantOption {
+				stmt += " WITH ADMIN OPTION"
+			}
+			return stmt, nil
+		}
+		stmt := "REVOKE "
+		if spec.WithGrantOption {
+			stmt += "ADMIN OPTION FOR "
+		}
+		stmt += fmt.Sprintf("%s FROM %s", quoteIdent(name), strings.Join(grantees, ", "))
+		if spec.Cascade {
+			stmt += " CASCADE"
+		}
+		return stmt, nil
+	}
+
+	kind, exists := grantObjects[objectType]
+	if !exists {
+		return "", errors.Errorf("unknown object type %s", spec.ObjectType)
+	}
+	if len(spec.Columns) > 0 {
+		if objectType != "table" {
+			return "", errors.New("column privileges can only be granted on a table")
+		}
+		kind = "column"
+	}
+
+	allowed := make(map[string]bool)
+	for _, privilege := range objectPrivileges[kind] {
+		allowed[privilege] = true
+	}
+
+	if len(spec.Privileges) == 0 {
+		return "", errors.New("at least one privilege is required")
+	}
+	var privileges []string
+	for _, privilege := range spec.Privileges {
+		privilege = strings.ToUpper(strings.Join(strings.Fields(privilege), " "))
+		if privilege == "TEMP" {
+			privilege = "TEMPORARY"
+		}
+		if privilege == "ALL" || privilege == "ALL PRIVILEGES" {
+			privilege = "ALL"
+		} else if !allowed[privilege] {
+			return "", errors.Errorf("%s doesn't apply to a %s", privilege, kind)
+		}
+		if len(spec.Columns) > 0 {
+			privilege += " (" + quoteIdents(spec.Columns) + ")"
+		}
+		privileges = append(privileges, privilege)
+	}
+
+	qualified := func() (string, error) {
+		if name == "" {
+			return "", errors.Errorf("the %s name is required", objectType)
+		}
+		if schema == "" {
+			schema = "public"
+		}
+		return quoteIdent(schema) + "." + quoteIdent(name), nil
+	}
+
+	var object string
+	var err error
+	switch objectType {
+	case "table":
+		object, err = qualified()
+		object = "TABLE " + object
+	case "sequence":
+		object, err = qualified()
+		object = "SEQUENCE " + object
+	case "function":
+		// The argument types follow the name
+		args := "()"
+		if i := strings.Index(name, "("); i >= 0 {
+			name, args = strings.TrimSpace(name[:i]), name[i:]
+		}
+		object, err = qualified()
+		object = "FUNCTION " + object + args
+	case "schema":
+		if name == "" {
+			name = schema
+		}
+		if name == "" {
+			return "", errors.New("the schema name is required")
+		}
+		object = "SCHEMA " + quoteIdent(name)
+	case "database":
+		if name == "" {
+			return "", errors.New("the database name is required")
+		}
+		object = "DATABASE " + quoteIdent(name)
+	default:
+		// all tables, all sequences and all functions of a schema
+		if schema == "" {
+			return "", errors.Errorf("%s needs a schema", objectType)
+		}
+		object = strings.ToUpper(objectType) + " IN SCHEMA " + quoteIdent(schema)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if grant {
+		stmt := fmt.Sprintf("GRANT %s ON %s TO %s", strings.Join(privileges, ", "), object, strings.Join(grantees, ", "))
+		if spec.WithGrantOption {
+			stmt += " WITH GRANT OPTION"
+		}
+		return stmt, nil
+	}
+
+	stmt := "REVOKE "
+	if spec.WithGrantOption {
+		stmt += "GRANT OPTION FOR "
+	}
+	stmt += fmt.Sprintf("%s ON %s FROM %s", strings.Join(privileges, ", "), object, strings.Join(grantees, ", "))
+	if spec.Cascade {
+		stmt += " CASCADE"
+	}
+	return stmt, nil
+}
+
+// roleStatements renders the statements of a role change
+func roleStatements(change model.RoleChange) ([]roleStatement, error) {
+	spec := change.Role
+	name := strings.TrimSpace(spec.Name)
+	plain := func(text string) roleStatement {
+		return roleStatement{text: text, display: text}
+	}
+	comment := func(role string) roleStatement {
+		value := "NULL"
+		if spec.Comment != "" {
+			value = quoteLiteral(spec.Comment)
+		}
+		return plain(fmt.Sprintf("COMMENT ON ROLE %s IS %s", quoteIdent(role), value))
+	}
+
+	var statements []roleStatement
+
+	switch strings.ToLower(strings.TrimSpace(change.Action)) {
+	case "create_role":
+		if name == "" {
+			return nil, errors.New("the role needs a name")
+		}
+		attributes, masked := roleAttributes(spec)
+		membership := ""
+		if len(spec.InRoles) > 0 {
+			membership = " IN ROLE " + quoteIdents(spec.InRoles)
+		}
+		statements = append(statements, roleStatement{
+			text:    fmt.Sprintf("CREATE ROLE %s WITH %s%s", quoteIdent(name), attributes, membership),
+			display: fmt.Sprintf("CREATE ROLE %s WITH %s%s", quoteIdent(name), masked, membership),
+		})
+		if spec.Comment != "" {
+			statements = append(statements, comment(name))
+		}
+
+	case "alter_role":
+		if name == "" {
+			return nil, errors.New("the role to alter is required")
+		}
+		attributes, masked := roleAttributes(spec)
+		statements = append(statements, roleStatement{
+			text:    fmt.Sprintf("ALTER ROLE %s WITH %s", quoteIdent(name), attributes),
+			display: fmt.Sprintf("ALTER ROLE %s WITH %s", quoteIdent(name), masked),
+		})
+		if newName := strings.TrimSpace(spec.NewName); newName != "" && newName != name {
+			statements = append(statements, plain(fmt.Sprintf("ALTER ROLE %s RENAME TO %s", quoteIdent(name), quoteIdent(newName))))
+			name = newName
+		}
+		statements = append(statements, comment(name))
+
+	case "drop_role":
+		if name == "" {
+			return nil, errors.New("the role to drop is required")
+		}
+		if reassignTo := strings.TrimSpace(spec.ReassignTo); reassignTo != "" {
+			statements = append(statements,
+				plain(fmt.Sprintf("REASSIGN OWNED BY %s TO %s", quoteIdent(name), quoteIdent(reassignTo))),
+				plain(fmt.Sprintf("DROP OWNED BY %s", quoteIdent(name))),
+			)
+		}
+		statements = append(statements, plain("DROP ROLE "+quoteIdent(name)))
+
+	case "grant", "revoke":
+		stmt, err := grantStatement(change.Action == "grant", change.Grant)
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, plain(stmt))
+
+	default:
+		return nil, errors.Errorf("unknown role change %s", change.Action)
+	}
+
+	return statements, nil
+}
+
+// roleScript joins the statements for display, with passwords masked
+func roleScript(statements []roleStatement) string {
+	var script strings.Builder
+	for _, stmt := range statements {
+		script.WriteString(stmt.display + ";\n")
+	}
+	return script.String()
+}
+
+// PreviewRoleChange returns the SQL of a role or privilege change, with passwords masked
+func (c *Connections) PreviewRoleChange(change model.RoleChange) (string, error) {
+	statements, err := roleStatements(change)
+	if err != nil {
+		return "", err
+	}
+	return roleScript(statements), nil
+}
+
+// ApplyRoleChange runs the SQL of a role or privilege change in a transaction. When
+// the environment policy asks for confirmation the token returned in the
+// confirmation has to be passed.
+func (c *Connections) ApplyRoleChange(activePoolID uuid.UUID, change model.RoleChange, token string) *model.RoleChangeResult {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return &model.RoleChangeResult{OK: false, Message: "pool doesn't exist"}
+	}
+
+	statements, err := roleStatements(change)
+	if err != nil {
+		return &model.RoleChangeResult{OK: false, Message: err.Error()}
+	}
+	script := roleScript(statements)
+
+	ctx := context.Background()
+	started := time.Now()
+
+	policy, err := c.poolPolicy(activePoolID)
+	if err != nil {
+		return &model.RoleChangeResult{OK: false, Message: err.Error()}
+	}
+
+	// Policies are checked on the masked script, which is also what gets confirmed
+	toConfirm, toConfirmInfo, err := checkPolicy(policy, script)
+	if err != nil {
+		c.audit(activePoolID, script, started, 0, auditBlocked, err)
+		return &model.RoleChangeResult{OK: false, Message: err.Error(), Script: script}
+	}
+
+	if len(toConfirm) > 0 && !c.consumeConfirmation(activePoolID, script, token) {
+		confirmation, err := c.requestConfirmation(ctx, activePoolID, policy, script, toConfirm, toConfirmInfo)
+		if err != nil {
+			return &model.RoleChangeResult{OK: false, Message: err.Error(), Script: script}
+		}
+
+		return &model.RoleChangeResult{
+			OK:                   false,
+			Message:              fmt.Sprintf("This changes roles or privileges on a %s connection and needs to be confirmed", policy.Env),
+			Script:               script,
+			RequiresConfirmation: true,
+			Confirmation:         confirmation,
+		}
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return &model.RoleChangeResult{OK: false, Message: err.Error(), Script: script}
+	}
+	defer tx.Rollback(ctx)
+
+	batch := c.newAuditBatch(activePoolID)
+	for _, stmt := range statements {
+		started := time.Now()
+		_, err := tx.Exec(ctx, stmt.text)
+		batch.add(stmt.display, started)
+		if err != nil {
+			batch.flush(err)
+			return &model.RoleChangeResult{OK: false, Message: err.Error(), Script: script}
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		batch.flush(err)
+		return &model.RoleChangeResult{OK: false, Message: err.Error(), Script: script}
+	}
+	batch.flush(nil)
+
+	return &model.RoleChangeResult{OK: true, Message: fmt.Sprintf("%d statements applied", len(statements)), Script: script}
+}
@@ -0,0 +1,148 @@
+package app
+
+import (
+	"testing"
+
+	"dbmx/model"
+)
+
+func TestGrantStatement(t *testing.T) {
+	tests := []struct {
+		name    string
+		grant   bool
+		spec    model.GrantSpec
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "table",
+			grant: true,
+			spec:  model.GrantSpec{Privileges: []string{"select", "insert"}, ObjectType: "table", Schema: "app", Name: "users", Grantees: []string{"reader"}},
+			want:  `GRANT SELECT, INSERT ON TABLE app.users TO reader`,
+		},
+		{
+			name:  "table in the default schema with grant option",
+			grant: true,
+			spec:  model.GrantSpec{Privileges: []string{"ALL PRIVILEGES"}, ObjectType: "Table", Name: "order", Grantees: []string{"public", "Admin"}, WithGrantOption: true},
+			want:  `GRANT ALL ON TABLE public."order" TO PUBLIC, "Admin" WITH GRANT OPTION`,
+		},
+		{
+			name:  "columns",
+			grant: true,
+			spec:  model.GrantSpec{Privileges: []string{"update"}, ObjectType: "table", Schema: "app", Name: "users", Columns: []string{"name", "email"}, Grantees: []string{"editor"}},
+			want:  `GRANT UPDATE (name, email) ON TABLE app.users TO editor`,
+		},
+		{
+			name:  "function",
+			grant: true,
+			spec:  model.GrantSpec{Privileges: []string{"execute"}, ObjectType: "function", Schema: "app", Name: "add(integer, integer)", Grantees: []string{"reader"}},
+			want:  `GRANT EXECUTE ON FUNCTION app.add(integer, integer) TO reader`,
+		},
+		{
+			name:  "schema",
+			grant: true,
+			spec:  model.GrantSpec{Privileges: []string{"usage"}, ObjectType: "schema", Schema: "app", Grantees: []string{"reader"}},
+			want:  `GRANT USAGE ON SCHEMA app TO reader`,
+		},
+		{
+			name:  "database",
+			grant: true,
+			spec:  model.GrantSpec{Privileges: []string{"temp", "connect"}, ObjectType: "database", Name: "shop", Grantees: []string{"reader"}},
+			want:  `GRANT TEMPORARY, CONNECT ON DATABASE shop TO reader`,
+		},
+		{
+			name:  "all tables",
+			grant: true,
+			spec:  model.GrantSpec{Privileges: []string{"select"}, ObjectType: "all tables", Schema: "app", Grantees: []string{"reader"}},
+			want:  `GRANT SELECT ON ALL TABLES IN SCHEMA app TO reader`,
+		},
+		{
+			name: "revoke grant option with cascade",
+			spec: model.GrantSpec{Privileges: []string{"usage"}, ObjectType: "sequence", Schema: "app", Name: "users_id_seq", Grantees: []string{"reader"}, WithGrantOption: true, Cascade: true},
+			want: `REVOKE GRANT OPTION FOR USAGE ON SEQUENCE app.users_id_seq FROM reader CASCADE`,
+		},
+		{
+			name:  "role",
+			grant: true,
+			spec:  model.GrantSpec{ObjectType: "role", Name: "readers", Grantees: []string{"alice"}, WithGrantOption: true},
+			want:  `GRANT readers TO alice WITH ADMIN OPTION`,
+		},
+		{
+			name: "revoke role",
+			spec: model.GrantSpec{ObjectType: "role", Name: "readers", Grantees: []string{"alice"}, WithGrantOption: true, Cascade: true},
+			want: `REVOKE ADMIN OPTION FOR readers FROM alice CASCADE`,
+		},
+		{
+			name:    "no grantee",
+			grant:   true,
+			spec:    model.GrantSpec{Privileges: []string{"select"}, ObjectType: "table", Name: "users"},
+			wantErr: "at least one grantee is required",
+		},
+		{
+			name:    "no role",
+			grant:   true,
+			spec:    model.GrantSpec{ObjectType: "role", Grantees: []string{"alice"}},
+			wantErr: "the role to grant is required",
+		},
+		{
+			name:    "unknown object type",
+			grant:   true,
+			spec:    model.GrantSpec{Privileges: []string{"usage"}, ObjectType: "domain", Name: "email", Grantees: []string{"reader"}},
+			wantErr: "unknown object type domain",
+		},
+		{
+			name:    "columns of a sequence",
+			grant:   true,
+			spec:    model.GrantSpec{Privileges: []string{"select"}, ObjectType: "sequence", Name: "s", Columns: []string{"a"}, Grantees: []string{"reader"}},
+			wantErr: "column privileges can only be granted on a table",
+		},
+		{
+			name:    "no privilege",
+			grant:   true,
+			spec:    model.GrantSpec{ObjectType: "table", Name: "users", Grantees: []string{"reader"}},
+			wantErr: "at least one privilege is required",
+		},
+		{
+			name:    "privilege of another object type",
+			grant:   true,
+			spec:    model.GrantSpec{Privileges: []string{"execute"}, ObjectType: "table", Name: "users", Grantees: []string{"reader"}},
+			wantErr: "EXECUTE doesn't apply to a table",
+		},
+		{
+			name:    "column privilege of the table only",
+			grant:   true,
+			spec:    model.GrantSpec{Privileges: []string{"delete"}, ObjectType: "table", Name: "users", Columns: []string{"a"}, Grantees: []string{"reader"}},
+			wantErr: "DELETE doesn't apply to a column",
+		},
+		{
+			name:    "no table name",
+			grant:   true,
+			spec:    model.GrantSpec{Privileges: []string{"select"}, ObjectType: "table", Schema: "app", Grantees: []string{"reader"}},
+			wantErr: "the table name is required",
+		},
+		{
+			name:    "all tables without a schema",
+			grant:   true,
+			spec:    model.GrantSpec{Privileges: []string{"select"}, ObjectType: "all tables", Grantees: []string{"reader"}},
+			wantErr: "all tables needs a schema",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := grantStatement(tt.grant, tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("grantStatement() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("grantStatement() failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("grantStatement() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,474 @@
+package app
+
+import (
+	"strings"
+	"unicode"
+)
+
+type sqlTokenKind int
+
+const (
+	tokenWord sqlTokenKind = iota
+	tokenQuotedIdent
+	tokenString
+	tokenNumber
+	tokenParam
+	tokenPunct
+)
+
+// sqlToken is a lexical token of a sql text, start and end are byte offsets into the text
+type sqlToken struct {
+	kind  sqlTokenKind
+	text  string
+	start int
+	end   int
+}
+
+// lower returns the token text in lower case, used to compare keywords
+func (t sqlToken) lower() string {
+	return strings.ToLower(t.text)
+}
+
+// isWord reports if the token is an unquoted word equal to one of the keywords
+func (t sqlToken) isWord(keywords ...string) bool {
+	if t.kind != tokenWord {
+		return false
+	}
+	for _, k := range keywords {
+		if strings.EqualFold(t.text, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// name returns the identifier the token refers to, unquoting quoted identifiers
+// and folding unquoted ones to lower case like postgres does
+func (t sqlToken) name() string {
+	if t.kind == tokenQuotedIdent {
+		return strings.ReplaceAll(strings.Trim(t.text, `"`), `""`, `"`)
+	}
+	return strings.ToLower(t.text)
+}
+
+// lexSQL splits sql into tokens, skipping whitespace and comments. It understands
+// quoted strings, escape strings, dollar quoting and quoted identifiers so that
+// semicolons and keywords inside them are not mistaken for sql.
+func lexSQL(sql string) []sqlToken {
+	var tokens []sqlToken
+	i := 0
+	n := len(sql)
+
+	for i < n {
+		ch := sql[i]
+		start := i
+
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\f':
+			i++
+			continue
+
+		// Line comment
+		case ch == '-' && i+1 < n && sql[i+1] == '-':
+			for i < n && sql[i] != '\n' {
+				i++
+			}
+			continue
+
+		// Block comment, postgres allows nesting
+		case ch == '/' && i+1 < n && sql[i+1] == '*':
+			depth := 0
+			for i < n {
+				if sql[i] == '/' && i+1 < n && sql[i+1] == '*' {
+					depth++
+					i += 2
+				} else if sql[i] == '*' && i+1 < n && sql[i+1] == '/' {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+			continue
+
+		// Escape string E'...'
+		case (ch == 'e' || ch == 'E') && i+1 < n && sql[i+1] == '\'':
+			i = scanQuoted(sql, i+1, '\'', true)
+			tokens = append(tokens, sqlToken{kind: tokenString, text: sql[start:i], start: start, end: i})
+
+		case ch == '\'':
+			i = scanQuoted(sql, i, '\'', false)
+			tokens = append(tokens, sqlToken{kind: tokenString, text: sql[start:i], start: start, end: i})
+
+		case ch == '"':
+			i = scanQuoted(sql, i, '"', false)
+			tokens = append(tokens, sqlToken{kind: tokenQuotedIdent, text: sql[start:i], start: start, end: i})
+
+		case ch == '$':
+			// Positional parameter $1
+			if i+1 < n && sql[i+1] >= '0' && sql[i+1] <= '9' {
+				i++
+				for i < n && sql[i] >= '0' && sql[i] <= '9' {
+					i++
+				}
+				tokens = append(tokens, sqlToken{kind: tokenParam, text: sql[start:i], start: start, end: i})
+				continue
+			}
+
+			// Dollar quoted string $tag$...$tag$
+			j := i + 1
+			for j < n && sql[j] != '$' && isIdentChar(rune(sql[j])) {
+				j++
+			}
+			if j < n && sql[j] == '$' {
+				tag := sql[i : j+1]
+				end := strings.Index(sql[j+1:], tag)
+				if end < 0 {
+					i = n
+				} else {
+					i = j + 1 + end + len(tag)
+				}
+				tokens = append(tokens, sqlToken{kind: tokenString, text: sql[start:i], start: start, end: i})
+				continue
+			}
+
+			i++
+			tokens = append(tokens, sqlToken{kind: tokenPunct, text: sql[start:i], start: start, end: i})
+
+		case ch >= '0' && ch <= '9' || (ch == '.' && i+1 < n && sql[i+1] >= '0' && sql[i+1] <= '9'):
+			for i < n && (sql[i] >= '0' && sql[i] <= '9' || sql[i] == '.' || sql[i] == 'e' || sql[i] == 'E' || sql[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: tokenNumber, text: sql[start:i], start: start, end: i})
+
+		case isIdentStart(rune(ch)) || ch >= 0x80:
+			for i < n && (isIdentChar(rune(sql[i])) || sql[i] >= 0x80) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: tokenWord, text: sql[start:i], start: start, end: i})
+
+		// Type cast operator
+		case ch == ':' && i+1 < n && sql[i+1] == ':':
+			i += 2
+			tokens = append(tokens, sqlToken{kind: tokenPunct, text: "::", start: start, end: i})
+
+		default:
+			i++
+			tokens = append(tokens, sqlToken{kind: tokenPunct, text: sql[start:i], start: start, end: i})
+		}
+	}
+
+	return tokens
+}
+
+// scanQuoted returns the offset just after the quoted text starting at i. Doubled quotes
+// are part of the text, and with backslashEscapes a backslash escapes the next byte.
+func scanQuoted(sql string, i int, quote byte, backslashEscapes bool) int {
+	n := len(sql)
+	i++
+	for i < n {
+		switch {
+		case backslashEscapes && sql[i] == '\\':
+			i += 2
+		case sql[i] == quote && i+1 < n && sql[i+1] == quote:
+			i += 2
+		case sql[i] == quote:
+			return i + 1
+		default:
+			i++
+		}
+	}
+	return n
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentChar(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// sqlStatement is one statement of a sql text along with its tokens
+type sqlStatement struct {
+	text   string
+	start  int
+	end    int
+	tokens []sqlToken
+}
+
+// splitStatements splits sql into statements on semicolons outside of
+// strings, comments and parentheses. Empty statements are dropped.
+func splitStatements(sql string) []sqlStatement {
+	var statements []sqlStatement
+	var current []sqlToken
+	depth := 0
+
+	flush := func() {
+		if len(current) == 0 {
+			return
+		}
+		start, end := current[0].start, current[len(current)-1].end
+		statements = append(statements, sqlStatement{
+			text:   sql[start:end],
+			start:  start,
+			end:    end,
+			tokens: current,
+		})
+		current = nil
+	}
+
+	for _, t := range lexSQL(sql) {
+		if t.kind == tokenPunct {
+			switch t.text {
+			case "(":
+				depth++
+			case ")":
+				if depth > 0 {
+					depth--
+				}
+			case ";":
+				if depth == 0 {
+					flush()
+					continue
+				}
+			}
+		}
+		current = append(current, t)
+	}
+	flush()
+
+	return statements
+}
+
+// Statement kinds
+const (
+	statementRead  = "read"
+	statementDML   = "dml"
+	statementDDL   = "ddl"
+	statementOther = "other"
+)
+
+var statementKinds = map[string]string{
+	"select":     statementRead,
+	"show":       statementRead,
+	"values":     statementRead,
+	"table":      statementRead,
+	"explain":    statementRead,
+	"fetch":      statementRead,
+	"insert":     statementDML,
+	"update":     statementDML,
+	"delete":     statementDML,
+	"merge":      statementDML,
+	"copy":       statementDML,
+	"call":       statementDML,
+	"do":         statementDML,
+	"execute":    statementDML,
+	"create":     statementDDL,
+	"alter":      statementDDL,
+	"drop":       statementDDL,
+	"truncate":   statementDDL,
+	"comment":    statementDDL,
+	"grant":      statementDDL,
+	"revoke":     statementDDL,
+	"reindex":    statementDDL,
+	"vacuum":     statementDDL,
+	"analyze":    statementDDL,
+	"cluster":    statementDDL,
+	"refresh":    statementDDL,
+	"security":   statementDDL,
+	"import":     statementDDL,
+	"reassign":   statementDDL,
+	"checkpoint": statementDDL,
+}
+
+// statementInfo is the classification of a single statement
+type statementInfo struct {
+	// Upper case main command, e.g. SELECT, UPDATE or DROP
+	Command string
+	// read, dml, ddl or other
+	Kind string
+	// Set for UPDATE and DELETE when the statement has a top level WHERE clause
+	HasWhere bool
+}
+
+// classifyStatement finds the main command of a statement and what kind of statement it is
+func classifyStatement(stmt sqlStatement) statementInfo {
+	tokens := stmt.tokens
+	if len(tokens) == 0 {
+		return statementInfo{Kind: statementOther}
+	}
+
+	// Skip leading parentheses of e.g. (SELECT ...) UNION (SELECT ...)
+	i := 0
+	for i < len(tokens) && tokens[i].text == "(" {
+		i++
+	}
+	if i >= len(tokens) {
+		return statementInfo{Kind: statementOther}
+	}
+
+	first := tokens[i]
+	command := first.lower()
+	mainIndex := i
+
+	switch command {
+	case "with":
+		// The main command is the first command at the top level after the CTE list
+		depth := 0
+		for j := i + 1; j < len(tokens); j++ {
+			t := tokens[j]
+			switch {
+			case t.text == "(":
+				depth++
+			case t.text == ")":
+				depth--
+			case depth == 0 && t.isWord("select", "insert", "update", "delete", "merge", "values", "table"):
+				command = t.lower()
+				mainIndex = j
+			}
+			if mainIndex != i {
+				break
+			}
+		}
+
+	case "explain":
+		// EXPLAIN ANALYZE runs the statement, so it's as dangerous as the statement itself
+		analyze := false
+		j := i + 1
+		for ; j < len(tokens); j++ {
+			t := tokens[j]
+			if t.isWord("analyze", "analyse") {
+				analyze = true
+				continue
+			}
+			if t.isWord("verbose") {
+				continue
+			}
+			if t.text == "(" {
+				for ; j < len(tokens) && tokens[j].text != ")"; j++ {
+					if tokens[j].isWord("analyze", "analyse") && !(j+1 < len(tokens) && tokens[j+1].isWord("false", "off", "0")) {
+						analyze = true
+					}
+				}
+				continue
+			}
+			break
+		}
+		if analyze && j < len(tokens) {
+			inner := classifyStatement(sqlStatement{text: stmt.text, tokens: tokens[j:]})
+			inner.Command = "EXPLAIN ANALYZE " + inner.Command
+			return inner
+		}
+
+	case "prepare":
+		// A prepared statement is as dangerous as the statement it prepares. EXECUTE
+		// can't be traced back to its statement, so it's always treated as DML.
+		for j := i + 1; j < len(tokens); j++ {
+			if tokens[j].isWord("as") {
+				inner := classifyStatement(sqlStatement{text: stmt.text, tokens: tokens[j+1:]})
+				inner.Command = "PREPARE " + inner.Command
+				return inner
+			}
+		}
+	}
+
+	kind, ok := statementKinds[command]
+	if !ok {
+		kind = statementOther
+	}
+
+	info := statementInfo{Command: strings.ToUpper(command), Kind: kind}
+
+	depth := 0
+	for j := mainIndex + 1; j < len(tokens); j++ {
+		t := tokens[j]
+		switch {
+		case t.text == "(":
+			depth++
+			// Data modifying statements inside a CTE or subquery
+			if j+1 < len(tokens) && tokens[j+1].isWord("insert", "update", "delete", "merge") && info.Kind == statementRead {
+				info.Kind = statementDML
+			}
+		case t.text == ")":
+			depth--
+		case depth == 0 && t.isWord("where"):
+			if command == "update" || command == "delete" {
+				info.HasWhere = true
+			}
+		case depth == 0 && t.isWord("into") && command == "select":
+			// SELECT ... INTO creates a table
+			info.Kind = statementDDL
+		}
+	}
+
+	// Data modifying CTEs before the main command
+	if first.isWord("with") && info.Kind == statementRead {
+		for j := i + 1; j < mainIndex; j++ {
+			if tokens[j].text == "(" && j+1 < len(tokens) && tokens[j+1].isWord("insert", "update", "delete", "merge") {
+				info.Kind = statementDML
+				break
+			}
+		}
+	}
+
+	return info
+}
+
+// cteStatements returns the statements of a WITH statement's common table expressions,
+// and of the expressions nested in them, e.g. the DELETE of
+// WITH d AS (DELETE FROM t RETURNING *) SELECT * FROM d
+func cteStatements(stmt sqlStatement) []sqlStatement {
+	tokens := stmt.tokens
+	i := 0
+	for i < len(tokens) && tokens[i].text == "(" {
+		i++
+	}
+	if i >= len(tokens) || !tokens[i].isWord("with") {
+		return nil
+	}
+
+	var statements []sqlStatement
+	depth := 0
+	for j := i + 1; j < len(tokens); j++ {
+		t := tokens[j]
+		switch {
+		case t.text == "(" && depth == 0 && tokens[j-1].isWord("as", "materialized"):
+			// The body of an expression runs until its closing parenthesis
+			end := j + 1
+			for nested := 0; end < len(tokens); end++ {
+				if tokens[end].text == "(" {
+					nested++
+				} else if tokens[end].text == ")" {
+					if nested == 0 {
+						break
+					}
+					nested--
+				}
+			}
+			if body := tokens[j+1 : end]; len(body) > 0 {
+				start, bodyEnd := body[0].start, body[len(body)-1].end
+				inner := sqlStatement{
+					text:   stmt.text[start-stmt.start : bodyEnd-stmt.start],
+					start:  start,
+					end:    bodyEnd,
+					tokens: body,
+				}
+				statements = append(statements, inner)
+				statements = append(statements, cteStatements(inner)...)
+			}
+			j = end
+		case t.text == "(":
+			depth++
+		case t.text == ")":
+			depth--
+		case depth == 0 && t.isWord("select", "insert", "update", "delete", "merge", "values", "table"):
+			// The main command follows the last expression
+			return statements
+		}
+	}
+	return statements
+}
@@ -0,0 +1,135 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"only semicolons", " ; ;; ", nil},
+		{"single without semicolon", "SELECT 1", []string{"SELECT 1"}},
+		{"trailing whitespace is trimmed", "  SELECT 1 ;  ", []string{"SELECT 1"}},
+		{"several", "SELECT 1; SELECT 2;SELECT 3", []string{"SELECT 1", "SELECT 2", "SELECT 3"}},
+		{"semicolon in a string", "SELECT 'a;b'; SELECT 2", []string{"SELECT 'a;b'", "SELECT 2"}},
+		{"semicolon in an escape string", `SELECT E'a\';b'; SELECT 2`, []string{`SELECT E'a\';b'`, "SELECT 2"}},
+		{"semicolon in a quoted identifier", `SELECT 1 AS "a;b"; SELECT 2`, []string{`SELECT 1 AS "a;b"`, "SELECT 2"}},
+		{"semicolon in a line comment", "SELECT 1 -- a;b\n; SELECT 2", []string{"SELECT 1", "SELECT 2"}},
+		{"semicolon in a nested block comment", "SELECT /* a /* ; */ ; */ 1; SELECT 2", []string{"SELECT /* a /* ; */ ; */ 1", "SELECT 2"}},
+		{
+			"semicolon in a dollar quoted body",
+			"CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql; SELECT 2",
+			[]string{"CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql", "SELECT 2"},
+		},
+		{"semicolon in parentheses", "SELECT (1;2); SELECT 3", []string{"SELECT (1;2)", "SELECT 3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, stmt := range splitStatements(tt.sql) {
+				if stmt.text != tt.sql[stmt.start:stmt.end] {
+					t.Errorf("text %q doesn't match offsets %d:%d", stmt.text, stmt.start, stmt.end)
+				}
+				got = append(got, stmt.text)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitStatements(%q) = %q, want %q", tt.sql, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyStatement(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want statementInfo
+	}{
+		{"SELECT * FROM users", statementInfo{Command: "SELECT", Kind: statementRead}},
+		{"select 1", statementInfo{Command: "SELECT", Kind: statementRead}},
+		{"(SELECT 1) UNION (SELECT 2)", statementInfo{Command: "SELECT", Kind: statementRead}},
+		{"SHOW work_mem", statementInfo{Command: "SHOW", Kind: statementRead}},
+		{"VALUES (1), (2)", statementInfo{Command: "VALUES", Kind: statementRead}},
+		{"TABLE users", statementInfo{Command: "TABLE", Kind: statementRead}},
+		{"FETCH 10 FROM c", statementInfo{Command: "FETCH", Kind: statementRead}},
+		{"SELECT * INTO copy FROM users", statementInfo{Command: "SELECT", Kind: statementDDL}},
+		{"INSERT INTO users VALUES (1)", statementInfo{Command: "INSERT", Kind: statementDML}},
+		{"UPDATE users SET name = 'a'", statementInfo{Command: "UPDATE", Kind: statementDML}},
+		{"UPDATE users SET name = 'a' WHERE id = 1", statementInfo{Command: "UPDATE", Kind: statementDML, HasWhere: true}},
+		{"DELETE FROM users", statementInfo{Command: "DELETE", Kind: statementDML}},
+		{"DELETE FROM users WHERE id IN (SELECT id FROM old)", statementInfo{Command: "DELETE", Kind: statementDML, HasWhere: true}},
+		{"DELETE FROM users u USING (SELECT id FROM old WHERE x) o", statementInfo{Command: "DELETE", Kind: statementDML}},
+		{"WITH t AS (SELECT 1) SELECT * FROM t", statementInfo{Command: "SELECT", Kind: statementRead}},
+		{"WITH t AS (SELECT 1) DELETE FROM users WHERE id = 1", statementInfo{Command: "DELETE", Kind: statementDML, HasWhere: true}},
+		{"WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d", statementInfo{Command: "SELECT", Kind: statementDML}},
+		{"SELECT * FROM (DELETE FROM users RETURNING *) d", statementInfo{Command: "SELECT", Kind: statementDML}},
+		{"EXPLAIN SELECT 1", statementInfo{Command: "EXPLAIN", Kind: statementRead}},
+		{"EXPLAIN DELETE FROM users", statementInfo{Command: "EXPLAIN", Kind: statementRead}},
+		{"EXPLAIN ANALYZE DELETE FROM users", statementInfo{Command: "EXPLAIN ANALYZE DELETE", Kind: statementDML}},
+		{"EXPLAIN (ANALYZE, BUFFERS) UPDATE users SET a = 1 WHERE id = 1", statementInfo{Command: "EXPLAIN ANALYZE UPDATE", Kind: statementDML, HasWhere: true}},
+		{"EXPLAIN (ANALYZE false) DELETE FROM users", statementInfo{Command: "EXPLAIN", Kind: statementRead}},
+		{"PREPARE p AS DELETE FROM users", statementInfo{Command: "PREPARE DELETE", Kind: statementDML}},
+		{"PREPARE p (int) AS SELECT $1", statementInfo{Command: "PREPARE SELECT", Kind: statementRead}},
+		{"EXECUTE p", statementInfo{Command: "EXECUTE", Kind: statementDML}},
+		{"CREATE TABLE t (id int)", statementInfo{Command: "CREATE", Kind: statementDDL}},
+		{"DROP TABLE t", statementInfo{Command: "DROP", Kind: statementDDL}},
+		{"TRUNCATE t", statementInfo{Command: "TRUNCATE", Kind: statementDDL}},
+		{"SET search_path = public", statementInfo{Command: "SET", Kind: statementOther}},
+		{"BEGIN", statementInfo{Command: "BEGIN", Kind: statementOther}},
+		{"(", statementInfo{Kind: statementOther}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			statements := splitStatements(tt.sql)
+			if len(statements) != 1 {
+				t.Fatalf("splitStatements(%q) returned %d statements", tt.sql, len(statements))
+			}
+			if got := classifyStatement(statements[0]); got != tt.want {
+				t.Errorf("classifyStatement(%q) = %+v, want %+v", tt.sql, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCteStatements(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want []statementInfo
+	}{
+		{"SELECT * FROM users", nil},
+		{"WITH t AS (SELECT 1) SELECT * FROM t", []statementInfo{{Command: "SELECT", Kind: statementRead}}},
+		{
+			"WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d",
+			[]statementInfo{{Command: "DELETE", Kind: statementDML}},
+		},
+		{
+			"WITH RECURSIVE t(n) AS (VALUES (1)), u AS MATERIALIZED (UPDATE users SET a = (SELECT 1) WHERE id = 1 RETURNING id) SELECT * FROM t, u",
+			[]statementInfo{{Command: "VALUES", Kind: statementRead}, {Command: "UPDATE", Kind: statementDML, HasWhere: true}},
+		},
+		{
+			"WITH a AS NOT MATERIALIZED (WITH b AS (DELETE FROM users WHERE id = 1 RETURNING *) SELECT * FROM b) DELETE FROM orders WHERE user_id IN (SELECT id FROM a)",
+			[]statementInfo{{Command: "SELECT", Kind: statementDML}, {Command: "DELETE", Kind: statementDML, HasWhere: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			var got []statementInfo
+			for _, inner := range cteStatements(splitStatements(tt.sql)[0]) {
+				if inner.text != tt.sql[inner.start:inner.end] {
+					t.Errorf("text %q doesn't match offsets %d:%d", inner.text, inner.start, inner.end)
+				}
+				got = append(got, classifyStatement(inner))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cteStatements(%q) = %+v, want %+v", tt.sql, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,946 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"dbmx/model"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Events emitted to the frontend by stream tabs
+const (
+	StreamChangeEvent = "stream:change"
+	StreamStateEvent  = "stream:state"
+)
+
+// Logical decoding output plugins
+const (
+	pluginPgoutput = "pgoutput"
+	pluginWal2json = "wal2json"
+)
+
+const (
+	// Changes kept per tab, the oldest are dropped once the buffer is full
+	streamBufferSize = 1000
+
+	// How often the stream reports its position to the server
+	standbyInterval = 10 * time.Second
+
+	// Microseconds between the unix epoch and the postgres epoch, 2000-01-01
+	postgresEpochMicros = 946684800 * 1000000
+)
+
+// streamTable is a table whose changes a stream shows
+type streamTable struct {
+	schema string
+	name   string
+}
+
+// pgoutputRelation is a table as described by a pgoutput relation message
+type pgoutputRelation struct {
+	schema  string
+	name    string
+	columns []string
+	// Columns of the replica identity, the only ones a key tuple has values for
+	key []bool
+}
+
+// tabStream is the replication connection and temporary slot of a stream tab
+type tabStream struct {
+	tabID  int64
+	poolID uuid.UUID
+	conn   *pgconn.PgConn
+
+	slot        string
+	plugin      string
+	publication string
+	tables      []string
+	watched     map[string]bool
+
+	// Told about the publication's CREATE and DROP for the audit log
+	audit func(statement string, started time.Time, err error)
+
+	cancel  context.CancelFunc
+	done    chan struct{}
+	cleaned sync.Once
+
+	// Decoding state, only touched by the stream's goroutine
+	relations  map[uint32]pgoutputRelation
+	xid        uint32
+	commitTime string
+
+	// Guards the fields below
+	mu      sync.Mutex
+	buffer  []model.ChangeEvent
+	next    int
+	dropped int64
+	running bool
+	err     string
+}
+
+// StreamManager keeps the change streams of the stream tabs, at most one per tab
+type StreamManager struct {
+	PM *PoolManager
+
+	// Random per run of the app, it keeps publication names of two running apps apart
+	instance string
+
+	streams map[int64]*tabStream
+	mu      sync.Mutex
+}
+
+func NewStreamManager(pm *PoolManager) *StreamManager {
+	instance := make([]byte, 4)
+	_, _ = rand.Read(instance)
+
+	return &StreamManager{
+		PM:       pm,
+		instance: hex.EncodeToString(instance),
+		streams:  make(map[int64]*tabStream),
+	}
+}
+
+// errPublicationConfirmation stops a stream whose publication needs to be confirmed first
+var errPublicationConfirmation = errors.New("the publication needs to be confirmed")
+
+// publicationHooks apply the environment policy to the publication pgoutput needs
+type publicationHooks struct {
+	// check is asked before the publication is created, an error stops the stream
+	check func(statement string) error
+	// audit is told about the publication's CREATE and DROP once they ran
+	audit func(statement string, started time.Time, err error)
+}
+
+// publicationName is the publication of the tab's stream. It's the same until the app
+// restarts, so a confirmed CREATE PUBLICATION matches the one which runs. The slots of
+// the tab's streams are named after it.
+func (sm *StreamManager) publicationName(tabID int64) string {
+	return fmt.Sprintf("dbmx_%d_%s", tabID, sm.instance)
+}
+
+// publicationStatement creates the tab's publication of the tables
+func (sm *StreamManager) publicationStatement(tabID int64, tables []streamTable) string {
+	var qualified []string
+	for _, t := range tables {
+		qualified = append(qualified, quoteIdent(t.schema)+"."+quoteIdent(t.name))
+	}
+	return "CREATE PUBLICATION " + quoteIdent(sm.publicationName(tabID)) + " FOR TABLE " + strings.Join(qualified, ", ")
+}
+
+// formatLSN formats a WAL position the way postgres does
+func formatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", uint32(lsn>>32), uint32(lsn))
+}
+
+// postgresTime formats a timestamp of the replication protocol, in microseconds since 2000-01-01
+func postgresTime(micros int64) string {
+	return time.UnixMicro(micros + postgresEpochMicros).UTC().Format(time.RFC3339Nano)
+}
+
+// replicationLiteral quotes an option value of a replication command
+func replicationLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// wal2jsonTable writes a table for wal2json's add-tables option, which splits on
+// unescaped commas, periods and asterisks
+func wal2jsonTable(t streamTable) string {
+	escape := strings.NewReplacer(`\`, `\\`, " ", `\ `, "'", `\'`, ",", `\,`, ".", `\.`, "*", `\*`)
+	return escape.Replace(t.schema) + "." + escape.Replace(t.name)
+}
+
+// walReader reads the fields of a replication message, the first error sticks
+type walReader struct {
+	data []byte
+	err  error
+}
+
+func (r *walReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.data) < n {
+		r.err = errors.New("replication message is truncated")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *walReader) uint8() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *walReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *walReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *walReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *walReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.data, 0)
+	if i < 0 {
+		r.err = errors.New("replication message is truncated")
+		return ""
+	}
+	s := string(r.data[:i])
+	r.data = r.data[i+1:]
+	return s
+}
+
+// tuple reads the column values of a row, keeping only the key columns of a key tuple
+func (r *walReader) tuple(rel pgoutputRelation, keyOnly bool) []model.ChangeColumn {
+	n := int(r.uint16())
+	columns := make([]model.ChangeColumn, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		var column model.ChangeColumn
+		if i < len(rel.columns) {
+			column.Name = rel.columns[i]
+		}
+		switch r.uint8() {
+		case 'u':
+			column.Unchanged = true
+		case 't':
+			value := string(r.next(int(r.uint32())))
+			column.Value = &value
+		}
+		if keyOnly && (i >= len(rel.key) || !rel.key[i]) {
+			continue
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// decodePgoutput decodes a message of the pgoutput plugin, protocol version 1
+func (ts *tabStream) decodePgoutput(lsn string, data []byte) ([]model.ChangeEvent, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	r := &walReader{data: data[1:]}
+
+	relation := func() (pgoutputRelation, bool) {
+		id := r.uint32()
+		rel, exists := ts.relations[id]
+		if !exists && r.err == nil {
+			r.err = errors.Errorf("replication stream references unknown relation %d", id)
+		}
+		return rel, exists
+	}
+
+	event := func(action string, rel pgoutputRelation) model.ChangeEvent {
+		return model.ChangeEvent{TabID: ts.tabID, LSN: lsn, XID: ts.xid, CommitTime: ts.commitTime, Action: action, Schema: rel.schema, Table: rel.name}
+	}
+
+	var events []model.ChangeEvent
+	switch data[0] {
+	case 'B':
+		r.uint64()
+		ts.commitTime = postgresTime(int64(r.uint64()))
+		ts.xid = r.uint32()
+
+	case 'R':
+		id := r.uint32()
+		rel := pgoutputRelation{schema: r.cstring(), name: r.cstring()}
+		r.uint8()
+		n := int(r.uint16())
+		for i := 0; i < n && r.err == nil; i++ {
+			flags := r.uint8()
+			rel.columns = append(rel.columns, r.cstring())
+			rel.key = append(rel.key, flags&1 == 1)
+			r.uint32()
+			r.uint32()
+		}
+		ts.relations[id] = rel
+
+	case 'I':
+		if rel, ok := relation(); ok {
+			r.uint8()
+			e := event("insert", rel)
+			e.After = r.tuple(rel, false)
+			events = append(events, e)
+		}
+
+	case 'U':
+		if rel, ok := relation(); ok {
+			e := event("update", rel)
+			kind := r.uint8()
+			if kind == 'K' || kind == 'O' {
+				e.Before = r.tuple(rel, kind == 'K')
+				r.uint8()
+			}
+			e.After = r.tuple(rel, false)
+			events = append(events, e)
+		}
+
+	case 'D':
+		if rel, ok := relation(); ok {
+			kind := r.uint8()
+			e := event("delete", rel)
+			e.Before = r.tuple(rel, kind == 'K')
+			events = append(events, e)
+		}
+
+	case 'T':
+		n := int(r.uint32())
+		r.uint8()
+		for i := 0; i < n && r.err == nil; i++ {
+			if rel, ok := relation(); ok {
+				events = append(events, event("truncate", rel))
+			}
+		}
+	}
+
+	return events, r.err
+}
+
+type wal2jsonColumn struct {
+	Name  string          `json:"name"`
+	Value json.RawMessage `json:"value"`
+}
+
+// wal2jsonMessage is a message of wal2json's format version 2
+type wal2jsonMessage struct {
+	Action    string           `json:"action"`
+	XID       uint32           `json:"xid"`
+	Timestamp string           `json:"timestamp"`
+	Schema    string           `json:"schema"`
+	Table     string           `json:"table"`
+	Columns   []wal2jsonColumn `json:"columns"`
+	Identity  []wal2jsonColumn `json:"identity"`
+}
+
+// wal2jsonColumns converts the JSON values of wal2json columns to their text
+func wal2jsonColumns(columns []wal2jsonColumn) []model.ChangeColumn {
+	var converted []model.ChangeColumn
+	for _, c := range columns {
+		column := model.ChangeColumn{Name: c.Name}
+		var text string
+		switch {
+		case len(c.Value) == 0 || string(c.Value) == "null":
+		case json.Unmarshal(c.Value, &text) == nil:
+			column.Value = &text
+		default:
+			value := string(c.Value)
+			column.Value = &value
+		}
+		converted = append(converted, column)
+	}
+	return converted
+}
+
+// decodeWal2json decodes a message of the wal2json plugin
+func (ts *tabStream) decodeWal2json(lsn string, data []byte) ([]model.ChangeEvent, error) {
+	var m wal2jsonMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrap(err, "failed to decode wal2json message")
+	}
+
+	actions := map[string]string{"I": "insert", "U": "update", "D": "delete", "T": "truncate"}
+	switch m.Action {
+	case "B":
+		ts.xid, ts.commitTime = m.XID, m.Timestamp
+		return nil, nil
+	case "C", "M":
+		return nil, nil
+	}
+
+	action, known := actions[m.Action]
+	if !known {
+		return nil, nil
+	}
+	return []model.ChangeEvent{{
+		TabID:      ts.tabID,
+		LSN:        lsn,
+		XID:        ts.xid,
+		CommitTime: ts.commitTime,
+		Action:     action,
+		Schema:     m.Schema,
+		Table:      m.Table,
+		Before:     wal2jsonColumns(m.Identity),
+		After:      wal2jsonColumns(m.Columns),
+	}}, nil
+}
+
+// push adds a change to the ring buffer
+func (ts *tabStream) push(e model.ChangeEvent) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if len(ts.buffer) < streamBufferSize {
+		ts.buffer = append(ts.buffer, e)
+		return
+	}
+	ts.buffer[ts.next] = e
+	ts.next = (ts.next + 1) % streamBufferSize
+	ts.dropped++
+}
+
+// state returns the stream's slot and the buffered changes, oldest first
+func (ts *tabStream) state() model.StreamState {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	state := model.StreamState{
+		TabID:       ts.tabID,
+		PoolID:      ts.poolID.String(),
+		Slot:        ts.slot,
+		Plugin:      ts.plugin,
+		Tables:      ts.tables,
+		Publication: ts.publication,
+		Running:     ts.running,
+		Changes:     make([]model.ChangeEvent, 0, len(ts.buffer)),
+		Dropped:     ts.dropped,
+		Error:       ts.err,
+	}
+	state.Changes = append(state.Changes, ts.buffer[ts.next:]...)
+	state.Changes = append(state.Changes, ts.buffer[:ts.next]...)
+
+	return state
+}
+
+// sendStandbyStatus reports the position the stream received up to
+func (ts *tabStream) sendStandbyStatus(lsn uint64) error {
+	data := make([]byte, 34)
+	data[0] = 'r'
+	binary.BigEndian.PutUint64(data[1:], lsn)
+	binary.BigEndian.PutUint64(data[9:], lsn)
+	binary.BigEndian.PutUint64(data[17:], lsn)
+	binary.BigEndian.PutUint64(data[25:], uint64(time.Now().UnixMicro()-postgresEpochMicros))
+
+	ts.conn.Frontend().Send(&pgproto3.CopyData{Data: data})
+	return ts.conn.Frontend().Flush()
+}
+
+// cleanup closes the replication connection, which drops the temporary slot, and drops
+// the publication created for pgoutput
+func (sm *StreamManager) cleanup(ts *tabStream) {
+	ts.cleaned.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		defer cancel()
+
+		_ = ts.conn.Close(ctx)
+
+		if ts.publication == "" {
+			return
+		}
+		if pool, exists := sm.PM.GetPool(ts.poolID); exists {
+			statement := "DROP PUBLICATION IF EXISTS " + quoteIdent(ts.publication)
+			started := time.Now()
+			_, err := pool.Exec(ctx, statement)
+			ts.audit(statement, started, err)
+			if err != nil {
+				fmt.Println("Error dropping publication", ts.publication+":", err)
+			}
+		}
+	})
+}
+
+// stream decodes the changes the server sends until the stream is closed or fails
+func (sm *StreamManager) stream(ctx context.Context, ts *tabStream) {
+	defer close(ts.done)
+
+	fail := func(err error) {
+		ts.mu.Lock()
+		ts.running = false
+		ts.err = err.Error()
+		ts.mu.Unlock()
+		sm.cleanup(ts)
+		sm.PM.emit(StreamStateEvent, ts.state())
+	}
+
+	var received uint64
+	nextStatus := time.Now().Add(standbyInterval)
+
+	for {
+		if !time.Now().Before(nextStatus) {
+			if err := ts.sendStandbyStatus(received); err != nil {
+				fail(err)
+				return
+			}
+			nextStatus = time.Now().Add(standbyInterval)
+		}
+
+		receiveCtx, cancel := context.WithDeadline(ctx, nextStatus)
+		msg, err := ts.conn.ReceiveMessage(receiveCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if pgconn.Timeout(err) {
+				continue
+			}
+			fail(err)
+			return
+		}
+
+		var copyData *pgproto3.CopyData
+		switch msg := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			fail(pgconn.ErrorResponseToPgError(msg))
+			return
+		case *pgproto3.CopyData:
+			copyData = msg
+		default:
+			continue
+		}
+		if len(copyData.Data) == 0 {
+			continue
+		}
+
+		r := &walReader{data: copyData.Data[1:]}
+		switch copyData.Data[0] {
+		case 'k':
+			// Keepalive, answered right away when the server asks for it
+			walEnd := r.uint64()
+			r.uint64()
+			if r.uint8() == 1 {
+				nextStatus = time.Now()
+			}
+			if walEnd > received {
+				received = walEnd
+			}
+
+		case 'w':
+			walStart := r.uint64()
+			r.uint64()
+			r.uint64()
+			if r.err != nil {
+				fail(r.err)
+				return
+			}
+
+			decode := ts.decodePgoutput
+			if ts.plugin == pluginWal2json {
+				decode = ts.decodeWal2json
+			}
+			events, err := decode(formatLSN(walStart), r.data)
+			if err != nil {
+				fail(err)
+				return
+			}
+			for _, e := range events {
+				if !ts.watched[e.Schema+"."+e.Table] {
+					continue
+				}
+				ts.push(e)
+				sm.PM.emit(StreamChangeEvent, e)
+			}
+
+			if end := walStart + uint64(len(r.data)); end > received {
+				received = end
+			}
+		}
+	}
+}
+
+// command runs a replication command and returns the rows of its result
+func command(ctx context.Context, conn *pgconn.PgConn, sql string) ([][][]byte, error) {
+	results, err := conn.Exec(ctx, sql).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var rows [][][]byte
+	for _, result := range results {
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		rows = append(rows, result.Rows...)
+	}
+	return rows, nil
+}
+
+// startReplication starts streaming from the slot and waits for the server to switch
+// the connection to the copy protocol
+func startReplication(ctx context.Context, conn *pgconn.PgConn, sql string) error {
+	conn.Frontend().Send(&pgproto3.Query{String: sql})
+	if err := conn.Frontend().Flush(); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyBothResponse:
+			return nil
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.NoticeResponse:
+		default:
+			return errors.Errorf("unexpected response to START_REPLICATION: %T", msg)
+		}
+	}
+}
+
+// Start creates a temporary slot for the tab on a replication connection and streams
+// the changes of the tables from it. For pgoutput a publication of the tables is
+// created first, once the hooks allow it, and it is dropped along with the slot.
+func (sm *StreamManager) Start(ctx context.Context, pool *pgxpool.Pool, poolID uuid.UUID, tabID int64, plugin string, tables []streamTable, hooks publicationHooks) (model.StreamState, error) {
+	if plugin != "" && plugin != pluginPgoutput && plugin != pluginWal2json {
+		return model.StreamState{}, errors.Errorf("unknown plugin %s, use pgoutput or wal2json", plugin)
+	}
+
+	sm.Close(tabID)
+
+	config, err := sm.PM.ReplicationConfig(poolID)
+	if err != nil {
+		return model.StreamState{}, err
+	}
+	conn, err := pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return model.StreamState{}, errors.Wrap(err, "failed to open replication connection")
+	}
+
+	// A temporary slot may outlive its connection for a moment, every start gets a new one
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	publication := sm.publicationName(tabID)
+	name := publication + "_" + hex.EncodeToString(suffix)
+
+	ts := &tabStream{
+		tabID:     tabID,
+		poolID:    poolID,
+		conn:      conn,
+		slot:      name,
+		watched:   make(map[string]bool),
+		audit:     hooks.audit,
+		relations: make(map[uint32]pgoutputRelation),
+		done:      make(chan struct{}),
+	}
+	for _, t := range tables {
+		ts.watched[t.schema+"."+t.name] = true
+		ts.tables = append(ts.tables, t.schema+"."+t.name)
+	}
+	sort.Strings(ts.tables)
+
+	createSlot := func(plugin string) error {
+		_, err := command(ctx, conn, fmt.Sprintf("CREATE_REPLICATION_SLOT %s TEMPORARY LOGICAL %s NOEXPORT_SNAPSHOT", name, plugin))
+		return err
+	}
+
+	// wal2json filters the tables itself, pgoutput needs a publication which has to
+	// exist before the slot's starting point to be seen
+	usePgoutput := func() error {
+		ts.plugin = pluginPgoutput
+		statement := sm.publicationStatement(tabID, tables)
+		if err := hooks.check(statement); err != nil {
+			return err
+		}
+		started := time.Now()
+		_, err := pool.Exec(ctx, statement)
+		hooks.audit(statement, started, err)
+		if err != nil {
+			return errors.Wrap(err, "failed to create publication for pgoutput")
+		}
+		ts.publication = publication
+		return createSlot(pluginPgoutput)
+	}
+
+	switch plugin {
+	case pluginPgoutput:
+		err = usePgoutput()
+	case pluginWal2json:
+		ts.plugin = pluginWal2json
+		err = createSlot(pluginWal2json)
+	default:
+		ts.plugin = pluginWal2json
+		if createSlot(pluginWal2json) != nil {
+			err = usePgoutput()
+		}
+	}
+	if err != nil {
+		sm.cleanup(ts)
+		return model.StreamState{}, err
+	}
+
+	start := fmt.Sprintf("START_REPLICATION SLOT %s LOGICAL 0/0 (proto_version '1', publication_names %s)", name, replicationLiteral(publication))
+	if ts.plugin == pluginWal2json {
+		var filter []string
+		for _, t := range tables {
+			filter = append(filter, wal2jsonTable(t))
+		}
+		start = fmt.Sprintf(`START_REPLICATION SLOT %s LOGICAL 0/0 ("format-version" '2', "include-xids" '1', "include-timestamp" '1', "add-tables" %s)`, name, replicationLiteral(strings.Join(filter, ",")))
+	}
+	if err := startReplication(ctx, conn, start); err != nil {
+		sm.cleanup(ts)
+		return model.StreamState{}, err
+	}
+
+	streamCtx, cancel := context.WithCancel(context.Background())
+	ts.cancel = cancel
+	ts.running = true
+
+	sm.mu.Lock()
+	sm.streams[tabID] = ts
+	sm.mu.Unlock()
+
+	go sm.stream(streamCtx, ts)
+
+	return ts.state(), nil
+}
+
+// State returns the slot and changes of the tab's stream
+func (sm *StreamManager) State(tabID int64) (model.StreamState, bool) {
+	sm.mu.Lock()
+	ts, exists := sm.streams[tabID]
+	sm.mu.Unlock()
+	if !exists {
+		return model.StreamState{}, false
+	}
+	return ts.state(), true
+}
+
+// Close stops the tab's stream and drops its slot and publication
+func (sm *StreamManager) Close(tabID int64) {
+	sm.mu.Lock()
+	ts, exists := sm.streams[tabID]
+	delete(sm.streams, tabID)
+	sm.mu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	ts.cancel()
+	<-ts.done
+	sm.cleanup(ts)
+}
+
+// CloseForPool closes the streams of the pool. Their publications are dropped through
+// the pool, so this has to happen before the pool is closed.
+func (sm *StreamManager) CloseForPool(poolID uuid.UUID) {
+	sm.mu.Lock()
+	var tabIDs []int64
+	for tabID, ts := range sm.streams {
+		if ts.poolID == poolID {
+			tabIDs = append(tabIDs, tabID)
+		}
+	}
+	sm.mu.Unlock()
+
+	for _, tabID := range tabIDs {
+		sm.Close(tabID)
+	}
+}
+
+// CloseAll closes every stream
+func (sm *StreamManager) CloseAll() {
+	sm.mu.Lock()
+	var tabIDs []int64
+	for tabID := range sm.streams {
+		tabIDs = append(tabIDs, tabID)
+	}
+	sm.mu.Unlock()
+
+	for _, tabID := range tabIDs {
+		sm.Close(tabID)
+	}
+}
+
+// StartChangeStream streams the row changes of the tables into a stream tab through a
+// temporary logical replication slot. Changes are emitted with the stream:change event,
+// and stream:state when the stream fails. The connection's role needs the REPLICATION
+// attribute and the server wal_level = logical. The publication pgoutput needs is subject
+// to the environment policy, when it asks for confirmation the token returned in the
+// confirmation has to be passed.
+func (c *Connections) StartChangeStream(activePoolID uuid.UUID, tabID int64, spec model.StreamSpec, token string) (*model.StreamState, error) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return nil, errors.New("pool doesn't exist")
+	}
+
+	ctx := context.Background()
+
+	// Resolve the names the way the server would, so they match the stream's
+	var tables []streamTable
+	for _, name := range spec.Tables {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		schema, table := "public", name
+		if i := strings.LastIndex(name, "."); i > 0 {
+			schema, table = name[:i], name[i+1:]
+		}
+		schema, table = strings.Trim(schema, `"`), strings.Trim(table, `"`)
+
+		var t streamTable
+		err := pool.QueryRow(ctx, `
+			SELECT n.nspname, c.relname
+			FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE c.oid = to_regclass($1) AND c.relkind IN ('r', 'p')
+		`, quoteIdent(schema)+"."+quoteIdent(table)).Scan(&t.schema, &t.name)
+		if err != nil {
+			return nil, errors.Errorf("table %s doesn't exist", name)
+		}
+		tables = append(tables, t)
+	}
+	if len(tables) == 0 {
+		return nil, errors.New("at least one table is required")
+	}
+
+	policy, err := c.poolPolicy(activePoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	publication := c.SM.publicationStatement(tabID, tables)
+	confirmed := token != "" && c.consumeConfirmation(activePoolID, publication, token)
+	var toConfirm []sqlStatement
+	var toConfirmInfo []statementInfo
+
+	hooks := publicationHooks{
+		check: func(statement string) error {
+			var err error
+			toConfirm, toConfirmInfo, err = checkPolicy(policy, statement)
+			if err != nil {
+				c.audit(activePoolID, statement, time.Now(), 0, auditBlocked, err)
+				return err
+			}
+			if len(toConfirm) > 0 && !confirmed {
+				return errPublicationConfirmation
+			}
+			return nil
+		},
+		audit: func(statement string, started time.Time, err error) {
+			if err != nil {
+				c.audit(activePoolID, statement, started, 0, auditError, err)
+				return
+			}
+			c.audit(activePoolID, statement, started, 0, auditSuccess, nil)
+		},
+	}
+
+	state, err := c.SM.Start(ctx, pool, activePoolID, tabID, strings.ToLower(strings.TrimSpace(spec.Plugin)), tables, hooks)
+	if errors.Is(err, errPublicationConfirmation) {
+		confirmation, err := c.requestConfirmation(ctx, activePoolID, policy, publication, toConfirm, toConfirmInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		return &model.StreamState{
+			TabID:                tabID,
+			PoolID:               activePoolID.String(),
+			Plugin:               pluginPgoutput,
+			Error:                fmt.Sprintf("Streaming with pgoutput creates a publication on a %s connection and needs to be confirmed", policy.Env),
+			RequiresConfirmation: true,
+			Confirmation:         confirmation,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Kept as the tab's editor content so the tab can stream again once reopened
+	specJSON, err := json.Marshal(model.StreamSpec{Plugin: spec.Plugin, Tables: state.Tables})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.DB.Exec("UPDATE tabs SET editor = ? WHERE id = ? AND type = 'stream'", string(specJSON), tabID); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// dropOrphanPublications drops the stream publications which an earlier run of the app
+// left behind, e.g. when it was killed. A publication still has a slot named after it
+// while its stream runs, in this app or another one.
+func (c *Connections) dropOrphanPublications(activePoolID uuid.UUID) {
+	pool, exists := c.PM.GetPool(activePoolID)
+	if !exists {
+		return
+	}
+
+	policy, err := c.poolPolicy(activePoolID)
+	if err != nil || policy.ReadOnly {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	rows, err := pool.Query(ctx, `
+		SELECT p.pubname
+		FROM pg_publication p
+		WHERE p.pubname LIKE 'dbmx\_%'
+			AND NOT EXISTS (
+				SELECT 1 FROM pg_replication_slots s
+				WHERE s.slot_name = p.pubname OR left(s.slot_name, length(p.pubname) + 1) = p.pubname || '_'
+			)
+	`)
+	if err != nil {
+		return
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		statement := "DROP PUBLICATION IF EXISTS " + quoteIdent(name)
+		started := time.Now()
+		if _, err := pool.Exec(ctx, statement); err != nil {
+			c.audit(activePoolID, statement, started, 0, auditError, err)
+			fmt.Println("Error dropping publication", name+":", err)
+			continue
+		}
+		c.audit(activePoolID, statement, started, 0, auditSuccess, nil)
+	}
+}
+
+// StopChangeStream stops a stream tab's stream and drops its slot
+func (c *Connections) StopChangeStream(tabID int64) {
+	c.SM.Close(tabID)
+}
+
+// GetChangeStream returns the slot of a stream tab and the changes it received
+func (c *Connections) GetChangeStream(tabID int64) (*model.StreamState, error) {
+	state, exists := c.SM.State(tabID)
+	if !exists {
+		return nil, errors.New("tab isn't streaming")
+	}
+	return &state, nil
+}
@@ -0,0 +1,169 @@
+package app
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"dbmx/model"
+)
+
+// pgoutputMessage writes the fields of a pgoutput message: bytes, strings as
+// null terminated strings, and integers in network order
+func pgoutputMessage(fields ...any) []byte {
+	var b []byte
+	for _, f := range fields {
+		switch v := f.(type) {
+		case byte:
+			b = append(b, v)
+		case string:
+			b = append(append(b, v...), 0)
+		case uint16:
+			b = binary.BigEndian.AppendUint16(b, v)
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, v)
+		case []byte:
+			b = append(b, v...)
+		}
+	}
+	return b
+}
+
+// pgoutputTuple writes a tuple, nil values are nulls and "\x00" values unchanged TOAST
+func pgoutputTuple(values ...*string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(values)))
+	for _, v := range values {
+		switch {
+		case v == nil:
+			b = append(b, 'n')
+		case *v == "\x00":
+			b = append(b, 'u')
+		default:
+			b = append(b, 't')
+			b = binary.BigEndian.AppendUint32(b, uint32(len(*v)))
+			b = append(b, *v...)
+		}
+	}
+	return b
+}
+
+func TestDecodePgoutput(t *testing.T) {
+	text := func(s string) *string { return &s }
+	unchanged := text("\x00")
+
+	// app.users (id, name, bio), id being the replica identity
+	relation := pgoutputMessage(byte('R'), uint32(16384), "app", "users", byte('d'), uint16(3),
+		byte(1), "id", uint32(23), uint32(0xffffffff),
+		byte(0), "name", uint32(25), uint32(0xffffffff),
+		byte(0), "bio", uint32(25), uint32(0xffffffff),
+	)
+	// Committed one second after 2000-01-01
+	begin := pgoutputMessage(byte('B'), uint64(0x16b3748), uint64(1000000), uint32(42))
+	commit := pgoutputMessage(byte('C'), byte(0), uint64(0x16b3748), uint64(0x16b3778), uint64(1000000))
+
+	event := func(action string, before, after []model.ChangeColumn) model.ChangeEvent {
+		return model.ChangeEvent{TabID: 7, LSN: "0/16B3748", XID: 42, CommitTime: "2000-01-01T00:00:01Z", Action: action, Schema: "app", Table: "users", Before: before, After: after}
+	}
+	column := func(name string, value *string) model.ChangeColumn {
+		return model.ChangeColumn{Name: name, Value: value}
+	}
+
+	tests := []struct {
+		name     string
+		messages [][]byte
+		want     []model.ChangeEvent
+		wantErr  string
+	}{
+		{"empty", [][]byte{{}}, nil, ""},
+		{"transaction without changes", [][]byte{begin, relation, commit}, nil, ""},
+		{
+			"insert",
+			[][]byte{relation, begin, pgoutputMessage(byte('I'), uint32(16384), byte('N'), pgoutputTuple(text("1"), text("ann"), nil)), commit},
+			[]model.ChangeEvent{event("insert", nil, []model.ChangeColumn{column("id", text("1")), column("name", text("ann")), column("bio", nil)})},
+			"",
+		},
+		{
+			"update with unchanged toast",
+			[][]byte{relation, begin, pgoutputMessage(byte('U'), uint32(16384), byte('N'), pgoutputTuple(text("1"), text("bea"), unchanged))},
+			[]model.ChangeEvent{event("update", nil, []model.ChangeColumn{column("id", text("1")), column("name", text("bea")), {Name: "bio", Unchanged: true}})},
+			"",
+		},
+		{
+			"update of the key",
+			[][]byte{relation, begin, pgoutputMessage(byte('U'), uint32(16384), byte('K'), pgoutputTuple(text("1"), nil, nil), byte('N'), pgoutputTuple(text("2"), text("ann"), nil))},
+			[]model.ChangeEvent{event("update", []model.ChangeColumn{column("id", text("1"))}, []model.ChangeColumn{column("id", text("2")), column("name", text("ann")), column("bio", nil)})},
+			"",
+		},
+		{
+			"update with the old row",
+			[][]byte{relation, begin, pgoutputMessage(byte('U'), uint32(16384), byte('O'), pgoutputTuple(text("1"), text("ann"), nil), byte('N'), pgoutputTuple(text("1"), text("bea"), nil))},
+			[]model.ChangeEvent{event("update",
+				[]model.ChangeColumn{column("id", text("1")), column("name", text("ann")), column("bio", nil)},
+				[]model.ChangeColumn{column("id", text("1")), column("name", text("bea")), column("bio", nil)},
+			)},
+			"",
+		},
+		{
+			"delete",
+			[][]byte{relation, begin, pgoutputMessage(byte('D'), uint32(16384), byte('K'), pgoutputTuple(text("1"), nil, nil))},
+			[]model.ChangeEvent{event("delete", []model.ChangeColumn{column("id", text("1"))}, nil)},
+			"",
+		},
+		{
+			"truncate",
+			[][]byte{relation, begin, pgoutputMessage(byte('T'), uint32(1), byte(0), uint32(16384))},
+			[]model.ChangeEvent{event("truncate", nil, nil)},
+			"",
+		},
+		{
+			"unknown relation",
+			[][]byte{begin, pgoutputMessage(byte('I'), uint32(16385), byte('N'), pgoutputTuple(text("1")))},
+			nil,
+			"replication stream references unknown relation 16385",
+		},
+		{
+			"truncated tuple",
+			[][]byte{relation, begin, pgoutputMessage(byte('I'), uint32(16384), byte('N'), uint16(3), byte('t'), uint32(10), "ab")},
+			nil,
+			"replication message is truncated",
+		},
+		{
+			"truncated relation",
+			[][]byte{pgoutputMessage(byte('R'), uint32(16384), []byte("app"))},
+			nil,
+			"replication message is truncated",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := &tabStream{tabID: 7, relations: make(map[uint32]pgoutputRelation)}
+
+			var events []model.ChangeEvent
+			var err error
+			for _, message := range tt.messages {
+				var decoded []model.ChangeEvent
+				decoded, err = ts.decodePgoutput("0/16B3748", message)
+				if err != nil {
+					break
+				}
+				events = append(events, decoded...)
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("decodePgoutput() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodePgoutput() failed: %v", err)
+			}
+			if !reflect.DeepEqual(events, tt.want) {
+				t.Errorf("decodePgoutput() = %+v, want %+v", events, tt.want)
+			}
+		})
+	}
+}
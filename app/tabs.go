@@ -13,12 +13,20 @@ import (
 type Tabs struct {
 	DB *sql.DB
 	PM *PoolManager
+	RS *ResultStore
+	CM *CursorManager
+	LM *ListenerManager
+	SM *StreamManager
 }
 
-func NewTabs(db *sql.DB, pm *PoolManager) *Tabs {
+func NewTabs(db *sql.DB, pm *PoolManager, rs *ResultStore, cm *CursorManager, lm *ListenerManager, sm *StreamManager) *Tabs {
 	return &Tabs{
 		DB: db,
 		PM: pm,
+		RS: rs,
+		CM: cm,
+		LM: lm,
+		SM: sm,
 	}
 }
 
@@ -96,6 +104,27 @@ func (t *Tabs) AddTab(activeDBID, activeDB, activeDBColour, tableName, tabType s
 		tableColumnsString = string(tableColumnsJSON)
 	}
 
+	if tabType == "erd" {
+		if activeDBID == "" {
+			return nil, errors.New("active db pool id is required for tab type erd")
+		}
+		name = "ERD"
+	}
+
+	if tabType == "listen" {
+		if activeDBID == "" {
+			return nil, errors.New("active db pool id is required for tab type listen")
+		}
+		name = "LISTEN"
+	}
+
+	if tabType == "stream" {
+		if activeDBID == "" {
+			return nil, errors.New("active db pool id is required for tab type stream")
+		}
+		name = "Changes"
+	}
+
 	if activeDBID != "" {
 		active_db_id = &activeDBID
 	}
@@ -108,7 +137,7 @@ func (t *Tabs) AddTab(activeDBID, activeDB, activeDBColour, tableName, tabType s
 	}
 
 	if !model.IsValidTabType(tabType) {
-		return nil, errors.New("invalid tab type. Only editor and table are allowed.")
+		return nil, errors.New("invalid tab type. Only editor, table, erd, listen and stream are allowed.")
 	}
 
 	// Insert a new active tab
@@ -129,6 +158,11 @@ func (t *Tabs) AddTab(activeDBID, activeDB, activeDBColour, tableName, tabType s
 		return nil, err
 	}
 
+	// Mark the pool as being used by the new tab
+	if activePoolID, err := uuid.Parse(activeDBID); err == nil {
+		t.PM.Retain(activePoolID, insertedID)
+	}
+
 	return &model.Tab{
 		ID:               insertedID,
 		Name:             name,
@@ -168,19 +202,11 @@ func (t *Tabs) SetActiveTab(id int64) (*model.Tab, error) {
 		}
 	}
 
-	if len(tab.Output) == 0 {
-		return &tab, nil
-	}
-
-	var output model.Output
-	err = json.Unmarshal([]byte(tab.Output), &output)
+	err = t.loadResult(&tab)
 	if err != nil {
 		return nil, err
 	}
 
-	tab.Columns = output.Columns
-	tab.Rows = output.Rows
-
 	return &tab, nil
 }
 
@@ -209,15 +235,9 @@ func (t *Tabs) GetAllTabs() ([]model.Tab, error) {
 				}
 			}
 
-			if len(tab.Output) > 0 {
-				var output model.Output
-				err = json.Unmarshal([]byte(tab.Output), &output)
-				if err != nil {
-					return nil, err
-				}
-
-				tab.Columns = output.Columns
-				tab.Rows = output.Rows
+			err = t.loadResult(&tab)
+			if err != nil {
+				return nil, err
 			}
 		}
 
@@ -272,21 +292,28 @@ func (t *Tabs) DeleteTab(id int64) (*model.Tab, error) {
 				}
 			}
 
-			if len(tab.Output) > 0 {
-				var output model.Output
-				err = json.Unmarshal([]byte(tab.Output), &output)
-				if err != nil {
-					return nil, err
-				}
-
-				tab.Columns = output.Columns
-				tab.Rows = output.Rows
+			err = t.loadResult(&tab)
+			if err != nil {
+				return nil, err
 			}
 		} else {
 			isLastTab = true
 		}
 	}
 
+	// The deleted tab no longer uses its pool, cursor, listener or stream
+	t.PM.Release(id)
+	t.CM.Close(id)
+	t.LM.Close(id)
+	t.SM.Close(id)
+
+	// Remove the stored result of the tab, once its queued writes are done, before the
+	// tab itself so that none of them is left to write for a tab which is gone
+	err = t.RS.Delete(id)
+	if err != nil {
+		return nil, err
+	}
+
 	// Delete the tab
 	query = `DELETE FROM tabs WHERE id = ?`
 	_, err = t.DB.Exec(query, id)
@@ -326,10 +353,89 @@ func (t *Tabs) SaveActiveDBProps(id int64, activeDBID, activeDB, activeDBColour
 	// NOTE: Only update for tab type editor
 	// Update the active db properties in the tab of type editor
 	query := `UPDATE tabs SET active_db_id = ?, active_db = ?, active_db_colour = ? WHERE id = ? AND type = 'editor'`
-	_, err := t.DB.Exec(query, active_db_id, active_db, active_db_colour, id)
+	result, err := t.DB.Exec(query, active_db_id, active_db, active_db_colour, id)
+	if err != nil {
+		return err
+	}
+
+	// Move the tab's reference from its previous pool to the new one
+	if updated, err := result.RowsAffected(); err == nil && updated > 0 {
+		t.PM.Release(id)
+		if activePoolID, err := uuid.Parse(activeDBID); err == nil {
+			t.PM.Retain(activePoolID, id)
+		}
+	}
+
+	return nil
+}
+
+// loadResult sets the first page of the tab's stored result on the tab
+func (t *Tabs) loadResult(tab *model.Tab) error {
+	page, err := t.RS.Page(tab.ID, 0, defaultResultPageSize)
 	if err != nil {
 		return err
 	}
+	if page == nil {
+		return nil
+	}
+
+	tab.Columns = page.Columns
+	tab.Rows = page.Rows
+	tab.ResultRows = page.StoredRows
+	tab.ResultTruncated = page.Truncated
 
 	return nil
 }
+
+// GetTabResultPage returns rows [offset, offset+limit) of the tab's stored result
+func (t *Tabs) GetTabResultPage(tabID int64, offset, limit int) (*model.ResultPage, error) {
+	page, err := t.RS.Page(tabID, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	if page == nil {
+		return nil, errors.New("tab has no stored result")
+	}
+
+	return page, nil
+}
+
+// AddFilteredTableTab opens a table tab showing only the rows matching the filter,
+// used to follow foreign keys from one table to another
+func (t *Tabs) AddFilteredTableTab(activeDBID, activeDB, activeDBColour, tableName string, postgresConnID int64, dbName, postgresConnName, where string) (*model.Tab, error) {
+	tab, err := t.AddTab(activeDBID, activeDB, activeDBColour, tableName, "table", postgresConnID, dbName, postgresConnName)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.DB.Exec(`UPDATE tabs SET "where" = ? WHERE id = ?`, where, tab.ID)
+	if err != nil {
+		return nil, err
+	}
+	tab.Where = where
+
+	return tab, nil
+}
+
+// AddERDTab opens a diagram of the database, the diagram options are kept as the tab's editor content
+func (t *Tabs) AddERDTab(activeDBID, activeDB, activeDBColour string, postgresConnID int64, dbName, postgresConnName string, options model.ERDOptions) (*model.Tab, error) {
+	optionsJSON, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+
+	tab, err := t.AddTab(activeDBID, activeDB, activeDBColour, "", "erd", postgresConnID, dbName, postgresConnName)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.DB.Exec(`UPDATE tabs SET editor = ?, postgres_conn_id = ?, db_name = ? WHERE id = ?`, string(optionsJSON), postgresConnID, dbName, tab.ID)
+	if err != nil {
+		return nil, err
+	}
+	tab.Editor = string(optionsJSON)
+	tab.PostgresConnID = &postgresConnID
+	tab.DBName = &dbName
+
+	return tab, nil
+}
@@ -0,0 +1,755 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"dbmx/model"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// Events emitted to the frontend while transfers run
+const (
+	TransferProgressEvent = "transfer:progress"
+	TransferDoneEvent     = "transfer:done"
+)
+
+// Transfer modes
+const (
+	transferAppend   = "append"
+	transferTruncate = "truncate"
+	transferUpsert   = "upsert"
+)
+
+const (
+	defaultTransferBatch = 5000
+
+	// Rejected rows kept on a job, and the bytes of their data kept
+	maxTransferRejections = 100
+	maxRejectedData       = 500
+)
+
+// Staging table upsert copies each batch to, dropped with the transaction
+const transferStage = "dbmx_transfer_stage"
+
+// transferPlan is the plan of a transfer along with the statements only run internally
+type transferPlan struct {
+	model.TransferPlan
+
+	mode      string
+	batchSize int
+	create    []string
+	truncate  string
+	// COPY TO run on the source, and COPY FROM run on the target or the staging table
+	copyOut string
+	copyIn  string
+	stage   string
+	upsert  string
+}
+
+// transferJob is a running or finished transfer with what's needed to cancel it
+type transferJob struct {
+	job          model.TransferJob
+	sourcePoolID uuid.UUID
+	targetPoolID uuid.UUID
+	cancel       context.CancelFunc
+	cancelled    bool
+	finished     time.Time
+}
+
+// TransferManager keeps the transfers. Every transfer reads from a connection of the
+// source pool and writes through a connection of the target pool.
+type TransferManager struct {
+	PM *PoolManager
+
+	jobs map[string]*transferJob
+	mu   sync.Mutex
+}
+
+func NewTransferManager(pm *PoolManager) *TransferManager {
+	return &TransferManager{
+		PM:   pm,
+		jobs: make(map[string]*transferJob),
+	}
+}
+
+// snapshot returns a copy of the job safe to hand out
+func (tm *TransferManager) snapshot(id string) (model.TransferJob, bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tj, exists := tm.jobs[id]
+	if !exists {
+		return model.TransferJob{}, false
+	}
+	return tj.job, true
+}
+
+// update changes the job and emits its progress
+func (tm *TransferManager) update(tj *transferJob, change func(job *model.TransferJob)) {
+	tm.mu.Lock()
+	change(&tj.job)
+	job := tj.job
+	tm.mu.Unlock()
+
+	tm.PM.emit(TransferProgressEvent, job)
+}
+
+// start runs the transfer in the background
+func (tm *TransferManager) start(job model.TransferJob, sourcePoolID, targetPoolID uuid.UUID, run func(ctx context.Context, tj *transferJob) error, done func(job model.TransferJob, started time.Time, err error)) model.TransferJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := time.Now()
+
+	job.ID = uuid.New().String()
+	job.State = jobRunning
+	job.StartedAt = started.UTC().Format(time.RFC3339)
+	job.Percent = -1
+	job.Rejections = []model.TransferRejection{}
+
+	tj := &transferJob{
+		job:          job,
+		sourcePoolID: sourcePoolID,
+		targetPoolID: targetPoolID,
+		cancel:       cancel,
+	}
+
+	tm.mu.Lock()
+	for id, old := range tm.jobs {
+		if !old.finished.IsZero() && time.Since(old.finished) > finishedJobTTL {
+			delete(tm.jobs, id)
+		}
+	}
+	tm.jobs[job.ID] = tj
+	tm.mu.Unlock()
+
+	go func() {
+		err := run(ctx, tj)
+		cancel()
+
+		tm.mu.Lock()
+		tj.finished = time.Now()
+		tj.job.FinishedAt = tj.finished.UTC().Format(time.RFC3339)
+		switch {
+		case tj.cancelled:
+			tj.job.State = jobCancelled
+		case err != nil:
+			tj.job.State = jobFailed
+			tj.job.Error = err.Error()
+		default:
+			tj.job.State = jobSucceeded
+			tj.job.Percent = 100
+		}
+		job := tj.job
+		tm.mu.Unlock()
+
+		done(job, started, err)
+		tm.PM.emit(TransferDoneEvent, job)
+	}()
+
+	return job
+}
+
+// Cancel stops a running transfer, rolling back what it wrote
+func (tm *TransferManager) Cancel(id string) error {
+	tm.mu.Lock()
+	tj, exists := tm.jobs[id]
+	if !exists {
+		tm.mu.Unlock()
+		return errors.New("job doesn't exist")
+	}
+	if tj.job.State != jobRunning {
+		tm.mu.Unlock()
+		return errors.Errorf("job already %s", tj.job.State)
+	}
+	tj.cancelled = true
+	tm.mu.Unlock()
+
+	// Cancelling the context cancels the statements running on both connections
+	tj.cancel()
+	return nil
+}
+
+// CancelForPool cancels the transfers reading from or writing to the pool, needed
+// before the pool is closed since closing a pool waits for its connections to be released
+func (tm *TransferManager) CancelForPool(poolID uuid.UUID) {
+	tm.mu.Lock()
+	var ids []string
+	for id, tj := range tm.jobs {
+		if (tj.sourcePoolID == poolID || tj.targetPoolID == poolID) && tj.job.State == jobRunning {
+			ids = append(ids, id)
+		}
+	}
+	tm.mu.Unlock()
+
+	for _, id := range ids {
+		_ = tm.Cancel(id)
+	}
+}
+
+// CancelAll cancels every running transfer
+func (tm *TransferManager) CancelAll() {
+	tm.mu.Lock()
+	var ids []string
+	for id, tj := range tm.jobs {
+		if tj.job.State == jobRunning {
+			ids = append(ids, id)
+		}
+	}
+	tm.mu.Unlock()
+
+	for _, id := range ids {
+		_ = tm.Cancel(id)
+	}
+}
+
+// List returns the running transfers and the recently finished ones, newest first
+func (tm *TransferManager) List() []model.TransferJob {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	jobs := []model.TransferJob{}
+	for _, tj := range tm.jobs {
+		jobs = append(jobs, tj.job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt > jobs[j].StartedAt
+	})
+	return jobs
+}
+
+// transferColumns maps the source columns to the target. Without a mapping the columns
+// the target has as well are copied, or all of them when the target is created.
+func transferColumns(source, target *model.Relation, mapping []model.ColumnMapping) ([]model.ColumnMapping, error) {
+	sourceColumns := make(map[string]bool, len(source.Columns))
+	for _, column := range source.Columns {
+		sourceColumns[column.Name] = true
+	}
+	targetColumns := make(map[string]bool)
+	if target != nil {
+		for _, column := range target.Columns {
+			targetColumns[column.Name] = true
+		}
+	}
+
+	if len(mapping) == 0 {
+		for _, column := range source.Columns {
+			if target == nil || targetColumns[column.Name] {
+				mapping = append(mapping, model.ColumnMapping{Source: column.Name, Target: column.Name})
+			}
+		}
+		if len(mapping) == 0 {
+			return nil, errors.New("the source and target have no column in common")
+		}
+		return mapping, nil
+	}
+
+	columns := make([]model.ColumnMapping, 0, len(mapping))
+	mapped := make(map[string]bool, len(mapping))
+	for _, m := range mapping {
+		m.Source, m.Target = strings.TrimSpace(m.Source), strings.TrimSpace(m.Target)
+		if m.Target == "" {
+			m.Target = m.Source
+		}
+		if !sourceColumns[m.Source] {
+			return nil, errors.Errorf("the source has no column %s", m.Source)
+		}
+		if target != nil && !targetColumns[m.Target] {
+			return nil, errors.Errorf("the target has no column %s", m.Target)
+		}
+		if mapped[m.Target] {
+			return nil, errors.Errorf("column %s of the target is mapped twice", m.Target)
+		}
+		mapped[m.Target] = true
+		columns = append(columns, m)
+	}
+
+	return columns, nil
+}
+
+// transferTableSpec describes the target created from the source's mapped columns. The
+// primary key is kept when all of its columns are copied, defaults are left out since
+// they may use sequences and functions of the source.
+func transferTableSpec(source *model.Relation, schema, name string, columns []model.ColumnMapping) model.TableSpec {
+	sourceColumns := make(map[string]model.Column, len(source.Columns))
+	for _, column := range source.Columns {
+		sourceColumns[column.Name] = column
+	}
+
+	spec := model.TableSpec{Schema: schema, Name: name}
+	targets := make(map[string]string, len(columns))
+	for _, m := range columns {
+		column := sourceColumns[m.Source]
+		spec.Columns = append(spec.Columns, model.ColumnSpec{Name: m.Target, Type: column.Type, NotNull: !column.Nullable})
+		targets[m.Source] = m.Target
+	}
+
+	var primaryKey []string
+	for _, key := range source.PrimaryKey {
+		target, exists := targets[key]
+		if !exists {
+			return spec
+		}
+		primaryKey = append(primaryKey, target)
+	}
+	spec.PrimaryKey = primaryKey
+
+	return spec
+}
+
+// singleCondition reports if the filter stays within its WHERE clause. COPY runs with
+// the simple protocol, the filter must not close the query or add statements of its own.
+func singleCondition(where string) bool {
+	depth := 0
+	for _, t := range lexSQL(where) {
+		if t.kind != tokenPunct {
+			continue
+		}
+		switch t.text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		case ";":
+			return false
+		}
+		if depth < 0 {
+			return false
+		}
+	}
+	return depth == 0
+}
+
+// transferPlan checks the spec against both databases and renders the statements of
+// the transfer
+func (c *Connections) transferPlan(ctx context.Context, sourcePoolID, targetPoolID uuid.UUID, spec model.TransferSpec) (*transferPlan, error) {
+	source, exists := c.PM.GetPool(sourcePoolID)
+	if !exists {
+		return nil, errors.New("source pool doesn't exist")
+	}
+	target, exists := c.PM.GetPool(targetPoolID)
+	if !exists {
+		return nil, errors.New("target pool doesn't exist")
+	}
+
+	plan := &transferPlan{
+		mode:      strings.ToLower(strings.TrimSpace(spec.Mode)),
+		batchSize: spec.BatchSize,
+	}
+	if plan.mode == "" {
+		plan.mode = transferAppend
+	}
+	if plan.mode != transferAppend && plan.mode != transferTruncate && plan.mode != transferUpsert {
+		return nil, errors.Errorf("unknown transfer mode %s, use append, truncate or upsert", spec.Mode)
+	}
+	if plan.batchSize <= 0 {
+		plan.batchSize = defaultTransferBatch
+	}
+
+	// The mapping and the target's DDL have to match both servers, not older stored copies
+	for _, poolID := range []uuid.UUID{sourcePoolID, targetPoolID} {
+		if _, err := c.MC.Refresh(ctx, poolID); err != nil {
+			return nil, err
+		}
+	}
+	sourceMetadata, err := c.MC.Get(ctx, sourcePoolID)
+	if err != nil {
+		return nil, err
+	}
+	sourceRel, err := tableRelation(sourceMetadata, strings.TrimSpace(spec.SourceTable))
+	if err != nil {
+		return nil, err
+	}
+
+	targetName := strings.TrimSpace(spec.TargetTable)
+	if targetName == "" {
+		targetName = tabTableName(sourceRel.Schema, sourceRel.Name)
+	}
+	targetMetadata, err := c.MC.Get(ctx, targetPoolID)
+	if err != nil {
+		return nil, err
+	}
+	targetRel, err := tableRelation(targetMetadata, targetName)
+	if err != nil {
+		if !spec.CreateTarget {
+			return nil, err
+		}
+		targetRel = nil
+	} else if targetRel.Kind != "table" && targetRel.Kind != "partitioned table" {
+		return nil, errors.Errorf("%s is a %s, only tables can be copied to", targetName, targetRel.Kind)
+	}
+
+	plan.Columns, err = transferColumns(sourceRel, targetRel, spec.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	targetSchema, targetTable := splitTableName(targetName)
+	primaryKey := []string{}
+	if targetRel == nil {
+		tableSpec := transferTableSpec(sourceRel, targetSchema, targetTable, plan.Columns)
+		types, err := resolveColumnTypes(ctx, target, tableSpec.Columns)
+		if err != nil {
+			return nil, err
+		}
+		plan.create, err = renderCreateTable(tableSpec, types)
+		if err != nil {
+			return nil, err
+		}
+		plan.CreateTarget = true
+		primaryKey = tableSpec.PrimaryKey
+	} else {
+		targetSchema, targetTable = targetRel.Schema, targetRel.Name
+		primaryKey = targetRel.PrimaryKey
+	}
+
+	sourceQualified := quoteIdent(sourceRel.Schema) + "." + quoteIdent(sourceRel.Name)
+	targetQualified := quoteIdent(targetSchema) + "." + quoteIdent(targetTable)
+	plan.Source = tabTableName(sourceRel.Schema, sourceRel.Name)
+	plan.Target = tabTableName(targetSchema, targetTable)
+
+	var sourceColumns, targetColumns []string
+	for _, m := range plan.Columns {
+		sourceColumns = append(sourceColumns, m.Source)
+		targetColumns = append(targetColumns, m.Target)
+	}
+
+	selectRows := "SELECT " + quoteIdents(sourceColumns) + " FROM " + sourceQualified
+	if where := strings.TrimSpace(spec.Where); where != "" {
+		if !singleCondition(where) {
+			return nil, errors.New("the filter has to be a single condition")
+		}
+		// The line break ends a trailing comment of the filter
+		selectRows += " WHERE (" + where + "\n)"
+	}
+	plan.copyOut = "COPY (" + selectRows + ") TO STDOUT"
+
+	if plan.mode == transferTruncate {
+		plan.truncate = "TRUNCATE " + targetQualified
+	}
+
+	copyTarget := "COPY " + targetQualified + " (" + quoteIdents(targetColumns) + ") FROM STDIN"
+	statements := append([]string{}, plan.create...)
+	if plan.truncate != "" {
+		statements = append(statements, plan.truncate)
+	}
+
+	if plan.mode == transferUpsert {
+		keys := spec.ConflictColumns
+		if len(keys) == 0 {
+			keys = primaryKey
+		}
+		if len(keys) == 0 {
+			return nil, errors.Errorf("%s has no primary key, upsert needs the conflict columns", plan.Target)
+		}
+
+		isKey := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			isKey[key] = true
+		}
+		var updates []string
+		for _, column := range targetColumns {
+			if !isKey[column] {
+				updates = append(updates, quoteIdent(column)+" = EXCLUDED."+quoteIdent(column))
+			}
+			delete(isKey, column)
+		}
+		for key := range isKey {
+			return nil, errors.Errorf("conflict column %s isn't copied", key)
+		}
+
+		onConflict := " ON CONFLICT (" + quoteIdents(keys) + ") DO NOTHING"
+		if len(updates) > 0 {
+			onConflict = " ON CONFLICT (" + quoteIdents(keys) + ") DO UPDATE SET " + strings.Join(updates, ", ")
+		}
+
+		plan.stage = "CREATE TEMP TABLE " + transferStage + " ON COMMIT DROP AS SELECT " + quoteIdents(targetColumns) + " FROM " + targetQualified + " WITH NO DATA"
+		plan.copyIn = "COPY " + transferStage + " (" + quoteIdents(targetColumns) + ") FROM STDIN"
+		// Emptying the stage in the same statement readies it for the next batch
+		plan.upsert = "WITH staged AS (DELETE FROM " + transferStage + " RETURNING " + quoteIdents(targetColumns) + ") INSERT INTO " + targetQualified + " (" + quoteIdents(targetColumns) + ") SELECT " + quoteIdents(targetColumns) + " FROM staged" + onConflict
+		statements = append(statements, plan.stage, plan.copyIn, plan.upsert)
+	} else {
+		plan.copyIn = copyTarget
+		statements = append(statements, copyTarget)
+	}
+
+	plan.Statements = statements
+	plan.Script = strings.Join(statements, ";\n\n") + ";\n"
+
+	// The statistics only help without a filter
+	plan.EstimatedRows = -1
+	if strings.TrimSpace(spec.Where) == "" {
+		var estimate int64
+		err := source.QueryRow(ctx, "SELECT reltuples::bigint FROM pg_class WHERE oid = $1", sourceRel.OID).Scan(&estimate)
+		if err == nil && estimate > 0 {
+			plan.EstimatedRows = estimate
+		}
+	}
+
+	return plan, nil
+}
+
+// writeTransferBatch writes the rows to the target in a savepoint. The first error is
+// the rows' own, which leaves the transaction usable, the second ends the transfer.
+func writeTransferBatch(ctx context.Context, tx pgx.Tx, plan *transferPlan, rows [][]byte) (error, error) {
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsErr := func() error {
+		if _, err := savepoint.Conn().PgConn().CopyFrom(ctx, bytes.NewReader(bytes.Join(rows, nil)), plan.copyIn); err != nil {
+			return err
+		}
+		if plan.upsert == "" {
+			return nil
+		}
+		_, err := savepoint.Exec(ctx, plan.upsert)
+		return err
+	}()
+
+	if rowsErr != nil {
+		if err := savepoint.Rollback(ctx); err != nil {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return rowsErr, nil
+	}
+
+	return nil, savepoint.Commit(ctx)
+}
+
+// rejectedData is the row as the rejection shows it
+func rejectedData(row []byte) string {
+	data := strings.TrimSuffix(string(row), "\n")
+	if len(data) > maxRejectedData {
+		data = strings.ToValidUTF8(data[:maxRejectedData], "") + "…"
+	}
+	return data
+}
+
+// runTransfer streams the source rows in COPY text format to the target in batches,
+// in a single transaction of the target. A batch the target refuses is retried a row
+// at a time so that only the bad rows are rejected.
+func (tm *TransferManager) runTransfer(ctx context.Context, tj *transferJob, plan *transferPlan, source, target *pgxpool.Pool) error {
+	targetConn, err := acquireConn(ctx, target)
+	if err != nil {
+		return err
+	}
+	defer releaseUntimed(targetConn)
+
+	// A transfer takes as long as the table needs, like maintenance it runs without
+	// the environment's statement timeout on either side
+	if _, err := targetConn.Exec(ctx, "SET statement_timeout = 0"); err != nil {
+		return err
+	}
+
+	tx, err := targetConn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	setup := append([]string{}, plan.create...)
+	if plan.truncate != "" {
+		setup = append(setup, plan.truncate)
+	}
+	if plan.stage != "" {
+		setup = append(setup, plan.stage)
+	}
+	for _, statement := range setup {
+		if _, err := tx.Exec(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	sourceConn, err := acquireConn(ctx, source)
+	if err != nil {
+		return err
+	}
+	defer releaseUntimed(sourceConn)
+
+	if _, err := sourceConn.Exec(ctx, "SET statement_timeout = 0"); err != nil {
+		return err
+	}
+
+	rows, w := io.Pipe()
+	copying := make(chan struct{})
+	go func() {
+		defer close(copying)
+		_, err := sourceConn.Conn().PgConn().CopyTo(ctx, w, plan.copyOut)
+		w.CloseWithError(err)
+	}()
+	// Stops the copy when the transfer ends early, a connection left mid-copy is closed
+	defer func() {
+		rows.Close()
+		<-copying
+	}()
+
+	var read, copied, rejected int64
+	var rejections []model.TransferRejection
+	reader := bufio.NewReaderSize(rows, 1<<16)
+	batch := make([][]byte, 0, plan.batchSize)
+
+	for {
+		// The text format escapes newlines in values, every line is a row
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		if len(line) > 0 {
+			batch = append(batch, line)
+		}
+
+		if len(batch) > 0 && (len(batch) >= plan.batchSize || readErr == io.EOF) {
+			first := read + 1
+			read += int64(len(batch))
+
+			rowsErr, err := writeTransferBatch(ctx, tx, plan, batch)
+			if err != nil {
+				return err
+			}
+			if rowsErr == nil {
+				copied += int64(len(batch))
+			} else {
+				for i, row := range batch {
+					rowErr, err := writeTransferBatch(ctx, tx, plan, [][]byte{row})
+					if err != nil {
+						return err
+					}
+					if rowErr == nil {
+						copied++
+						continue
+					}
+					rejected++
+					if len(rejections) < maxTransferRejections {
+						rejections = append(rejections, model.TransferRejection{Row: first + int64(i), Data: rejectedData(row), Error: rowErr.Error()})
+					}
+				}
+			}
+			batch = batch[:0]
+
+			tm.update(tj, func(job *model.TransferJob) {
+				job.Read, job.Copied, job.Rejected = read, copied, rejected
+				job.Rejections = append(job.Rejections[:0:0], rejections...)
+				if plan.EstimatedRows > 0 {
+					// The estimate may be short of the actual rows
+					job.Percent = min(float64(read)*100/float64(plan.EstimatedRows), 99)
+				}
+			})
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// PreviewTransfer returns the statements a transfer runs on the target without running them
+func (c *Connections) PreviewTransfer(sourcePoolID, targetPoolID uuid.UUID, spec model.TransferSpec) (*model.TransferPlan, error) {
+	plan, err := c.transferPlan(context.Background(), sourcePoolID, targetPoolID, spec)
+	if err != nil {
+		return nil, err
+	}
+	return &plan.TransferPlan, nil
+}
+
+// StartTransfer copies the rows of a table from the source pool to the target pool in
+// the background. Its progress is emitted with the transfer:progress event and its end
+// with transfer:done. When the target's environment policy asks for confirmation the
+// token returned in the confirmation has to be passed.
+func (c *Connections) StartTransfer(sourcePoolID, targetPoolID uuid.UUID, spec model.TransferSpec, token string) (*model.TransferJob, error) {
+	ctx := context.Background()
+	started := time.Now()
+
+	plan, err := c.transferPlan(ctx, sourcePoolID, targetPoolID, spec)
+	if err != nil {
+		return nil, err
+	}
+	source, _ := c.PM.GetPool(sourcePoolID)
+	target, _ := c.PM.GetPool(targetPoolID)
+
+	policy, err := c.poolPolicy(targetPoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	toConfirm, toConfirmInfo, err := checkPolicy(policy, plan.Script)
+	if err != nil {
+		c.audit(targetPoolID, plan.Script, started, 0, auditBlocked, err)
+		return nil, err
+	}
+
+	if len(toConfirm) > 0 && !c.consumeConfirmation(targetPoolID, plan.Script, token) {
+		confirmation, err := c.requestConfirmation(ctx, targetPoolID, policy, plan.Script, toConfirm, toConfirmInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		return &model.TransferJob{
+			SourcePoolID:         sourcePoolID.String(),
+			TargetPoolID:         targetPoolID.String(),
+			Mode:                 plan.mode,
+			Plan:                 &plan.TransferPlan,
+			RequiresConfirmation: true,
+			Confirmation:         confirmation,
+		}, nil
+	}
+
+	job := model.TransferJob{
+		SourcePoolID: sourcePoolID.String(),
+		TargetPoolID: targetPoolID.String(),
+		Mode:         plan.mode,
+		Plan:         &plan.TransferPlan,
+	}
+
+	job = c.TM.start(job, sourcePoolID, targetPoolID, func(ctx context.Context, tj *transferJob) error {
+		return c.TM.runTransfer(ctx, tj, plan, source, target)
+	}, func(job model.TransferJob, started time.Time, err error) {
+		outcome := auditSuccess
+		if err != nil {
+			outcome = auditError
+		}
+		c.audit(targetPoolID, plan.Script, started, job.Copied, outcome, err)
+
+		if plan.CreateTarget && job.State == jobSucceeded {
+			c.MC.Invalidate(targetPoolID)
+		}
+	})
+
+	return &job, nil
+}
+
+// CancelTransfer cancels a running transfer, nothing it wrote is kept
+func (c *Connections) CancelTransfer(jobID string) (bool, error) {
+	if err := c.TM.Cancel(jobID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetTransferJobs lists the running and recently finished transfers
+func (c *Connections) GetTransferJobs() []model.TransferJob {
+	return c.TM.List()
+}
+
+// GetTransferJob returns a transfer by id
+func (c *Connections) GetTransferJob(jobID string) (*model.TransferJob, error) {
+	job, exists := c.TM.snapshot(jobID)
+	if !exists {
+		return nil, errors.Errorf("job %s doesn't exist", jobID)
+	}
+	return &job, nil
+}
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"dbmx/migrations"
+)
+
+// migration is one goose migration file, only its Up section is kept
+type migration struct {
+	version int64
+	name    string
+	up      string
+}
+
+// loadMigrations reads the embedded migrations in version order
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	var list []migration
+	for _, name := range names {
+		prefix, _, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s has no version prefix", name)
+		}
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", name, err)
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, migration{version: version, name: name, up: upSection(string(data))})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].version < list[j].version })
+	return list, nil
+}
+
+// upSection returns the statements between "-- +goose Up" and "-- +goose Down". The
+// StatementBegin/End markers are plain comments to sqlite, which runs the section as is.
+func upSection(src string) string {
+	var b strings.Builder
+	inUp := false
+	for _, line := range strings.SplitAfter(src, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "-- +goose ") {
+			switch strings.TrimSpace(strings.TrimPrefix(trimmed, "-- +goose ")) {
+			case "Up":
+				inUp = true
+			case "Down":
+				inUp = false
+			}
+			continue
+		}
+		if inUp {
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
+
+// appliedVersions reads goose's version table, creating it when the database has none.
+// The latest row of a version tells whether it's applied, as goose records downs as rows.
+func appliedVersions(ctx context.Context, db *sql.DB) (map[int64]bool, error) {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS goose_db_version (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		version_id INTEGER NOT NULL,
+		is_applied INTEGER NOT NULL,
+		tstamp TIMESTAMP DEFAULT (datetime('now'))
+	)`); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `SELECT version_id, is_applied FROM goose_db_version ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int64]bool{}
+	for rows.Next() {
+		var version int64
+		var isApplied bool
+		if err := rows.Scan(&version, &isApplied); err != nil {
+			return nil, err
+		}
+		applied[version] = isApplied
+	}
+	return applied, rows.Err()
+}
+
+// migrate applies the embedded migrations the database is missing. The database copied
+// on first start already has them, installs from earlier releases only have the older
+// ones. Each migration runs in its own transaction and is recorded the way goose records
+// it, so the goose CLI keeps working on the file.
+func migrate(ctx context.Context, db *sql.DB) error {
+	list, err := loadMigrations(migrations.FS)
+	if err != nil {
+		return err
+	}
+	applied, err := appliedVersions(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		if _, err := db.ExecContext(ctx, `INSERT INTO goose_db_version (version_id, is_applied) VALUES (0, 1)`); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range list {
+		if applied[m.version] {
+			continue
+		}
+		if err := applyMigration(ctx, db, m); err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		fmt.Printf("Applied migration %s\n", m.name)
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(m.up) != "" {
+		if _, err := tx.ExecContext(ctx, m.up); err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO goose_db_version (version_id, is_applied) VALUES (?, 1)`, m.version); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	return tx.Commit()
+}
@@ -56,6 +56,10 @@ func NewSqlite3DB(ctx context.Context) (*Sqlite3, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := migrate(ctx, db); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("migrating %s: %w", dbPath, err)
+	}
 	fmt.Println("Connected to the SQLite database successfully.")
 	return &Sqlite3{DB: db}, nil
 }
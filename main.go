@@ -30,9 +30,16 @@ func main() {
 	defer db.CloseConn()
 
 	pm := a.NewPoolManager()
+	rs := a.NewResultStore(db.DB)
+	cm := a.NewCursorManager()
+	mc := a.NewMetadataCache(db.DB, pm)
+	jm := a.NewJobManager(pm)
+	lm := a.NewListenerManager(pm)
+	sm := a.NewStreamManager(pm)
+	tm := a.NewTransferManager(pm)
 
-	conn := a.NewConnections(db.DB, pm)
-	tabs := a.NewTabs(db.DB, pm)
+	conn := a.NewConnections(db.DB, pm, rs, cm, mc, jm, lm, sm, tm)
+	tabs := a.NewTabs(db.DB, pm, rs, cm, lm, sm)
 	app := NewApp(conn)
 
 	// Create application with options
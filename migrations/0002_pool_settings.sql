@@ -0,0 +1,15 @@
+-- +goose Up
+ALTER TABLE "postgres" ADD COLUMN "max_conns" INTEGER NOT NULL DEFAULT 4;
+ALTER TABLE "postgres" ADD COLUMN "min_conns" INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE "postgres" ADD COLUMN "max_conn_lifetime" INTEGER NOT NULL DEFAULT 3600;
+ALTER TABLE "postgres" ADD COLUMN "max_conn_idle_time" INTEGER NOT NULL DEFAULT 1800;
+ALTER TABLE "postgres" ADD COLUMN "health_check_period" INTEGER NOT NULL DEFAULT 60;
+ALTER TABLE "postgres" ADD COLUMN "application_name" VARCHAR NOT NULL DEFAULT 'dbmx';
+
+-- +goose Down
+ALTER TABLE "postgres" DROP COLUMN "application_name";
+ALTER TABLE "postgres" DROP COLUMN "health_check_period";
+ALTER TABLE "postgres" DROP COLUMN "max_conn_idle_time";
+ALTER TABLE "postgres" DROP COLUMN "max_conn_lifetime";
+ALTER TABLE "postgres" DROP COLUMN "min_conns";
+ALTER TABLE "postgres" DROP COLUMN "max_conns";
@@ -0,0 +1,18 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS "env_policies" (
+  "env" VARCHAR PRIMARY KEY NOT NULL,
+  "read_only" INTEGER NOT NULL DEFAULT 0,
+  "confirm_writes" INTEGER NOT NULL DEFAULT 0,
+  "block_unsafe_writes" INTEGER NOT NULL DEFAULT 0,
+  "block_destructive" INTEGER NOT NULL DEFAULT 0,
+  "statement_timeout_ms" INTEGER NOT NULL DEFAULT 0,
+  "lock_timeout_ms" INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO "env_policies" ("env", "read_only", "confirm_writes", "block_unsafe_writes", "block_destructive", "statement_timeout_ms", "lock_timeout_ms") VALUES
+  ('production', 0, 1, 1, 1, 30000, 5000),
+  ('staging', 0, 1, 1, 0, 60000, 10000),
+  ('local', 0, 0, 0, 0, 0, 0);
+
+-- +goose Down
+DROP TABLE IF EXISTS "env_policies";
@@ -0,0 +1,49 @@
+-- +goose Up
+ALTER TABLE "env_policies" ADD COLUMN "audit" INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE "env_policies" ADD COLUMN "redact_literals" INTEGER NOT NULL DEFAULT 0;
+
+UPDATE "env_policies" SET "audit" = 0 WHERE "env" = 'local';
+
+CREATE TABLE IF NOT EXISTS "audit_log" (
+  "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+  "created_at" VARCHAR NOT NULL,
+  "os_user" VARCHAR NOT NULL DEFAULT '',
+  "postgres_conn_id" BIGINT DEFAULT NULL,
+  "postgres_conn_name" VARCHAR NOT NULL DEFAULT '',
+  "database" VARCHAR NOT NULL DEFAULT '',
+  "env" VARCHAR NOT NULL DEFAULT '',
+  "kind" VARCHAR NOT NULL DEFAULT '',
+  "command" VARCHAR NOT NULL DEFAULT '',
+  "statement" TEXT NOT NULL,
+  "redacted" INTEGER NOT NULL DEFAULT 0,
+  "duration_ms" INTEGER NOT NULL DEFAULT 0,
+  "rows_affected" INTEGER NOT NULL DEFAULT 0,
+  "outcome" VARCHAR NOT NULL,
+  "error" TEXT NOT NULL DEFAULT '',
+  "prev_hash" VARCHAR NOT NULL,
+  "hash" VARCHAR NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_env ON "audit_log" ("env");
+
+-- The audit log is append only
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON "audit_log"
+BEGIN
+  SELECT RAISE(ABORT, 'audit log is append only');
+END;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON "audit_log"
+BEGIN
+  SELECT RAISE(ABORT, 'audit log is append only');
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+DROP TRIGGER IF EXISTS audit_log_no_delete;
+DROP TRIGGER IF EXISTS audit_log_no_update;
+DROP TABLE IF EXISTS "audit_log";
+ALTER TABLE "env_policies" DROP COLUMN "redact_literals";
+ALTER TABLE "env_policies" DROP COLUMN "audit";
@@ -0,0 +1,25 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS "tab_results" (
+  "tab_id" INTEGER PRIMARY KEY NOT NULL REFERENCES "tabs" ("id") ON DELETE CASCADE,
+  "seq" INTEGER NOT NULL,
+  "columns" TEXT NOT NULL DEFAULT '[]',
+  "total_rows" INTEGER NOT NULL DEFAULT 0,
+  "stored_rows" INTEGER NOT NULL DEFAULT 0,
+  "truncated" INTEGER NOT NULL DEFAULT 0,
+  "chunk_size" INTEGER NOT NULL,
+  "created_at" VARCHAR NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS "tab_result_chunks" (
+  "tab_id" INTEGER NOT NULL REFERENCES "tab_results" ("tab_id") ON DELETE CASCADE,
+  "chunk_index" INTEGER NOT NULL,
+  "data" BLOB NOT NULL,
+  PRIMARY KEY ("tab_id", "chunk_index")
+);
+
+-- Results are no longer stored in the tabs table
+UPDATE "tabs" SET "output" = '';
+
+-- +goose Down
+DROP TABLE IF EXISTS "tab_result_chunks";
+DROP TABLE IF EXISTS "tab_results";
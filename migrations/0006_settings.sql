@@ -0,0 +1,12 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS "settings" (
+  "key" VARCHAR PRIMARY KEY NOT NULL,
+  "value" TEXT NOT NULL
+);
+
+INSERT INTO "settings" ("key", "value") VALUES
+  ('cursor_page_size', '500'),
+  ('cursor_row_limit', '100000');
+
+-- +goose Down
+DROP TABLE IF EXISTS "settings";
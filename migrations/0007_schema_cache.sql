@@ -0,0 +1,29 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS "schema_cache" (
+  "postgres_conn_id" INTEGER NOT NULL REFERENCES "postgres" ("id") ON DELETE CASCADE,
+  "database" VARCHAR NOT NULL,
+  "search_path" TEXT NOT NULL DEFAULT '[]',
+  "schemas" TEXT NOT NULL DEFAULT '[]',
+  "functions" TEXT NOT NULL DEFAULT '[]',
+  "functions_marker" VARCHAR NOT NULL DEFAULT '',
+  "refreshed_at" VARCHAR NOT NULL,
+  PRIMARY KEY ("postgres_conn_id", "database")
+);
+
+-- One row per relation, the marker changes whenever the relation's catalog rows change
+CREATE TABLE IF NOT EXISTS "schema_cache_relations" (
+  "postgres_conn_id" INTEGER NOT NULL,
+  "database" VARCHAR NOT NULL,
+  "oid" INTEGER NOT NULL,
+  "schema" VARCHAR NOT NULL,
+  "name" VARCHAR NOT NULL,
+  "kind" VARCHAR NOT NULL,
+  "marker" VARCHAR NOT NULL,
+  "data" TEXT NOT NULL,
+  PRIMARY KEY ("postgres_conn_id", "database", "oid"),
+  FOREIGN KEY ("postgres_conn_id", "database") REFERENCES "schema_cache" ("postgres_conn_id", "database") ON DELETE CASCADE
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS "schema_cache_relations";
+DROP TABLE IF EXISTS "schema_cache";
@@ -0,0 +1,15 @@
+-- +goose Up
+-- Server settings saved to compare servers against later, kept when the connection is deleted
+CREATE TABLE IF NOT EXISTS "settings_snapshots" (
+  "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+  "name" VARCHAR NOT NULL,
+  "postgres_conn_id" BIGINT DEFAULT NULL,
+  "postgres_conn_name" VARCHAR NOT NULL DEFAULT '',
+  "database" VARCHAR NOT NULL DEFAULT '',
+  "server_version" VARCHAR NOT NULL DEFAULT '',
+  "created_at" VARCHAR NOT NULL,
+  "settings" TEXT NOT NULL DEFAULT '[]'
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS "settings_snapshots";
@@ -0,0 +1,7 @@
+-- +goose Up
+-- Open result cursors, listeners and background jobs each hold a connection,
+-- connections still on the old default of 4 get the new default
+UPDATE "postgres" SET "max_conns" = 10 WHERE "max_conns" = 4;
+
+-- +goose Down
+UPDATE "postgres" SET "max_conns" = 4 WHERE "max_conns" = 10;
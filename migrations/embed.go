@@ -0,0 +1,8 @@
+// Package migrations embeds the goose migrations so the app can bring an existing
+// database up to date on startup.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
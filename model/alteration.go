@@ -0,0 +1,78 @@
+package model
+
+// TableChange is a single change to a table made in the structure view
+type TableChange struct {
+	// add_column, drop_column, rename_column, alter_type, set_default, drop_default,
+	// set_not_null, drop_not_null, add_constraint, drop_constraint, add_index,
+	// drop_index, table_comment, column_comment, enable_rls, disable_rls, force_rls,
+	// no_force_rls, create_policy, alter_policy or drop_policy
+	Action string `json:"action"`
+
+	Column  string `json:"column"`
+	NewName string `json:"newName"`
+
+	// Type of an added column or the new type of a column
+	Type string `json:"type"`
+	// Expression converting the old values when changing the type
+	Using string `json:"using"`
+	// Default expression of an added column or of set_default
+	Default string `json:"default"`
+	// Added column is NOT NULL
+	NotNull bool `json:"notNull"`
+
+	// Name of the constraint or index
+	Name string `json:"name"`
+	// Constraint definition, e.g. CHECK (price > 0) or UNIQUE (email)
+	Definition string `json:"definition"`
+	// Validate an added CHECK or FOREIGN KEY constraint later
+	NotValid bool `json:"notValid"`
+
+	// Index columns or expressions, with the index method and predicate of a partial index
+	IndexColumns []string `json:"indexColumns"`
+	Unique       bool     `json:"unique"`
+	Method       string   `json:"method"`
+	Where        string   `json:"where"`
+	// Builds or drops the index without blocking writes, outside of the transaction
+	Concurrently bool `json:"concurrently"`
+
+	// Drop dependent objects as well
+	Cascade bool `json:"cascade"`
+
+	// New comment, empty removes the comment
+	Comment string `json:"comment"`
+
+	// Row level security policy to create, alter or drop
+	Policy PolicySpec `json:"policy"`
+}
+
+// AlterationStatement is a statement of an alteration script with the lock it takes
+type AlterationStatement struct {
+	Statement string `json:"statement"`
+	Lock      string `json:"lock"`
+	Warning   string `json:"warning"`
+	// Statements which can't run in a transaction block run after it
+	Transactional bool `json:"transactional"`
+	// Removes data, a constraint, default, index or policy, blocked where the
+	// environment policy blocks destructive statements
+	Destructive bool `json:"destructive"`
+}
+
+// AlterationPlan is the preview of the script altering a table
+type AlterationPlan struct {
+	Table      string                `json:"table"`
+	Statements []AlterationStatement `json:"statements"`
+	Script     string                `json:"script"`
+	Warnings   []string              `json:"warnings"`
+}
+
+// AlterationResult reports how applying an alteration went
+type AlterationResult struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+	// Statements which were committed
+	Applied int `json:"applied"`
+
+	// Set when the environment policy requires the script to be confirmed before it runs
+	RequiresConfirmation bool          `json:"requiresConfirmation"`
+	Confirmation         *Confirmation `json:"confirmation"`
+}
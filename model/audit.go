@@ -0,0 +1,41 @@
+package model
+
+// AuditEntry is a row of the append only audit log of statements sent to servers
+type AuditEntry struct {
+	ID                     int64  `json:"id"`
+	CreatedAt              string `json:"createdAt"`
+	OSUser                 string `json:"osUser"`
+	PostgresConnectionID   int64  `json:"postgresConnectionId"`
+	PostgresConnectionName string `json:"postgresConnectionName"`
+	Database               string `json:"database"`
+	Env                    string `json:"env"`
+
+	// Classification of the statement, read, dml, ddl or other, and its main command
+	Kind    string `json:"kind"`
+	Command string `json:"command"`
+
+	// Statement text, with literals replaced by ? when Redacted is set
+	Statement string `json:"statement"`
+	Redacted  bool   `json:"redacted"`
+
+	DurationMs   int64 `json:"durationMs"`
+	RowsAffected int64 `json:"rowsAffected"`
+
+	// success, error, blocked or dry_run
+	Outcome string `json:"outcome"`
+	Error   string `json:"error"`
+
+	// Each entry's hash covers its fields and the hash of the previous entry
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+// AuditVerification is the result of checking the hash chain of the audit log
+type AuditVerification struct {
+	OK      bool  `json:"ok"`
+	Entries int64 `json:"entries"`
+
+	// First entry whose hash doesn't match, 0 if the chain is intact
+	BrokenAtID int64  `json:"brokenAtId"`
+	Message    string `json:"message"`
+}
@@ -0,0 +1,67 @@
+package model
+
+// ServerSetting is a row of pg_settings
+type ServerSetting struct {
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	// The value as pg_settings reports it, in the setting's unit
+	Value string `json:"value"`
+	Unit  string `json:"unit"`
+	// The value with its unit in the largest unit it's a whole number of, e.g. 128MB or 5min
+	Normalized string `json:"normalized"`
+	// default, configuration file, session, client, database, user...
+	Source     string `json:"source"`
+	SourceFile string `json:"sourceFile"`
+	SourceLine int    `json:"sourceLine"`
+	// Changed in the configuration but only applied once the server restarts
+	PendingRestart bool `json:"pendingRestart"`
+	// When the setting can be changed: postmaster, sighup, superuser, user...
+	Context     string `json:"context"`
+	Type        string `json:"type"`
+	BootValue   string `json:"bootValue"`
+	ResetValue  string `json:"resetValue"`
+	Description string `json:"description"`
+	Details     string `json:"details"`
+}
+
+// SettingsCategory groups the settings of a pg_settings category
+type SettingsCategory struct {
+	Name     string          `json:"name"`
+	Settings []ServerSetting `json:"settings"`
+}
+
+// SettingsSnapshot is the settings of a server saved to compare other servers against
+type SettingsSnapshot struct {
+	ID                     int64           `json:"id"`
+	Name                   string          `json:"name"`
+	PostgresConnectionID   *int64          `json:"postgresConnectionId"`
+	PostgresConnectionName string          `json:"postgresConnectionName"`
+	Database               string          `json:"database"`
+	ServerVersion          string          `json:"serverVersion"`
+	CreatedAt              string          `json:"createdAt"`
+	Settings               []ServerSetting `json:"settings,omitempty"`
+}
+
+// SettingDifference is a setting which differs between the two sides of a diff
+type SettingDifference struct {
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	// changed, or only_left or only_right for settings one server version doesn't have
+	Status      string `json:"status"`
+	Left        string `json:"left"`
+	Right       string `json:"right"`
+	LeftSource  string `json:"leftSource"`
+	RightSource string `json:"rightSource"`
+	// Set when a side's value comes from the connection rather than the server's
+	// configuration, e.g. timeouts applied by the environment policy
+	SessionOnly bool `json:"sessionOnly"`
+}
+
+// SettingsDiff compares the settings of two servers, or a server and a snapshot
+type SettingsDiff struct {
+	Left        string              `json:"left"`
+	Right       string              `json:"right"`
+	Differences []SettingDifference `json:"differences"`
+	// Number of settings with the same value on both sides
+	Same int `json:"same"`
+}
@@ -12,6 +12,14 @@ type PostgresConnection struct {
 	Env      string
 	Colour   string
 	IsActive bool
+
+	// Pool settings, durations are in seconds
+	MaxConns          int32
+	MinConns          int32
+	MaxConnLifetime   int64
+	MaxConnIdleTime   int64
+	HealthCheckPeriod int64
+	ApplicationName   string
 }
 
 type Database struct {
@@ -32,11 +40,16 @@ type Database struct {
 	// Tables and columns are set for the active database
 	Tables  []string
 	Columns []string
+
+	// Set when the database was refreshed
+	Changes *MetadataChanges
 }
 
 type Cell struct {
 	Column string `json:"column"`
 	Value  string `json:"value"`
+	// Set for NULL, whose value reads NULL just like the text 'NULL' does
+	Null bool `json:"null,omitempty"`
 }
 
 type QueryResult struct {
@@ -45,6 +58,15 @@ type QueryResult struct {
 	Rows         [][]Cell `json:"rows"`
 	RowsAffected int64    `json:"rowsAffected"`
 	Message      string   `json:"message"`
+
+	// Set when the result is read through a cursor which has more rows to fetch
+	HasMore bool `json:"hasMore"`
+	// Set when fetching stopped at the in memory row limit
+	LimitReached bool `json:"limitReached"`
+
+	// Set when the environment policy requires the query to be confirmed before it runs
+	RequiresConfirmation bool          `json:"requiresConfirmation"`
+	Confirmation         *Confirmation `json:"confirmation"`
 }
 
 type Output struct {
@@ -67,8 +89,49 @@ type Rules struct {
 	Rows    [][]Cell `json:"rows"`
 }
 
+type PoolStats struct {
+	PoolID   string `json:"poolId"`
+	Database string `json:"database"`
+
+	// Number of tabs using the pool
+	TabCount int    `json:"tabCount"`
+	LastUsed string `json:"lastUsed"`
+
+	// Evicted pools have no open connections and are reopened on next use
+	Evicted bool `json:"evicted"`
+
+	// connected, reconnecting or lost
+	State string `json:"state"`
+
+	MaxConns                int32 `json:"maxConns"`
+	TotalConns              int32 `json:"totalConns"`
+	AcquiredConns           int32 `json:"acquiredConns"`
+	IdleConns               int32 `json:"idleConns"`
+	ConstructingConns       int32 `json:"constructingConns"`
+	AcquireCount            int64 `json:"acquireCount"`
+	AcquireDurationMs       int64 `json:"acquireDurationMs"`
+	EmptyAcquireCount       int64 `json:"emptyAcquireCount"`
+	CanceledAcquireCount    int64 `json:"canceledAcquireCount"`
+	NewConnsCount           int64 `json:"newConnsCount"`
+	MaxLifetimeDestroyCount int64 `json:"maxLifetimeDestroyCount"`
+	MaxIdleDestroyCount     int64 `json:"maxIdleDestroyCount"`
+}
+
+// PoolState is emitted to the frontend whenever the connection state of a pool changes
+type PoolState struct {
+	PoolID               string `json:"poolId"`
+	PostgresConnectionID int64  `json:"postgresConnectionId"`
+	Database             string `json:"database"`
+
+	// connected, reconnecting or lost
+	State   string `json:"state"`
+	Message string `json:"message"`
+}
+
 type TableInfo struct {
 	Structure Structure `json:"structure"`
 	Indexes   Indexes   `json:"indexes"`
 	Rules     Rules     `json:"rules"`
+
+	RowSecurity RowSecurity `json:"rowSecurity"`
 }
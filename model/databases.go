@@ -0,0 +1,41 @@
+package model
+
+// DatabaseSpec describes a database to create
+type DatabaseSpec struct {
+	Name     string `json:"name"`
+	Owner    string `json:"owner"`
+	Encoding string `json:"encoding"`
+	Locale   string `json:"locale"`
+	// Database to copy, template1 when empty. Cloning a database uses it as the template.
+	Template string `json:"template"`
+}
+
+// DatabaseSession is a session connected to a database
+type DatabaseSession struct {
+	PID             int32  `json:"pid"`
+	User            string `json:"user"`
+	ApplicationName string `json:"applicationName"`
+	ClientAddr      string `json:"clientAddr"`
+	State           string `json:"state"`
+	BackendStart    string `json:"backendStart"`
+	Query           string `json:"query"`
+}
+
+// DatabaseOperationResult reports the outcome of creating, cloning, renaming or
+// dropping a database
+type DatabaseOperationResult struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+
+	// Set when other sessions are connected to the database the operation needs for
+	// itself, the operation can be retried with them terminated
+	RequiresTermination bool              `json:"requiresTermination"`
+	Sessions            []DatabaseSession `json:"sessions"`
+
+	// Pools of the app which were closed, tabs using them no longer have an active database
+	ClosedPools []string `json:"closedPools"`
+
+	// Set when the environment policy requires the statement to be confirmed before it runs
+	RequiresConfirmation bool          `json:"requiresConfirmation"`
+	Confirmation         *Confirmation `json:"confirmation"`
+}
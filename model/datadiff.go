@@ -0,0 +1,71 @@
+package model
+
+// DataDiffSpec describes the table whose rows are compared between two pools
+type DataDiffSpec struct {
+	// Table names as table tabs use them, the target defaults to the source's name
+	SourceTable string `json:"sourceTable"`
+	TargetTable string `json:"targetTable"`
+	// Rows hashed together in a chunk, defaults to 10000
+	ChunkRows int `json:"chunkRows"`
+}
+
+// DataDiffColumn is a column of a row on both sides, nil values are NULL
+type DataDiffColumn struct {
+	Name    string  `json:"name"`
+	Source  *string `json:"source"`
+	Target  *string `json:"target"`
+	Changed bool    `json:"changed"`
+}
+
+// DataDiffRow is a row which differs between the source and the target
+type DataDiffRow struct {
+	// only_source, only_target or changed
+	Status string `json:"status"`
+	// Primary key values in key order
+	Key     []string         `json:"key"`
+	Columns []DataDiffColumn `json:"columns"`
+}
+
+// DataDiff compares the rows of a table on two pools by primary key. Rows are hashed in
+// chunks on each server and only the chunks whose hashes differ are read and compared.
+type DataDiff struct {
+	Source     string   `json:"source"`
+	Target     string   `json:"target"`
+	Table      string   `json:"table"`
+	KeyColumns []string `json:"keyColumns"`
+	// Columns compared, and the columns only one side has which are left out
+	Columns           []string `json:"columns"`
+	SourceOnlyColumns []string `json:"sourceOnlyColumns"`
+	TargetOnlyColumns []string `json:"targetOnlyColumns"`
+
+	Chunks          int   `json:"chunks"`
+	DifferingChunks int   `json:"differingChunks"`
+	SourceRows      int64 `json:"sourceRows"`
+	TargetRows      int64 `json:"targetRows"`
+
+	OnlySource int64 `json:"onlySource"`
+	OnlyTarget int64 `json:"onlyTarget"`
+	Changed    int64 `json:"changed"`
+	// Differing rows, cut when there are too many to list
+	Rows      []DataDiffRow `json:"rows"`
+	Truncated bool          `json:"truncated"`
+
+	// Statements making the target's rows match the source's, empty when truncated
+	Statements []string `json:"statements"`
+	Script     string   `json:"script"`
+}
+
+// DataSyncResult reports the outcome of applying the synchronisation script to the target
+type DataSyncResult struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+
+	Inserted int64 `json:"inserted"`
+	Updated  int64 `json:"updated"`
+	Deleted  int64 `json:"deleted"`
+
+	// Set when the environment policy of the target requires the script to be
+	// confirmed before it runs
+	RequiresConfirmation bool          `json:"requiresConfirmation"`
+	Confirmation         *Confirmation `json:"confirmation"`
+}
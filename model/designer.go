@@ -0,0 +1,95 @@
+package model
+
+// TableSpec describes a table to create in the table designer
+type TableSpec struct {
+	Schema  string       `json:"schema"`
+	Name    string       `json:"name"`
+	Comment string       `json:"comment"`
+	Columns []ColumnSpec `json:"columns"`
+
+	PrimaryKey  []string         `json:"primaryKey"`
+	Uniques     []UniqueSpec     `json:"uniques"`
+	Checks      []CheckSpec      `json:"checks"`
+	ForeignKeys []ForeignKeySpec `json:"foreignKeys"`
+	Indexes     []IndexSpec      `json:"indexes"`
+
+	// Creates a partitioned table when set
+	Partition *PartitionSpec `json:"partition"`
+}
+
+type ColumnSpec struct {
+	Name string `json:"name"`
+	// Any type known to the server, including enums and domains, or smallserial,
+	// serial and bigserial
+	Type    string `json:"type"`
+	Default string `json:"default"`
+	// Empty, always or by default for GENERATED ... AS IDENTITY
+	Identity string `json:"identity"`
+	NotNull  bool   `json:"notNull"`
+	Comment  string `json:"comment"`
+}
+
+type UniqueSpec struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+}
+
+type CheckSpec struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+type ForeignKeySpec struct {
+	Name       string   `json:"name"`
+	Columns    []string `json:"columns"`
+	RefSchema  string   `json:"refSchema"`
+	RefTable   string   `json:"refTable"`
+	RefColumns []string `json:"refColumns"`
+	// NO ACTION, RESTRICT, CASCADE, SET NULL or SET DEFAULT, empty means NO ACTION
+	OnDelete string `json:"onDelete"`
+	OnUpdate string `json:"onUpdate"`
+}
+
+type IndexSpec struct {
+	Name string `json:"name"`
+	// Columns or expressions in index order
+	Columns []string `json:"columns"`
+	Unique  bool     `json:"unique"`
+	Method  string   `json:"method"`
+	Where   string   `json:"where"`
+}
+
+type PartitionSpec struct {
+	// range, list or hash
+	Strategy string `json:"strategy"`
+	// Columns or expressions of the partition key
+	Columns []string `json:"columns"`
+}
+
+// ColumnType is a column type as resolved by the server
+type ColumnType struct {
+	Column string `json:"column"`
+	Type   string `json:"type"`
+	// base, enum, domain, composite, range, multirange or pseudo
+	Kind string `json:"kind"`
+}
+
+// CreateTablePlan is the DDL rendered from a table spec
+type CreateTablePlan struct {
+	Table      string       `json:"table"`
+	Statements []string     `json:"statements"`
+	Script     string       `json:"script"`
+	Types      []ColumnType `json:"types"`
+}
+
+// CreateTableResult reports the outcome of creating a table
+type CreateTableResult struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+	// Tables of the database for the sidebar, set once the table was created
+	Tables []string `json:"tables"`
+
+	// Set when the environment policy requires the DDL to be confirmed before it runs
+	RequiresConfirmation bool          `json:"requiresConfirmation"`
+	Confirmation         *Confirmation `json:"confirmation"`
+}
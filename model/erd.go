@@ -0,0 +1,44 @@
+package model
+
+// ERDOptions limits the diagram to a schema, or to the tables within a number of
+// foreign key hops of a table
+type ERDOptions struct {
+	Schema string `json:"schema"`
+	// schema.table, or a table of the public schema
+	Table string `json:"table"`
+	Hops  int    `json:"hops"`
+}
+
+type ERDColumn struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Nullable   bool   `json:"nullable"`
+	PrimaryKey bool   `json:"primaryKey"`
+	ForeignKey bool   `json:"foreignKey"`
+}
+
+// ERDNode is a table of the diagram, its id is schema.table
+type ERDNode struct {
+	ID      string      `json:"id"`
+	Schema  string      `json:"schema"`
+	Name    string      `json:"name"`
+	Kind    string      `json:"kind"`
+	Columns []ERDColumn `json:"columns"`
+}
+
+// ERDEdge is a foreign key from the child table to the parent table
+type ERDEdge struct {
+	Name       string   `json:"name"`
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	Columns    []string `json:"columns"`
+	RefColumns []string `json:"refColumns"`
+	// Set when the key columns are nullable, a child doesn't need a parent
+	Optional bool `json:"optional"`
+}
+
+type ERDGraph struct {
+	Options ERDOptions `json:"options"`
+	Nodes   []ERDNode  `json:"nodes"`
+	Edges   []ERDEdge  `json:"edges"`
+}
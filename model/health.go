@@ -0,0 +1,63 @@
+package model
+
+// TableSize is the storage a table or materialized view takes
+type TableSize struct {
+	Schema string `json:"schema"`
+	Name   string `json:"name"`
+	// -1 when the table was never analyzed
+	RowEstimate int64 `json:"rowEstimate"`
+	TableBytes  int64 `json:"tableBytes"`
+	ToastBytes  int64 `json:"toastBytes"`
+	IndexBytes  int64 `json:"indexBytes"`
+	TotalBytes  int64 `json:"totalBytes"`
+	// Estimated from the column statistics, -1 when the table has none
+	BloatBytes int64 `json:"bloatBytes"`
+}
+
+// IndexUsage is the size and use of an index
+type IndexUsage struct {
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+	Name   string `json:"name"`
+	Method string `json:"method"`
+	Bytes  int64  `json:"bytes"`
+	// Scans since the statistics were last reset
+	Scans int64 `json:"scans"`
+	// Estimated for btree indexes from the column statistics, -1 when unknown
+	BloatBytes int64 `json:"bloatBytes"`
+	// Unique and primary key indexes, and indexes backing a constraint, can't simply be dropped
+	Unique     bool `json:"unique"`
+	Constraint bool `json:"constraint"`
+}
+
+// CacheHitRatios are the share of blocks read from shared buffers, -1 when nothing was read yet
+type CacheHitRatios struct {
+	Database float64 `json:"database"`
+	Tables   float64 `json:"tables"`
+	Indexes  float64 `json:"indexes"`
+}
+
+// HealthFinding is a problem found in the database along with the statement that fixes it
+type HealthFinding struct {
+	// table_bloat, index_bloat, unused_index, duplicate_index, redundant_index,
+	// missing_primary_key, unindexed_foreign_key, sequence_exhaustion, wraparound or cache_hit
+	Category string `json:"category"`
+	// info, warning or critical
+	Severity string `json:"severity"`
+	// Qualified name of the table, index or sequence, empty for the database
+	Object string `json:"object"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix"`
+}
+
+// HealthReport is the storage and health of a database
+type HealthReport struct {
+	Database    string          `json:"database"`
+	GeneratedAt string          `json:"generatedAt"`
+	Tables      []TableSize     `json:"tables"`
+	Indexes     []IndexUsage    `json:"indexes"`
+	CacheHit    CacheHitRatios  `json:"cacheHit"`
+	Findings    []HealthFinding `json:"findings"`
+	// When the statistics behind the scan counts were last reset, empty if never
+	StatsReset string `json:"statsReset"`
+}
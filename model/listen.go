@@ -0,0 +1,27 @@
+package model
+
+// Notification is a NOTIFY received by a listen tab, emitted to the frontend with the
+// listen:notification event
+type Notification struct {
+	TabID   int64  `json:"tabId"`
+	Channel string `json:"channel"`
+	Payload string `json:"payload"`
+	// The payload indented when it is JSON, empty otherwise
+	Pretty string `json:"pretty"`
+	// Backend which sent the notification
+	PID        uint32 `json:"pid"`
+	ReceivedAt string `json:"receivedAt"`
+}
+
+// ListenerState is what a listen tab is subscribed to along with the notifications it
+// kept, oldest first, emitted with the listen:state event when the listener stops
+type ListenerState struct {
+	TabID         int64          `json:"tabId"`
+	PoolID        string         `json:"poolId"`
+	Channels      []string       `json:"channels"`
+	Notifications []Notification `json:"notifications"`
+	// Notifications dropped from the buffer to make room for newer ones
+	Dropped int64 `json:"dropped"`
+	// Set when the connection was lost, the tab has to listen again
+	Error string `json:"error"`
+}
@@ -0,0 +1,84 @@
+package model
+
+// SessionLock is a lock a session holds or waits for
+type SessionLock struct {
+	LockType string `json:"lockType"`
+	Mode     string `json:"mode"`
+	Granted  bool   `json:"granted"`
+	// The locked relation, or the lock type and its identifier for other locks
+	Object string `json:"object"`
+}
+
+// LockSession is a session taking part in the wait-for graph
+type LockSession struct {
+	PID             int32  `json:"pid"`
+	User            string `json:"user"`
+	Database        string `json:"database"`
+	ApplicationName string `json:"applicationName"`
+	ClientAddr      string `json:"clientAddr"`
+	BackendType     string `json:"backendType"`
+	// Identifies the session along with its pid, which the server may reuse
+	BackendStart string `json:"backendStart"`
+	State        string `json:"state"`
+	WaitEvent    string `json:"waitEvent"`
+	Query        string `json:"query"`
+	// Seconds since the transaction started and the state last changed, -1 when unknown
+	TransactionSeconds float64 `json:"transactionSeconds"`
+	StateSeconds       float64 `json:"stateSeconds"`
+
+	// Sessions this session waits for and the sessions waiting for it
+	BlockedBy []int32 `json:"blockedBy"`
+	Blocking  []int32 `json:"blocking"`
+	// Sessions waiting for this session directly or through other sessions
+	BlockedCount int `json:"blockedCount"`
+
+	// Blocks other sessions without waiting for any
+	RootBlocker bool `json:"rootBlocker"`
+	// Idle in a transaction for long while holding locks
+	IdleInTransaction bool `json:"idleInTransaction"`
+
+	Locks []SessionLock `json:"locks"`
+}
+
+// LockWait is an edge of the wait-for graph, the waiter waits for the blocker
+type LockWait struct {
+	Waiter  int32 `json:"waiter"`
+	Blocker int32 `json:"blocker"`
+	// What the waiter asks for, and the blocker's lock on the same object when it holds one
+	Object      string `json:"object"`
+	WaitMode    string `json:"waitMode"`
+	BlockerMode string `json:"blockerMode"`
+}
+
+// LockAction is a backend suggested to be cancelled or terminated to unblock the others
+type LockAction struct {
+	PID          int32  `json:"pid"`
+	BackendStart string `json:"backendStart"`
+	// cancel or terminate
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+	// Sessions waiting for the backend directly or through other sessions
+	Unblocks int `json:"unblocks"`
+}
+
+// LockGraph is the wait-for graph of the server's sessions
+type LockGraph struct {
+	GeneratedAt string        `json:"generatedAt"`
+	Sessions    []LockSession `json:"sessions"`
+	Waits       []LockWait    `json:"waits"`
+	// Root blockers, the sessions to act on first
+	RootBlockers      []int32 `json:"rootBlockers"`
+	IdleInTransaction []int32 `json:"idleInTransaction"`
+	// The fewest backends to cancel or terminate for every waiting session to go on
+	Suggestions []LockAction `json:"suggestions"`
+}
+
+// LockActionResult reports the outcome of cancelling or terminating a backend
+type LockActionResult struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+
+	// Set when the action needs to be confirmed before it runs
+	RequiresConfirmation bool          `json:"requiresConfirmation"`
+	Confirmation         *Confirmation `json:"confirmation"`
+}
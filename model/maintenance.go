@@ -0,0 +1,51 @@
+package model
+
+// MaintenanceSpec describes a maintenance operation on a table, index or materialized view
+type MaintenanceSpec struct {
+	// vacuum, analyze, reindex, cluster or refresh
+	Operation string `json:"operation"`
+	Schema    string `json:"schema"`
+	// Table, or materialized view for refresh
+	Table string `json:"table"`
+	// Reindexes only this index, or the index CLUSTER orders the table by
+	Index string `json:"index"`
+
+	// VACUUM options
+	Full    bool `json:"full"`
+	Analyze bool `json:"analyze"`
+	Freeze  bool `json:"freeze"`
+
+	// REINDEX and REFRESH MATERIALIZED VIEW without blocking writes or reads
+	Concurrently bool `json:"concurrently"`
+}
+
+// MaintenanceProgress is the progress of a job as reported by pg_stat_progress_*
+type MaintenanceProgress struct {
+	// vacuum, analyze, create_index or cluster, empty while nothing is reported
+	View  string `json:"view"`
+	Phase string `json:"phase"`
+	Done  int64  `json:"done"`
+	Total int64  `json:"total"`
+	// 0 to 100, -1 when the phase doesn't report how much is left
+	Percent float64 `json:"percent"`
+}
+
+// MaintenanceJob is a maintenance operation running in the background, emitted to the
+// frontend with the maintenance:progress event while it runs and maintenance:done once it ends
+type MaintenanceJob struct {
+	ID        string `json:"id"`
+	PoolID    string `json:"poolId"`
+	Operation string `json:"operation"`
+	Statement string `json:"statement"`
+	// running, succeeded, failed or cancelled
+	State      string              `json:"state"`
+	Error      string              `json:"error"`
+	StartedAt  string              `json:"startedAt"`
+	FinishedAt string              `json:"finishedAt"`
+	Progress   MaintenanceProgress `json:"progress"`
+
+	// Set when the environment policy requires the statement to be confirmed before
+	// the job starts, the job isn't running then
+	RequiresConfirmation bool          `json:"requiresConfirmation"`
+	Confirmation         *Confirmation `json:"confirmation"`
+}
@@ -0,0 +1,92 @@
+package model
+
+// SchemaMetadata describes the objects of a database, used for suggestions
+type SchemaMetadata struct {
+	// Schemas of the session's search path in order, used to resolve unqualified names
+	SearchPath  []string     `json:"searchPath"`
+	Schemas     []string     `json:"schemas"`
+	Relations   []Relation   `json:"relations"`
+	ForeignKeys []ForeignKey `json:"foreignKeys"`
+	Functions   []Function   `json:"functions"`
+}
+
+// Relation is a table, view, materialized view or foreign table
+type Relation struct {
+	OID    int64  `json:"oid"`
+	Schema string `json:"schema"`
+	Name   string `json:"name"`
+	// table, view, materialized view, foreign table or partitioned table
+	Kind       string   `json:"kind"`
+	Comment    string   `json:"comment"`
+	Columns    []Column `json:"columns"`
+	PrimaryKey []string `json:"primaryKey"`
+	Indexes    []Index  `json:"indexes"`
+}
+
+type Column struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+	Default  string `json:"default"`
+	Position int    `json:"position"`
+	Comment  string `json:"comment"`
+}
+
+type Index struct {
+	Name string `json:"name"`
+	// Key columns or expressions in index order
+	Columns    []string `json:"columns"`
+	Unique     bool     `json:"unique"`
+	Primary    bool     `json:"primary"`
+	Method     string   `json:"method"`
+	Definition string   `json:"definition"`
+}
+
+type ForeignKey struct {
+	Name       string   `json:"name"`
+	Schema     string   `json:"schema"`
+	Table      string   `json:"table"`
+	Columns    []string `json:"columns"`
+	RefSchema  string   `json:"refSchema"`
+	RefTable   string   `json:"refTable"`
+	RefColumns []string `json:"refColumns"`
+}
+
+type Function struct {
+	Schema    string `json:"schema"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Result    string `json:"result"`
+	// function, aggregate, window or procedure
+	Kind string `json:"kind"`
+}
+
+// MetadataChanges reports what a refresh of the schema metadata found changed,
+// relations are named schema.name
+type MetadataChanges struct {
+	Added            []string `json:"added"`
+	Removed          []string `json:"removed"`
+	Changed          []string `json:"changed"`
+	FunctionsChanged bool     `json:"functionsChanged"`
+	RefreshedAt      string   `json:"refreshedAt"`
+}
+
+// Suggestion is a single autocomplete suggestion
+type Suggestion struct {
+	Label string `json:"label"`
+	// Text inserted in place of the word being typed
+	Insert string `json:"insert"`
+	// schema, table, view, column, function, keyword, alias, cte or join
+	Kind string `json:"kind"`
+	// Column type, function signature or the relation a column belongs to
+	Detail string `json:"detail"`
+	Score  int    `json:"score"`
+}
+
+// CompletionResult holds the suggestions for a cursor position. From and To are the
+// editor offsets of the word being typed which a suggestion replaces.
+type CompletionResult struct {
+	From        int          `json:"from"`
+	To          int          `json:"to"`
+	Suggestions []Suggestion `json:"suggestions"`
+}
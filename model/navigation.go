@@ -0,0 +1,27 @@
+package model
+
+// ReferencedRow is the parent row a foreign key of a row points to
+type ReferencedRow struct {
+	ForeignKey ForeignKey `json:"foreignKey"`
+	// Parent table, named the way table tabs name tables
+	Table   string   `json:"table"`
+	Columns []string `json:"columns"`
+	// Nil when the key is NULL or the parent row doesn't exist
+	Row []Cell `json:"row"`
+	// Filter which opens the parent row in a table tab
+	Where string `json:"where"`
+}
+
+// ChildRows are the rows of a table which reference a row through a foreign key
+type ChildRows struct {
+	ForeignKey ForeignKey `json:"foreignKey"`
+	// Child table, named the way table tabs name tables
+	Table string `json:"table"`
+	Count int64  `json:"count"`
+	// Set when there are more rows than were counted
+	CountCapped bool     `json:"countCapped"`
+	Columns     []string `json:"columns"`
+	Preview     [][]Cell `json:"preview"`
+	// Filter which opens the child rows in a table tab
+	Where string `json:"where"`
+}
@@ -0,0 +1,42 @@
+package model
+
+// EnvPolicy holds the safety rules enforced on connections of an environment
+type EnvPolicy struct {
+	Env string `json:"env"`
+
+	// Pools are created with default_transaction_read_only and writes are rejected
+	ReadOnly bool `json:"readOnly"`
+	// DML and DDL need to be confirmed before they are executed
+	ConfirmWrites bool `json:"confirmWrites"`
+	// UPDATE and DELETE without a WHERE clause are rejected
+	BlockUnsafeWrites bool `json:"blockUnsafeWrites"`
+	// DROP and TRUNCATE are rejected
+	BlockDestructive bool `json:"blockDestructive"`
+
+	// Session defaults of the pool, 0 means no timeout
+	StatementTimeoutMs int64 `json:"statementTimeoutMs"`
+	LockTimeoutMs      int64 `json:"lockTimeoutMs"`
+
+	// Statements are written to the audit log, optionally with literals redacted
+	Audit          bool `json:"audit"`
+	RedactLiterals bool `json:"redactLiterals"`
+}
+
+// StatementConfirmation describes a statement which has to be confirmed before it's executed
+type StatementConfirmation struct {
+	Statement string `json:"statement"`
+	Command   string `json:"command"`
+	Kind      string `json:"kind"`
+
+	// Rows an UPDATE or DELETE would affect, found by running it in a rolled back transaction
+	DryRunRows  *int64 `json:"dryRunRows"`
+	DryRunError string `json:"dryRunError"`
+}
+
+// Confirmation is returned instead of executing a query which the environment policy
+// requires to be confirmed. The token is passed back to execute the confirmed query.
+type Confirmation struct {
+	Env        string                  `json:"env"`
+	Token      string                  `json:"token"`
+	Statements []StatementConfirmation `json:"statements"`
+}
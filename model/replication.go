@@ -0,0 +1,85 @@
+package model
+
+// ReplicationStandby is a standby streaming WAL from the server, a row of pg_stat_replication
+type ReplicationStandby struct {
+	PID             int32  `json:"pid"`
+	ApplicationName string `json:"applicationName"`
+	ClientAddr      string `json:"clientAddr"`
+	State           string `json:"state"`
+	SyncState       string `json:"syncState"`
+	SentLSN         string `json:"sentLsn"`
+	WriteLSN        string `json:"writeLsn"`
+	FlushLSN        string `json:"flushLsn"`
+	ReplayLSN       string `json:"replayLsn"`
+	// WAL the standby has not received or replayed yet
+	SendLagBytes   int64 `json:"sendLagBytes"`
+	ReplayLagBytes int64 `json:"replayLagBytes"`
+	// Seconds reported by the server, -1 when the standby is idle or the server doesn't know yet
+	WriteLagSeconds  float64 `json:"writeLagSeconds"`
+	FlushLagSeconds  float64 `json:"flushLagSeconds"`
+	ReplayLagSeconds float64 `json:"replayLagSeconds"`
+}
+
+// ReplicationSlot is a slot of the server and the WAL it keeps from being removed
+type ReplicationSlot struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Plugin   string `json:"plugin"`
+	Database string `json:"database"`
+	Active   bool   `json:"active"`
+	// 0 when no session uses the slot
+	ActivePID int32 `json:"activePid"`
+	Temporary bool  `json:"temporary"`
+	// WAL kept for the slot, behind the server's current position
+	RetainedBytes int64 `json:"retainedBytes"`
+	// reserved, extended, unreserved or lost, empty before PostgreSQL 13
+	WalStatus string `json:"walStatus"`
+	// WAL which can still be written before the slot is lost, -1 when unlimited or unknown
+	SafeWalBytes int64 `json:"safeWalBytes"`
+	// Set when the slot keeps WAL piling up on the server's disk
+	Filling bool   `json:"filling"`
+	Warning string `json:"warning"`
+}
+
+// WalReceiver is the connection of a standby to its upstream server, from pg_stat_wal_receiver
+type WalReceiver struct {
+	PID        int32  `json:"pid"`
+	Status     string `json:"status"`
+	SenderHost string `json:"senderHost"`
+	SenderPort int32  `json:"senderPort"`
+	SlotName   string `json:"slotName"`
+	// Last WAL position flushed to disk by the receiver
+	FlushedLSN         string `json:"flushedLsn"`
+	LastMessageReceipt string `json:"lastMessageReceipt"`
+}
+
+// ReplicationStatus is the replication state of a server. Standbys and slots are
+// listed for primaries and for standbys which cascade, the receiver and replay
+// position only for standbys.
+type ReplicationStatus struct {
+	PostgresConnectionID int64  `json:"postgresConnectionId"`
+	InRecovery           bool   `json:"inRecovery"`
+	CurrentLSN           string `json:"currentLsn"`
+
+	Standbys []ReplicationStandby `json:"standbys"`
+	Slots    []ReplicationSlot    `json:"slots"`
+
+	Receiver   *WalReceiver `json:"receiver"`
+	ReceiveLSN string       `json:"receiveLsn"`
+	ReplayLSN  string       `json:"replayLsn"`
+	// WAL received but not replayed yet
+	ReplayLagBytes int64 `json:"replayLagBytes"`
+	// Seconds since the last replayed transaction committed on the primary, -1 when unknown
+	ReplayDelaySeconds float64 `json:"replayDelaySeconds"`
+	ReplayPaused       bool    `json:"replayPaused"`
+}
+
+// ReplicationSlotResult reports the outcome of dropping a replication slot
+type ReplicationSlotResult struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+
+	// Set when the environment policy requires the statement to be confirmed before it runs
+	RequiresConfirmation bool          `json:"requiresConfirmation"`
+	Confirmation         *Confirmation `json:"confirmation"`
+}
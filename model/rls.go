@@ -0,0 +1,34 @@
+package model
+
+// RowSecurity holds the row level security settings of a table
+type RowSecurity struct {
+	Enabled bool `json:"enabled"`
+	// Policies apply to the table owner as well
+	Forced   bool     `json:"forced"`
+	Policies []Policy `json:"policies"`
+}
+
+// Policy is a row level security policy of a table
+type Policy struct {
+	Name string `json:"name"`
+	// ALL, SELECT, INSERT, UPDATE or DELETE
+	Command    string `json:"command"`
+	Permissive bool   `json:"permissive"`
+	// PUBLIC when the policy applies to every role
+	Roles     []string `json:"roles"`
+	Using     string   `json:"using"`
+	WithCheck string   `json:"withCheck"`
+}
+
+// PolicySpec describes a policy to create or alter. Altering either renames the policy
+// or changes its roles and expressions, the command and permissiveness can't change.
+type PolicySpec struct {
+	Name    string `json:"name"`
+	NewName string `json:"newName"`
+	// ALL, SELECT, INSERT, UPDATE or DELETE, ALL when empty
+	Command     string   `json:"command"`
+	Restrictive bool     `json:"restrictive"`
+	Roles       []string `json:"roles"`
+	Using       string   `json:"using"`
+	WithCheck   string   `json:"withCheck"`
+}
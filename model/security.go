@@ -0,0 +1,130 @@
+package model
+
+// Role is a role of the server with its attributes and memberships
+type Role struct {
+	Name            string `json:"name"`
+	Superuser       bool   `json:"superuser"`
+	CreateDB        bool   `json:"createDB"`
+	CreateRole      bool   `json:"createRole"`
+	Inherit         bool   `json:"inherit"`
+	Login           bool   `json:"login"`
+	Replication     bool   `json:"replication"`
+	BypassRLS       bool   `json:"bypassRLS"`
+	ConnectionLimit int32  `json:"connectionLimit"`
+	ValidUntil      string `json:"validUntil"`
+	Comment         string `json:"comment"`
+
+	// Roles this role is a member of
+	MemberOf []RoleMembership `json:"memberOf"`
+	// Roles which are members of this role
+	Members []RoleMembership `json:"members"`
+}
+
+type RoleMembership struct {
+	Role        string `json:"role"`
+	AdminOption bool   `json:"adminOption"`
+}
+
+// PrivilegeRow holds the privileges of a role on a single object
+type PrivilegeRow struct {
+	// database, schema, table, view, materialized view, foreign table,
+	// partitioned table, column, sequence or function
+	ObjectType string `json:"objectType"`
+	Schema     string `json:"schema"`
+	Name       string `json:"name"`
+	Column     string `json:"column"`
+	// Privilege to whether the role has it, directly, through a membership or PUBLIC
+	Effective map[string]bool `json:"effective"`
+	// Privileges granted to the role itself, as found in the object's ACL
+	Direct []string `json:"direct"`
+	// Direct privileges the role may grant to others
+	Grantable []string `json:"grantable"`
+}
+
+// PrivilegeMatrix holds the effective privileges of a role on the objects of a database
+type PrivilegeMatrix struct {
+	Role string         `json:"role"`
+	Rows []PrivilegeRow `json:"rows"`
+}
+
+// DefaultPrivilege is a privilege granted on objects created in the future,
+// set with ALTER DEFAULT PRIVILEGES
+type DefaultPrivilege struct {
+	// Role whose new objects get the privileges
+	Owner string `json:"owner"`
+	// Empty for all schemas
+	Schema string `json:"schema"`
+	// table, sequence, function, type or schema
+	ObjectType string `json:"objectType"`
+	// PUBLIC for everyone
+	Grantee    string   `json:"grantee"`
+	Privileges []string `json:"privileges"`
+	Grantable  []string `json:"grantable"`
+}
+
+// RoleSpec describes a role to create or the attributes to set on an existing role
+type RoleSpec struct {
+	Name string `json:"name"`
+	// Renames the role when altering it
+	NewName string `json:"newName"`
+	// Empty leaves the password unchanged
+	Password    string `json:"password"`
+	Superuser   bool   `json:"superuser"`
+	CreateDB    bool   `json:"createDB"`
+	CreateRole  bool   `json:"createRole"`
+	Inherit     bool   `json:"inherit"`
+	Login       bool   `json:"login"`
+	Replication bool   `json:"replication"`
+	BypassRLS   bool   `json:"bypassRLS"`
+	// 0 or less for no limit
+	ConnectionLimit int32 `json:"connectionLimit"`
+	// Timestamp the password expires at, empty for never
+	ValidUntil string `json:"validUntil"`
+	// Roles the new role becomes a member of
+	InRoles []string `json:"inRoles"`
+	Comment string   `json:"comment"`
+
+	// When dropping, objects owned by the role in the current database are
+	// reassigned to this role before its privileges are dropped
+	ReassignTo string `json:"reassignTo"`
+}
+
+// GrantSpec describes a GRANT or REVOKE
+type GrantSpec struct {
+	// Privileges, e.g. SELECT or ALL, ignored when granting a role
+	Privileges []string `json:"privileges"`
+	// table, sequence, function, schema, database, all tables, all sequences,
+	// all functions or role
+	ObjectType string `json:"objectType"`
+	Schema     string `json:"schema"`
+	// Object name, or the role granted when the object type is role. Functions
+	// are named with their argument types, e.g. add(integer, integer)
+	Name string `json:"name"`
+	// Limits table privileges to these columns
+	Columns  []string `json:"columns"`
+	Grantees []string `json:"grantees"`
+	// WITH GRANT OPTION, or WITH ADMIN OPTION for roles. A revoke only takes the option away.
+	WithGrantOption bool `json:"withGrantOption"`
+	// Revokes dependent privileges as well
+	Cascade bool `json:"cascade"`
+}
+
+// RoleChange is a change to roles or privileges
+type RoleChange struct {
+	// create_role, alter_role, drop_role, grant or revoke
+	Action string    `json:"action"`
+	Role   RoleSpec  `json:"role"`
+	Grant  GrantSpec `json:"grant"`
+}
+
+// RoleChangeResult reports the outcome of applying a role change
+type RoleChangeResult struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+	// Script which was run, passwords masked
+	Script string `json:"script"`
+
+	// Set when the environment policy requires the script to be confirmed before it runs
+	RequiresConfirmation bool          `json:"requiresConfirmation"`
+	Confirmation         *Confirmation `json:"confirmation"`
+}
@@ -0,0 +1,57 @@
+package model
+
+// StreamSpec selects the tables whose changes a stream tab shows
+type StreamSpec struct {
+	// pgoutput or wal2json, empty uses wal2json when the server has it and pgoutput otherwise
+	Plugin string `json:"plugin"`
+	// schema.table, or a table of the public schema
+	Tables []string `json:"tables"`
+}
+
+// ChangeColumn is a column value of a changed row, Value is nil for NULL
+type ChangeColumn struct {
+	Name  string  `json:"name"`
+	Value *string `json:"value"`
+	// Set for TOAST values an update left untouched, the server doesn't send them
+	Unchanged bool `json:"unchanged"`
+}
+
+// ChangeEvent is a row change decoded from the replication stream, emitted to the
+// frontend with the stream:change event
+type ChangeEvent struct {
+	TabID int64  `json:"tabId"`
+	LSN   string `json:"lsn"`
+	XID   uint32 `json:"xid"`
+	// When the transaction committed
+	CommitTime string `json:"commitTime"`
+	// insert, update, delete or truncate
+	Action string `json:"action"`
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+	// Before is only sent for updates and deletes, with the replica identity columns
+	// unless the table has REPLICA IDENTITY FULL
+	Before []ChangeColumn `json:"before"`
+	After  []ChangeColumn `json:"after"`
+}
+
+// StreamState is the slot of a stream tab and the changes it kept, oldest first,
+// emitted with the stream:state event when the stream stops
+type StreamState struct {
+	TabID  int64    `json:"tabId"`
+	PoolID string   `json:"poolId"`
+	Slot   string   `json:"slot"`
+	Plugin string   `json:"plugin"`
+	Tables []string `json:"tables"`
+	// Publication created for pgoutput, dropped with the slot
+	Publication string        `json:"publication"`
+	Running     bool          `json:"running"`
+	Changes     []ChangeEvent `json:"changes"`
+	// Changes dropped from the buffer to make room for newer ones
+	Dropped int64  `json:"dropped"`
+	Error   string `json:"error"`
+
+	// Set when the environment policy asks for the publication pgoutput needs to be
+	// confirmed before it's created, the stream isn't running then
+	RequiresConfirmation bool          `json:"requiresConfirmation"`
+	Confirmation         *Confirmation `json:"confirmation"`
+}
@@ -17,10 +17,14 @@ type Tab struct {
 	ActiveDBColor *string
 	Type          string
 
-	// Output
+	// Output, only the first page of the stored result
 	Columns []string `json:"columns"`
 	Rows    [][]Cell `json:"rows"`
 
+	// Rows in the stored result and if the result was cut off
+	ResultRows      int64 `json:"resultRows"`
+	ResultTruncated bool  `json:"resultTruncated"`
+
 	// Required if type is table
 	PostgresConnID   *int64
 	PostgresConnName string
@@ -40,9 +44,35 @@ type Tab struct {
 var validTypes = map[string]struct{}{
 	"editor": {},
 	"table":  {},
+	"erd":    {},
+	"listen": {},
+	"stream": {},
 }
 
 func IsValidTabType(t string) bool {
 	_, ok := validTypes[t]
 	return ok
 }
+
+// ResultPage is a page of the stored result of a tab
+type ResultPage struct {
+	TabID int64 `json:"tabId"`
+	// Sequence number of the run which produced the result
+	Seq     int64    `json:"seq"`
+	Columns []string `json:"columns"`
+	Rows    [][]Cell `json:"rows"`
+	Offset  int      `json:"offset"`
+
+	// Rows the query returned and rows which were stored, fewer when truncated
+	TotalRows  int64 `json:"totalRows"`
+	StoredRows int64 `json:"storedRows"`
+	Truncated  bool  `json:"truncated"`
+}
+
+// ResultSettings controls how large results are streamed through server side cursors
+type ResultSettings struct {
+	// Rows fetched per page
+	PageSize int `json:"pageSize"`
+	// Rows kept in memory for a result before the cursor is closed
+	RowLimit int64 `json:"rowLimit"`
+}
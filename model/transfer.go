@@ -0,0 +1,77 @@
+package model
+
+// ColumnMapping copies a source column into a target column
+type ColumnMapping struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// TransferSpec describes copying the rows of a table from one pool to another
+type TransferSpec struct {
+	// Table names as table tabs use them, the target defaults to the source's name
+	SourceTable string `json:"sourceTable"`
+	TargetTable string `json:"targetTable"`
+	// Empty copies the source columns which the target has as well, or every source
+	// column when the target is created
+	Columns []ColumnMapping `json:"columns"`
+	// Filter on the source rows, without the WHERE keyword
+	Where string `json:"where"`
+	// Creates the target from the source's columns and primary key when it's missing
+	CreateTarget bool `json:"createTarget"`
+	// append, truncate or upsert
+	Mode string `json:"mode"`
+	// Conflict target of upsert, defaults to the target's primary key
+	ConflictColumns []string `json:"conflictColumns"`
+	// Rows sent to the target at a time, defaults to 5000
+	BatchSize int `json:"batchSize"`
+}
+
+// TransferPlan is what a transfer runs on the target
+type TransferPlan struct {
+	Source       string          `json:"source"`
+	Target       string          `json:"target"`
+	Columns      []ColumnMapping `json:"columns"`
+	CreateTarget bool            `json:"createTarget"`
+	Statements   []string        `json:"statements"`
+	Script       string          `json:"script"`
+	// Estimated from the table statistics, -1 when unknown or filtered
+	EstimatedRows int64 `json:"estimatedRows"`
+}
+
+// TransferRejection is a source row the target refused
+type TransferRejection struct {
+	// 1-based position of the row in the source's output
+	Row int64 `json:"row"`
+	// The row in COPY text format, cut when long
+	Data  string `json:"data"`
+	Error string `json:"error"`
+}
+
+// TransferJob is a transfer running in the background, emitted to the frontend with the
+// transfer:progress event after every batch and transfer:done once it ends. The target
+// is written in a single transaction, nothing is kept when the job fails or is cancelled.
+type TransferJob struct {
+	ID           string        `json:"id"`
+	SourcePoolID string        `json:"sourcePoolId"`
+	TargetPoolID string        `json:"targetPoolId"`
+	Mode         string        `json:"mode"`
+	Plan         *TransferPlan `json:"plan"`
+	// running, succeeded, failed or cancelled
+	State      string `json:"state"`
+	Error      string `json:"error"`
+	StartedAt  string `json:"startedAt"`
+	FinishedAt string `json:"finishedAt"`
+
+	Read     int64 `json:"read"`
+	Copied   int64 `json:"copied"`
+	Rejected int64 `json:"rejected"`
+	// 0 to 100, -1 when the number of rows isn't known
+	Percent float64 `json:"percent"`
+	// The first rejected rows
+	Rejections []TransferRejection `json:"rejections"`
+
+	// Set when the environment policy of the target requires the statements to be
+	// confirmed before the job starts, the job isn't running then
+	RequiresConfirmation bool          `json:"requiresConfirmation"`
+	Confirmation         *Confirmation `json:"confirmation"`
+}